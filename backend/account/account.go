@@ -0,0 +1,153 @@
+package account
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+)
+
+// ErrUnsettledShares is returned when an account still has unsettled spendings shared with others.
+var ErrUnsettledShares = errors.New("account has unsettled shared spendings")
+
+// CheckSettled returns ErrUnsettledShares if the user owes or is owed an unsettled share of
+// any spending: one they bought that someone else shares in, or one someone else bought that
+// they share in. Deleting such an account would silently change what the rest of the
+// household owes.
+func CheckSettled(q household.Querier, userID int64) error {
+	var count int
+	err := q.QueryRow(`
+		SELECT COUNT(DISTINCT ss.spending_id)
+		FROM spending_shares ss
+		JOIN user_spendings us ON us.spending_id = ss.spending_id
+		WHERE ss.settled_at IS NULL
+		  AND ss.user_id != us.buyer
+		  AND (us.buyer = ? OR ss.user_id = ?)
+	`, userID, userID).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("failed to count unsettled shared spendings: %w", err)
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %d", ErrUnsettledShares, count)
+	}
+	return nil
+}
+
+// Purge removes the user and everything they own inside the transaction.
+//
+// Shared spendings are handled as follows:
+//   - Spendings the user bought are deleted, including ones shared with others.
+//   - On spendings bought by someone else, the user's share is removed and the cost
+//     falls to the remaining participants (or to the buyer alone if none remain).
+//
+// Callers should ensure the account is settled first (see CheckSettled) so that
+// neither case changes an outstanding balance.
+//
+// The receipt photos of the user's AI jobs are returned rather than removed, since the
+// transaction may still roll back; pass them to RemoveReceipts once it has committed.
+func Purge(tx *sql.Tx, userID int64) ([]string, error) {
+	// 1. Drop the user's share from spendings bought by others
+	type sharedSpending struct {
+		spendingID int64
+		buyerID    int64
+	}
+	rows, err := tx.Query(`
+		SELECT us.spending_id, us.buyer
+		FROM user_spendings us
+		JOIN spending_shares ss ON ss.spending_id = us.spending_id
+		WHERE ss.user_id = ? AND us.buyer != ?
+	`, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query spendings shared with user: %w", err)
+	}
+	var shared []sharedSpending
+	for rows.Next() {
+		var s sharedSpending
+		if err := rows.Scan(&s.spendingID, &s.buyerID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan shared spending: %w", err)
+		}
+		shared = append(shared, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating shared spendings: %w", err)
+	}
+
+	for _, s := range shared {
+		shares, err := household.GetShares(tx, s.spendingID)
+		if err != nil {
+			return nil, err
+		}
+		var remaining []int64
+		for _, id := range shares {
+			if id != userID {
+				remaining = append(remaining, id)
+			}
+		}
+		if err := household.SetShares(tx, s.spendingID, s.buyerID, remaining); err != nil {
+			return nil, fmt.Errorf("failed to reassign shares of spending %d: %w", s.spendingID, err)
+		}
+		if err := ledger.RecordSpending(tx, s.spendingID); err != nil {
+			return nil, fmt.Errorf("failed to record reassigned shares of spending %d: %w", s.spendingID, err)
+		}
+	}
+	// Jobs keep their spendings, but no longer point at the user
+	if _, err := tx.Exec("UPDATE ai_categorization_jobs SET shared_with = NULL WHERE shared_with = ?", userID); err != nil {
+		return nil, fmt.Errorf("failed to detach shared AI jobs: %w", err)
+	}
+
+	// 2. Delete the user's own spendings and AI jobs, noting the jobs' receipt photos first.
+	// Deleted explicitly rather than relying on ON DELETE CASCADE, which only
+	// applies when foreign keys are enabled on the connection.
+	receipts, err := category.JobReceipts(tx, "SELECT id FROM ai_categorization_jobs WHERE buyer = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	ownSpendings := `SELECT spending_id FROM user_spendings WHERE buyer = ? UNION SELECT id FROM spendings WHERE made_by = ?`
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"DELETE FROM attachments WHERE spending_id IN (" + ownSpendings + ")", []interface{}{userID, userID}},
+		{"DELETE FROM attachments WHERE job_id IN (SELECT id FROM ai_categorization_jobs WHERE buyer = ?)", []interface{}{userID}},
+		{"DELETE FROM spending_shares WHERE spending_id IN (" + ownSpendings + ")", []interface{}{userID, userID}},
+		{"DELETE FROM ai_categorized_spendings WHERE spending_id IN (" + ownSpendings + ")", []interface{}{userID, userID}},
+		{"DELETE FROM ai_categorized_spendings WHERE job_id IN (SELECT id FROM ai_categorization_jobs WHERE buyer = ?)", []interface{}{userID}},
+		{"DELETE FROM spendings WHERE id IN (" + ownSpendings + ")", []interface{}{userID, userID}},
+		{"DELETE FROM user_spendings WHERE buyer = ?", []interface{}{userID}},
+		{"DELETE FROM ai_job_attempts WHERE job_id IN (SELECT id FROM ai_categorization_jobs WHERE buyer = ?)", []interface{}{userID}},
+		{"DELETE FROM ai_categorization_jobs WHERE buyer = ?", []interface{}{userID}},
+		{"DELETE FROM ai_job_batches WHERE buyer = ?", []interface{}{userID}},
+
+		// 3. Delete the rest of the user's data
+		{"DELETE FROM attachments WHERE deposit_id IN (SELECT id FROM deposits WHERE user_id = ?)", []interface{}{userID}},
+		{"DELETE FROM deposits WHERE user_id = ?", []interface{}{userID}},
+		{"UPDATE attachments SET uploaded_by = NULL WHERE uploaded_by = ?", []interface{}{userID}},
+		{"DELETE FROM llm_usage WHERE user_id = ?", []interface{}{userID}},
+		{"DELETE FROM transfers WHERE settled_by_user_id = ? OR settled_with_user_id = ?", []interface{}{userID, userID}},
+		{"DELETE FROM refresh_tokens WHERE user_id = ?", []interface{}{userID}},
+		{"DELETE FROM partnerships WHERE user1_id = ? OR user2_id = ?", []interface{}{userID, userID}},
+		{"DELETE FROM household_members WHERE user_id = ?", []interface{}{userID}},
+		{"DELETE FROM households WHERE id NOT IN (SELECT household_id FROM household_members)", nil},
+
+		// 4. Finally the user itself
+		{"DELETE FROM users WHERE id = ?", []interface{}{userID}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return nil, fmt.Errorf("failed to purge user data (%s): %w", stmt.query, err)
+		}
+	}
+	// The ledger entries of the deleted spendings and deposits go with them
+	if err := ledger.Prune(tx); err != nil {
+		return nil, fmt.Errorf("failed to purge user data: %w", err)
+	}
+
+	slog.Info("Purged user account", "user_id", userID, "reassigned_shared_spendings", len(shared))
+	return receipts, nil
+}
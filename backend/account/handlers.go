@@ -0,0 +1,359 @@
+package account
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/export"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// HandleGetProfile returns the authenticated user's profile.
+func HandleGetProfile(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for profile", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		profile, err := fetchProfile(db, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("failed to fetch profile", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(profile); err != nil {
+			slog.Error("failed to encode profile response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// HandleUpdateProfile changes the authenticated user's username, first name and/or AI notes.
+// The first name is what the AI categorizer uses to refer to the user, and the notes tell it
+// more about them.
+func HandleUpdateProfile(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for profile update", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate payload
+		var payload types.UpdateProfilePayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if payload.Username == nil && payload.FirstName == nil && payload.AINotes == nil && payload.Language == nil {
+			http.Error(w, "Bad Request: Nothing to update", http.StatusBadRequest)
+			return
+		}
+		if payload.Username != nil {
+			trimmed := strings.TrimSpace(*payload.Username)
+			if trimmed == "" {
+				http.Error(w, "Bad Request: Username cannot be empty", http.StatusBadRequest)
+				return
+			}
+			payload.Username = &trimmed
+		}
+		if payload.FirstName != nil {
+			trimmed := strings.TrimSpace(*payload.FirstName)
+			if trimmed == "" {
+				http.Error(w, "Bad Request: First name cannot be empty", http.StatusBadRequest)
+				return
+			}
+			payload.FirstName = &trimmed
+		}
+		if payload.AINotes != nil {
+			trimmed := strings.TrimSpace(*payload.AINotes)
+			if utf8.RuneCountInString(trimmed) > household.MaxAINotesLength {
+				http.Error(w, fmt.Sprintf("Bad Request: AI notes cannot be longer than %d characters", household.MaxAINotesLength), http.StatusBadRequest)
+				return
+			}
+			payload.AINotes = &trimmed
+		}
+		if payload.Language != nil && !category.HasPromptLanguage(*payload.Language) {
+			http.Error(w, fmt.Sprintf("Bad Request: Language must be one of %s", strings.Join(category.PromptLanguages(), ", ")), http.StatusBadRequest)
+			return
+		}
+
+		// 2. Apply changes in a transaction
+		tx, err := db.Begin()
+		if err != nil {
+			slog.Error("failed to begin transaction for profile update", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if payload.Username != nil {
+			var taken int
+			err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ? AND id != ?", *payload.Username, userID).Scan(&taken)
+			if err != nil {
+				slog.Error("failed to check username uniqueness", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if taken > 0 {
+				http.Error(w, "Username already exists", http.StatusConflict)
+				return
+			}
+			if _, err := tx.Exec("UPDATE users SET username = ? WHERE id = ?", *payload.Username, userID); err != nil {
+				slog.Error("failed to update username", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if payload.FirstName != nil {
+			if _, err := tx.Exec("UPDATE users SET first_name = ? WHERE id = ?", *payload.FirstName, userID); err != nil {
+				slog.Error("failed to update first name", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if payload.AINotes != nil {
+			// Empty notes are removed
+			notes := sql.NullString{String: *payload.AINotes, Valid: *payload.AINotes != ""}
+			if _, err := tx.Exec("UPDATE users SET ai_notes = ? WHERE id = ?", notes, userID); err != nil {
+				slog.Error("failed to update AI notes", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if payload.Language != nil {
+			if _, err := tx.Exec("UPDATE users SET language = ? WHERE id = ?", *payload.Language, userID); err != nil {
+				slog.Error("failed to update language", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		profile, err := fetchProfile(tx, userID)
+		if err != nil {
+			slog.Error("failed to fetch updated profile", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			slog.Error("failed to commit profile update", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Profile updated", "user_id", userID)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(profile); err != nil {
+			slog.Error("failed to encode profile response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// HandleChangePassword changes the authenticated user's password after verifying the current one.
+// All refresh tokens are revoked, so other sessions have to log in again.
+func HandleChangePassword(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for password change", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate payload
+		var payload types.ChangePasswordPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if payload.CurrentPassword == "" || payload.NewPassword == "" {
+			http.Error(w, "Bad Request: Current and new password are required", http.StatusBadRequest)
+			return
+		}
+		if auth.ValidatePassword(payload.NewPassword) != nil {
+			http.Error(w, fmt.Sprintf("Password must be at least %d characters long", auth.MinPasswordLength), http.StatusBadRequest)
+			return
+		}
+
+		// 2. Verify the current password
+		if !verifyPassword(w, r, db, userID, payload.CurrentPassword) {
+			return
+		}
+
+		// 3. Store the new hash and revoke existing sessions
+		tx, err := db.Begin()
+		if err != nil {
+			slog.Error("failed to begin transaction for password change", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := auth.SetPassword(tx, userID, payload.NewPassword); err != nil {
+			slog.Error("failed to set new password", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(); err != nil {
+			slog.Error("failed to commit password change", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Password changed", "user_id", userID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleDeleteAccount deletes the authenticated user's account.
+// The user's full data export is built first and returned in the response body,
+// then the account is purged in the same transaction. Deletion is refused while
+// the user still has unsettled spendings shared with other household members.
+// The receipt photos of the user's AI jobs are removed from the pool's receipt
+// directory once the deletion is committed.
+func HandleDeleteAccount(db *sql.DB, pool category.CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for account deletion", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Confirm with the password
+		var payload types.DeleteAccountPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if payload.Password == "" {
+			http.Error(w, "Bad Request: Password is required to delete the account", http.StatusBadRequest)
+			return
+		}
+		if !verifyPassword(w, r, db, userID, payload.Password) {
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			slog.Error("failed to begin transaction for account deletion", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// 2. Refuse while shared balances are outstanding
+		if err := CheckSettled(tx, userID); err != nil {
+			if errors.Is(err, ErrUnsettledShares) {
+				http.Error(w, "Conflict: Settle up with your household before deleting your account", http.StatusConflict)
+				return
+			}
+			slog.Error("failed to check unsettled spendings", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// 3. Export everything before it is gone
+		exportData, err := export.BuildFullExport(tx, userID)
+		if err != nil {
+			slog.Error("failed to build export before account deletion", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		jsonData, err := json.MarshalIndent(exportData, "", "  ")
+		if err != nil {
+			slog.Error("failed to marshal export before account deletion", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// 4. Purge and commit
+		receipts, err := Purge(tx, userID)
+		if err != nil {
+			slog.Error("failed to purge account", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			slog.Error("failed to commit account deletion", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		pool.RemoveReceipts(receipts)
+
+		// 5. Hand the export back to the user
+		filename := fmt.Sprintf("sapp_export_%s.json", time.Now().UTC().Format("20060102_150405"))
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write(jsonData); err != nil {
+			slog.Error("failed to write export after account deletion", "user_id", userID, "err", err)
+		}
+
+		slog.Info("Account deleted", "user_id", userID)
+	}
+}
+
+// fetchProfile reads the user's profile.
+func fetchProfile(q auth.Querier, userID int64) (types.ProfileResponse, error) {
+	profile := types.ProfileResponse{UserID: userID}
+	var firstName, aiNotes sql.NullString
+	err := q.QueryRow("SELECT username, first_name, ai_notes, language FROM users WHERE id = ?", userID).
+		Scan(&profile.Username, &firstName, &aiNotes, &profile.Language)
+	if err != nil {
+		return types.ProfileResponse{}, err
+	}
+	profile.FirstName = firstName.String
+	profile.AINotes = aiNotes.String
+	return profile, nil
+}
+
+// verifyPassword checks the password against the stored hash, writing an error response
+// and returning false if it does not match.
+func verifyPassword(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64, password string) bool {
+	var storedHash string
+	if err := db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&storedHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return false
+		}
+		slog.Error("failed to query password hash", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)); err != nil {
+		slog.Warn("password verification failed", "url", r.URL, "user_id", userID)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
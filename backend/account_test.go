@@ -0,0 +1,329 @@
+package main_test
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// TestProfile tests the GET and PUT /v1/profile endpoints.
+func TestProfile(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	// --- Test Case: Get Profile ---
+	t.Run("Get", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/profile", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.ProfileResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.UserID != env.UserID || resp.Username != "demo_user" || resp.FirstName != env.User1Name {
+			t.Errorf("Unexpected profile: %+v", resp)
+		}
+	})
+
+	// --- Test Case: Update First Name ---
+	t.Run("UpdateFirstName", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			FirstName: testutil.Ptr("  Dema "),
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.ProfileResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.FirstName != "Dema" || resp.Username != "demo_user" {
+			t.Errorf("Expected first name 'Dema' and unchanged username, got %+v", resp)
+		}
+	})
+
+	// --- Test Case: Username Taken ---
+	t.Run("ErrorUsernameTaken", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			Username: testutil.Ptr("partner_user"),
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusConflict)
+	})
+
+	// --- Test Case: Empty Username ---
+	t.Run("ErrorEmptyUsername", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			Username: testutil.Ptr("   "),
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "Username cannot be empty")
+	})
+
+	// --- Test Case: AI Notes ---
+	t.Run("UpdateAINotes", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			AINotes: testutil.Ptr(" Drinks energy drinks "),
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.ProfileResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.AINotes != "Drinks energy drinks" || resp.FirstName != "Dema" {
+			t.Errorf("Expected AI notes to be set and first name unchanged, got %+v", resp)
+		}
+
+		// Empty notes are removed
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			AINotes: testutil.Ptr(""),
+		})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var notes sql.NullString
+		if err := env.DB.QueryRow("SELECT ai_notes FROM users WHERE id = ?", env.UserID).Scan(&notes); err != nil || notes.Valid {
+			t.Errorf("Expected AI notes to be removed, got %v (err: %v)", notes, err)
+		}
+	})
+
+	t.Run("ErrorAINotesTooLong", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			AINotes: testutil.Ptr(strings.Repeat("ø", household.MaxAINotesLength+1)),
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	})
+
+	// --- Test Case: Prompt Language ---
+	t.Run("UpdateLanguage", func(t *testing.T) {
+		defer env.DB.Exec("UPDATE users SET language = 'nb' WHERE id = ?", env.UserID)
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			Language: testutil.Ptr("sv"),
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.ProfileResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.Language != "sv" {
+			t.Errorf("Expected language sv, got %+v", resp)
+		}
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile", env.AuthToken, types.UpdateProfilePayload{
+			Language: testutil.Ptr("xx"),
+		})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "de, nb, sv")
+	})
+}
+
+// TestHouseholdAINotes tests editing the household's AI notes through PUT /v1/household.
+func TestHouseholdAINotes(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+	defer func() {
+		if _, err := env.DB.Exec("UPDATE households SET ai_notes = NULL"); err != nil {
+			t.Fatalf("Failed to reset household AI notes: %v", err)
+		}
+	}()
+
+	partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+	if err != nil {
+		t.Fatalf("Failed to generate partner token: %v", err)
+	}
+
+	// Any member may edit them, and all members see them
+	req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/household", partnerToken, types.UpdateHouseholdPayload{
+		AINotes: testutil.Ptr("Groceries are always shared; 'Oda' is our cat"),
+	})
+	rr := testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+	req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/household", env.AuthToken, nil)
+	rr = testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+	var resp types.HouseholdResponse
+	testutil.DecodeJSONResponse(t, rr, &resp)
+	if resp.AINotes != "Groceries are always shared; 'Oda' is our cat" || len(resp.Members) != 2 {
+		t.Errorf("Unexpected household: %+v", resp)
+	}
+
+	req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/household", env.AuthToken, types.UpdateHouseholdPayload{})
+	rr = testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+}
+
+// TestHouseholdCurrency tests changing the household's currency through PUT /v1/household.
+func TestHouseholdCurrency(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+	defer func() {
+		if _, err := env.DB.Exec("UPDATE households SET currency = 'NOK'"); err != nil {
+			t.Fatalf("Failed to reset household currency: %v", err)
+		}
+	}()
+
+	req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/household", env.AuthToken, nil)
+	rr := testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+	var resp types.HouseholdResponse
+	testutil.DecodeJSONResponse(t, rr, &resp)
+	if resp.Currency != household.DefaultCurrency {
+		t.Errorf("Expected the default currency, got %+v", resp)
+	}
+
+	// Codes are normalized, and the AI notes are left alone
+	req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/household", env.AuthToken, types.UpdateHouseholdPayload{
+		Currency: testutil.Ptr(" sek "),
+	})
+	rr = testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+	testutil.DecodeJSONResponse(t, rr, &resp)
+	if resp.Currency != "SEK" || resp.AINotes != "" {
+		t.Errorf("Expected currency SEK, got %+v", resp)
+	}
+
+	for _, invalid := range []string{"kroner", "S3K", ""} {
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/household", env.AuthToken, types.UpdateHouseholdPayload{
+			Currency: testutil.Ptr(invalid),
+		})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	}
+}
+
+// TestChangePassword tests the PUT /v1/profile/password endpoint.
+func TestChangePassword(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	// --- Test Case: Wrong Current Password ---
+	t.Run("ErrorWrongCurrentPassword", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile/password", env.AuthToken, types.ChangePasswordPayload{
+			CurrentPassword: "wrongpassword", NewPassword: "newpassword",
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusUnauthorized)
+	})
+
+	// --- Test Case: New Password Too Short ---
+	t.Run("ErrorTooShort", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile/password", env.AuthToken, types.ChangePasswordPayload{
+			CurrentPassword: "password", NewPassword: "short",
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	})
+
+	// --- Test Case: Success ---
+	t.Run("Success", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/profile/password", env.AuthToken, types.ChangePasswordPayload{
+			CurrentPassword: "password", NewPassword: "newpassword",
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNoContent)
+
+		// The old password no longer works, the new one does
+		oldLogin := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/login", "", types.LoginRequest{Username: "demo_user", Password: "password"})
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, oldLogin), http.StatusUnauthorized)
+		newLogin := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/login", "", types.LoginRequest{Username: "demo_user", Password: "newpassword"})
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, newLogin), http.StatusOK)
+	})
+}
+
+// TestDeleteAccount tests the DELETE /v1/account endpoint.
+func TestDeleteAccount(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
+
+	// --- Setup Data ---
+	// User paid, shared with Partner
+	ownSpending := testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 50.0, "Shared Groceries", false, nil, nil)
+	// Partner paid, shared with User
+	partnerSpending := testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, groceriesID, 80.0, "Partner Groceries", false, nil, nil)
+	_ = testutil.InsertDeposit(t, env.DB, env.UserID, 1000.0, "Salary", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), false, nil)
+	// User uploaded a receipt, Partner too
+	ownReceipt := testutil.AttachReceipt(t, env.DB, env.Attachments, testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Receipt", 20.0, "completed", true, false, nil))
+	partnerReceipt := testutil.AttachReceipt(t, env.DB, env.Attachments, testutil.InsertAIJob(t, env.DB, env.PartnerID, nil, "Receipt", 30.0, "completed", true, false, nil))
+
+	// --- Test Case: Wrong Password ---
+	t.Run("ErrorWrongPassword", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodDelete, "/v1/account", env.AuthToken, types.DeleteAccountPayload{Password: "wrongpassword"})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusUnauthorized)
+	})
+
+	// --- Test Case: Unsettled Shared Spendings ---
+	t.Run("ErrorUnsettled", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodDelete, "/v1/account", env.AuthToken, types.DeleteAccountPayload{Password: "password"})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusConflict)
+		testutil.AssertBodyContains(t, rr, "Settle up")
+	})
+
+	// --- Test Case: Success After Settling ---
+	t.Run("Success", func(t *testing.T) {
+		settle := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", env.AuthToken, nil)
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, settle), http.StatusOK)
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodDelete, "/v1/account", env.AuthToken, types.DeleteAccountPayload{Password: "password"})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		// The response is the export taken before deletion
+		var exported types.FullExport
+		testutil.DecodeJSONResponse(t, rr, &exported)
+		if exported.User.Username != "demo_user" {
+			t.Errorf("Expected export for 'demo_user', got '%s'", exported.User.Username)
+		}
+		if len(exported.ManualSpendings) != 2 || len(exported.Deposits) != 1 {
+			t.Errorf("Expected 2 spendings and 1 deposit in export, got %d and %d", len(exported.ManualSpendings), len(exported.Deposits))
+		}
+
+		// The user and their own spending are gone
+		var count int
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", env.UserID).Scan(&count); err != nil || count != 0 {
+			t.Errorf("Expected user to be deleted, found %d (err: %v)", count, err)
+		}
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM spendings WHERE id = ?", ownSpending).Scan(&count); err != nil || count != 0 {
+			t.Errorf("Expected user's spending to be deleted, found %d (err: %v)", count, err)
+		}
+
+		// The user's receipt photos are removed, the partner's are kept
+		if _, err := env.Attachments.Open(ownReceipt); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected the user's receipt to be removed, got %v", err)
+		}
+		if file, err := env.Attachments.Open(partnerReceipt); err != nil {
+			t.Errorf("Expected the partner's receipt to remain: %v", err)
+		} else {
+			file.Close()
+		}
+
+		// The partner's spending survives, now borne by the partner alone
+		var sharedWith sql.NullInt64
+		if err := env.DB.QueryRow("SELECT shared_with FROM user_spendings WHERE spending_id = ?", partnerSpending).Scan(&sharedWith); err != nil {
+			t.Fatalf("Expected partner's spending to remain: %v", err)
+		}
+		if sharedWith.Valid {
+			t.Errorf("Expected partner's spending to no longer be shared, got shared_with %d", sharedWith.Int64)
+		}
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM spending_shares WHERE spending_id = ?", partnerSpending).Scan(&count); err != nil || count != 0 {
+			t.Errorf("Expected no shares left on partner's spending, found %d (err: %v)", count, err)
+		}
+
+		// The partner's household lives on without the user
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM household_members WHERE user_id = ?", env.PartnerID).Scan(&count); err != nil || count != 1 {
+			t.Errorf("Expected partner to remain in a household, found %d (err: %v)", count, err)
+		}
+	})
+}
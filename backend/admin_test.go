@@ -0,0 +1,205 @@
+package main_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// TestAdminModels tests the GET /v1/admin/models and PUT /v1/admin/models/default endpoints.
+func TestAdminModels(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	// --- Test Case: Not an Admin ---
+	t.Run("ErrorNotAdmin", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/admin/models", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/admin/models/default", env.AuthToken, types.SetDefaultModelPayload{Model: "mock:fallback"})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+	})
+
+	// The user becomes an admin
+	if _, err := env.DB.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", env.UserID); err != nil {
+		t.Fatalf("Failed to make user an admin: %v", err)
+	}
+
+	// --- Test Case: List Models ---
+	t.Run("ListModels", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/admin/models", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.ModelsResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if len(resp.Models) != 2 || resp.Default != "mock:primary" {
+			t.Errorf("Expected two models with mock:primary as default, got %+v", resp)
+		}
+	})
+
+	// --- Test Case: Switch Default ---
+	t.Run("SwitchDefault", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/admin/models/default", env.AuthToken, types.SetDefaultModelPayload{Model: "mock:fallback"})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.ModelsResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.Default != "mock:fallback" {
+			t.Errorf("Expected default mock:fallback, got %q", resp.Default)
+		}
+
+		// The choice is stored, so it survives a restart
+		var stored string
+		if err := env.DB.QueryRow("SELECT value FROM app_settings WHERE key = 'default_model'").Scan(&stored); err != nil || stored != "mock:fallback" {
+			t.Errorf("Expected stored default mock:fallback, got %q (err: %v)", stored, err)
+		}
+	})
+
+	// --- Test Case: Unknown Model ---
+	t.Run("ErrorUnknownModel", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/admin/models/default", env.AuthToken, types.SetDefaultModelPayload{Model: "openrouter:nope"})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	})
+
+	if _, err := env.DB.Exec("DELETE FROM app_settings"); err != nil {
+		t.Fatalf("Failed to clean up app settings: %v", err)
+	}
+	if _, err := env.DB.Exec("UPDATE users SET is_admin = 0 WHERE id = ?", env.UserID); err != nil {
+		t.Fatalf("Failed to clean up admin flag: %v", err)
+	}
+}
+
+// TestAdminLLMUsage tests the LLM usage report and household quotas.
+func TestAdminLLMUsage(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	var householdID int64
+	if err := env.DB.QueryRow("SELECT household_id FROM household_members WHERE user_id = ?", env.UserID).Scan(&householdID); err != nil {
+		t.Fatalf("Failed to query household: %v", err)
+	}
+	quotaURL := "/v1/admin/households/" + strconv.FormatInt(householdID, 10) + "/llm-quota"
+
+	// --- Setup Data ---
+	// Two requests by the user, one failed, and one by the partner
+	for _, row := range []struct {
+		userID int64
+		model  *string
+		tokens int
+		cost   float64
+		errMsg *string
+	}{
+		{env.UserID, ptr("mock:primary"), 1000, 1.5, nil},
+		{env.UserID, nil, 0, 0, ptr("timeout")},
+		{env.PartnerID, ptr("mock:fallback"), 500, 0.5, nil},
+	} {
+		_, err := env.DB.Exec(`INSERT INTO llm_usage (user_id, household_id, model, prompt_tokens, completion_tokens, latency_ms, cost, error_message)
+			VALUES (?, ?, ?, ?, 10, 200, ?, ?)`, row.userID, householdID, row.model, row.tokens, row.cost, row.errMsg)
+		if err != nil {
+			t.Fatalf("Failed to insert usage: %v", err)
+		}
+	}
+
+	// --- Test Case: Not an Admin ---
+	t.Run("ErrorNotAdmin", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/admin/llm-usage", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+	})
+
+	// The user becomes an admin
+	if _, err := env.DB.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", env.UserID); err != nil {
+		t.Fatalf("Failed to make user an admin: %v", err)
+	}
+
+	// --- Test Case: Usage Report ---
+	t.Run("Report", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/admin/llm-usage", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.LLMUsageResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.Total.Requests != 3 || resp.Total.Failures != 1 || resp.Total.PromptTokens != 1500 || resp.Total.Cost != 2.0 || resp.Total.AvgLatencyMs != 200 {
+			t.Errorf("Unexpected totals: %+v", resp.Total)
+		}
+		if len(resp.ByDay) != 1 || resp.ByDay[0].Requests != 3 {
+			t.Errorf("Expected one day with three requests, got %+v", resp.ByDay)
+		}
+		if len(resp.ByUser) != 2 || resp.ByUser[0].UserID != env.UserID || resp.ByUser[0].Requests != 2 || resp.ByUser[0].Username != "demo_user" {
+			t.Errorf("Expected the user first with two requests, got %+v", resp.ByUser)
+		}
+	})
+
+	// --- Test Case: Invalid Range ---
+	t.Run("ErrorInvalidRange", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/admin/llm-usage?from=2025-02-01&to=2025-01-01", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	})
+
+	// --- Test Case: Quota Rejects Categorization ---
+	t.Run("QuotaExceeded", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, quotaURL, env.AuthToken, types.SetLLMQuotaPayload{MonthlyCostLimit: ptr(1.0)})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var quota types.LLMQuotaResponse
+		testutil.DecodeJSONResponse(t, rr, &quota)
+		if quota.MonthlyCostLimit == nil || *quota.MonthlyCostLimit != 1.0 || quota.SpentThisMonth != 2.0 {
+			t.Errorf("Unexpected quota: %+v", quota)
+		}
+
+		// The partner's household is over its quota
+		partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+		if err != nil {
+			t.Fatalf("Failed to generate JWT for partner: %v", err)
+		}
+		categorize := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize", partnerToken, types.AICategorizationPayload{Amount: 1000, Prompt: "Milk"})
+		rr = testutil.ExecuteRequest(t, env.Handler, categorize)
+		testutil.AssertStatusCode(t, rr, http.StatusTooManyRequests)
+
+		// Removing the quota lets categorization through again
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPut, quotaURL, env.AuthToken, types.SetLLMQuotaPayload{})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		categorize = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize", partnerToken, types.AICategorizationPayload{Amount: 1000, Prompt: "Milk"})
+		rr = testutil.ExecuteRequest(t, env.Handler, categorize)
+		testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+	})
+
+	// --- Test Case: Invalid Quotas ---
+	t.Run("ErrorInvalidQuota", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, quotaURL, env.AuthToken, types.SetLLMQuotaPayload{MonthlyCostLimit: ptr(-1.0)})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/admin/households/99999/llm-quota", env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+
+	for _, stmt := range []string{
+		"DELETE FROM llm_usage",
+		"DELETE FROM ai_categorization_jobs",
+		"UPDATE households SET llm_monthly_cost_limit = NULL",
+		"UPDATE users SET is_admin = 0",
+	} {
+		if _, err := env.DB.Exec(stmt); err != nil {
+			t.Fatalf("Failed to clean up (%s): %v", stmt, err)
+		}
+	}
+}
+
+// ptr returns a pointer to the value, for optional fields in payloads.
+func ptr[T any](v T) *T {
+	return &v
+}
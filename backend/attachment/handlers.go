@@ -0,0 +1,399 @@
+package attachment
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// MaxSize bounds the size of an attached file.
+const MaxSize = 10 << 20 // 10 MiB
+
+// maxFileNameLength bounds the stored name of an attached file, in bytes.
+const maxFileNameLength = 255
+
+// mediaTypes lists the types of files that can be attached, with their file extensions.
+var mediaTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+}
+
+// attachmentColumns are the columns scanned by scanAttachment.
+const attachmentColumns = "a.id, a.spending_id, a.deposit_id, a.file_name, a.media_type, a.size, a.sha256, a.created_at"
+
+// attachmentOwner is the owner of the spending, deposit or AI job an attachment belongs to.
+const attachmentOwner = `(
+		SELECT COALESCE(
+			(SELECT buyer FROM user_spendings WHERE spending_id = a.spending_id),
+			(SELECT user_id FROM deposits WHERE id = a.deposit_id),
+			(SELECT buyer FROM ai_categorization_jobs WHERE id = a.job_id)
+		)
+	)`
+
+// HandleAddSpendingAttachment attaches a file to a spending, an AI categorized one or a manual
+// pay entry (protected). Like editing the spending, only its buyer may do so. The request is
+// multipart/form-data with the file in the "file" field: a PDF, JPEG, PNG or WebP of at most MaxSize.
+func HandleAddSpendingAttachment(db *sql.DB, store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for adding spending attachment", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		spendingID, ok := ownedSpending(w, r, db, userID)
+		if !ok {
+			return
+		}
+		addAttachment(w, r, db, store, userID, types.Attachment{SpendingID: &spendingID})
+	}
+}
+
+// HandleAddDepositAttachment attaches a file to a deposit (protected), like
+// HandleAddSpendingAttachment. Only the owner of the deposit may do so.
+func HandleAddDepositAttachment(db *sql.DB, store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for adding deposit attachment", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		depositID, ok := ownedDeposit(w, r, db, userID)
+		if !ok {
+			return
+		}
+		addAttachment(w, r, db, store, userID, types.Attachment{DepositID: &depositID})
+	}
+}
+
+// HandleGetSpendingAttachments lists the attachments of a spending to its buyer.
+func HandleGetSpendingAttachments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for getting spending attachments", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		spendingID, ok := ownedSpending(w, r, db, userID)
+		if !ok {
+			return
+		}
+		listAttachments(w, r, db, userID, "a.spending_id = ?", spendingID)
+	}
+}
+
+// HandleGetDepositAttachments lists the attachments of a deposit to its owner.
+func HandleGetDepositAttachments(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for getting deposit attachments", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		depositID, ok := ownedDeposit(w, r, db, userID)
+		if !ok {
+			return
+		}
+		listAttachments(w, r, db, userID, "a.deposit_id = ?", depositID)
+	}
+}
+
+// HandleDownloadAttachment serves the content of an attachment to the owner of the spending
+// or deposit it is attached to.
+func HandleDownloadAttachment(db *sql.DB, store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for downloading attachment", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		attachment, ok := ownedAttachment(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		file, err := store.Open(attachment.SHA256)
+		if err != nil {
+			slog.Error("failed to open attachment file", "url", r.URL, "user_id", userID, "attachment_id", attachment.ID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", attachment.MediaType)
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName}))
+		w.Header().Set("Cache-Control", "private, max-age=86400") // The content of an attachment never changes
+		if _, err := io.Copy(w, file); err != nil {
+			slog.Warn("failed to write attachment", "url", r.URL, "user_id", userID, "attachment_id", attachment.ID, "err", err)
+		}
+	}
+}
+
+// HandleDeleteAttachment deletes an attachment. Only the owner of the spending or deposit it is
+// attached to may do so.
+func HandleDeleteAttachment(db *sql.DB, store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for deleting attachment", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		attachment, ok := ownedAttachment(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		if err := store.Delete(db, attachment.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Attachment not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("failed to delete attachment", "url", r.URL, "user_id", userID, "attachment_id", attachment.ID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Attachment deleted successfully", "url", r.URL, "user_id", userID, "attachment_id", attachment.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ownedSpending reads the spending ID from the path and checks that the user bought it, like
+// spendings.HandleUpdateSpending. Otherwise it writes an error response and returns false.
+func ownedSpending(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) (int64, bool) {
+	spendingIDStr := r.PathValue("spending_id")
+	spendingID, err := strconv.ParseInt(spendingIDStr, 10, 64)
+	if err != nil {
+		slog.Warn("invalid spending ID format", "url", r.URL, "user_id", userID, "spending_id_str", spendingIDStr, "err", err)
+		http.Error(w, "Invalid spending ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var buyerID int64
+	err = db.QueryRow("SELECT buyer FROM user_spendings WHERE spending_id = ?", spendingID).Scan(&buyerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Spending item not found", http.StatusNotFound)
+		} else {
+			slog.Error("failed to query spending buyer for attachment", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return 0, false
+	}
+	if buyerID != userID {
+		slog.Warn("unauthorized attempt to access spending attachments", "url", r.URL, "user_id", userID, "spending_id", spendingID, "actual_buyer_id", buyerID)
+		http.Error(w, "Forbidden: You can only manage attachments of your own spending items", http.StatusForbidden)
+		return 0, false
+	}
+	return spendingID, true
+}
+
+// ownedDeposit reads the deposit ID from the path and checks that the user owns the deposit.
+// Otherwise it writes an error response and returns false.
+func ownedDeposit(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) (int64, bool) {
+	depositIDStr := r.PathValue("deposit_id")
+	depositID, err := strconv.ParseInt(depositIDStr, 10, 64)
+	if err != nil {
+		slog.Warn("invalid deposit ID format", "url", r.URL, "user_id", userID, "deposit_id_str", depositIDStr, "err", err)
+		http.Error(w, "Invalid deposit ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var ownerID int64
+	err = db.QueryRow("SELECT user_id FROM deposits WHERE id = ?", depositID).Scan(&ownerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Deposit not found", http.StatusNotFound)
+		} else {
+			slog.Error("failed to query deposit owner for attachment", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return 0, false
+	}
+	if ownerID != userID {
+		slog.Warn("unauthorized attempt to access deposit attachments", "url", r.URL, "user_id", userID, "deposit_id", depositID, "actual_owner_id", ownerID)
+		http.Error(w, "Forbidden: You can only manage attachments of your own deposits", http.StatusForbidden)
+		return 0, false
+	}
+	return depositID, true
+}
+
+// ownedAttachment reads the attachment ID from the path and loads the attachment, checking
+// that the user owns what it is attached to. Otherwise it writes an error response and returns false.
+func ownedAttachment(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) (types.Attachment, bool) {
+	attachmentIDStr := r.PathValue("attachment_id")
+	attachmentID, err := strconv.ParseInt(attachmentIDStr, 10, 64)
+	if err != nil {
+		slog.Warn("invalid attachment ID format", "url", r.URL, "user_id", userID, "attachment_id_str", attachmentIDStr, "err", err)
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return types.Attachment{}, false
+	}
+
+	var ownerID sql.NullInt64
+	row := db.QueryRow("SELECT "+attachmentColumns+", "+attachmentOwner+" FROM attachments a WHERE a.id = ?", attachmentID)
+	attachment, err := scanAttachment(row, &ownerID)
+	// An attachment whose spending or deposit is gone is about to be removed
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !ownerID.Valid) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return types.Attachment{}, false
+	}
+	if err != nil {
+		slog.Error("failed to query attachment", "url", r.URL, "user_id", userID, "attachment_id", attachmentID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return types.Attachment{}, false
+	}
+	if ownerID.Int64 != userID {
+		slog.Warn("unauthorized attempt to access attachment", "url", r.URL, "user_id", userID, "attachment_id", attachmentID, "actual_owner_id", ownerID.Int64)
+		http.Error(w, "Forbidden: You can only manage attachments of your own spending items and deposits", http.StatusForbidden)
+		return types.Attachment{}, false
+	}
+	return attachment, true
+}
+
+// scanAttachment scans attachmentColumns, followed by the given extra destinations.
+func scanAttachment(row interface{ Scan(...any) error }, extra ...any) (types.Attachment, error) {
+	var a types.Attachment
+	var spendingID, depositID sql.NullInt64
+	dest := append([]any{&a.ID, &spendingID, &depositID, &a.FileName, &a.MediaType, &a.Size, &a.SHA256, &a.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return types.Attachment{}, err
+	}
+	if spendingID.Valid {
+		a.SpendingID = &spendingID.Int64
+	}
+	if depositID.Valid {
+		a.DepositID = &depositID.Int64
+	}
+	return a, nil
+}
+
+// addAttachment reads the uploaded file and stores it as the given attachment, responding with
+// the attachment.
+func addAttachment(w http.ResponseWriter, r *http.Request, db *sql.DB, store *Store, userID int64, attachment types.Attachment) {
+	// 1. Read the file, bounding the size of the whole request
+	r.Body = http.MaxBytesReader(w, r.Body, MaxSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Attachment too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.Warn("failed to parse attachment upload", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Bad Request: Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Bad Request: Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, MaxSize+1))
+	if err != nil {
+		slog.Error("failed to read attachment upload", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(data) > MaxSize {
+		http.Error(w, "Attachment too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "Bad Request: Empty file", http.StatusBadRequest)
+		return
+	}
+
+	// 2. Go by the content rather than the client's word
+	attachment.MediaType = http.DetectContentType(data)
+	ext, ok := mediaTypes[attachment.MediaType]
+	if !ok {
+		http.Error(w, "Unsupported attachment type, expected PDF, JPEG, PNG or WebP", http.StatusUnsupportedMediaType)
+		return
+	}
+	attachment.FileName = fileName(header.Filename, ext)
+
+	// 3. Store it
+	attachment, err = store.Add(db, attachment, userID, data)
+	if err != nil {
+		slog.Error("failed to store attachment", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Attachment added", "url", r.URL, "user_id", userID, "attachment_id", attachment.ID, "size", attachment.Size, "media_type", attachment.MediaType)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// listAttachments responds with the attachments matching the condition, oldest first.
+func listAttachments(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64, condition string, id int64) {
+	rows, err := db.Query("SELECT "+attachmentColumns+" FROM attachments a WHERE "+condition+" ORDER BY a.id ASC", id)
+	if err != nil {
+		slog.Error("failed to query attachments", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attachments := []types.Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			slog.Error("failed to scan attachment", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		attachments = append(attachments, attachment)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error iterating attachments", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// fileName cleans the name of an uploaded file for storing, falling back to a generic name
+// with the extension of its type.
+func fileName(name, ext string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == "/" || name == "" {
+		return "attachment" + ext
+	}
+	for len(name) > maxFileNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
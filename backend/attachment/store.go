@@ -0,0 +1,258 @@
+// Package attachment stores files attached to spendings and deposits, such as invoices and
+// warranty cards.
+package attachment
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// ErrInvalidHash is returned for a content key that is not a hex SHA-256 digest.
+var ErrInvalidHash = errors.New("invalid attachment hash")
+
+// Store is a content-addressed file store: every file is kept under the SHA-256 of its content,
+// so a file attached several times is stored once. The attachments table references the files,
+// and so do AI jobs, whose receipt photos are kept here too; a file is removed once nothing
+// references it.
+type Store struct {
+	dir string
+	// mu serializes adding and removing files, so a file is not removed while a record
+	// referencing it is being added
+	mu sync.Mutex
+}
+
+// NewStore returns a store keeping its files in dir, which is created when the first file is added.
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// path returns where the file with the given hash is kept, spread over subdirectories by the
+// first two characters of the hash.
+func (s *Store) path(hash string) (string, error) {
+	if len(hash) != sha256.Size*2 {
+		return "", ErrInvalidHash
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", ErrInvalidHash
+	}
+	return filepath.Join(s.dir, hash[:2], hash), nil
+}
+
+// Add stores the content of an attachment and inserts it, returning it with its ID, hash and size.
+// Exactly one of a.SpendingID and a.DepositID must be set.
+func (s *Store) Add(db *sql.DB, a types.Attachment, uploadedBy int64, data []byte) (types.Attachment, error) {
+	if (a.SpendingID == nil) == (a.DepositID == nil) {
+		return types.Attachment{}, errors.New("attachment needs exactly one of a spending and a deposit")
+	}
+	sum := sha256.Sum256(data)
+	a.SHA256 = hex.EncodeToString(sum[:])
+	a.Size = int64(len(data))
+	a.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(a.SHA256, data); err != nil {
+		return types.Attachment{}, err
+	}
+	res, err := db.Exec(`
+		INSERT INTO attachments (spending_id, deposit_id, uploaded_by, file_name, media_type, size, sha256, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, a.SpendingID, a.DepositID, uploadedBy, a.FileName, a.MediaType, a.Size, a.SHA256, a.CreatedAt)
+	if err != nil {
+		s.removeUnreferenced(db, a.SHA256)
+		return types.Attachment{}, fmt.Errorf("inserting attachment: %w", err)
+	}
+	a.ID, err = res.LastInsertId()
+	if err != nil {
+		return types.Attachment{}, fmt.Errorf("getting attachment ID: %w", err)
+	}
+	return a, nil
+}
+
+// Put stores a file for a record other than an attachment that references it by hash, such as
+// the receipt photo of an AI job. insert is called with the hash to store the record; the store
+// stays locked meanwhile, so Sweep does not remove the file before the record references it.
+// If insert fails, the file is removed again unless something else references it.
+func (s *Store) Put(db *sql.DB, data []byte, insert func(hash string) error) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(hash, data); err != nil {
+		return "", err
+	}
+	if err := insert(hash); err != nil {
+		s.removeUnreferenced(db, hash)
+		return "", err
+	}
+	return hash, nil
+}
+
+// write stores data under its hash, unless the file is there already. Callers hold s.mu.
+func (s *Store) write(hash string, data []byte) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("creating attachment directory: %w", err)
+		}
+		// Write to a temporary file first, so a failed upload never leaves a truncated file
+		if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+			return fmt.Errorf("writing attachment: %w", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return fmt.Errorf("writing attachment: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("checking attachment: %w", err)
+	}
+	return nil
+}
+
+// Delete deletes an attachment, and its file unless another attachment has the same content.
+func (s *Store) Delete(db *sql.DB, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hash string
+	if err := db.QueryRow("SELECT sha256 FROM attachments WHERE id = ?", id).Scan(&hash); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM attachments WHERE id = ?", id); err != nil {
+		return fmt.Errorf("deleting attachment: %w", err)
+	}
+	s.removeUnreferenced(db, hash)
+	return nil
+}
+
+// Release removes the files with the given hashes that nothing references anymore, such as the
+// receipt photos of deleted AI jobs. Call it once the deletion has committed. Failures are only
+// logged; Sweep removes the files later.
+func (s *Store) Release(db *sql.DB, hashes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, hash := range hashes {
+		s.removeUnreferenced(db, hash)
+	}
+}
+
+// Open opens the file with the given hash.
+func (s *Store) Open(hash string) (*os.File, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// referencedHashes selects the hashes of the files in use: those of attachments and of the
+// receipt photos of AI jobs.
+const referencedHashes = `
+	SELECT sha256 FROM attachments
+	UNION SELECT receipt_sha256 FROM ai_categorization_jobs WHERE receipt_sha256 IS NOT NULL`
+
+// removeUnreferenced removes the file with the given hash if nothing references it. Failures
+// are only logged; Sweep removes the file later. Callers hold s.mu.
+func (s *Store) removeUnreferenced(db *sql.DB, hash string) {
+	var referenced bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM ("+referencedHashes+") WHERE sha256 = ?)", hash).Scan(&referenced); err != nil {
+		slog.Error("failed to check references to attachment file", "sha256", hash, "err", err)
+		return
+	}
+	if referenced {
+		return
+	}
+	path, err := s.path(hash)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("failed to remove attachment file", "sha256", hash, "err", err)
+	}
+}
+
+// Sweep removes the files nothing references anymore. Deleting a spending, deposit, AI job or
+// account deletes its attachments along with it, and a receipt photo goes with its job; their
+// files are removed here if not right away. Returns the number of files removed.
+func (s *Store) Sweep(db *sql.DB) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referenced := map[string]bool{}
+	rows, err := db.Query(referencedHashes)
+	if err != nil {
+		return 0, fmt.Errorf("querying attachment hashes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return 0, fmt.Errorf("scanning attachment hash: %w", err)
+		}
+		referenced[hash] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("iterating attachment hashes: %w", err)
+	}
+
+	removed := 0
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == s.dir {
+				return fs.SkipAll // Nothing attached yet
+			}
+			return err
+		}
+		// Leftovers of failed writes are removed too
+		if d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("removing unreferenced attachment files: %w", err)
+	}
+	return removed, nil
+}
+
+// SweepEvery sweeps the store right away and then at every interval, until ctx is done.
+func (s *Store) SweepEvery(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		removed, err := s.Sweep(db)
+		if err != nil {
+			slog.Error("failed to sweep attachment store", "dir", s.dir, "err", err)
+		} else if removed > 0 {
+			slog.Info("Removed unreferenced attachment files", "dir", s.dir, "count", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+	"git.sr.ht/~relay/sapp-backend/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestAttachments tests attaching files to spendings and deposits, their export along with
+// receipt photos, and the cleanup of both.
+func TestAttachments(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+	require.NoError(t, err)
+
+	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
+	spendingID := testutil.InsertSpending(t, env.DB, env.UserID, nil, groceriesID, 1200.0, "Washing machine", false, nil, nil)
+	depositID := testutil.InsertDeposit(t, env.DB, env.UserID, 500.0, "Refund", time.Now().UTC(), false, nil)
+	receiptJobID := testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Receipt", 20.0, "completed", true, false, nil)
+	receipt := testutil.AttachReceipt(t, env.DB, env.Attachments, receiptJobID)
+	defer func() {
+		for _, query := range []string{
+			"DELETE FROM attachments",
+			"DELETE FROM ai_categorization_jobs",
+			"DELETE FROM user_spendings WHERE spending_id = ?",
+			"DELETE FROM spendings WHERE id = ?",
+		} {
+			_, err := env.DB.Exec(query, spendingID)
+			require.NoError(t, err)
+		}
+		_, err := env.DB.Exec("DELETE FROM deposits WHERE id = ?", depositID)
+		require.NoError(t, err)
+	}()
+
+	invoice := []byte("%PDF-1.7\ninvoice")
+	upload := func(t *testing.T, path, token, name string, file []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, err := form.CreateFormFile("file", name)
+		require.NoError(t, err)
+		part.Write(file)
+		form.Close()
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, path, token, nil)
+		req.Body = io.NopCloser(&body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return testutil.ExecuteRequest(t, env.Handler, req)
+	}
+	spendingPath := fmt.Sprintf("/v1/spendings/%d/attachments", spendingID)
+	depositPath := fmt.Sprintf("/v1/deposits/%d/attachments", depositID)
+
+	// --- Test Case: Attach to a Spending and a Deposit ---
+	var spendingAttachment, depositAttachment types.Attachment
+	t.Run("Upload", func(t *testing.T) {
+		rr := upload(t, spendingPath, env.AuthToken, "../invoice.pdf", invoice)
+		testutil.AssertStatusCode(t, rr, http.StatusCreated)
+		testutil.DecodeJSONResponse(t, rr, &spendingAttachment)
+		assert.Equal(t, "invoice.pdf", spendingAttachment.FileName)
+		assert.Equal(t, "application/pdf", spendingAttachment.MediaType)
+		assert.Equal(t, int64(len(invoice)), spendingAttachment.Size)
+		require.NotNil(t, spendingAttachment.SpendingID)
+		assert.Equal(t, spendingID, *spendingAttachment.SpendingID)
+
+		// The same file is stored once
+		rr = upload(t, depositPath, env.AuthToken, "refund.pdf", invoice)
+		testutil.AssertStatusCode(t, rr, http.StatusCreated)
+		testutil.DecodeJSONResponse(t, rr, &depositAttachment)
+		assert.Equal(t, spendingAttachment.SHA256, depositAttachment.SHA256)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		rr := upload(t, spendingPath, env.AuthToken, "notes.pdf", []byte("just some text"))
+		testutil.AssertStatusCode(t, rr, http.StatusUnsupportedMediaType)
+
+		rr = upload(t, spendingPath, partnerToken, "invoice.pdf", invoice)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+
+		rr = upload(t, "/v1/spendings/999999/attachments", env.AuthToken, "invoice.pdf", invoice)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+
+	// --- Test Case: List and Download ---
+	t.Run("ListAndDownload", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, spendingPath, env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var attachments []types.Attachment
+		testutil.DecodeJSONResponse(t, rr, &attachments)
+		require.Len(t, attachments, 1)
+		assert.Equal(t, spendingAttachment.ID, attachments[0].ID)
+
+		downloadPath := fmt.Sprintf("/v1/attachments/%d", spendingAttachment.ID)
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, downloadPath, env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		assert.Equal(t, invoice, rr.Body.Bytes())
+		assert.Equal(t, "application/pdf", rr.Header().Get("Content-Type"))
+		assert.Equal(t, "attachment; filename=invoice.pdf", rr.Header().Get("Content-Disposition"))
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, downloadPath, partnerToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+	})
+
+	// --- Test Case: Export Archive ---
+	t.Run("ExportArchive", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/export/archive", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		assert.Equal(t, "application/zip", rr.Header().Get("Content-Type"))
+
+		archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		require.NoError(t, err)
+		files := map[string][]byte{}
+		for _, f := range archive.File {
+			r, err := f.Open()
+			require.NoError(t, err)
+			files[f.Name], err = io.ReadAll(r)
+			require.NoError(t, err)
+			r.Close()
+		}
+		require.Len(t, files, 3, "export.json, the shared attachment file and the receipt")
+
+		var export types.FullExport
+		require.NoError(t, json.Unmarshal(files["export.json"], &export))
+		require.Len(t, export.ManualSpendings, 1)
+		require.Len(t, export.ManualSpendings[0].Attachments, 1)
+		path := export.ManualSpendings[0].Attachments[0].Path
+		assert.Equal(t, invoice, files[path])
+		require.Len(t, export.Deposits, 1)
+		require.Len(t, export.Deposits[0].Attachments, 1)
+		assert.Equal(t, path, export.Deposits[0].Attachments[0].Path)
+
+		// The receipt photo of the AI job is in the archive too
+		require.Len(t, export.AIJobs, 1)
+		require.NotNil(t, export.AIJobs[0].Receipt)
+		assert.Equal(t, receipt, export.AIJobs[0].Receipt.SHA256)
+		assert.Equal(t, "image/png", export.AIJobs[0].Receipt.MediaType)
+		assert.Contains(t, files, export.AIJobs[0].Receipt.Path)
+	})
+
+	// --- Test Case: Delete ---
+	t.Run("Delete", func(t *testing.T) {
+		deletePath := fmt.Sprintf("/v1/attachments/%d", spendingAttachment.ID)
+		req := testutil.NewAuthenticatedRequest(t, http.MethodDelete, deletePath, partnerToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodDelete, deletePath, env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNoContent)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, deletePath, env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+
+		// The deposit's attachment still has the file
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, fmt.Sprintf("/v1/attachments/%d", depositAttachment.ID), env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		assert.Equal(t, invoice, rr.Body.Bytes())
+	})
+
+	// --- Test Case: Deleting the Deposit Removes its Attachments ---
+	t.Run("DeleteDeposit", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodDelete, fmt.Sprintf("/v1/deposits/%d", depositID), env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var count int
+		require.NoError(t, env.DB.QueryRow("SELECT COUNT(*) FROM attachments").Scan(&count))
+		assert.Zero(t, count)
+
+		removed, err := env.Attachments.Sweep(env.DB)
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		_, err = env.Attachments.Open(depositAttachment.SHA256)
+		assert.Error(t, err, "file should be removed once no attachment references it")
+	})
+
+	// --- Test Case: The Sweep Covers Receipt Photos ---
+	t.Run("SweepReceipts", func(t *testing.T) {
+		removed, err := env.Attachments.Sweep(env.DB)
+		require.NoError(t, err)
+		assert.Zero(t, removed, "the job still references its receipt")
+
+		// Deleted behind the pool's back, so the receipt is left for the sweep
+		_, err = env.DB.Exec("DELETE FROM ai_categorization_jobs WHERE id = ?", receiptJobID)
+		require.NoError(t, err)
+		removed, err = env.Attachments.Sweep(env.DB)
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		_, err = env.Attachments.Open(receipt)
+		assert.Error(t, err, "receipt should be removed once no job references it")
+	})
+}
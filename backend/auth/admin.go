@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// IsAdmin reports whether the user may change instance-wide settings.
+// Admins are appointed with "sappadmin set-admin"; there is no endpoint for it.
+func IsAdmin(q Querier, userID int64) (bool, error) {
+	var isAdmin bool
+	err := q.QueryRow("SELECT is_admin FROM users WHERE id = ?", userID).Scan(&isAdmin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return isAdmin, err
+}
+
+// RequireAdmin returns middleware rejecting users who are not admins with 403 Forbidden.
+// It must run after AuthMiddleware, which puts the user ID into the context.
+func RequireAdmin(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, ok := GetUserIDFromContext(r.Context())
+			if !ok {
+				slog.Error("failed to get user ID from context for admin check", "url", r.URL)
+				http.Error(w, "Authentication error", http.StatusInternalServerError)
+				return
+			}
+
+			isAdmin, err := IsAdmin(db, userID)
+			if err != nil {
+				slog.Error("failed to check admin status", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if !isAdmin {
+				slog.Warn("non-admin attempted admin request", "url", r.URL, "user_id", userID)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -432,25 +432,27 @@ type Querier interface {
 	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
-// GetPartnerUserID finds the partner ID for a given user ID by querying the partnerships table.
+// GetPartnerUserID finds the partner ID for a given user ID from their household.
+// A partner only exists when the household has exactly two members; larger households
+// should use the household package to work with the full member list.
 // It accepts a Querier interface, which can be either *sql.DB or *sql.Tx.
 func GetPartnerUserID(q Querier, requestingUserID int64) (int64, bool) {
 	var partnerID int64
+	var memberCount int
 
-	// Query based on the user being either user1_id or user2_id
-	// The CHECK constraint ensures user1_id < user2_id, simplifying the query slightly
-	// but we query both possibilities for robustness.
 	query := `
-		SELECT user2_id FROM partnerships WHERE user1_id = ?
-		UNION
-		SELECT user1_id FROM partnerships WHERE user2_id = ?
+		SELECT MIN(other.user_id), (SELECT COUNT(*) FROM household_members c WHERE c.household_id = self.household_id)
+		FROM household_members self
+		JOIN household_members other ON other.household_id = self.household_id AND other.user_id != self.user_id
+		WHERE self.user_id = ?
+		GROUP BY self.household_id
 	`
 	// Use the Querier interface 'q' to execute the query
-	err := q.QueryRow(query, requestingUserID, requestingUserID).Scan(&partnerID)
+	err := q.QueryRow(query, requestingUserID).Scan(&partnerID, &memberCount)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
-			// No partner found for this user
+			// No household, or the user is its only member
 			return 0, false
 		}
 		// Log other database errors
@@ -458,6 +460,11 @@ func GetPartnerUserID(q Querier, requestingUserID int64) (int64, bool) {
 		return 0, false
 	}
 
+	if memberCount != 2 {
+		// More than one other member: there is no single partner
+		return 0, false
+	}
+
 	return partnerID, true
 }
 
@@ -486,23 +493,9 @@ func HandlePartnerRegistration(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Basic password length check (example)
-		if len(u1.Password) < 6 || len(u2.Password) < 6 {
-			http.Error(w, "Password must be at least 6 characters long", http.StatusBadRequest)
-			return
-		}
-
-		// --- Password Hashing ---
-		hashedPassword1, err := bcrypt.GenerateFromPassword([]byte(u1.Password), bcrypt.DefaultCost)
-		if err != nil {
-			slog.Error("Failed to hash password for user 1", "username", u1.Username, "err", err)
-			http.Error(w, "Internal server error during registration", http.StatusInternalServerError)
-			return
-		}
-		hashedPassword2, err := bcrypt.GenerateFromPassword([]byte(u2.Password), bcrypt.DefaultCost)
-		if err != nil {
-			slog.Error("Failed to hash password for user 2", "username", u2.Username, "err", err)
-			http.Error(w, "Internal server error during registration", http.StatusInternalServerError)
+		// Same password policy as everywhere else a password is set
+		if ValidatePassword(u1.Password) != nil || ValidatePassword(u2.Password) != nil {
+			http.Error(w, fmt.Sprintf("Password must be at least %d characters long", MinPasswordLength), http.StatusBadRequest)
 			return
 		}
 
@@ -528,35 +521,19 @@ func HandlePartnerRegistration(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Insert User 1
-		res1, err := tx.Exec("INSERT INTO users (username, password_hash, first_name) VALUES (?, ?, ?)",
-			u1.Username, string(hashedPassword1), u1.FirstName)
+		// Insert both users (validation and hashing shared with the admin CLI)
+		user1ID, err := CreateUser(tx, u1)
 		if err != nil {
 			slog.Error("Failed to insert user 1", "username", u1.Username, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		user1ID, err := res1.LastInsertId()
-		if err != nil {
-			slog.Error("Failed to get last insert ID for user 1", "err", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-
-		// Insert User 2
-		res2, err := tx.Exec("INSERT INTO users (username, password_hash, first_name) VALUES (?, ?, ?)",
-			u2.Username, string(hashedPassword2), u2.FirstName)
+		user2ID, err := CreateUser(tx, u2)
 		if err != nil {
 			slog.Error("Failed to insert user 2", "username", u2.Username, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		user2ID, err := res2.LastInsertId()
-		if err != nil {
-			slog.Error("Failed to get last insert ID for user 2", "err", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
 
 		// Insert Partnership (ensure user1_id < user2_id for the CHECK constraint)
 		var partner1, partner2 int64
@@ -574,6 +551,26 @@ func HandlePartnerRegistration(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		// Create the household shared by the two new users
+		resHousehold, err := tx.Exec("INSERT INTO households (name) VALUES (?)", u1.FirstName+" & "+u2.FirstName)
+		if err != nil {
+			slog.Error("Failed to insert household", "user1", partner1, "user2", partner2, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		householdID, err := resHousehold.LastInsertId()
+		if err != nil {
+			slog.Error("Failed to get last insert ID for household", "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec("INSERT INTO household_members (household_id, user_id) VALUES (?, ?), (?, ?)", householdID, user1ID, householdID, user2ID)
+		if err != nil {
+			slog.Error("Failed to insert household members", "household_id", householdID, "user1", user1ID, "user2", user2ID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		// Commit Transaction
 		if err = tx.Commit(); err != nil {
 			slog.Error("Failed to commit transaction for partner registration", "err", err)
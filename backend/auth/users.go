@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// MinPasswordLength is the shortest password accepted anywhere a password is set.
+const MinPasswordLength = 6
+
+// ErrUsernameTaken is returned when creating or renaming a user to an existing username.
+var ErrUsernameTaken = errors.New("username already exists")
+
+// ErrInvalidUserDetails wraps validation failures for user details, so callers can map them to a 400.
+var ErrInvalidUserDetails = errors.New("invalid user details")
+
+// ValidatePassword checks a new password against the password policy.
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("%w: password must be at least %d characters long", ErrInvalidUserDetails, MinPasswordLength)
+	}
+	return nil
+}
+
+// ValidateUserDetails checks the details needed to register a user.
+func ValidateUserDetails(details types.UserRegistrationDetails) error {
+	if strings.TrimSpace(details.Username) == "" || details.Password == "" || strings.TrimSpace(details.FirstName) == "" {
+		return fmt.Errorf("%w: username, password and first name are required", ErrInvalidUserDetails)
+	}
+	return ValidatePassword(details.Password)
+}
+
+// HashPassword hashes a password for storage.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// CreateUser validates the details and inserts a new user, returning its ID.
+func CreateUser(tx *sql.Tx, details types.UserRegistrationDetails) (int64, error) {
+	if err := ValidateUserDetails(details); err != nil {
+		return 0, err
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", details.Username).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to check username uniqueness: %w", err)
+	}
+	if count > 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUsernameTaken, details.Username)
+	}
+
+	hash, err := HashPassword(details.Password)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO users (username, password_hash, first_name) VALUES (?, ?, ?)",
+		details.Username, hash, details.FirstName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert user %s: %w", details.Username, err)
+	}
+	return res.LastInsertId()
+}
+
+// SetPassword validates and stores a new password for the user, then revokes
+// their sessions so every device has to log in again.
+func SetPassword(tx *sql.Tx, userID int64, password string) error {
+	if err := ValidatePassword(password); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update password hash: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("user %d: %w", userID, sql.ErrNoRows)
+	}
+	if _, err := RevokeSessions(tx, userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RevokeSessions deletes all refresh tokens of the user and returns how many were removed.
+// Access tokens stay valid until they expire.
+func RevokeSessions(tx *sql.Tx, userID int64) (int64, error) {
+	res, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return res.RowsAffected()
+}
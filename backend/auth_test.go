@@ -43,8 +43,8 @@ func TestLogin(t *testing.T) {
 		testutil.DecodeJSONResponse(t, rr, &respBody)
 
 		// Validate the JWT token
-		claims := &auth.Claims{}
-		_, err := jwt.ParseWithClaims(respBody.Token, claims, func(token *jwt.Token) (interface{}, error) {
+		claims := &auth.AccessTokenClaims{}
+		_, err := jwt.ParseWithClaims(respBody.AccessToken, claims, func(token *jwt.Token) (interface{}, error) {
 			// Use the secret set by t.Setenv in SetupTestEnvironment
 			secret := []byte(os.Getenv("JWT_SECRET_KEY"))
 			if len(secret) == 0 {
@@ -141,8 +141,8 @@ func TestLogin(t *testing.T) {
 		testutil.DecodeJSONResponse(t, rrPartner, &respBodyPartner)
 
 		// Validate the JWT token for the partner
-		claimsPartner := &auth.Claims{}
-		_, err := jwt.ParseWithClaims(respBodyPartner.Token, claimsPartner, func(token *jwt.Token) (interface{}, error) {
+		claimsPartner := &auth.AccessTokenClaims{}
+		_, err := jwt.ParseWithClaims(respBodyPartner.AccessToken, claimsPartner, func(token *jwt.Token) (interface{}, error) {
 			// Use the secret set by t.Setenv in SetupTestEnvironment
 			secret := []byte(os.Getenv("JWT_SECRET_KEY"))
 			if len(secret) == 0 {
@@ -2,11 +2,17 @@ package category
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ModelAPIResponse struct {
@@ -16,36 +22,142 @@ type ModelAPIResponse struct {
 	Object   string `json:"object"`
 	Created  int    `json:"created"`
 	Choices  []Choice
+	Usage    *Usage `json:"usage"`
+	Backend  string `json:"-"` // Name of the ModelChain backend that answered, set by the chain
 }
 
+// Usage is the token count of a request, as reported by OpenAI-compatible APIs.
+type Usage struct {
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	TotalTokens      int      `json:"total_tokens"`
+	Cost             *float64 `json:"cost,omitempty"` // USD, reported by OpenRouter's usage accounting
+}
+
+// ModelAPI sends a prompt to a language model, after the system message setting up the
+// conversation (see promptTemplate.system). Implementations must stop waiting for the model
+// when the context is cancelled.
 type ModelAPI interface {
-	Prompt(prompt string) (*ModelAPIResponse, error)
+	Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error)
+}
+
+// Image is an image sent to a model along with a prompt, such as a photo of a receipt.
+type Image struct {
+	MediaType string // e.g. "image/jpeg"
+	Data      []byte
+}
+
+// VisionModelAPI is a ModelAPI that can also send images, for vision-capable models. Whether
+// the model behind it reads them is up to the provider, which fails the request otherwise.
+type VisionModelAPI interface {
+	ModelAPI
+	PromptWithImages(ctx context.Context, system, prompt string, images []Image) (*ModelAPIResponse, error)
+}
+
+// ErrNoVision is returned when images are sent to a ModelAPI that cannot send them.
+var ErrNoVision = errors.New("model does not support images")
+
+// promptModel sends the prompt to the model, with the images if there are any. Sending images
+// to a text-only ModelAPI fails permanently.
+func promptModel(ctx context.Context, api ModelAPI, system, prompt string, images []Image) (*ModelAPIResponse, error) {
+	if len(images) == 0 {
+		return api.Prompt(ctx, system, prompt)
+	}
+	vision, ok := api.(VisionModelAPI)
+	if !ok {
+		return nil, &ModelAPIError{Err: ErrNoVision}
+	}
+	return vision.PromptWithImages(ctx, system, prompt, images)
+}
+
+// openRouterEndpoint is the OpenRouter chat completions endpoint.
+const openRouterEndpoint = "https://openrouter.ai/api/v1/chat/completions"
+
+// defaultModelRequestTimeout bounds a single request to the model provider.
+const defaultModelRequestTimeout = 60 * time.Second
+
+// maxErrorBodyLength limits how much of an error response is kept in the error message.
+const maxErrorBodyLength = 500
+
+// ModelAPIError describes a failed request to the model provider.
+type ModelAPIError struct {
+	StatusCode int           // HTTP status code, 0 if no response was received
+	RetryAfter time.Duration // Delay the provider asked for (Retry-After), 0 if none
+	Transient  bool          // Whether the same request may succeed later
+	Err        error
+}
+
+func (e *ModelAPIError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("model API returned status %d: %v", e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("model API request failed: %v", e.Err)
+}
+
+func (e *ModelAPIError) Unwrap() error { return e.Err }
+
+// IsTransientStatus reports whether a response with the status code is worth retrying: rate
+// limiting, timeouts and server errors, but also authentication and billing problems. Those
+// affect every job alike and are fixed by the operator, so jobs should wait rather than fail.
+// Other client errors are specific to the request and permanent.
+func IsTransientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusRequestTimeout,
+		http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusForbidden:
+		return true
+	}
+	return code >= 500
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
 }
 
 type OpenRouterAPI struct {
-	apiKey string
-	model  string
+	apiKey       string
+	model        string
+	client       *http.Client
+	timeout      time.Duration // Per request, see defaultModelRequestTimeout
+	endpoint     string        // Overridden in tests, defaults to openRouterEndpoint
+	reportsUsage bool          // Whether to ask for usage accounting, which only OpenRouter supports
 }
 
 func NewOpenRouterAPI(apiKey string, model string) OpenRouterAPI {
 	if apiKey == "" {
 		slog.Warn("OpenRouter API key is empty. Ensure OPENROUTER_KEY environment variable is set.")
 	} else {
-		// Log length for confirmation, not the key itself for security
 		// Log length at Debug level for confirmation, not the key itself for security
 		slog.Debug("OpenRouter API key loaded.", "key_length", len(apiKey))
 	}
-	return OpenRouterAPI{apiKey: apiKey, model: model}
+	return OpenRouterAPI{apiKey: apiKey, model: model, client: &http.Client{}, timeout: defaultModelRequestTimeout, endpoint: openRouterEndpoint, reportsUsage: true}
+}
+
+// NewLocalModelAPI talks to a self-hosted model behind an OpenAI-compatible chat completions
+// endpoint, such as Ollama's http://localhost:11434/v1/chat/completions. No API key is sent.
+func NewLocalModelAPI(endpoint string, model string) OpenRouterAPI {
+	return OpenRouterAPI{model: model, client: &http.Client{}, timeout: defaultModelRequestTimeout, endpoint: endpoint}
 }
 
-func (or OpenRouterAPI) Prompt(prompt string) (*ModelAPIResponse, error) {
+// Prompt sends the system message and the prompt to OpenRouter. Failures are returned as
+// *ModelAPIError, unless the caller's context was cancelled, in which case its error is returned.
+func (or OpenRouterAPI) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
 	// Create the request payload
 	payload := ChatCompletionRequest{
 		Model: or.model,
 		Messages: []Message{
 			{
 				Role:    "system",
-				Content: "Du er norsk og tenker på norsk.",
+				Content: system,
 			},
 			{
 				Role:    "user",
@@ -53,46 +165,106 @@ func (or OpenRouterAPI) Prompt(prompt string) (*ModelAPIResponse, error) {
 			},
 		},
 	}
+	if or.reportsUsage {
+		payload.Usage = &UsageOptions{Include: true}
+	}
+	return or.send(ctx, payload)
+}
 
+// PromptWithImages sends the prompt with the images inlined as data URLs, in the
+// OpenAI-compatible format for vision models. Failures are returned like for Prompt.
+func (or OpenRouterAPI) PromptWithImages(ctx context.Context, system, prompt string, images []Image) (*ModelAPIResponse, error) {
+	content := []ContentPart{{Type: "text", Text: prompt}}
+	for _, img := range images {
+		url := "data:" + img.MediaType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+		content = append(content, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+	}
+	payload := VisionChatCompletionRequest{
+		Model: or.model,
+		Messages: []VisionMessage{
+			{Role: "system", Content: []ContentPart{{Type: "text", Text: system}}},
+			{Role: "user", Content: content},
+		},
+	}
+	if or.reportsUsage {
+		payload.Usage = &UsageOptions{Include: true}
+	}
+	return or.send(ctx, payload)
+}
+
+// send posts a chat completion request and decodes the response.
+func (or OpenRouterAPI) send(ctx context.Context, payload any) (*ModelAPIResponse, error) {
 	// Marshal the payload into JSON
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal payload: %v", err)
+		return nil, &ModelAPIError{Err: fmt.Errorf("failed to marshal payload: %w", err)}
 	}
 
+	// Bound the request, so a hanging provider cannot hold a worker forever
+	timeout := or.timeout
+	if timeout <= 0 {
+		timeout = defaultModelRequestTimeout
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	// Create the HTTP request
-	req, err := http.NewRequest("POST", "https://openrouter.ai/api/v1/chat/completions", bytes.NewBuffer(payloadBytes))
+	endpoint := or.endpoint
+	if endpoint == "" {
+		endpoint = openRouterEndpoint
+	}
+	req, err := http.NewRequestWithContext(reqCtx, "POST", endpoint, bytes.NewBuffer(payloadBytes))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return nil, &ModelAPIError{Err: fmt.Errorf("failed to create request: %w", err)}
 	}
 
 	// Set the headers
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+or.apiKey)
+	if or.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+or.apiKey)
+	}
 
 	// Send the request
-	client := &http.Client{}
+	client := or.client
+	if client == nil {
+		client = http.DefaultClient
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err() // Cancelled by the caller, e.g. on shutdown
+		}
+		// Network errors and our own timeout are worth retrying
+		return nil, &ModelAPIError{Transient: true, Err: fmt.Errorf("failed to send request: %w", err)}
 	}
 	defer resp.Body.Close()
 
 	// Read the response body
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &ModelAPIError{StatusCode: resp.StatusCode, Transient: true, Err: fmt.Errorf("failed to read response body: %w", err)}
 	}
 
 	// Check if the response status code is not 200 OK
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed with status code %d: %s", resp.StatusCode, string(body))
+		if len(body) > maxErrorBodyLength {
+			body = body[:maxErrorBodyLength]
+		}
+		return nil, &ModelAPIError{
+			StatusCode: resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+			Transient:  IsTransientStatus(resp.StatusCode),
+			Err:        errors.New(string(body)),
+		}
 	}
 
 	var unmarshalledRespone = &ModelAPIResponse{}
-
-	err = json.Unmarshal(body, unmarshalledRespone)
-
-	// Return the response body as a string
-	return unmarshalledRespone, err
+	if err := json.Unmarshal(body, unmarshalledRespone); err != nil {
+		// A garbled success response is most likely a provider hiccup
+		return nil, &ModelAPIError{StatusCode: resp.StatusCode, Transient: true, Err: fmt.Errorf("failed to decode response: %w", err)}
+	}
+	return unmarshalledRespone, nil
 }
@@ -1,6 +1,13 @@
 package category
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
 
 func TestIsLikelyValidOpenRouterAPIKey(t *testing.T) {
 	tests := []struct {
@@ -22,3 +29,91 @@ func TestIsLikelyValidOpenRouterAPIKey(t *testing.T) {
 		})
 	}
 }
+
+func TestOpenRouterAPIErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		transient  bool
+		wantAfter  time.Duration
+	}{
+		{name: "rate limited", status: http.StatusTooManyRequests, retryAfter: "30", transient: true, wantAfter: 30 * time.Second},
+		{name: "server error", status: http.StatusBadGateway, transient: true},
+		{name: "out of credits", status: http.StatusPaymentRequired, transient: true},
+		{name: "bad request", status: http.StatusBadRequest, transient: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				http.Error(w, "provider says no", tt.status)
+			}))
+			defer server.Close()
+
+			api := NewOpenRouterAPI("sk-or-test", "test-model")
+			api.endpoint = server.URL
+			_, err := api.Prompt(context.Background(), "system", "prompt")
+
+			var apiErr *ModelAPIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Prompt() error = %v, expected *ModelAPIError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Transient != tt.transient || apiErr.RetryAfter != tt.wantAfter {
+				t.Fatalf("Prompt() error = %+v, expected status %d, transient %v, retry after %v", apiErr, tt.status, tt.transient, tt.wantAfter)
+			}
+			if IsPermanent(err) == tt.transient {
+				t.Fatalf("IsPermanent() = %v for transient = %v", IsPermanent(err), tt.transient)
+			}
+		})
+	}
+}
+
+func TestOpenRouterAPITimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock // Does not answer while the test runs
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	api := NewOpenRouterAPI("sk-or-test", "test-model")
+	api.endpoint = server.URL
+	api.timeout = 20 * time.Millisecond
+	_, err := api.Prompt(context.Background(), "system", "prompt")
+
+	var apiErr *ModelAPIError
+	if !errors.As(err, &apiErr) || !apiErr.Transient || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Prompt() error = %v, expected a transient timeout", err)
+	}
+
+	// Cancellation by the caller is reported as such, not as a provider failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := api.Prompt(ctx, "system", "prompt"); !errors.Is(err, context.Canceled) || errors.As(err, &apiErr) {
+		t.Fatalf("Prompt() with cancelled context error = %v, expected context.Canceled", err)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: 0},
+		{value: "120", expected: 2 * time.Minute},
+		{value: "Wed, 01 Jan 2025 12:00:30 GMT", expected: 30 * time.Second},
+		{value: "Wed, 01 Jan 2025 11:00:00 GMT", expected: 0},
+		{value: "soon", expected: 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, expected %v", tt.value, got, tt.expected)
+		}
+	}
+}
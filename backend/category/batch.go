@@ -0,0 +1,332 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// maxBatchPurchases bounds how many purchases a batch may be split into.
+const maxBatchPurchases = 20
+
+// Purchase is one purchase of a batch, as the model found it in the message.
+type Purchase struct {
+	Prompt          string       `json:"prompt"`
+	TotalAmount     money.Amount `json:"total_amount"`
+	TransactionDate string       `json:"transaction_date,omitempty"` // YYYY-MM-DD, only if asked for and mentioned
+}
+
+// getSegmentPrompt asks the model to split a message into separate purchases. The purchases
+// are categorized one by one afterwards, with the usual prompt.
+func getSegmentPrompt(t *promptTemplate, params CategorizationParams) (string, error) {
+	return t.render("segment", newPromptData(t, params))
+}
+
+// SegmentPurchases splits the message in params.Prompt into purchases. Like
+// ProcessCategorizationJob, the model is asked again when its answer does not validate, and
+// failed model calls are returned right away.
+func SegmentPurchases(ctx context.Context, api ModelAPI, params CategorizationParams) ([]Purchase, error) {
+	tmpl := params.promptTemplate()
+	prompt, err := getSegmentPrompt(tmpl, params)
+	if err != nil {
+		return nil, err
+	}
+	system := tmpl.system()
+
+	var problem error
+	for try := 1; try <= maxOutputTries; try++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		res, err := api.Prompt(ctx, system, prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		var purchases []Purchase
+		purchases, problem = parseSegments(res, params)
+		if problem == nil {
+			return purchases, nil
+		}
+		slog.Warn("AI segmentation failed validation, retrying", "user_id", params.Buyer.Id, "try", try, "err", problem)
+	}
+
+	return nil, Permanent(fmt.Errorf("%w after %d tries: %v", ErrInvalidModelOutput, maxOutputTries, problem))
+}
+
+// parseSegments decodes the model's split of a message and checks it: at least one purchase,
+// each described and with a positive amount, adding up to the total if one was given.
+func parseSegments(res *ModelAPIResponse, params CategorizationParams) ([]Purchase, error) {
+	if res == nil || len(res.Choices) == 0 {
+		return nil, errors.New("response has no choices")
+	}
+
+	var output struct {
+		Purchases []Purchase `json:"purchases"`
+	}
+	if err := json.Unmarshal([]byte(res.Choices[0].Message.Content), &output); err != nil {
+		return nil, fmt.Errorf("decoding output: %w", err)
+	}
+	if len(output.Purchases) == 0 {
+		return nil, errors.New("no purchases found in the message")
+	}
+	if len(output.Purchases) > maxBatchPurchases {
+		return nil, fmt.Errorf("%d purchases found, at most %d are allowed", len(output.Purchases), maxBatchPurchases)
+	}
+
+	var total money.Amount
+	for i := range output.Purchases {
+		purchase := &output.Purchases[i]
+		purchase.Prompt = strings.TrimSpace(purchase.Prompt)
+		if purchase.Prompt == "" {
+			return nil, fmt.Errorf("purchase %d has no prompt", i+1)
+		}
+		if purchase.TotalAmount <= 0 {
+			return nil, fmt.Errorf("purchase %d has invalid total_amount %v", i+1, purchase.TotalAmount)
+		}
+		total += purchase.TotalAmount
+
+		if params.LocalDate == "" {
+			purchase.TransactionDate = "" // The date was given for the whole batch
+		} else if purchase.TransactionDate != "" {
+			if _, err := time.Parse(dateLayout, purchase.TransactionDate); err != nil {
+				return nil, fmt.Errorf("purchase %d has invalid transaction_date %q, expected YYYY-MM-DD", i+1, purchase.TransactionDate)
+			}
+		}
+	}
+
+	if params.TotalAmount > 0 && total != params.TotalAmount {
+		return nil, fmt.Errorf("sum of purchases (%s) does not match total amount (%s)", total, params.TotalAmount)
+	}
+	return output.Purchases, nil
+}
+
+// AddBatch splits the message in params.Prompt into purchases right away and queues a job for
+// each, grouped as a batch. Purchases share the batch's date if one is given, else each keeps
+// the date the model found. Implausible dates are left for the purchase's job to find again,
+// which flags them for review. Like Preview, it is bounded by the preview timeout and fails
+// fast while the circuit breaker is open.
+func (p *CategorizingPool) AddBatch(ctx context.Context, params CategorizationParams, transactionDate *time.Time) (int64, error) {
+	if p.breaker.isOpen() {
+		return 0, ErrProviderPaused
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.PreviewTimeout)
+	defer cancel()
+
+	api := newUsageRecorder(p.db, p.api, p.config.ModelPrices, 0, params.Buyer.Id)
+	purchases, err := SegmentPurchases(ctx, api, params)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO ai_job_batches (buyer, prompt, created_at) VALUES (?, ?, ?)", params.Buyer.Id, params.Prompt, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("inserting batch: %w", err)
+	}
+	batchID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("getting batch ID: %w", err)
+	}
+
+	jobIDs := make([]int64, 0, len(purchases))
+	for _, purchase := range purchases {
+		jobParams := params
+		jobParams.Prompt = purchase.Prompt
+		jobParams.TotalAmount = purchase.TotalAmount
+
+		date := transactionDate
+		if date == nil && purchase.TransactionDate != "" {
+			found, err := time.Parse(dateLayout, purchase.TransactionDate)
+			if err == nil && implausibleDate(found, params.LocalDate) == "" {
+				date = &found
+			}
+		}
+		jobID, err := insertJob(tx, jobParams, date, sql.NullInt64{Int64: batchID, Valid: true})
+		if err != nil {
+			return 0, err
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	for _, jobID := range jobIDs {
+		p.publishJobEvent(jobID)
+		p.wake()
+	}
+	slog.Debug("Batch queued", "batch_id", batchID, "jobs", len(jobIDs))
+	return batchID, nil
+}
+
+// HandleAICategorizeBatch splits a message describing several purchases, like "Rema 312, kaffe
+// 45, kino 280 delt", into one AI job per purchase. The message is split right away, so the
+// response lists the purchases; they are categorized in the background like single jobs.
+// An amount in the payload is the total of all purchases.
+func HandleAICategorizeBatch(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for AI categorization batch", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate the payload, the same as for POST /v1/categorize
+		var payload types.AICategorizationPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode AI categorization batch request body", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Bad Request: Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		if payload.Prompt == "" || payload.Amount < 0 {
+			http.Error(w, "Bad Request: Missing prompt or invalid amount", http.StatusBadRequest)
+			return
+		}
+		transactionDate := parseTransactionDate(r, userID, payload)
+		if !checkCurrency(w, r, db, userID, &payload, transactionDate) {
+			return
+		}
+
+		// 2. Splitting uses the model too, so it counts against the quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 3. Split the message and queue its purchases
+		params, err := categorizationParams(r, db, userID, payload)
+		if err != nil {
+			slog.Error("failed to prepare AI categorization batch", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if transactionDate == nil {
+			params.LocalDate = localDate(r, userID, payload)
+		}
+		batchID, err := pool.AddBatch(r.Context(), params, transactionDate)
+		if err != nil {
+			writeModelError(w, r, userID, "AI categorization batch", "AI could not split the message into purchases", err)
+			return
+		}
+
+		// 4. Respond with the batch and its queued purchases
+		resp, err := loadBatchResponse(db, batchID, userID)
+		if err != nil {
+			slog.Error("failed to load AI categorization batch", "url", r.URL, "user_id", userID, "batch_id", batchID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("AI categorization batch added", "url", r.URL, "user_id", userID, "batch_id", batchID, "purchases", len(resp.Purchases))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode AI categorization batch", "url", r.URL, "user_id", userID, "batch_id", batchID, "err", err)
+		}
+	}
+}
+
+// HandleGetBatch returns a batch with the state of each of its purchases.
+// Batches are visible to every member of the buyer's household, like their jobs.
+func HandleGetBatch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for getting AI batch", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		batchIDStr := r.PathValue("batch_id")
+		batchID, err := strconv.ParseInt(batchIDStr, 10, 64)
+		if err != nil {
+			slog.Warn("invalid batch ID format", "url", r.URL, "user_id", userID, "batch_id_str", batchIDStr, "err", err)
+			http.Error(w, "Invalid batch ID", http.StatusBadRequest)
+			return
+		}
+
+		resp, err := loadBatchResponse(db, batchID, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Batch not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("failed to load AI batch", "url", r.URL, "user_id", userID, "batch_id", batchID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// Not found rather than forbidden, so batch IDs of other households are not revealed
+		if !sameHousehold(db, userID, resp.BuyerID) {
+			slog.Warn("attempt to view AI batch outside household", "url", r.URL, "user_id", userID, "batch_id", batchID, "buyer_id", resp.BuyerID)
+			http.Error(w, "Batch not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode AI batch response", "url", r.URL, "user_id", userID, "batch_id", batchID, "err", err)
+		}
+	}
+}
+
+// loadBatchResponse loads a batch and the state of its purchases, as seen by the user.
+// Returns sql.ErrNoRows if the batch does not exist.
+func loadBatchResponse(db *sql.DB, batchID, userID int64) (types.BatchResponse, error) {
+	resp := types.BatchResponse{BatchID: batchID, Done: true, Purchases: []types.JobResponse{}}
+	err := db.QueryRow("SELECT buyer, prompt, created_at FROM ai_job_batches WHERE id = ?", batchID).
+		Scan(&resp.BuyerID, &resp.Prompt, &resp.CreatedAt)
+	if err != nil {
+		return types.BatchResponse{}, err
+	}
+
+	rows, err := db.Query("SELECT id FROM ai_categorization_jobs WHERE batch_id = ? ORDER BY id", batchID)
+	if err != nil {
+		return types.BatchResponse{}, fmt.Errorf("querying jobs of batch %d: %w", batchID, err)
+	}
+	var jobIDs []int64
+	for rows.Next() {
+		var jobID int64
+		if err := rows.Scan(&jobID); err != nil {
+			rows.Close()
+			return types.BatchResponse{}, fmt.Errorf("scanning job of batch %d: %w", batchID, err)
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return types.BatchResponse{}, fmt.Errorf("iterating jobs of batch %d: %w", batchID, err)
+	}
+
+	for _, jobID := range jobIDs {
+		job, err := loadJobResponse(db, jobID, userID)
+		if err != nil {
+			return types.BatchResponse{}, fmt.Errorf("loading job %d of batch %d: %w", jobID, batchID, err)
+		}
+		if job.State == types.JobStatePending || job.State == types.JobStateProcessing {
+			resp.Done = false
+		}
+		resp.Purchases = append(resp.Purchases, job)
+	}
+	return resp, nil
+}
@@ -0,0 +1,91 @@
+package category
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// probeWait is how long workers wait while another worker's probe job is in flight.
+const probeWait = time.Second
+
+// circuitBreaker pauses the pool while the model provider is down, so queued jobs do not use up
+// their attempts against an outage. It opens after threshold consecutive provider failures, or
+// right away when the provider asks for a pause with Retry-After. Once the cooldown has passed
+// a single job is let through as a probe, and its outcome closes or reopens the breaker.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int       // Consecutive provider failures
+	openUntil time.Time // Zero while closed
+	probing   bool      // A worker was let through while half-open and has not reported back
+	now       func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// wait returns how long a worker should wait before claiming a job, 0 if it may go ahead.
+// A worker let through must report the outcome with success, failure or release.
+func (b *circuitBreaker) wait() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return 0
+	}
+	if now := b.now(); now.Before(b.openUntil) {
+		return b.openUntil.Sub(now)
+	}
+	if b.probing {
+		return probeWait
+	}
+	b.probing = true
+	return 0
+}
+
+// isOpen reports whether the breaker currently pauses requests, without letting a probe through.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.openUntil.IsZero() && b.now().Before(b.openUntil)
+}
+
+// success records that the provider answered, closing the breaker.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.openUntil.IsZero() {
+		slog.Info("Model API circuit breaker closed")
+	}
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// failure records a transient provider failure. retryAfter is the pause the provider asked for, if any.
+func (b *circuitBreaker) failure(retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	halfOpen := !b.openUntil.IsZero()
+	b.probing = false
+	if b.failures < b.threshold && retryAfter <= 0 && !halfOpen {
+		return
+	}
+
+	pause := max(b.cooldown, retryAfter)
+	b.openUntil = b.now().Add(pause)
+	slog.Warn("Model API circuit breaker open, pausing categorization", "consecutive_failures", b.failures, "pause", pause)
+}
+
+// release reports that a worker let through did not reach the provider, e.g. because no job was due.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,63 @@
+package category
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	// Stays closed below the threshold
+	b.failure(0)
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("wait() after one failure = %v, expected 0", wait)
+	}
+
+	// Opens at the threshold
+	b.failure(0)
+	if wait := b.wait(); wait != time.Minute {
+		t.Fatalf("wait() after two failures = %v, expected 1m", wait)
+	}
+
+	// Half-open after the cooldown: one probe, everyone else waits
+	now = now.Add(time.Minute)
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("wait() for probe = %v, expected 0", wait)
+	}
+	if wait := b.wait(); wait != probeWait {
+		t.Fatalf("wait() during probe = %v, expected %v", wait, probeWait)
+	}
+
+	// A failed probe reopens, honouring a longer Retry-After
+	b.failure(5 * time.Minute)
+	if wait := b.wait(); wait != 5*time.Minute {
+		t.Fatalf("wait() after failed probe = %v, expected 5m", wait)
+	}
+
+	// A probe that found nothing to do lets the next worker probe
+	now = now.Add(5 * time.Minute)
+	b.wait()
+	b.release()
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("wait() after released probe = %v, expected 0", wait)
+	}
+
+	// A successful probe closes
+	b.success()
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("wait() after success = %v, expected 0", wait)
+	}
+	b.failure(0)
+	if wait := b.wait(); wait != 0 {
+		t.Fatalf("wait() after one failure following success = %v, expected 0", wait)
+	}
+
+	// Retry-After opens right away
+	b.failure(30 * time.Second)
+	if wait := b.wait(); wait != time.Minute {
+		t.Fatalf("wait() after Retry-After = %v, expected the 1m cooldown", wait)
+	}
+}
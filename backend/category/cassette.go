@@ -0,0 +1,193 @@
+package category
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNoRecording is returned by a replaying Cassette for a prompt it has no recording of.
+var ErrNoRecording = errors.New("no recorded response")
+
+// CassetteMode selects whether a Cassette asks the model or answers from its recordings.
+type CassetteMode int
+
+const (
+	CassetteReplay         CassetteMode = iota // Answer from recordings only, never ask the model
+	CassetteRecord                             // Always ask the model and record its answers, replacing older recordings
+	CassetteReplayOrRecord                     // Answer from recordings, asking the model only about unknown prompts
+)
+
+// cassetteFile is the recording of one prompt, stored as <sha256 of system message and prompt>.json.
+type cassetteFile struct {
+	System       string                `json:"system"` // Kept for reading the recordings, not used for lookups
+	Prompt       string                `json:"prompt"` // Likewise
+	Interactions []cassetteInteraction `json:"interactions"`
+}
+
+// cassetteInteraction is one answer of the model to the prompt.
+type cassetteInteraction struct {
+	Backend    string            `json:"backend,omitempty"` // Model of the chain that answered, see ModelAPIResponse.Backend
+	Response   *ModelAPIResponse `json:"response"`
+	RecordedAt time.Time         `json:"recorded_at"`
+}
+
+// Cassette is a ModelAPI recording the answers of a real model to files, keyed by a hash of
+// the system message and the prompt, and replaying them without network access. This gives tests and offline
+// development real model output, deterministically. A prompt asked several times, such as
+// after output that did not validate, gets the recorded answers in order, then the last again.
+// Failed requests are not recorded.
+type Cassette struct {
+	dir  string
+	mode CassetteMode
+	api  ModelAPI // Asked in the recording modes
+
+	mu       sync.Mutex
+	played   map[string]int  // Answers given per prompt hash during this run
+	recorded map[string]bool // Prompt hashes re-recorded during this run, in CassetteRecord mode
+}
+
+// NewCassette creates a cassette on the recordings in dir. The api is only needed for the
+// recording modes, which create dir if it is missing.
+func NewCassette(dir string, mode CassetteMode, api ModelAPI) (*Cassette, error) {
+	if mode == CassetteReplay {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("cassette directory %q not found", dir)
+		}
+	} else {
+		if api == nil {
+			return nil, errors.New("recording cassette needs a model to record")
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating cassette directory: %w", err)
+		}
+	}
+	return &Cassette{dir: dir, mode: mode, api: api, played: make(map[string]int), recorded: make(map[string]bool)}, nil
+}
+
+// PromptHash returns the key of a prompt after the system message in the recordings.
+func PromptHash(system, prompt string) string {
+	sum := sha256.Sum256([]byte(system + "\x00" + prompt))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cassette) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+// Prompt answers from the recordings or asks the model, depending on the mode.
+func (c *Cassette) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	return c.play(PromptHash(system, prompt), system, prompt, func() (*ModelAPIResponse, error) {
+		return c.api.Prompt(ctx, system, prompt)
+	})
+}
+
+// PromptWithImages answers like Prompt, keyed by the system message, the prompt and the images. Recording needs a
+// ModelAPI that can send images.
+func (c *Cassette) PromptWithImages(ctx context.Context, system, prompt string, images []Image) (*ModelAPIResponse, error) {
+	return c.play(imagePromptHash(system, prompt, images), system, prompt, func() (*ModelAPIResponse, error) {
+		return promptModel(ctx, c.api, system, prompt, images)
+	})
+}
+
+// imagePromptHash returns the key of a prompt with images in the recordings.
+func imagePromptHash(system, prompt string, images []Image) string {
+	h := sha256.New()
+	h.Write([]byte(system + "\x00" + prompt))
+	for _, img := range images {
+		sum := sha256.Sum256(img.Data)
+		h.Write([]byte("\x00" + img.MediaType + "\x00"))
+		h.Write(sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// play answers from the recording under key or makes the request, depending on the mode.
+func (c *Cassette) play(key, system, prompt string, request func() (*ModelAPIResponse, error)) (*ModelAPIResponse, error) {
+	c.mu.Lock()
+	if c.mode != CassetteRecord {
+		file, err := c.load(key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			c.mu.Unlock()
+			return nil, &ModelAPIError{Err: fmt.Errorf("reading recording %s: %w", key[:12], err)}
+		}
+		if err == nil && len(file.Interactions) > 0 {
+			i := min(c.played[key], len(file.Interactions)-1)
+			c.played[key]++
+			c.mu.Unlock()
+
+			// Copy, so callers cannot alter the recording
+			res := *file.Interactions[i].Response
+			res.Backend = file.Interactions[i].Backend
+			return &res, nil
+		}
+		if c.mode == CassetteReplay {
+			c.mu.Unlock()
+			// Permanent: asking again will not make a recording appear
+			return nil, &ModelAPIError{Err: fmt.Errorf("%w for prompt %s", ErrNoRecording, key[:12])}
+		}
+	}
+	c.mu.Unlock()
+
+	// Ask the model without holding the lock, requests may be slow
+	res, err := request()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.record(key, system, prompt, res); err != nil {
+		return nil, &ModelAPIError{Err: fmt.Errorf("recording response: %w", err)}
+	}
+	return res, nil
+}
+
+// load reads the recording of a prompt. Callers hold c.mu.
+func (c *Cassette) load(key string) (cassetteFile, error) {
+	var file cassetteFile
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return file, err
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, err
+	}
+	return file, nil
+}
+
+// record appends the answer to the recording of the prompt. In CassetteRecord mode the first
+// answer of a run replaces what was recorded before, so re-recording does not mix old and new.
+func (c *Cassette) record(key, system, prompt string, res *ModelAPIResponse) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	file := cassetteFile{System: system, Prompt: prompt}
+	if c.mode != CassetteRecord || c.recorded[key] {
+		existing, err := c.load(key)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			file.Interactions = existing.Interactions
+		}
+	}
+	file.Interactions = append(file.Interactions, cassetteInteraction{Backend: res.Backend, Response: res, RecordedAt: time.Now().UTC()})
+	c.recorded[key] = true
+	c.played[key] = len(file.Interactions) // Replays in this run continue after what was just recorded
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so an interrupted run never leaves a truncated recording
+	tmp := c.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path(key))
+}
@@ -0,0 +1,101 @@
+package category
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// answerOf asks the model and returns the message content of its answer.
+func answerOf(t *testing.T, api ModelAPI, prompt string) string {
+	t.Helper()
+	res, err := api.Prompt(context.Background(), "system", prompt)
+	if err != nil {
+		t.Fatalf("Prompt() error = %v", err)
+	}
+	return res.Choices[0].Message.Content
+}
+
+func TestCassetteRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	// Record two answers to the same prompt, as when the first did not validate
+	model := NewFakeModelAPI(FakeAnswer("first"), FakeAnswer("second"))
+	recorder, err := NewCassette(dir, CassetteRecord, model)
+	if err != nil {
+		t.Fatalf("NewCassette() error = %v", err)
+	}
+	for _, want := range []string{"first", "second"} {
+		if got := answerOf(t, recorder, "prompt"); got != want {
+			t.Fatalf("recording Prompt() = %q, expected %q", got, want)
+		}
+	}
+
+	// Replaying gives the answers in order, then repeats the last, without asking the model
+	player, err := NewCassette(dir, CassetteReplay, nil)
+	if err != nil {
+		t.Fatalf("NewCassette() error = %v", err)
+	}
+	for _, want := range []string{"first", "second", "second"} {
+		if got := answerOf(t, player, "prompt"); got != want {
+			t.Fatalf("replaying Prompt() = %q, expected %q", got, want)
+		}
+	}
+	if model.Calls() != 2 {
+		t.Fatalf("model asked %d times, expected only while recording", model.Calls())
+	}
+
+	// Unknown prompts fail permanently
+	_, err = player.Prompt(ctx, "system", "other prompt")
+	if !errors.Is(err, ErrNoRecording) || !IsPermanent(err) {
+		t.Fatalf("Prompt() of unknown prompt error = %v, expected permanent ErrNoRecording", err)
+	}
+	if _, err := player.Prompt(ctx, "other system", "prompt"); !errors.Is(err, ErrNoRecording) {
+		t.Fatalf("Prompt() after another system message error = %v, expected ErrNoRecording", err)
+	}
+
+	// Replay-or-record asks only about unknown prompts
+	model.Script(FakeAnswer("new"))
+	mixed, err := NewCassette(dir, CassetteReplayOrRecord, model)
+	if err != nil {
+		t.Fatalf("NewCassette() error = %v", err)
+	}
+	if got := answerOf(t, mixed, "prompt"); got != "first" || model.Calls() != 0 {
+		t.Fatalf("Prompt() of recorded prompt = %q after %d calls", got, model.Calls())
+	}
+	if got := answerOf(t, mixed, "other prompt"); got != "new" || model.Calls() != 1 {
+		t.Fatalf("Prompt() of unknown prompt = %q after %d calls", got, model.Calls())
+	}
+
+	// Recording again replaces the old answers
+	rerecorder, _ := NewCassette(dir, CassetteRecord, model)
+	if _, err := rerecorder.Prompt(ctx, "system", "prompt"); err != nil {
+		t.Fatalf("Prompt() error = %v", err)
+	}
+	player, _ = NewCassette(dir, CassetteReplay, nil)
+	for i := 0; i < 2; i++ {
+		if got := answerOf(t, player, "prompt"); got != "new" {
+			t.Fatalf("Prompt() after re-recording = %q, expected only the new answer", got)
+		}
+	}
+}
+
+func TestCassetteKeepsBackend(t *testing.T) {
+	dir := t.TempDir()
+	chain, _ := NewModelChain(ModelBackend{Name: "a", API: NewFakeModelAPI(FakeAnswer("ok"))})
+	recorder, _ := NewCassette(dir, CassetteRecord, chain)
+	if _, err := recorder.Prompt(context.Background(), "system", "prompt"); err != nil {
+		t.Fatalf("Prompt() error = %v", err)
+	}
+
+	player, _ := NewCassette(dir, CassetteReplay, nil)
+	res, err := player.Prompt(context.Background(), "system", "prompt")
+	if err != nil || res.Backend != "a" {
+		t.Fatalf("replayed Prompt() = %+v, %v, expected backend a", res, err)
+	}
+
+	if _, err := NewCassette(t.TempDir()+"/missing", CassetteReplay, nil); err == nil {
+		t.Fatal("NewCassette() of a missing directory succeeded")
+	}
+}
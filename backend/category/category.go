@@ -1,30 +1,77 @@
 package category
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
 )
 
+// dateLayout is the format of dates in prompts and payloads.
+const dateLayout = "2006-01-02"
+
 type JobResult struct {
 	IsAmbiguityFlagged  bool        `json:"is_ambiguity_flagged"`
 	AmbiguityFlagReason string      `json:"ambiguity_flag"`
 	Spendings           []Spendings `json:"spendings"`
+	Model               string      `json:"-"` // Model that produced the result, see ModelChain
+	PromptTemplate      string      `json:"-"` // Version of the prompts used, e.g. "nb/v1"
+
+	// Found in the prompt, see CategorizationParams. Once validated, TotalAmount is always set
+	// and TransactionDate is set only if the model was asked for it and the prompt had one.
+	TotalAmount     money.Amount `json:"total_amount,omitempty"`
+	TransactionDate string       `json:"transaction_date,omitempty"` // YYYY-MM-DD
 }
 
 type Spendings struct {
-	Id            int64   `json:"id"`
-	Category      string  `json:"category"`
-	Amount        float64 `json:"amount"`
-	ApportionMode string  `json:"apportion_mode"`
-	Description   string  `json:"description"`
+	Id            int64        `json:"id"`
+	Category      string       `json:"category"`
+	Amount        money.Amount `json:"amount"`
+	ApportionMode string       `json:"apportion_mode"`
+	Description   string       `json:"description"`
+	SharedWith    []string     `json:"shared_with,omitempty"` // Names of the household members involved; empty means all of them
 }
 
 type ChatCompletionRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+	Model    string        `json:"model"`
+	Messages []Message     `json:"messages"`
+	Usage    *UsageOptions `json:"usage,omitempty"`
+}
+
+// VisionChatCompletionRequest is a ChatCompletionRequest whose messages may contain images.
+type VisionChatCompletionRequest struct {
+	Model    string          `json:"model"`
+	Messages []VisionMessage `json:"messages"`
+	Usage    *UsageOptions   `json:"usage,omitempty"`
+}
+
+// VisionMessage is a Message made of parts, text or images.
+type VisionMessage struct {
+	Role    string        `json:"role"`
+	Content []ContentPart `json:"content"`
+}
+
+// ContentPart is a part of a VisionMessage: Text for type "text", ImageURL for "image_url".
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL string `json:"url"` // Images are sent inline as data URLs
+}
+
+// UsageOptions enables OpenRouter's usage accounting, which reports the cost of a request.
+type UsageOptions struct {
+	Include bool `json:"include"`
 }
 
 type Message struct {
@@ -39,51 +86,339 @@ type Choice struct {
 }
 
 type Person struct {
-	Id   int64
-	Name string
+	Id    int64
+	Name  string
+	Notes string // Context about the person for the AI, see types.UpdateProfilePayload.AINotes
 }
 
 // SharedMode removed, AI infers apportionment from prompt
 type CategorizationParams struct {
-	TotalAmount float64
+	TotalAmount money.Amount // 0 if the model should find the amount in the prompt
 	Buyer       Person
-	SharedWith  *Person // Potential partner, AI decides if used. Populated by handler.
+	SharedWith  *Person  // Potential partner, AI decides if used. Populated by handler.
+	Household   []Person // Other household members besides the buyer (includes the partner, if any)
 	Prompt      string
-	PreSettled  bool // Added: Flag to indicate if the job's spendings should be settled immediately
-	tries       int
+	PreSettled  bool   // Added: Flag to indicate if the job's spendings should be settled immediately
+	JobID       int64  // Job being processed; its attempts are recorded in ai_job_attempts unless 0
+	Attempt     int    // Processing attempt of the job, see Job.Attempts
+	LocalDate   string // Buyer's date today (YYYY-MM-DD) if the model should find the transaction date in the prompt
+	Receipt     *Image // Photo of the receipt, read by a vision model along with the prompt
+	// Context about the household for the AI, see types.UpdateHouseholdPayload.AINotes
+	HouseholdNotes string
+	Language       string // Buyer's language, which selects the prompt template. DefaultLanguage if empty
+	PromptTemplate string // Version of the prompts to use instead of the latest in Language, e.g. "nb/v1"
+	Currency       string // Currency of the amounts (ISO 4217) if not the household's, converted when stored
+	BaseCurrency   string // Household's currency (ISO 4217). household.DefaultCurrency if empty
 }
 
-// ProcessCategorizationJob now requires the db connection and the ModelAPI implementation.
-func ProcessCategorizationJob(db *sql.DB, api ModelAPI, params CategorizationParams) (JobResult, error) {
-	if params.tries >= 3 {
-		return JobResult{}, fmt.Errorf("too many retries")
+// promptTemplate returns the prompts to use: the version in PromptTemplate if there is one,
+// otherwise the latest in the buyer's language.
+func (params CategorizationParams) promptTemplate() *promptTemplate {
+	if t, ok := promptVersions[params.PromptTemplate]; ok {
+		return t
+	}
+	return promptTemplateFor(params.Language)
+}
+
+// currency returns the currency of the amounts.
+func (params CategorizationParams) currency() string {
+	if params.Currency != "" {
+		return params.Currency
+	}
+	return params.baseCurrency()
+}
+
+// baseCurrency returns the currency of the household, which amounts are converted to.
+func (params CategorizationParams) baseCurrency() string {
+	if params.BaseCurrency == "" {
+		return household.DefaultCurrency
+	}
+	return params.BaseCurrency
+}
+
+// images returns the images to send with the prompt.
+func (params CategorizationParams) images() []Image {
+	if params.Receipt == nil {
+		return nil
+	}
+	return []Image{*params.Receipt}
+}
+
+// others returns the household members the buyer can share with.
+// Falls back to SharedWith for callers that only know the partner.
+func (params CategorizationParams) others() []Person {
+	if len(params.Household) > 0 {
+		return params.Household
+	}
+	if params.SharedWith != nil {
+		return []Person{*params.SharedWith}
+	}
+	return nil
+}
+
+// participantsFor returns the IDs of the users bearing the cost of a spending item,
+// based on its apportion mode. An empty result means the buyer pays alone.
+func participantsFor(spending Spendings, buyerID int64, others []Person) ([]int64, error) {
+	if spending.ApportionMode == "alone" {
+		return nil, nil
+	}
+	if spending.ApportionMode != "shared" && spending.ApportionMode != "other" {
+		return nil, fmt.Errorf("invalid apportion_mode '%s'", spending.ApportionMode)
 	}
-	params.tries += 1
-	// Use the provided api instance instead of creating one here.
+	if len(others) == 0 {
+		return nil, fmt.Errorf("apportion_mode '%s' requires another household member", spending.ApportionMode)
+	}
+
+	// Default to everyone else in the household; otherwise match the named members.
+	var involved []int64
+	if len(spending.SharedWith) == 0 {
+		for _, o := range others {
+			involved = append(involved, o.Id)
+		}
+	} else {
+		for _, name := range spending.SharedWith {
+			found := false
+			for _, o := range others {
+				if o.Name != "" && strings.EqualFold(strings.TrimSpace(name), o.Name) {
+					involved = append(involved, o.Id)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("shared_with name '%s' is not a household member", name)
+			}
+		}
+	}
+
+	if spending.ApportionMode == "shared" {
+		return append([]int64{buyerID}, involved...), nil
+	}
+	return involved, nil
+}
+
+// Outcomes of a model request, stored in ai_job_attempts.outcome.
+const (
+	attemptAccepted      = "accepted"       // Output validated and was used
+	attemptInvalidOutput = "invalid_output" // Output did not validate, the model was asked again unless out of tries
+	attemptModelError    = "model_error"    // The request failed, the pool retries the job later
+)
+
+// maxOutputTries is how often the model is asked again when its answer does not validate.
+const maxOutputTries = 3
 
-	// Pass the db connection to getPrompt
-	prompt, err := getPrompt(db, params)
+// ErrInvalidModelOutput is returned when the model's answers kept failing validation.
+var ErrInvalidModelOutput = errors.New("model output did not validate")
+
+// PermanentError marks a failure that retrying will not fix, such as model output that keeps
+// failing validation. The pool dead-letters jobs failing with one instead of retrying them.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err as a PermanentError.
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err is a permanent failure: a PermanentError, or a ModelAPIError
+// that is not transient. Anything else is assumed to be transient.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	if errors.As(err, &permanent) {
+		return true
+	}
+	var apiErr *ModelAPIError
+	return errors.As(err, &apiErr) && !apiErr.Transient
+}
+
+// ProcessCategorizationJob now requires the db connection and the ModelAPI implementation.
+// The model is asked again (up to maxOutputTries times) when its answer does not validate.
+// Failed model calls are returned right away; the pool retries those with backoff.
+// Spendings far outside the usual amounts of their category are flagged as ambiguous.
+// Cancelling the context aborts the model call.
+func ProcessCategorizationJob(ctx context.Context, db *sql.DB, api ModelAPI, params CategorizationParams) (JobResult, error) {
+	// Pass the db connection to getPrompt; the buyer's language selects the template
+	tmpl := params.promptTemplate()
+	// The typical amounts are in the household's currency, so they only apply to amounts in it
+	var stats map[string]AmountStats
+	if params.currency() == params.baseCurrency() {
+		var err error
+		stats, err = HouseholdStats(db, params.Buyer.Id)
+		if err != nil {
+			// The typical amounts are only hints
+			slog.Error("failed to load category stats", "job_id", params.JobID, "user_id", params.Buyer.Id, "err", err)
+		}
+	}
+	prompt, err := getPrompt(db, tmpl, params, stats)
 	if err != nil {
 		return JobResult{}, err
 	}
+	system := tmpl.system()
+
+	var problem error
+	for try := 1; try <= maxOutputTries; try++ {
+		if err := ctx.Err(); err != nil {
+			return JobResult{}, err
+		}
+
+		res, err := promptModel(ctx, api, system, prompt, params.images())
+		if err != nil {
+			if ctx.Err() == nil { // Cancelled requests were not answered, so there is nothing to learn from them
+				recordAttempt(db, params, try, prompt, nil, attemptModelError, err)
+			}
+			return JobResult{}, err
+		}
+
+		var job JobResult
+		job, problem = parseModelOutput(tmpl, res, params)
+		if problem == nil {
+			recordAttempt(db, params, try, prompt, res, attemptAccepted, nil)
+			job.Model = modelName(res)
+			job.PromptTemplate = tmpl.ID
+			flagOutliers(tmpl, params, stats, &job)
+			return job, nil
+		}
+		recordAttempt(db, params, try, prompt, res, attemptInvalidOutput, problem)
+		slog.Warn("AI output failed validation, retrying", "job_id", params.JobID, "try", try, "err", problem)
+	}
+
+	return JobResult{}, Permanent(fmt.Errorf("%w after %d tries: %v", ErrInvalidModelOutput, maxOutputTries, problem))
+}
 
-	res, err := api.Prompt(prompt)
+// modelName returns the name of the model that produced the response.
+func modelName(res *ModelAPIResponse) string {
+	if res.Backend != "" {
+		return res.Backend
+	}
+	return res.Model // A plain ModelAPI, outside a chain
+}
+
+// recordAttempt stores a model request of the job in ai_job_attempts. Recording must not fail
+// the job, so errors are only logged. Nothing is recorded for requests outside a job.
+func recordAttempt(db *sql.DB, params CategorizationParams, try int, prompt string, res *ModelAPIResponse, outcome string, problem error) {
+	if params.JobID == 0 {
+		return
+	}
+	var model, rawResponse, errMsg sql.NullString
+	if res != nil {
+		model = sql.NullString{String: modelName(res), Valid: modelName(res) != ""}
+		if len(res.Choices) > 0 {
+			rawResponse = sql.NullString{String: res.Choices[0].Message.Content, Valid: true}
+		}
+	}
+	if problem != nil {
+		errMsg = sql.NullString{String: problem.Error(), Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO ai_job_attempts (job_id, attempt, try, model, prompt, raw_response, outcome, error_message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, params.JobID, params.Attempt, try, model, prompt, rawResponse, outcome, errMsg)
 	if err != nil {
-		return JobResult{}, err
+		slog.Error("failed to record AI job attempt", "job_id", params.JobID, "try", try, "err", err)
 	}
+}
 
+// parseModelOutput decodes the model's answer and checks it against the job: valid apportion
+// modes that fit the household, and amounts adding up to the total. Flag reasons are in the
+// language of tmpl.
+func parseModelOutput(tmpl *promptTemplate, res *ModelAPIResponse, params CategorizationParams) (JobResult, error) {
+	if res == nil || len(res.Choices) == 0 {
+		return JobResult{}, fmt.Errorf("response has no choices")
+	}
 	message := res.Choices[0].Message.Content
 
 	jsonContent := []byte(message)
 	job := JobResult{}
 
-	slog.Info("llm generated text", "text", string(jsonContent))
-	err = json.Unmarshal(jsonContent, &job)
-	if err != nil {
+	slog.Debug("llm generated text", "text", string(jsonContent))
+	if err := json.Unmarshal(jsonContent, &job); err != nil {
+		return JobResult{}, fmt.Errorf("decoding output: %w", err)
+	}
+	if err := checkExtracted(tmpl, &job, params); err != nil {
+		return JobResult{}, err
+	}
+	totalParams := params
+	totalParams.TotalAmount = job.TotalAmount
+	if err := validateResult(job, totalParams); err != nil {
 		return JobResult{}, err
 	}
 
-	var countedTotal float64 = 0
+	if job.AmbiguityFlagReason != "" {
+		job.IsAmbiguityFlagged = true
+	}
+
+	return job, nil
+}
+
+// checkExtracted checks the amount and date the model found in the prompt, if it was asked to,
+// and sets the total the spendings must add up to. Values that are missing or implausible flag
+// the result as ambiguous instead of failing it, so the user can correct them in review.
+func checkExtracted(tmpl *promptTemplate, job *JobResult, params CategorizationParams) error {
+	if params.TotalAmount > 0 {
+		job.TotalAmount = params.TotalAmount
+	} else if job.TotalAmount <= 0 {
+		// No amount in the prompt; go by the spendings, for the user to check
+		for _, s := range job.Spendings {
+			job.TotalAmount += s.Amount
+		}
+		if job.TotalAmount <= 0 {
+			return errors.New("no total_amount found in the prompt")
+		}
+		flagAmbiguity(job, tmpl.text("flag no total"))
+	}
+
+	if params.LocalDate == "" {
+		job.TransactionDate = "" // The date was given, the model's guess does not matter
+		return nil
+	}
+	if job.TransactionDate == "" {
+		return nil
+	}
+	date, err := time.Parse(dateLayout, job.TransactionDate)
+	if err != nil {
+		return fmt.Errorf("invalid transaction_date %q, expected YYYY-MM-DD", job.TransactionDate)
+	}
+	if reason := implausibleDate(date, params.LocalDate); reason != "" {
+		flagAmbiguity(job, tmpl.text(reason))
+	}
+	return nil
+}
+
+// implausibleDate returns why a transaction date found in a prompt is unlikely to be right
+// given the buyer's date today, as the name of the template with the reason, or "" if it is
+// plausible.
+func implausibleDate(date time.Time, localDate string) string {
+	today, err := time.Parse(dateLayout, localDate)
+	if err != nil {
+		return ""
+	}
+	if date.After(today) {
+		return "flag future date"
+	}
+	if date.Before(today.AddDate(-1, 0, 0)) {
+		return "flag old date"
+	}
+	return ""
+}
+
+// flagAmbiguity adds a reason to the result's ambiguity flag.
+func flagAmbiguity(job *JobResult, reason string) {
+	if job.AmbiguityFlagReason != "" {
+		reason = job.AmbiguityFlagReason + ". " + reason
+	}
+	job.AmbiguityFlagReason = reason
+	job.IsAmbiguityFlagged = true
+}
+
+// validateResult checks spendings against the job: valid apportion modes that fit the
+// household, and amounts adding up to the total. Used for model output and for previews
+// confirmed by users.
+func validateResult(job JobResult, params CategorizationParams) error {
+	var countedTotal money.Amount
 
 	for _, spending := range job.Spendings {
 		// Validate the ApportionMode provided by the AI for each spending item.
@@ -97,38 +432,21 @@ func ProcessCategorizationJob(db *sql.DB, api ModelAPI, params CategorizationPar
 		}
 
 		if !isValidApportionMode {
-			slog.Warn("AI returned invalid apportion_mode, retrying", "spending_description", spending.Description, "invalid_mode", spending.ApportionMode)
-			return ProcessCategorizationJob(db, api, params) // Retry, passing api
-		}
-
-		// If there's no shared person, the mode MUST be 'alone'.
-		if params.SharedWith == nil && spending.ApportionMode != "alone" {
-			slog.Warn("AI returned non-'alone' apportion_mode when there is no shared person, retrying", "spending_description", spending.Description, "mode", spending.ApportionMode)
-			return ProcessCategorizationJob(db, api, params) // Retry, passing api
+			return fmt.Errorf("invalid apportion_mode '%s' for '%s'", spending.ApportionMode, spending.Description)
 		}
 
-		// Validation based on SharedMode hint is removed.
-		// The AI now decides apportionment based solely on the prompt.
-		// We still validate that 'other' is only used if a partner *exists*.
-		if spending.ApportionMode == "other" && params.SharedWith == nil {
-			slog.Warn("AI returned 'other' apportion_mode when there is no shared person configured, retrying", "spending_description", spending.Description)
-			return ProcessCategorizationJob(db, api, params) // Retry, passing api
+		// The mode must be possible within the household (no sharing without other members,
+		// and any named members must exist).
+		if _, err := participantsFor(spending, params.Buyer.Id, params.others()); err != nil {
+			return fmt.Errorf("apportionment of '%s' does not fit the household: %w", spending.Description, err)
 		}
 
 		countedTotal += spending.Amount
 	}
 
-	// Check if the sum of amounts matches the total amount (within tolerance)
-	// Use a small tolerance for floating point comparisons
-	tolerance := 0.01 // e.g., 1 cent
-	if math.Abs(countedTotal-params.TotalAmount) > tolerance {
-		slog.Warn("spending amount and total amount did not match up, retrying", "counted_total", countedTotal, "actual_total", params.TotalAmount)
-		return ProcessCategorizationJob(db, api, params) // Retry, passing api and db connection
+	// The amounts must add up to the total exactly, to the minor unit
+	if countedTotal != params.TotalAmount {
+		return fmt.Errorf("spending amounts add up to %s, expected %s", countedTotal, params.TotalAmount)
 	}
-
-	if job.AmbiguityFlagReason != "" {
-		job.IsAmbiguityFlagged = true
-	}
-
-	return job, nil
+	return nil
 }
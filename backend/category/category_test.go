@@ -0,0 +1,255 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// scriptedModelAPI answers with the scripted results in order, repeating the last one.
+type scriptedModelAPI struct {
+	results []scriptedResult
+	calls   *int
+}
+
+type scriptedResult struct {
+	content string
+	err     error
+}
+
+func (s scriptedModelAPI) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	r := s.results[min(*s.calls, len(s.results)-1)]
+	*s.calls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &ModelAPIResponse{Choices: []Choice{{Message: Message{Content: r.content}}}}, nil
+}
+
+func TestProcessCategorizationJob(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	valid := `{"ambiguity_flag": "", "spendings": [{"apportion_mode": "alone", "category": "Groceries", "amount": 30, "description": "Food"}]}`
+	wrongTotal := `{"ambiguity_flag": "", "spendings": [{"apportion_mode": "alone", "category": "Groceries", "amount": 20, "description": "Food"}]}`
+	params := CategorizationParams{TotalAmount: 3000, Buyer: Person{Id: 1, Name: "Demo"}, Prompt: "food"}
+
+	tests := []struct {
+		name          string
+		results       []scriptedResult
+		expectedCalls int
+		checkErr      func(error) bool
+	}{
+		{
+			name:          "valid output",
+			results:       []scriptedResult{{content: valid}},
+			expectedCalls: 1,
+			checkErr:      func(err error) bool { return err == nil },
+		},
+		{
+			name:          "asks again after invalid output",
+			results:       []scriptedResult{{content: "not json"}, {content: wrongTotal}, {content: valid}},
+			expectedCalls: 3,
+			checkErr:      func(err error) bool { return err == nil },
+		},
+		{
+			name:          "gives up on output that never validates",
+			results:       []scriptedResult{{content: wrongTotal}},
+			expectedCalls: maxOutputTries,
+			checkErr: func(err error) bool {
+				return errors.Is(err, ErrInvalidModelOutput) && IsPermanent(err)
+			},
+		},
+		{
+			name:          "does not repeat failed model calls",
+			results:       []scriptedResult{{err: &ModelAPIError{StatusCode: 503, Transient: true}}},
+			expectedCalls: 1,
+			checkErr: func(err error) bool {
+				var apiErr *ModelAPIError
+				return errors.As(err, &apiErr) && !IsPermanent(err)
+			},
+		},
+		{
+			name:          "response without choices",
+			results:       []scriptedResult{{content: ""}},
+			expectedCalls: maxOutputTries,
+			checkErr:      func(err error) bool { return errors.Is(err, ErrInvalidModelOutput) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			_, err := ProcessCategorizationJob(context.Background(), db, scriptedModelAPI{results: tt.results, calls: &calls}, params)
+			if !tt.checkErr(err) {
+				t.Fatalf("ProcessCategorizationJob() unexpected error = %v", err)
+			}
+			if calls != tt.expectedCalls {
+				t.Fatalf("ProcessCategorizationJob() called the model %d times, expected %d", calls, tt.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestProcessCategorizationJobRecordsAttempts(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	jobID := insertAIJobForTest(t, db, buyerID, nil, "food", 30, "processing", false)
+	valid := `{"ambiguity_flag": "", "spendings": [{"apportion_mode": "alone", "category": "Groceries", "amount": 30, "description": "Food"}]}`
+	params := CategorizationParams{TotalAmount: 3000, Buyer: Person{Id: buyerID, Name: "Demo"}, Prompt: "food", JobID: jobID, Attempt: 2}
+
+	calls := 0
+	api := scriptedModelAPI{results: []scriptedResult{{content: "not json"}, {content: valid}}, calls: &calls}
+	if _, err := ProcessCategorizationJob(context.Background(), db, api, params); err != nil {
+		t.Fatalf("ProcessCategorizationJob() error = %v", err)
+	}
+
+	rows, err := db.Query("SELECT attempt, try, prompt, raw_response, outcome, error_message FROM ai_job_attempts WHERE job_id = ? ORDER BY id", jobID)
+	if err != nil {
+		t.Fatalf("querying attempts: %v", err)
+	}
+	defer rows.Close()
+	type attempt struct {
+		attempt, try         int
+		prompt, raw, outcome string
+		errMsg               sql.NullString
+	}
+	var attempts []attempt
+	for rows.Next() {
+		var a attempt
+		if err := rows.Scan(&a.attempt, &a.try, &a.prompt, &a.raw, &a.outcome, &a.errMsg); err != nil {
+			t.Fatalf("scanning attempt: %v", err)
+		}
+		attempts = append(attempts, a)
+	}
+
+	if len(attempts) != 2 {
+		t.Fatalf("recorded %d attempts, expected 2", len(attempts))
+	}
+	first, second := attempts[0], attempts[1]
+	if first.attempt != 2 || first.try != 1 || first.raw != "not json" || first.outcome != attemptInvalidOutput || !strings.Contains(first.errMsg.String, "decoding output") {
+		t.Errorf("first attempt = %+v, expected rejected output", first)
+	}
+	if !strings.Contains(first.prompt, "food") {
+		t.Errorf("first attempt prompt does not contain the user's prompt: %q", first.prompt)
+	}
+	if second.try != 2 || second.raw != valid || second.outcome != attemptAccepted || second.errMsg.Valid {
+		t.Errorf("second attempt = %+v, expected accepted output", second)
+	}
+
+	// Failed requests are recorded without a response
+	failing := scriptedModelAPI{results: []scriptedResult{{err: &ModelAPIError{StatusCode: 503, Transient: true, Err: errors.New("overloaded")}}}, calls: new(int)}
+	if _, err := ProcessCategorizationJob(context.Background(), db, failing, params); err == nil {
+		t.Fatal("ProcessCategorizationJob() succeeded, expected the model error")
+	}
+	var outcome string
+	var raw sql.NullString
+	if err := db.QueryRow("SELECT outcome, raw_response FROM ai_job_attempts WHERE job_id = ? ORDER BY id DESC LIMIT 1", jobID).Scan(&outcome, &raw); err != nil {
+		t.Fatalf("querying last attempt: %v", err)
+	}
+	if outcome != attemptModelError || raw.Valid {
+		t.Errorf("failed request recorded as %q with response %v", outcome, raw)
+	}
+}
+
+func TestParseModelOutputExtraction(t *testing.T) {
+	params := CategorizationParams{Buyer: Person{Id: 1, Name: "Demo"}, Prompt: "kaffe i går", LocalDate: "2024-05-21"}
+	output := func(extra string) *ModelAPIResponse {
+		content := `{"ambiguity_flag": "", ` + extra + `"spendings": [{"apportion_mode": "alone", "category": "Coffee", "amount": 45, "description": "Kaffe"}]}`
+		return &ModelAPIResponse{Choices: []Choice{{Message: Message{Content: content}}}}
+	}
+
+	tests := []struct {
+		name       string
+		language   string
+		extra      string
+		wantErr    bool
+		wantReason string // Flagged as ambiguous for this reason, if any
+		wantDate   string
+	}{
+		{name: "amount and date found", extra: `"total_amount": 45, "transaction_date": "2024-05-20", `, wantDate: "2024-05-20"},
+		{name: "amount missing", extra: `"transaction_date": "2024-05-20", `, wantReason: "Fant ikke totalbeløpet i beskrivelsen", wantDate: "2024-05-20"},
+		{name: "date in the future", extra: `"total_amount": 45, "transaction_date": "2024-05-22", `, wantReason: "Datoen er fram i tid", wantDate: "2024-05-22"},
+		{name: "date too old", extra: `"total_amount": 45, "transaction_date": "2023-05-20", `, wantReason: "Datoen er mer enn ett år tilbake i tid", wantDate: "2023-05-20"},
+		{name: "reason in Swedish", language: "sv", extra: `"total_amount": 45, "transaction_date": "2024-05-22", `, wantReason: "Datumet är i framtiden", wantDate: "2024-05-22"},
+		{name: "reason in German", language: "de", extra: `"transaction_date": "2024-05-20", `, wantReason: "Der Gesamtbetrag wurde in der Beschreibung nicht gefunden", wantDate: "2024-05-20"},
+		{name: "invalid date", extra: `"total_amount": 45, "transaction_date": "i går", `, wantErr: true},
+		{name: "total does not add up", extra: `"total_amount": 50, `, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := parseModelOutput(promptTemplateFor(tt.language), output(tt.extra), params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseModelOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if job.TotalAmount != 4500 {
+				t.Errorf("TotalAmount = %v, expected 45.00", job.TotalAmount)
+			}
+			if job.IsAmbiguityFlagged != (tt.wantReason != "") || job.AmbiguityFlagReason != tt.wantReason {
+				t.Errorf("IsAmbiguityFlagged = %v (%q), expected reason %q", job.IsAmbiguityFlagged, job.AmbiguityFlagReason, tt.wantReason)
+			}
+			if job.TransactionDate != tt.wantDate {
+				t.Errorf("TransactionDate = %q, expected %q", job.TransactionDate, tt.wantDate)
+			}
+		})
+	}
+
+	t.Run("given date ignores the model's", func(t *testing.T) {
+		given := params
+		given.TotalAmount = 4500
+		given.LocalDate = ""
+		job, err := parseModelOutput(promptTemplateFor("nb"), output(`"transaction_date": "2024-05-20", `), given)
+		if err != nil {
+			t.Fatalf("parseModelOutput() error = %v", err)
+		}
+		if job.TransactionDate != "" || job.IsAmbiguityFlagged {
+			t.Errorf("expected no date and no flag, got %q and %v", job.TransactionDate, job.IsAmbiguityFlagged)
+		}
+	})
+}
+
+func TestParseSegments(t *testing.T) {
+	params := CategorizationParams{Buyer: Person{Id: 1, Name: "Demo"}, Prompt: "Rema 312, kaffe 45", LocalDate: "2024-05-21"}
+	output := func(content string) *ModelAPIResponse {
+		return &ModelAPIResponse{Choices: []Choice{{Message: Message{Content: content}}}}
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		total   money.Amount
+		wantErr bool
+	}{
+		{name: "valid", content: `{"purchases": [{"prompt": "Rema", "total_amount": 312}, {"prompt": "kaffe", "total_amount": 45, "transaction_date": "2024-05-20"}]}`},
+		{name: "matches total", content: `{"purchases": [{"prompt": "Rema", "total_amount": 312}, {"prompt": "kaffe", "total_amount": 45}]}`, total: 35700},
+		{name: "does not match total", content: `{"purchases": [{"prompt": "Rema", "total_amount": 312}]}`, total: 35700, wantErr: true},
+		{name: "no purchases", content: `{"purchases": []}`, wantErr: true},
+		{name: "missing amount", content: `{"purchases": [{"prompt": "Rema"}]}`, wantErr: true},
+		{name: "missing prompt", content: `{"purchases": [{"prompt": " ", "total_amount": 312}]}`, wantErr: true},
+		{name: "invalid date", content: `{"purchases": [{"prompt": "kaffe", "total_amount": 45, "transaction_date": "i går"}]}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := params
+			p.TotalAmount = tt.total
+			purchases, err := parseSegments(output(tt.content), p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSegments() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(purchases) == 0 {
+				t.Errorf("parseSegments() returned no purchases")
+			}
+		})
+	}
+}
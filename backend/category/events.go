@@ -0,0 +1,90 @@
+package category
+
+import (
+	"sync"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// jobEventBuffer is how many events a slow subscriber may fall behind before events are dropped.
+const jobEventBuffer = 16
+
+// JobEventBroker fans out job state changes to the subscribers of a household.
+// Subscribers are keyed by household ID, or by the negated user ID for users
+// without a household, see HouseholdKey.
+type JobEventBroker struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[chan types.JobEvent]struct{}
+	closed      bool
+}
+
+// NewJobEventBroker creates a broker without subscribers.
+func NewJobEventBroker() *JobEventBroker {
+	return &JobEventBroker{subscribers: make(map[int64]map[chan types.JobEvent]struct{})}
+}
+
+// HouseholdKey returns the key events for the user's jobs are published under.
+func HouseholdKey(q household.Querier, userID int64) int64 {
+	if householdID, ok := household.GetHouseholdID(q, userID); ok {
+		return householdID
+	}
+	return -userID
+}
+
+// Subscribe registers a subscriber for the key. The returned function must be called
+// to unsubscribe; it closes the channel. The channel is also closed when the broker is.
+func (b *JobEventBroker) Subscribe(key int64) (<-chan types.JobEvent, func()) {
+	ch := make(chan types.JobEvent, jobEventBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subscribers[key] == nil {
+		b.subscribers[key] = make(map[chan types.JobEvent]struct{})
+	}
+	b.subscribers[key][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[key][ch]; !ok {
+			return // Already unsubscribed, or closed by Close
+		}
+		delete(b.subscribers[key], ch)
+		if len(b.subscribers[key]) == 0 {
+			delete(b.subscribers, key)
+		}
+		close(ch)
+	}
+}
+
+// Close closes all subscriber channels, ending their event streams, and rejects new subscribers.
+// Used on shutdown, as open streams would otherwise keep the HTTP server from draining.
+func (b *JobEventBroker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+	}
+	b.subscribers = make(map[int64]map[chan types.JobEvent]struct{})
+	b.closed = true
+}
+
+// Publish sends the event to every subscriber of the key without blocking.
+// Subscribers whose buffer is full miss the event; they can catch up via GET /v1/jobs/{job_id}.
+func (b *JobEventBroker) Publish(key int64, event types.JobEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers[key] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package category
+
+import (
+	"testing"
+
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+func TestJobEventBroker(t *testing.T) {
+	broker := NewJobEventBroker()
+	events, unsubscribe := broker.Subscribe(1)
+	other, unsubscribeOther := broker.Subscribe(2)
+	defer unsubscribeOther()
+
+	broker.Publish(1, types.JobEvent{JobID: 7, State: types.JobStatePending})
+	select {
+	case event := <-events:
+		if event.JobID != 7 {
+			t.Fatalf("received event for job %d, expected 7", event.JobID)
+		}
+	default:
+		t.Fatalf("subscriber did not receive the event")
+	}
+	select {
+	case event := <-other:
+		t.Fatalf("subscriber of another household received event for job %d", event.JobID)
+	default:
+	}
+
+	// A full buffer drops events instead of blocking the publisher
+	for i := 0; i < jobEventBuffer+1; i++ {
+		broker.Publish(1, types.JobEvent{JobID: int64(i)})
+	}
+
+	unsubscribe()
+	unsubscribe() // Safe to call twice
+	for range events {
+	}
+}
+
+func TestJobEventBrokerClose(t *testing.T) {
+	broker := NewJobEventBroker()
+	events, unsubscribe := broker.Subscribe(1)
+
+	broker.Close()
+	if _, ok := <-events; ok {
+		t.Fatalf("subscriber channel still open after Close")
+	}
+	unsubscribe() // Must not close the channel again
+
+	late, _ := broker.Subscribe(1)
+	if _, ok := <-late; ok {
+		t.Fatalf("subscribing after Close returned an open channel")
+	}
+}
@@ -0,0 +1,152 @@
+package category
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// fakeDefaultContent is answered by a FakeModelAPI without a script.
+const fakeDefaultContent = `{"ambiguity_flag": "mock default response", "spendings":[]}`
+
+// FakeReply is one scripted answer of a FakeModelAPI. See the Fake* constructors for the
+// usual ones.
+type FakeReply struct {
+	Content string        // Message content, used when Err is nil
+	Err     error         // Returned instead of an answer
+	Delay   time.Duration // Waited before replying; cancelling the context ends the wait with its error
+}
+
+// FakeModelAPI is a ModelAPI for tests, replying with a script of answers and failures so each
+// error path of ProcessCategorizationJob and the pool can be exercised. Replies are used in
+// order and the last one repeats once the script runs out. It is safe for concurrent use.
+type FakeModelAPI struct {
+	mu      sync.Mutex
+	script  []FakeReply
+	systems []string // System message sent with each prompt
+	prompts []string
+	images  [][]Image // Images sent with each prompt, nil for text-only prompts
+}
+
+// NewFakeModelAPI creates a fake replying with the script.
+func NewFakeModelAPI(replies ...FakeReply) *FakeModelAPI {
+	return &FakeModelAPI{script: replies}
+}
+
+// Script replaces the replies and restarts counting calls.
+func (f *FakeModelAPI) Script(replies ...FakeReply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = replies
+	f.systems = nil
+	f.prompts = nil
+	f.images = nil
+}
+
+// Calls returns how often the fake was prompted since the script was set.
+func (f *FakeModelAPI) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.prompts)
+}
+
+// Prompts returns the prompts received since the script was set.
+func (f *FakeModelAPI) Prompts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.prompts...)
+}
+
+// Systems returns the system messages sent with each prompt since the script was set.
+func (f *FakeModelAPI) Systems() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.systems...)
+}
+
+// Images returns the images sent with each prompt since the script was set.
+func (f *FakeModelAPI) Images() [][]Image {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]Image(nil), f.images...)
+}
+
+func (f *FakeModelAPI) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	return f.PromptWithImages(ctx, system, prompt, nil)
+}
+
+// PromptWithImages replies like Prompt; the fake acts as a vision model.
+func (f *FakeModelAPI) PromptWithImages(ctx context.Context, system, prompt string, images []Image) (*ModelAPIResponse, error) {
+	f.mu.Lock()
+	reply := FakeReply{Content: fakeDefaultContent}
+	if len(f.script) > 0 {
+		reply = f.script[min(len(f.prompts), len(f.script)-1)]
+	}
+	f.systems = append(f.systems, system)
+	f.prompts = append(f.prompts, prompt)
+	f.images = append(f.images, images)
+	f.mu.Unlock()
+
+	if reply.Delay > 0 {
+		timer := time.NewTimer(reply.Delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	return &ModelAPIResponse{
+		Model:   "fake",
+		Choices: []Choice{{FinishReason: "stop", Message: Message{Role: "assistant", Content: reply.Content}}},
+	}, nil
+}
+
+// FakeAnswer replies with the content as the model's message.
+func FakeAnswer(content string) FakeReply {
+	return FakeReply{Content: content}
+}
+
+// FakeSpendings replies with a valid answer splitting the purchase into the spendings.
+func FakeSpendings(spendings ...Spendings) FakeReply {
+	content, err := json.Marshal(JobResult{Spendings: spendings})
+	if err != nil {
+		panic(err) // Spendings always marshal
+	}
+	return FakeReply{Content: string(content)}
+}
+
+// FakeMalformed replies with chatter around truncated JSON, as models do when they ignore
+// the requested format.
+func FakeMalformed() FakeReply {
+	return FakeReply{Content: "Here is the categorization you asked for:\n```json\n{\"spendings\": [{\"category\": \"Groceries\", \"amount\": "}
+}
+
+// FakeWrongSum replies with a well-formed answer whose amounts add up to half the total.
+func FakeWrongSum(total money.Amount) FakeReply {
+	return FakeSpendings(Spendings{Category: "Groceries", Amount: total / 2, ApportionMode: "alone", Description: "Half of it"})
+}
+
+// FakeTimeout fails like a request that hit the per-request timeout of OpenRouterAPI.
+func FakeTimeout() FakeReply {
+	return FakeReply{Err: &ModelAPIError{Transient: true, Err: fmt.Errorf("failed to send request: %w", context.DeadlineExceeded)}}
+}
+
+// FakeRateLimited fails like a provider answering 429 Too Many Requests with Retry-After.
+func FakeRateLimited(retryAfter time.Duration) FakeReply {
+	return FakeReply{Err: &ModelAPIError{
+		StatusCode: http.StatusTooManyRequests,
+		RetryAfter: retryAfter,
+		Transient:  true,
+		Err:        errors.New(`{"error":{"message":"Rate limit exceeded","code":429}}`),
+	}}
+}
@@ -0,0 +1,74 @@
+package category
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProcessCategorizationJobFailureModes(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	params := CategorizationParams{TotalAmount: 3000, Buyer: Person{Id: 1, Name: "Demo"}, Prompt: "food"}
+	valid := FakeSpendings(Spendings{Category: "Groceries", Amount: 3000, ApportionMode: "alone", Description: "Food"})
+
+	tests := []struct {
+		name          string
+		script        []FakeReply
+		expectedCalls int
+		checkErr      func(error) bool
+	}{
+		{
+			name:          "recovers from malformed JSON",
+			script:        []FakeReply{FakeMalformed(), valid},
+			expectedCalls: 2,
+			checkErr:      func(err error) bool { return err == nil },
+		},
+		{
+			name:          "gives up on amounts that never add up",
+			script:        []FakeReply{FakeWrongSum(3000)},
+			expectedCalls: maxOutputTries,
+			checkErr:      func(err error) bool { return errors.Is(err, ErrInvalidModelOutput) && IsPermanent(err) },
+		},
+		{
+			name:          "provider timeout is retried by the pool",
+			script:        []FakeReply{FakeTimeout()},
+			expectedCalls: 1,
+			checkErr: func(err error) bool {
+				return errors.Is(err, context.DeadlineExceeded) && !IsPermanent(err)
+			},
+		},
+		{
+			name:          "rate limiting keeps Retry-After",
+			script:        []FakeReply{FakeRateLimited(30 * time.Second)},
+			expectedCalls: 1,
+			checkErr: func(err error) bool {
+				var apiErr *ModelAPIError
+				return errors.As(err, &apiErr) && apiErr.StatusCode == 429 && apiErr.RetryAfter == 30*time.Second && !IsPermanent(err)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := NewFakeModelAPI(tt.script...)
+			_, err := ProcessCategorizationJob(context.Background(), db, api, params)
+			if !tt.checkErr(err) {
+				t.Fatalf("ProcessCategorizationJob() error = %v", err)
+			}
+			if api.Calls() != tt.expectedCalls {
+				t.Fatalf("model called %d times, expected %d", api.Calls(), tt.expectedCalls)
+			}
+		})
+	}
+
+	// A slow model is abandoned when the caller gives up
+	api := NewFakeModelAPI(FakeReply{Content: valid.Content, Delay: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := ProcessCategorizationJob(ctx, db, api, params); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ProcessCategorizationJob() with a slow model error = %v, expected the deadline", err)
+	}
+}
@@ -5,11 +5,14 @@ import (
 
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/household"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
@@ -83,89 +86,37 @@ func HandleAICategorize(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerF
 		}
 		defer r.Body.Close()
 
-		// --- Parse Optional Transaction Date ---
-		var transactionDateTime *time.Time // Use pointer to handle optional date
-		if payload.TransactionDate != nil && *payload.TransactionDate != "" {
-			parsedDate, err := time.Parse("2006-01-02", *payload.TransactionDate)
-			if err != nil {
-				slog.Warn("invalid transaction_date format received for AI job, ignoring", "url", r.URL, "user_id", userID, "date_string", *payload.TransactionDate, "err", err)
-				// Don't fail, just proceed without a specific date (pool will handle nil)
-			} else {
-				// Use the start of the day in UTC for consistency
-				t := time.Date(parsedDate.Year(), parsedDate.Month(), parsedDate.Day(), 0, 0, 0, 0, time.UTC)
-				transactionDateTime = &t
-				slog.Debug("Using provided transaction_date for AI job", "user_id", userID, "date", *transactionDateTime)
-			}
-		} else {
-			slog.Debug("transaction_date not provided for AI job, will use current time on insertion", "user_id", userID)
-		}
-		// --- End Parse Optional Transaction Date ---
+		transactionDateTime := parseTransactionDate(r, userID, payload)
 
-		// 2. Validate payload
+		// 2. Validate payload. Without an amount, the AI finds it in the prompt.
 		// shared_status validation is removed
-		if payload.Prompt == "" || payload.Amount <= 0 {
+		if payload.Prompt == "" || payload.Amount < 0 {
 			slog.Warn("invalid AI categorization payload received", "url", r.URL, "user_id", userID, "payload", payload)
 			http.Error(w, "Bad Request: Missing prompt or invalid amount", http.StatusBadRequest)
 			return
 		}
+		if !checkCurrency(w, r, db, userID, &payload, transactionDateTime) {
+			return
+		}
 
-		// 3. Determine Buyer and potentially SharedWith using authenticated user and partner logic
+		// 2b. Reject the job if the household used up its monthly AI quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 3. Determine the buyer, partner and household, and prepare the parameters for the job.
 		// We always fetch the partner now, if one exists, and let the AI decide based on the prompt.
-		var buyer Person
-		buyerRow := db.QueryRow("SELECT first_name FROM users WHERE id = ?", userID)
-		err := buyerRow.Scan(&buyer.Name)
+		params, err := categorizationParams(r, db, userID, payload)
 		if err != nil {
-			// Handle case where authenticated user ID somehow doesn't exist
-			if errors.Is(err, sql.ErrNoRows) {
-				slog.Error("authenticated user not found in database", "url", r.URL, "user_id", userID)
-				http.Error(w, "Internal Server Error: User configuration issue", http.StatusInternalServerError)
-			} else {
-				slog.Error("failed to query buyer user", "url", r.URL, "user_id", userID, "err", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			}
+			slog.Error("failed to prepare AI categorization", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		buyer.Id = userID
-
-		// Always try to find the partner using the new DB query method.
-		var sharedWith *Person = nil
-		partnerID, partnerOk := auth.GetPartnerUserID(db, userID) // Pass db connection
-		if partnerOk {
-			// Partner relationship exists, fetch partner details
-			var partnerName string
-			partnerRow := db.QueryRow("SELECT first_name FROM users WHERE id = ?", partnerID)
-			err := partnerRow.Scan(&partnerName)
-			if err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					// Log error but don't fail the request, maybe partner was deleted? AI can proceed without partner name.
-					slog.Error("configured partner user ID not found in database (AI categorization)", "url", r.URL, "user_id", userID, "partner_id", partnerID)
-					// sharedWith remains nil
-				} else {
-					// Log DB error but don't fail the request, proceed without partner name.
-					slog.Error("failed to query partner user (AI categorization)", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
-					// sharedWith remains nil
-				}
-			} else {
-				// Partner found, set the sharedWith object
-				sharedWith = &Person{Id: partnerID, Name: partnerName}
-				slog.Info("Partner found for AI categorization", "user_id", userID, "partner_id", partnerID, "partner_name", partnerName)
-			}
-		} else {
-			slog.Info("No partner configured for user (AI categorization)", "user_id", userID)
-		}
-
-		// 4. Prepare parameters for the categorization job
-		// SharedMode is removed
-		params := CategorizationParams{
-			TotalAmount: payload.Amount,
-			Buyer:       buyer,      // Use authenticated buyer object
-			SharedWith:  sharedWith, // Use determined sharedWith object (or nil)
-			Prompt:      payload.Prompt,
-			PreSettled:  payload.PreSettled, // Pass the pre-settled flag
-			// 'tries' is handled internally by ProcessCategorizationJob
+		if transactionDateTime == nil {
+			params.LocalDate = localDate(r, userID, payload)
 		}
 
-		// 5. Add the job to the pool, passing the parsed transactionDate
+		// 4. Add the job to the pool, passing the parsed transactionDate
 		jobID, err := pool.AddJob(params, transactionDateTime) // Pass parsed date (or nil)
 		if err != nil {
 			slog.Error("failed to add AI categorization job to pool", "url", r.URL, "user_id", userID, "pre_settled", payload.PreSettled, "transaction_date", transactionDateTime, "err", err)
@@ -175,10 +126,170 @@ func HandleAICategorize(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerF
 
 		slog.Info("AI categorization job added", "url", r.URL, "user_id", userID, "job_id", jobID, "amount", payload.Amount, "pre_settled", payload.PreSettled, "transaction_date", transactionDateTime)
 
-		// 6. Respond with 202 Accepted
+		// 5. Respond with 202 Accepted
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
 		// Optionally return the job ID
 		json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
 	}
 }
+
+// parseTransactionDate reads the optional transaction date of the payload. An invalid date is
+// ignored, so the job falls back to the current time.
+func parseTransactionDate(r *http.Request, userID int64, payload types.AICategorizationPayload) *time.Time {
+	if payload.TransactionDate == nil || *payload.TransactionDate == "" {
+		slog.Debug("transaction_date not provided for AI job, will use current time on insertion", "user_id", userID)
+		return nil
+	}
+	parsedDate, err := time.Parse("2006-01-02", *payload.TransactionDate)
+	if err != nil {
+		slog.Warn("invalid transaction_date format received for AI job, ignoring", "url", r.URL, "user_id", userID, "date_string", *payload.TransactionDate, "err", err)
+		return nil
+	}
+	// Use the start of the day in UTC for consistency
+	t := time.Date(parsedDate.Year(), parsedDate.Month(), parsedDate.Day(), 0, 0, 0, 0, time.UTC)
+	slog.Debug("Using provided transaction_date for AI job", "user_id", userID, "date", t)
+	return &t
+}
+
+// localDate returns the user's date today from the payload, for the AI to resolve dates like
+// "i går" against. Defaults to today in UTC if missing or invalid.
+func localDate(r *http.Request, userID int64, payload types.AICategorizationPayload) string {
+	if payload.LocalDate != nil && *payload.LocalDate != "" {
+		if _, err := time.Parse(dateLayout, *payload.LocalDate); err == nil {
+			return *payload.LocalDate
+		}
+		slog.Warn("invalid local_date format received for AI job, using UTC", "url", r.URL, "user_id", userID, "date_string", *payload.LocalDate)
+	}
+	return time.Now().UTC().Format(dateLayout)
+}
+
+// checkCurrency validates the optional currency of the payload, responding with 400 and
+// returning false if it is malformed or has no exchange rate to the household's currency on the
+// transaction date (today if nil). A currency that is the household's is cleared.
+func checkCurrency(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64, payload *types.AICategorizationPayload, transactionDate *time.Time) bool {
+	code, ok := currency.ParseCode(payload.Currency)
+	if !ok {
+		http.Error(w, "Bad Request: Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+		return false
+	}
+	payload.Currency = nil
+	if code == "" {
+		return true
+	}
+	base, err := household.GetCurrency(db, userID)
+	if err != nil {
+		slog.Error("failed to get household currency", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if code == base {
+		return true
+	}
+	date := time.Now().UTC()
+	if transactionDate != nil {
+		date = *transactionDate
+	}
+	if _, err := currency.Rate(db, code, base, date); err != nil {
+		if errors.Is(err, currency.ErrNoRate) {
+			slog.Warn("no exchange rate for AI categorization", "url", r.URL, "user_id", userID, "currency", code, "err", err)
+			http.Error(w, "Bad Request: No exchange rate for the currency on the transaction date", http.StatusBadRequest)
+			return false
+		}
+		slog.Error("failed to look up exchange rate", "url", r.URL, "user_id", userID, "currency", code, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	payload.Currency = &code
+	return true
+}
+
+// checkLLMQuota responds with 429 and returns false if the user's household used up its
+// monthly AI quota.
+func checkLLMQuota(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) bool {
+	exceeded, err := LLMQuotaExceeded(db, userID)
+	if err != nil {
+		slog.Error("failed to check AI quota", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if exceeded {
+		slog.Warn("AI categorization rejected, monthly quota exceeded", "url", r.URL, "user_id", userID)
+		http.Error(w, "Monthly AI quota exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// categorizationParams prepares the categorization of the payload for the user: the buyer, the
+// partner the AI may share with, and the other household members.
+func categorizationParams(r *http.Request, db *sql.DB, userID int64, payload types.AICategorizationPayload) (CategorizationParams, error) {
+	var buyer Person
+	buyerRow := db.QueryRow("SELECT first_name FROM users WHERE id = ?", userID)
+	if err := buyerRow.Scan(&buyer.Name); err != nil {
+		// Handle case where authenticated user ID somehow doesn't exist
+		if errors.Is(err, sql.ErrNoRows) {
+			return CategorizationParams{}, errors.New("authenticated user not found in database")
+		}
+		return CategorizationParams{}, fmt.Errorf("failed to query buyer user: %w", err)
+	}
+	buyer.Id = userID
+
+	// Always try to find the partner using the new DB query method.
+	var sharedWith *Person = nil
+	partnerID, partnerOk := auth.GetPartnerUserID(db, userID) // Pass db connection
+	if partnerOk {
+		// Partner relationship exists, fetch partner details
+		var partnerName string
+		partnerRow := db.QueryRow("SELECT first_name FROM users WHERE id = ?", partnerID)
+		err := partnerRow.Scan(&partnerName)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				// Log error but don't fail the request, maybe partner was deleted? AI can proceed without partner name.
+				slog.Error("configured partner user ID not found in database (AI categorization)", "url", r.URL, "user_id", userID, "partner_id", partnerID)
+				// sharedWith remains nil
+			} else {
+				// Log DB error but don't fail the request, proceed without partner name.
+				slog.Error("failed to query partner user (AI categorization)", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
+				// sharedWith remains nil
+			}
+		} else {
+			// Partner found, set the sharedWith object
+			sharedWith = &Person{Id: partnerID, Name: partnerName}
+			slog.Info("Partner found for AI categorization", "user_id", userID, "partner_id", partnerID, "partner_name", partnerName)
+		}
+	} else {
+		slog.Info("No partner configured for user (AI categorization)", "user_id", userID)
+	}
+
+	// Collect the other household members so the AI can share with more than one person.
+	var householdMembers []Person
+	members, err := household.GetMembers(db, userID)
+	if err != nil {
+		// Log but don't fail the request; the AI can still use the partner, if any.
+		slog.Error("failed to query household members (AI categorization)", "url", r.URL, "user_id", userID, "err", err)
+	}
+	for _, m := range members {
+		if m.UserID != userID {
+			householdMembers = append(householdMembers, Person{Id: m.UserID, Name: m.FirstName})
+		}
+	}
+
+	// SharedMode is removed
+	params := CategorizationParams{
+		TotalAmount: payload.Amount,
+		Buyer:       buyer,      // Use authenticated buyer object
+		SharedWith:  sharedWith, // Use determined sharedWith object (or nil)
+		Household:   householdMembers,
+		Prompt:      payload.Prompt,
+		PreSettled:  payload.PreSettled, // Pass the pre-settled flag
+	}
+	if payload.Currency != nil { // Checked by checkCurrency
+		params.Currency = *payload.Currency
+	}
+	if err := loadContext(db, &params); err != nil {
+		// Log but don't fail the request; the AI can do without the notes.
+		slog.Error("failed to load AI notes (AI categorization)", "url", r.URL, "user_id", userID, "err", err)
+	}
+	return params, nil
+}
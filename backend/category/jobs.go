@@ -0,0 +1,484 @@
+package category
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/history"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// jobEventsHeartbeat is how often a comment is sent on idle event streams, so proxies keep them open.
+const jobEventsHeartbeat = 25 * time.Second
+
+// HandleGetJob returns the full state of an AI job and the spendings it produced.
+// Jobs are visible to every member of the buyer's household.
+func HandleGetJob(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for getting AI job", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Get Job ID from path
+		jobIDStr := r.PathValue("job_id")
+		jobID, err := strconv.ParseInt(jobIDStr, 10, 64)
+		if err != nil {
+			slog.Warn("invalid job ID format", "url", r.URL, "user_id", userID, "job_id_str", jobIDStr, "err", err)
+			http.Error(w, "Invalid job ID", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Load the job state
+		resp, err := loadJobResponse(db, jobID, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Job not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("failed to load AI job", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// 3. Verify the user is in the buyer's household. Not found rather than
+		// forbidden, so job IDs of other households are not revealed.
+		if !sameHousehold(db, userID, resp.BuyerID) {
+			slog.Warn("attempt to view AI job outside household", "url", r.URL, "user_id", userID, "job_id", jobID, "buyer_id", resp.BuyerID)
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode AI job response", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+		}
+	}
+}
+
+// loadJobResponse loads the state of a job and its spendings, as seen by the user.
+// Returns sql.ErrNoRows if the job does not exist.
+func loadJobResponse(db *sql.DB, jobID, userID int64) (types.JobResponse, error) {
+	var resp types.JobResponse
+	var errMsg, model, promptTemplate sql.NullString
+	var statusUpdatedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT buyer, status, is_finished, is_ambiguity_flagged, pre_settled, error_message, attempts, model, prompt_template,
+			created_at, status_updated_at
+		FROM ai_categorization_jobs WHERE id = ?
+	`, jobID).Scan(&resp.BuyerID, &resp.Status, &resp.IsFinished, &resp.IsAmbiguityFlagged, &resp.PreSettled, &errMsg, &resp.Attempts, &model, &promptTemplate,
+		&resp.CreatedAt, &statusUpdatedAt)
+	if err != nil {
+		return types.JobResponse{}, err
+	}
+
+	// The job details and spendings as history shows them
+	group, err := history.FetchTransactionGroup(db, jobID, userID)
+	if err != nil {
+		return types.JobResponse{}, fmt.Errorf("fetching spendings of job %d: %w", jobID, err)
+	}
+	resp.TransactionGroup = group
+	resp.State = JobStateFor(resp.Status, resp.IsAmbiguityFlagged)
+	if errMsg.Valid {
+		resp.ErrorMessage = &errMsg.String
+	}
+	if model.Valid {
+		resp.Model = &model.String
+	}
+	if promptTemplate.Valid {
+		resp.PromptTemplate = &promptTemplate.String
+	}
+	resp.StatusUpdatedAt = statusUpdatedAt.Time
+	return resp, nil
+}
+
+// HandleGetJobAttempts lists the model requests made for an AI job in order: the prompt as sent,
+// the raw answer and why it was rejected, if it was. Visible to the buyer's household, like the job.
+func HandleGetJobAttempts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for getting AI job attempts", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Get the job from the path, if it is the household's
+		jobID, ok := householdJobFromPath(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		// 2. Load the attempts
+		rows, err := db.Query(`
+			SELECT id, attempt, try, model, prompt, raw_response, outcome, error_message, created_at
+			FROM ai_job_attempts WHERE job_id = ? ORDER BY id
+		`, jobID)
+		if err != nil {
+			slog.Error("failed to query AI job attempts", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		attempts := []types.JobAttempt{}
+		for rows.Next() {
+			var a types.JobAttempt
+			var model, rawResponse, errMsg sql.NullString
+			if err := rows.Scan(&a.ID, &a.Attempt, &a.Try, &model, &a.Prompt, &rawResponse, &a.Outcome, &errMsg, &a.CreatedAt); err != nil {
+				slog.Error("failed to scan AI job attempt", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if model.Valid {
+				a.Model = &model.String
+			}
+			if rawResponse.Valid {
+				a.RawResponse = &rawResponse.String
+			}
+			if errMsg.Valid {
+				a.ErrorMessage = &errMsg.String
+			}
+			attempts = append(attempts, a)
+		}
+		if err := rows.Err(); err != nil {
+			slog.Error("failed to iterate AI job attempts", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(attempts); err != nil {
+			slog.Error("failed to encode AI job attempts", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+		}
+	}
+}
+
+// HandleRetryJob queues a failed job of the household for another try, right away and with a
+// fresh set of attempts.
+func HandleRetryJob(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for retrying AI job", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Get the job from the path, if it is the household's
+		jobID, ok := householdJobFromPath(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		// 2. Retrying uses the model, so it counts against the quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 3. Queue the job again
+		err := pool.RetryJob(jobID)
+		if errors.Is(err, ErrJobNotFailed) {
+			http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to retry AI job", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("AI job queued for retry", "url", r.URL, "user_id", userID, "job_id", jobID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
+	}
+}
+
+// HandleRecategorizeJob queues a completed job of the household to be categorized again, e.g.
+// after the categories' notes were improved. Its spendings are replaced once the model answers.
+func HandleRecategorizeJob(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for recategorizing AI job", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Get the job from the path, if it is the household's
+		jobID, ok := householdJobFromPath(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		// 2. Recategorizing uses the model, so it counts against the quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 3. Queue the job again
+		err := pool.Recategorize(jobID)
+		if errors.Is(err, ErrJobNotCompleted) || errors.Is(err, ErrPartlySettled) {
+			http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to recategorize AI job", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("AI job queued for recategorization", "url", r.URL, "user_id", userID, "job_id", jobID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
+	}
+}
+
+// HandleRecategorizeJobs queues the household's AI jobs from a date range and/or with spendings
+// in a category to be categorized again: completed jobs are recategorized, failed and
+// dead-lettered ones retried. Jobs that cannot be requeued are reported as skipped.
+func HandleRecategorizeJobs(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for recategorizing AI jobs", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate the filters; at least one is required
+		var payload types.RecategorizeJobsPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode recategorize jobs request body", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Bad Request: Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if payload.From == nil && payload.To == nil && payload.CategoryName == nil {
+			http.Error(w, "Bad Request: Give a date range or a category", http.StatusBadRequest)
+			return
+		}
+		conditions := []string{"j.status IN (?, ?, ?)"}
+		args := []interface{}{jobStatusCompleted, jobStatusFailed, jobStatusDeadLetter}
+		if payload.From != nil {
+			from, err := time.Parse("2006-01-02", *payload.From)
+			if err != nil {
+				http.Error(w, "Bad Request: Invalid 'from' date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, "j.transaction_date >= ?")
+			args = append(args, from)
+		}
+		if payload.To != nil {
+			to, err := time.Parse("2006-01-02", *payload.To)
+			if err != nil {
+				http.Error(w, "Bad Request: Invalid 'to' date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			conditions = append(conditions, "j.transaction_date < ?")
+			args = append(args, to.AddDate(0, 0, 1))
+		}
+		if payload.CategoryName != nil {
+			conditions = append(conditions, `EXISTS (
+				SELECT 1 FROM ai_categorized_spendings acs
+				JOIN spendings s ON s.id = acs.spending_id
+				JOIN categories c ON c.id = s.category
+				WHERE acs.job_id = j.id AND c.name = ?)`)
+			args = append(args, *payload.CategoryName)
+		}
+
+		// 2. Recategorizing uses the model, so it counts against the quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 3. Find the household's matching jobs
+		memberIDs, err := household.OtherMemberIDs(db, userID)
+		if err != nil {
+			slog.Error("failed to query household members for recategorizing", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		memberIDs = append(memberIDs, userID)
+		placeholders := make([]string, len(memberIDs))
+		for i, id := range memberIDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		conditions = append(conditions, fmt.Sprintf("j.buyer IN (%s)", strings.Join(placeholders, ",")))
+		rows, err := db.Query("SELECT j.id, j.status FROM ai_categorization_jobs j WHERE "+strings.Join(conditions, " AND ")+" ORDER BY j.id", args...)
+		if err != nil {
+			slog.Error("failed to query jobs to recategorize", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		type matchedJob struct {
+			id     int64
+			status string
+		}
+		var jobs []matchedJob
+		for rows.Next() {
+			var job matchedJob
+			if err := rows.Scan(&job.id, &job.status); err != nil {
+				rows.Close()
+				slog.Error("failed to scan job to recategorize", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			jobs = append(jobs, job)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			slog.Error("failed to iterate jobs to recategorize", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// 4. Queue them again
+		resp := types.RecategorizeJobsResponse{Recategorized: []int64{}, Retried: []int64{}, Skipped: []int64{}}
+		for _, job := range jobs {
+			var err error
+			if job.status == jobStatusCompleted {
+				err = pool.Recategorize(job.id)
+			} else {
+				err = pool.RetryJob(job.id)
+			}
+			switch {
+			case err == nil && job.status == jobStatusCompleted:
+				resp.Recategorized = append(resp.Recategorized, job.id)
+			case err == nil:
+				resp.Retried = append(resp.Retried, job.id)
+			case errors.Is(err, ErrJobNotCompleted), errors.Is(err, ErrJobNotFailed), errors.Is(err, ErrPartlySettled):
+				resp.Skipped = append(resp.Skipped, job.id)
+			default:
+				slog.Error("failed to requeue AI job", "url", r.URL, "user_id", userID, "job_id", job.id, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		slog.Info("AI jobs queued for recategorization", "url", r.URL, "user_id", userID,
+			"recategorized", len(resp.Recategorized), "retried", len(resp.Retried), "skipped", len(resp.Skipped))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode recategorize jobs response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// householdJobFromPath parses the job_id path value and checks that the job exists and was
+// bought by a member of the user's household. Otherwise it responds, with not found rather than
+// forbidden for other households' jobs so their IDs are not revealed, and returns false.
+func householdJobFromPath(w http.ResponseWriter, r *http.Request, db *sql.DB, userID int64) (int64, bool) {
+	jobIDStr := r.PathValue("job_id")
+	jobID, err := strconv.ParseInt(jobIDStr, 10, 64)
+	if err != nil {
+		slog.Warn("invalid job ID format", "url", r.URL, "user_id", userID, "job_id_str", jobIDStr, "err", err)
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	var buyerID int64
+	err = db.QueryRow("SELECT buyer FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&buyerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return 0, false
+		}
+		slog.Error("failed to query AI job", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !sameHousehold(db, userID, buyerID) {
+		slog.Warn("attempt to access AI job outside household", "url", r.URL, "user_id", userID, "job_id", jobID, "buyer_id", buyerID)
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return 0, false
+	}
+	return jobID, true
+}
+
+// HandleJobEvents streams job state changes for the user's household as server-sent events.
+// Each event is named "job" and carries a types.JobEvent as JSON. Clients fetch the
+// resulting spendings with GET /v1/jobs/{job_id} once a job is finished or flagged.
+//
+// The stream requires the usual Authorization header, so browsers need a fetch-based
+// event source rather than the built-in EventSource.
+func HandleJobEvents(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for job events", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		events, unsubscribe := pool.Events().Subscribe(HouseholdKey(db, userID))
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no") // Disable proxy buffering (nginx)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": connected\n\n")
+		if err := rc.Flush(); err != nil {
+			slog.Error("job event stream does not support flushing", "url", r.URL, "user_id", userID, "err", err)
+			return
+		}
+		slog.Info("Job event stream opened", "user_id", userID)
+
+		heartbeat := time.NewTicker(jobEventsHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				slog.Info("Job event stream closed", "user_id", userID)
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					slog.Error("failed to marshal job event", "user_id", userID, "job_id", event.JobID, "err", err)
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: job\ndata: %s\n\n", event.JobID, data)
+			}
+			if err := rc.Flush(); err != nil {
+				slog.Warn("failed to flush job event stream", "user_id", userID, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// sameHousehold reports whether the two users are the same or share a household.
+func sameHousehold(q household.Querier, userID, otherID int64) bool {
+	if userID == otherID {
+		return true
+	}
+	userHousehold, ok := household.GetHouseholdID(q, userID)
+	if !ok {
+		return false
+	}
+	otherHousehold, ok := household.GetHouseholdID(q, otherID)
+	return ok && userHousehold == otherHousehold
+}
@@ -0,0 +1,286 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// DefaultModelSpec is the model chain used unless AI_MODELS configures another.
+const DefaultModelSpec = "openrouter:x-ai/grok-4-fast"
+
+// DefaultLocalModelEndpoint is where "local:" models are served unless LOCAL_MODEL_URL says otherwise.
+const DefaultLocalModelEndpoint = "http://localhost:11434/v1/chat/completions"
+
+// defaultModelSetting is the app_settings key storing the name of the default model.
+const defaultModelSetting = "default_model"
+
+// ErrUnknownModel is returned when selecting a model that is not part of the chain.
+var ErrUnknownModel = errors.New("unknown model")
+
+// ModelBackend is one model in a ModelChain.
+type ModelBackend struct {
+	Name string // Unique within the chain, e.g. "openrouter:x-ai/grok-4-fast"
+	API  ModelAPI
+}
+
+// ModelChain is a ModelAPI trying several models in turn: the default model first, then the
+// others in configured order until one answers. This keeps jobs flowing while a provider or
+// model is degraded. The default can be switched at runtime, see HandleSetDefaultModel.
+type ModelChain struct {
+	backends []ModelBackend
+
+	mu           sync.RWMutex
+	defaultIndex int // Index into backends of the model tried first
+}
+
+// NewModelChain creates a chain of the backends, in fallback order. The first is the default.
+func NewModelChain(backends ...ModelBackend) (*ModelChain, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("model chain needs at least one model")
+	}
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		if b.Name == "" || b.API == nil {
+			return nil, errors.New("model chain entries need a name and an API")
+		}
+		if seen[b.Name] {
+			return nil, fmt.Errorf("model %q is listed twice", b.Name)
+		}
+		seen[b.Name] = true
+	}
+	return &ModelChain{backends: backends}, nil
+}
+
+// ParseModelChain builds a chain from a comma separated list of "provider:model" entries, e.g.
+// "openrouter:x-ai/grok-4-fast,openrouter:mistralai/mistral-small,local:llama3.1".
+// Providers are "openrouter", using the API key, "local", served at localEndpoint, and
+// "replay", answering offline from the Cassette recordings in the named directory.
+func ParseModelChain(spec, openRouterKey, localEndpoint string) (*ModelChain, error) {
+	var backends []ModelBackend
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		provider, model, ok := strings.Cut(entry, ":")
+		if !ok || model == "" {
+			return nil, fmt.Errorf("model %q must have the form provider:model", entry)
+		}
+		switch provider {
+		case "openrouter":
+			backends = append(backends, ModelBackend{Name: entry, API: NewOpenRouterAPI(openRouterKey, model)})
+		case "local":
+			backends = append(backends, ModelBackend{Name: entry, API: NewLocalModelAPI(localEndpoint, model)})
+		case "replay":
+			cassette, err := NewCassette(model, CassetteReplay, nil)
+			if err != nil {
+				return nil, fmt.Errorf("model %q: %w", entry, err)
+			}
+			backends = append(backends, ModelBackend{Name: entry, API: cassette})
+		default:
+			return nil, fmt.Errorf("model %q has unknown provider %q", entry, provider)
+		}
+	}
+	return NewModelChain(backends...)
+}
+
+// Models returns the names of the models in fallback order.
+func (c *ModelChain) Models() []string {
+	names := make([]string, len(c.backends))
+	for i, b := range c.backends {
+		names[i] = b.Name
+	}
+	return names
+}
+
+// Default returns the name of the model tried first.
+func (c *ModelChain) Default() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.backends[c.defaultIndex].Name
+}
+
+// SetDefault makes the named model the one tried first. The others keep their order.
+func (c *ModelChain) SetDefault(name string) error {
+	for i, b := range c.backends {
+		if b.Name == name {
+			c.mu.Lock()
+			c.defaultIndex = i
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %q", ErrUnknownModel, name)
+}
+
+// order returns the backends in the order they are tried.
+func (c *ModelChain) order() []ModelBackend {
+	c.mu.RLock()
+	defaultIndex := c.defaultIndex
+	c.mu.RUnlock()
+
+	ordered := make([]ModelBackend, 0, len(c.backends))
+	ordered = append(ordered, c.backends[defaultIndex])
+	for i, b := range c.backends {
+		if i != defaultIndex {
+			ordered = append(ordered, b)
+		}
+	}
+	return ordered
+}
+
+// Prompt sends the prompt to the default model, falling back to the next model whenever one
+// fails. The response's Backend names the model that answered. If every model fails the error
+// is transient when any failure was, so the pool retries the job later; with a single model its
+// error is returned unchanged.
+func (c *ModelChain) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	return c.try(ctx, c.order(), func(api ModelAPI) (*ModelAPIResponse, error) {
+		return api.Prompt(ctx, system, prompt)
+	})
+}
+
+// PromptWithImages sends the prompt with the images like Prompt, trying only the models of the
+// chain that can send images.
+func (c *ModelChain) PromptWithImages(ctx context.Context, system, prompt string, images []Image) (*ModelAPIResponse, error) {
+	var backends []ModelBackend
+	for _, b := range c.order() {
+		if _, ok := b.API.(VisionModelAPI); ok {
+			backends = append(backends, b)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, &ModelAPIError{Err: ErrNoVision}
+	}
+	return c.try(ctx, backends, func(api ModelAPI) (*ModelAPIResponse, error) {
+		return api.(VisionModelAPI).PromptWithImages(ctx, system, prompt, images)
+	})
+}
+
+// try makes the request with each backend in turn until one answers, see Prompt.
+func (c *ModelChain) try(ctx context.Context, backends []ModelBackend, request func(ModelAPI) (*ModelAPIResponse, error)) (*ModelAPIResponse, error) {
+	failures := make([]string, 0, len(backends))
+	var lastErr error
+	transient := false
+	var retryAfter time.Duration
+
+	for _, b := range backends {
+		res, err := request(b.API)
+		if err == nil {
+			if len(failures) > 0 {
+				slog.Info("Fallback model answered", "model", b.Name, "failed_models", len(failures))
+			}
+			res.Backend = b.Name
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err() // Cancelled by the caller, the other models would be too
+		}
+		slog.Warn("model failed, falling back to the next one", "model", b.Name, "err", err)
+
+		lastErr = err
+		failures = append(failures, fmt.Sprintf("%s: %v", b.Name, err))
+		// Unclassified errors count as transient, like in IsPermanent
+		var apiErr *ModelAPIError
+		if !errors.As(err, &apiErr) || apiErr.Transient {
+			// Any of the models may recover, so wait only as long as the most hopeful one asks
+			var wait time.Duration
+			if apiErr != nil {
+				wait = apiErr.RetryAfter
+			}
+			if !transient || wait < retryAfter {
+				retryAfter = wait
+			}
+			transient = true
+		}
+	}
+
+	if len(backends) == 1 {
+		return nil, lastErr
+	}
+	return nil, &ModelAPIError{
+		RetryAfter: retryAfter,
+		Transient:  transient,
+		Err:        fmt.Errorf("all %d models failed: %s", len(backends), strings.Join(failures, "; ")),
+	}
+}
+
+// LoadDefault restores the default model switched to by an admin. A stored model that is no
+// longer configured is ignored, so the first configured model stays the default.
+func (c *ModelChain) LoadDefault(db *sql.DB) error {
+	var name string
+	err := db.QueryRow("SELECT value FROM app_settings WHERE key = ?", defaultModelSetting).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading default model: %w", err)
+	}
+	if err := c.SetDefault(name); err != nil {
+		slog.Warn("stored default model is not configured, keeping the first model", "stored", name, "default", c.Default())
+	}
+	return nil
+}
+
+// HandleGetModels lists the configured models and the default. Admins only.
+func HandleGetModels(chain *ModelChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		resp := types.ModelsResponse{Models: chain.Models(), Default: chain.Default()}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode models response", "url", r.URL, "err", err)
+		}
+	}
+}
+
+// HandleSetDefaultModel switches the model tried first for all subsequent jobs. The choice
+// is stored in app_settings and survives restarts. Admins only.
+func HandleSetDefaultModel(db *sql.DB, chain *ModelChain) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := auth.GetUserIDFromContext(r.Context())
+
+		// 1. Decode the payload
+		var payload types.SetDefaultModelPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode set default model payload", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Switch the chain, which validates the name
+		previous := chain.Default()
+		if err := chain.SetDefault(payload.Model); err != nil {
+			http.Error(w, "Unknown model", http.StatusBadRequest)
+			return
+		}
+
+		// 3. Persist the choice, restoring the previous default if that fails
+		_, err := db.Exec(`
+			INSERT INTO app_settings (key, value, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at
+		`, defaultModelSetting, payload.Model)
+		if err != nil {
+			_ = chain.SetDefault(previous)
+			slog.Error("failed to store default model", "url", r.URL, "user_id", userID, "model", payload.Model, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Default AI model switched", "user_id", userID, "from", previous, "to", payload.Model)
+
+		w.Header().Set("Content-Type", "application/json")
+		resp := types.ModelsResponse{Models: chain.Models(), Default: chain.Default()}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode models response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
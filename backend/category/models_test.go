@@ -0,0 +1,158 @@
+package category
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestModelChainFallback(t *testing.T) {
+	var primaryCalls, fallbackCalls int
+	primary := scriptedModelAPI{calls: &primaryCalls, results: []scriptedResult{{err: &ModelAPIError{StatusCode: 503, Transient: true, Err: errors.New("overloaded")}}}}
+	fallback := scriptedModelAPI{calls: &fallbackCalls, results: []scriptedResult{{content: "ok"}}}
+	chain, err := NewModelChain(ModelBackend{Name: "a", API: primary}, ModelBackend{Name: "b", API: fallback})
+	if err != nil {
+		t.Fatalf("NewModelChain() error = %v", err)
+	}
+
+	res, err := chain.Prompt(context.Background(), "system", "prompt")
+	if err != nil {
+		t.Fatalf("Prompt() error = %v", err)
+	}
+	if res.Backend != "b" || primaryCalls != 1 || fallbackCalls != 1 {
+		t.Fatalf("Prompt() answered by %q after %d/%d calls, expected fallback after one call each", res.Backend, primaryCalls, fallbackCalls)
+	}
+
+	// Switching the default skips the failing model
+	if err := chain.SetDefault("b"); err != nil {
+		t.Fatalf("SetDefault() error = %v", err)
+	}
+	if res, err := chain.Prompt(context.Background(), "system", "prompt"); err != nil || res.Backend != "b" || primaryCalls != 1 {
+		t.Fatalf("Prompt() with default b = %v, %v after %d primary calls", res, err, primaryCalls)
+	}
+	if err := chain.SetDefault("c"); !errors.Is(err, ErrUnknownModel) || chain.Default() != "b" {
+		t.Fatalf("SetDefault(unknown) = %v, default %q", err, chain.Default())
+	}
+}
+
+func TestModelChainAllFail(t *testing.T) {
+	failing := func(err error) scriptedModelAPI {
+		return scriptedModelAPI{calls: new(int), results: []scriptedResult{{err: err}}}
+	}
+	badRequest := &ModelAPIError{StatusCode: 400, Err: errors.New("bad request")}
+	rateLimited := &ModelAPIError{StatusCode: 429, Transient: true, RetryAfter: time.Minute, Err: errors.New("slow down")}
+	busy := &ModelAPIError{StatusCode: 429, Transient: true, RetryAfter: 10 * time.Second, Err: errors.New("busy")}
+
+	tests := []struct {
+		name       string
+		errs       []error
+		permanent  bool
+		retryAfter time.Duration
+	}{
+		{"AllPermanent", []error{badRequest, badRequest}, true, 0},
+		{"AnyTransient", []error{badRequest, rateLimited}, false, time.Minute},
+		{"ShortestRetryAfter", []error{rateLimited, busy}, false, 10 * time.Second},
+		{"UnclassifiedIsTransient", []error{rateLimited, errors.New("boom")}, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backends []ModelBackend
+			for i, err := range tt.errs {
+				backends = append(backends, ModelBackend{Name: string(rune('a' + i)), API: failing(err)})
+			}
+			chain, err := NewModelChain(backends...)
+			if err != nil {
+				t.Fatalf("NewModelChain() error = %v", err)
+			}
+
+			_, err = chain.Prompt(context.Background(), "system", "prompt")
+			var apiErr *ModelAPIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("Prompt() error = %v, expected a ModelAPIError", err)
+			}
+			if IsPermanent(err) != tt.permanent || apiErr.RetryAfter != tt.retryAfter {
+				t.Fatalf("Prompt() error = %v, permanent %v, retry after %v", err, IsPermanent(err), apiErr.RetryAfter)
+			}
+		})
+	}
+
+	// A single model's error is passed through unchanged
+	chain, _ := NewModelChain(ModelBackend{Name: "only", API: failing(badRequest)})
+	if _, err := chain.Prompt(context.Background(), "system", "prompt"); err != badRequest {
+		t.Fatalf("Prompt() with one model error = %v, expected %v", err, badRequest)
+	}
+}
+
+func TestParseModelChain(t *testing.T) {
+	chain, err := ParseModelChain(" openrouter:x-ai/grok-4-fast, local:llama3.1 ,", "key", DefaultLocalModelEndpoint)
+	if err != nil {
+		t.Fatalf("ParseModelChain() error = %v", err)
+	}
+	if models := chain.Models(); len(models) != 2 || models[0] != "openrouter:x-ai/grok-4-fast" || models[1] != "local:llama3.1" {
+		t.Fatalf("Models() = %v", models)
+	}
+	if chain.Default() != "openrouter:x-ai/grok-4-fast" {
+		t.Fatalf("Default() = %q, expected the first model", chain.Default())
+	}
+
+	for _, spec := range []string{"", "grok", "openai:gpt", "local:", "local:a,local:a"} {
+		if _, err := ParseModelChain(spec, "key", DefaultLocalModelEndpoint); err == nil {
+			t.Errorf("ParseModelChain(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestModelChainLoadDefault(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	chain, _ := NewModelChain(ModelBackend{Name: "a", API: stubModelAPI{}}, ModelBackend{Name: "b", API: stubModelAPI{}})
+	if err := chain.LoadDefault(db); err != nil || chain.Default() != "a" {
+		t.Fatalf("LoadDefault() without setting = %v, default %q", err, chain.Default())
+	}
+
+	if _, err := db.Exec("INSERT INTO app_settings (key, value) VALUES (?, 'b')", defaultModelSetting); err != nil {
+		t.Fatalf("inserting setting: %v", err)
+	}
+	if err := chain.LoadDefault(db); err != nil || chain.Default() != "b" {
+		t.Fatalf("LoadDefault() = %v, default %q, expected b", err, chain.Default())
+	}
+
+	// A model removed from the configuration is ignored
+	if _, err := db.Exec("UPDATE app_settings SET value = 'gone' WHERE key = ?", defaultModelSetting); err != nil {
+		t.Fatalf("updating setting: %v", err)
+	}
+	other, _ := NewModelChain(ModelBackend{Name: "a", API: stubModelAPI{}})
+	if err := other.LoadDefault(db); err != nil || other.Default() != "a" {
+		t.Fatalf("LoadDefault() with unknown model = %v, default %q", err, other.Default())
+	}
+}
+
+func TestProcessJobRecordsModel(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	down := scriptedModelAPI{calls: new(int), results: []scriptedResult{{err: &ModelAPIError{StatusCode: 500, Transient: true, Err: errors.New("down")}}}}
+	up := stubModelAPI{content: `{"ambiguity_flag": "", "spendings": [
+		{"apportion_mode": "alone", "category": "Groceries", "amount": 12, "description": "Snacks"}
+	]}`}
+	chain, _ := NewModelChain(ModelBackend{Name: "primary", API: down}, ModelBackend{Name: "fallback", API: up})
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), chain)
+	jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "snacks", 12, "pending", false)
+
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	job, err = pool.GetStatus(jobID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if job.Status != jobStatusCompleted || job.Result == nil || job.Result.Model != "fallback" {
+		t.Fatalf("after processing job = %+v, expected completed by the fallback model", job)
+	}
+}
@@ -1,25 +1,72 @@
 package category
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	mathrand "math/rand/v2"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"time" // Added time import
+
+	"git.sr.ht/~relay/sapp-backend/attachment"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// Job statuses stored in ai_categorization_jobs.status.
+const (
+	jobStatusPending    = "pending"     // Waiting for a worker, possibly until next_attempt_at
+	jobStatusProcessing = "processing"  // Leased by a worker
+	jobStatusCompleted  = "completed"   // Spendings created
+	jobStatusFailed     = "failed"      // Legacy terminal failure, from before attempts were tracked
+	jobStatusDeadLetter = "dead_letter" // Gave up after PoolConfig.MaxAttempts attempts
 )
 
+// errLeaseLost is returned when a worker's lease on a job expired and another worker took it over.
+var errLeaseLost = errors.New("job lease lost to another worker")
+
+// ErrUnknownCategory is returned when storing a spending in a category that does not exist.
+var ErrUnknownCategory = errors.New("unknown category")
+
+// ErrPartlySettled is returned when replacing the spendings of a job of which only some were settled.
+var ErrPartlySettled = errors.New("job's spendings are partly settled")
+
+// ErrJobNotFailed is returned when retrying a job that has not failed.
+var ErrJobNotFailed = errors.New("job has not failed")
+
+// ErrJobNotCompleted is returned when recategorizing a job that has not completed.
+var ErrJobNotCompleted = errors.New("job is not completed")
+
+// ErrProviderPaused is returned by Preview while the circuit breaker pauses the pool.
+var ErrProviderPaused = errors.New("model provider is paused after repeated failures")
+
 // SharedMode removed from Job struct
 type Job struct {
-	Id              int64 `json:"id"`
-	TotalAmount     float64
-	Status          string     `json:"status"`
-	IsFinished      bool       `json:"isFinished"`
-	Prompt          string     `json:"prompt"`
-	Buyer           int64      `json:"buyer_id"`
-	SharedWithId    *int64     `json:"other_id"`
-	PreSettled      bool       `json:"pre_settled"`      // Added: Pre-settled flag from the job table
-	Result          *JobResult `json:"result"`           // Removed duplicate Result field
-	TransactionDate *time.Time `json:"transaction_date"` // Renamed from SpendingDate to match DB schema
+	Id               int64 `json:"id"`
+	TotalAmount      money.Amount
+	Status           string     `json:"status"`
+	IsFinished       bool       `json:"isFinished"`
+	Prompt           string     `json:"prompt"`
+	Buyer            int64      `json:"buyer_id"`
+	SharedWithId     *int64     `json:"other_id"`
+	PreSettled       bool       `json:"pre_settled"`      // Added: Pre-settled flag from the job table
+	Result           *JobResult `json:"result"`           // Removed duplicate Result field
+	TransactionDate  *time.Time `json:"transaction_date"` // Renamed from SpendingDate to match DB schema
+	Attempts         int        `json:"attempts"`         // Processing attempts started so far
+	LocalDate        string     `json:"local_date"`       // Set if the transaction date is to be found in the prompt, see CategorizationParams
+	ReceiptSHA256    string     `json:"-"`                // Hash of the receipt photo in PoolConfig.Receipts, if any
+	ReceiptMediaType string     `json:"-"`
+	Currency         string     `json:"currency,omitempty"` // ISO 4217 code of the amounts if not the household's, see CategorizationParams
 }
 
 type CategorizingPoolStrategy interface {
@@ -28,28 +75,152 @@ type CategorizingPoolStrategy interface {
 	StartPool()
 	GetStatus(int64) (Job, error)
 	RequeueBackfillJobs() (int, error)
+	// AddBatch splits a message describing several purchases into one job per purchase.
+	AddBatch(ctx context.Context, params CategorizationParams, transactionDate *time.Time) (int64, error)
+	// AddReceiptJob adds a job categorizing the photo of a receipt, which is stored with it.
+	AddReceiptJob(params CategorizationParams, transactionDate *time.Time, receipt Image) (int64, error)
+	// Receipt returns the receipt photo of a job, ErrNoReceipt if it has none.
+	Receipt(jobID int64) (Image, error)
+	// RemoveReceipts removes the receipt photos of deleted jobs, by their receipt_sha256.
+	RemoveReceipts(hashes []string)
+	// Preview categorizes without storing anything, see HandlePreviewCategorization.
+	Preview(ctx context.Context, params CategorizationParams) (JobResult, error)
+	// AddCompletedJob stores a categorization that was already made, e.g. a confirmed preview.
+	AddCompletedJob(params CategorizationParams, transactionDate *time.Time, result JobResult) (int64, error)
+	// ResolveReview clears the ambiguity flag of a job, applying the user's edit unless nil.
+	ResolveReview(jobID int64, edit *ReviewEdit) error
+	// Clarify re-queues a flagged job with the user's answer to the model's question.
+	Clarify(jobID int64, clarification string) error
+	// RetryJob queues a failed job again with a fresh set of attempts.
+	RetryJob(jobID int64) error
+	// Recategorize queues a completed job to be categorized again, replacing its spendings.
+	Recategorize(jobID int64) error
+	Events() *JobEventBroker
+	// Shutdown stops the workers, waiting for in-flight jobs until ctx ends.
+	Shutdown(ctx context.Context) error
 }
 
+// PoolConfig controls the concurrency, leasing and retries of a CategorizingPool.
+type PoolConfig struct {
+	Workers           int                   // Number of jobs processed concurrently
+	MaxAttempts       int                   // Attempts before a job is moved to the dead-letter status
+	LeaseDuration     time.Duration         // How long a job stays leased to a worker without a heartbeat
+	HeartbeatInterval time.Duration         // How often a worker renews the lease of its job
+	PollInterval      time.Duration         // How often idle workers look for jobs that became due
+	BaseBackoff       time.Duration         // Delay before the first retry, doubled for every further attempt
+	MaxBackoff        time.Duration         // Upper bound for the retry delay
+	BreakerThreshold  int                   // Consecutive provider failures that pause the pool
+	BreakerCooldown   time.Duration         // How long the pool pauses before probing the provider again
+	ModelPrices       map[string]ModelPrice // Prices for computing the cost of models that do not report it
+	PreviewTimeout    time.Duration         // How long a synchronous preview may take, see Preview
+	Receipts          *attachment.Store     // Where receipt photos are stored; uploads are disabled if nil
+}
+
+// DefaultPoolConfig returns the configuration used unless overridden, with one worker per CPU.
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		Workers:           max(runtime.NumCPU(), 1),
+		MaxAttempts:       5,
+		LeaseDuration:     2 * time.Minute,
+		HeartbeatInterval: 30 * time.Second,
+		PollInterval:      5 * time.Second,
+		BaseBackoff:       10 * time.Second,
+		MaxBackoff:        10 * time.Minute,
+		BreakerThreshold:  5,
+		BreakerCooldown:   time.Minute,
+		PreviewTimeout:    45 * time.Second,
+	}
+}
+
+// CategorizingPool processes AI categorization jobs. The ai_categorization_jobs table is the
+// queue of record: workers lease due jobs from it, so jobs survive restarts and crashes.
 type CategorizingPool struct {
-	db            *sql.DB
-	numWorkers    int
-	unhandledJobs chan Job
-	api           ModelAPI
+	db       *sql.DB
+	config   PoolConfig
+	api      ModelAPI
+	events   *JobEventBroker // Job state changes, for the SSE stream
+	wakeup   chan struct{}   // Signals idle workers that a job was added
+	instance string          // Identifies this process in lease_owner
+	breaker  *circuitBreaker // Pauses workers while the model provider is down
+
+	// Lifecycle, see Shutdown
+	stopping   chan struct{}      // Closed when shutting down; workers exit after their current job
+	stopOnce   *sync.Once         // Guards closing stopping
+	workers    *sync.WaitGroup    // Running workers
+	jobCtx     context.Context    // Passed to model calls
+	cancelJobs context.CancelFunc // Cancels jobCtx when the shutdown deadline is reached
 }
 
-// NewCategorizingPool now accepts a ModelAPI implementation.
-func NewCategorizingPool(db *sql.DB, numWorkers int, api ModelAPI) CategorizingPool {
+// NewCategorizingPool creates a pool processing jobs with the given ModelAPI implementation.
+func NewCategorizingPool(db *sql.DB, config PoolConfig, api ModelAPI) CategorizingPool {
+	defaults := DefaultPoolConfig()
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.MaxAttempts < 1 {
+		config.MaxAttempts = defaults.MaxAttempts
+	}
+	if config.LeaseDuration <= 0 {
+		config.LeaseDuration = defaults.LeaseDuration
+	}
+	if config.HeartbeatInterval <= 0 || config.HeartbeatInterval >= config.LeaseDuration {
+		config.HeartbeatInterval = config.LeaseDuration / 4
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaults.PollInterval
+	}
+	if config.BaseBackoff <= 0 {
+		config.BaseBackoff = defaults.BaseBackoff
+	}
+	if config.MaxBackoff < config.BaseBackoff {
+		config.MaxBackoff = config.BaseBackoff
+	}
+	if config.BreakerThreshold < 1 {
+		config.BreakerThreshold = defaults.BreakerThreshold
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = defaults.BreakerCooldown
+	}
+	if config.PreviewTimeout <= 0 {
+		config.PreviewTimeout = defaults.PreviewTimeout
+	}
+
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
 	return CategorizingPool{
-		db:            db,
-		numWorkers:    numWorkers,
-		unhandledJobs: make(chan Job, 100),
-		api:           api, // Store the provided API
+		db:         db,
+		config:     config,
+		api:        api, // Store the provided API
+		events:     NewJobEventBroker(),
+		wakeup:     make(chan struct{}, 1),
+		instance:   newInstanceID(),
+		breaker:    newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		stopping:   make(chan struct{}),
+		stopOnce:   &sync.Once{},
+		workers:    &sync.WaitGroup{},
+		jobCtx:     jobCtx,
+		cancelJobs: cancelJobs,
 	}
 }
 
+// newInstanceID returns an ID that distinguishes this process from others and from earlier runs.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Events returns the broker that job state changes are published to.
+func (p *CategorizingPool) Events() *JobEventBroker {
+	return p.events
+}
+
 // AddJob adds a new categorization job to the queue.
 // It inserts the job details (including optional transaction date) into the database
-// and sends the job details to the channel for processing.
+// and wakes an idle worker. It never waits for a worker to become available.
 func (p *CategorizingPool) AddJob(params CategorizationParams, transactionDate *time.Time) (int64, error) {
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -57,6 +228,24 @@ func (p *CategorizingPool) AddJob(params CategorizationParams, transactionDate *
 	}
 	defer tx.Rollback()
 
+	jobId, err := insertJob(tx, params, transactionDate, sql.NullInt64{})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	p.publishJobEvent(jobId)
+	p.wake()
+	slog.Debug("Job queued", "job_id", jobId)
+
+	return jobId, nil
+}
+
+// insertJob inserts a pending job, optionally as part of a batch.
+func insertJob(tx *sql.Tx, params CategorizationParams, transactionDate *time.Time, batchID sql.NullInt64) (int64, error) {
 	var otherPersonInt *int64 = nil
 
 	if params.SharedWith != nil {
@@ -69,9 +258,15 @@ func (p *CategorizingPool) AddJob(params CategorizationParams, transactionDate *
 		dateToInsert = *transactionDate
 	}
 
-	// Store pre_settled flag and transaction_date in the job record
-	result, err := tx.Exec(`INSERT INTO ai_categorization_jobs (buyer, shared_with, prompt, total_amount, pre_settled, transaction_date, status)
-	VALUES (?, ?, ?, ?, ?, ?, ?)`, params.Buyer.Id, otherPersonInt, params.Prompt, params.TotalAmount, params.PreSettled, dateToInsert, "pending")
+	// Store pre_settled flag and transaction_date in the job record. Without a date, the local date
+	// is kept for the model to find the date in the prompt; until then, the job is dated now.
+	var localDate sql.NullString
+	if transactionDate == nil && params.LocalDate != "" {
+		localDate = sql.NullString{String: params.LocalDate, Valid: true}
+	}
+	result, err := tx.Exec(`INSERT INTO ai_categorization_jobs (buyer, shared_with, prompt, total_amount, pre_settled, transaction_date, status, local_date, batch_id, currency)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, params.Buyer.Id, otherPersonInt, params.Prompt, params.TotalAmount, params.PreSettled, dateToInsert, jobStatusPending, localDate, batchID,
+		sql.NullString{String: params.Currency, Valid: params.Currency != ""})
 	if err != nil {
 		// Log the date that was attempted
 		slog.Error("error inserting ai categorization job", "error", err, "pre_settled", params.PreSettled, "transaction_date_attempted", dateToInsert)
@@ -83,371 +278,803 @@ func (p *CategorizingPool) AddJob(params CategorizationParams, transactionDate *
 		slog.Error("error getting ai categorization job ID", "error", err)
 		return 0, err
 	}
+	return jobId, nil
+}
+
+// Preview categorizes the purchase right away and returns the result without storing it, so
+// the user can review the split before anything is written. The model's usage is recorded, as
+// it counts against the household's quota. It fails fast while the circuit breaker is open.
+func (p *CategorizingPool) Preview(ctx context.Context, params CategorizationParams) (JobResult, error) {
+	if p.breaker.isOpen() {
+		return JobResult{}, ErrProviderPaused
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.config.PreviewTimeout)
+	defer cancel()
+
+	// JobID stays 0: there is no job, so no attempts are recorded
+	api := newUsageRecorder(p.db, p.api, p.config.ModelPrices, 0, params.Buyer.Id)
+	return ProcessCategorizationJob(ctx, p.db, api, params)
+}
+
+// AddCompletedJob stores a categorization made outside the queue, such as a confirmed preview,
+// as a completed job with its spendings. The result is validated like model output, and its
+// categories must exist (ErrUnknownCategory otherwise).
+func (p *CategorizingPool) AddCompletedJob(params CategorizationParams, transactionDate *time.Time, result JobResult) (int64, error) {
+	if err := validateResult(result, params); err != nil {
+		return 0, err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var otherPersonInt *int64
+	if params.SharedWith != nil {
+		otherPersonInt = &params.SharedWith.Id
+	}
+	dateToInsert := time.Now().UTC()
+	if transactionDate != nil {
+		dateToInsert = *transactionDate
+	}
+	var ambiguityReason sql.NullString
+	if result.AmbiguityFlagReason != "" {
+		ambiguityReason = sql.NullString{String: result.AmbiguityFlagReason, Valid: true}
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO ai_categorization_jobs (buyer, shared_with, prompt, total_amount, pre_settled, transaction_date, status,
+			is_finished, is_ambiguity_flagged, ambiguity_flag_reason, model, prompt_template, currency)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?, ?, ?, ?, ?)
+	`, params.Buyer.Id, otherPersonInt, params.Prompt, params.TotalAmount, params.PreSettled, dateToInsert, jobStatusCompleted,
+		ambiguityReason.Valid, ambiguityReason, sql.NullString{String: result.Model, Valid: result.Model != ""},
+		sql.NullString{String: result.PromptTemplate, Valid: result.PromptTemplate != ""},
+		sql.NullString{String: params.Currency, Valid: params.Currency != ""})
+	if err != nil {
+		return 0, fmt.Errorf("inserting completed job: %w", err)
+	}
+	jobID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("getting completed job ID: %w", err)
+	}
+
+	var settledAt sql.NullTime
+	if params.PreSettled {
+		settledAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+	if err := p.insertSpendings(tx, jobID, params.Buyer.Id, params.others(), result.Spendings, params.Currency, dateToInsert, settledAt); err != nil {
+		return 0, err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return 0, fmt.Errorf("failed to commit transaction: %w", err)
 	}
+	p.publishJobEvent(jobID)
+	return jobID, nil
+}
 
-	// Send job details to the worker channel (non-blocking send might be better if channel can fill)
-	// We pass the full job details needed by the worker.
-	// Create the Job struct to send to the worker channel
-	job := Job{
-		Id: jobId,
-		// Populate other fields from params as needed by the worker
-		TotalAmount:     params.TotalAmount,
-		Prompt:          params.Prompt,
-		Buyer:           params.Buyer.Id,
-		SharedWithId:    otherPersonInt,
-		PreSettled:      params.PreSettled,
-		TransactionDate: transactionDate, // Pass the parsed transaction date (or nil)
-		Status:          "pending",
-		// Result is initially nil
-	}
-	// Consider adding a timeout or select with a default case for non-blocking send
-	p.unhandledJobs <- job
-	slog.Debug("Job sent to worker channel", "job_id", jobId)
-
-	return jobId, nil
+// wake signals one idle worker to look for jobs. Workers also poll, so a missed signal only delays a job.
+func (p *CategorizingPool) wake() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
 }
 
 // StartPool launches the worker goroutines.
 func (p *CategorizingPool) StartPool() {
-	for i := 1; i <= p.numWorkers; i++ {
+	for i := 1; i <= p.config.Workers; i++ {
+		p.workers.Add(1)
 		go p.worker(i)
 	}
-	slog.Info("Categorization pool workers started", "count", p.numWorkers)
+	slog.Info("Categorization pool workers started", "count", p.config.Workers, "instance", p.instance)
 }
 
-// RequeueBackfillJobs finds AI jobs that never produced categorized spendings
-// and puts them back on the worker queue.
+// Shutdown stops the workers from taking new jobs and waits for them to finish their current one.
+// If ctx ends first, in-flight model calls are cancelled and their jobs released back to the queue
+// without counting the attempt; Shutdown then waits for the workers to return and reports ctx's error.
+func (p *CategorizingPool) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stopping) })
+
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancelJobs()
+		slog.Info("Categorization pool stopped")
+		return nil
+	case <-ctx.Done():
+		slog.Warn("Categorization pool shutdown deadline reached, cancelling in-flight jobs")
+		p.cancelJobs()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// RequeueBackfillJobs makes legacy 'queued' and 'failed' AI jobs that never produced categorized
+// spendings due immediately, with a fresh set of attempts. Pending jobs keep their attempts and
+// backoff, and expired leases are taken over by claimJob, so a job that keeps failing is still
+// dead-lettered across restarts. Dead-lettered jobs are left alone.
 func (p *CategorizingPool) RequeueBackfillJobs() (int, error) {
 	rows, err := p.db.Query(`
-		SELECT j.id, j.prompt, j.buyer, j.shared_with, j.total_amount, j.pre_settled, j.transaction_date
-		FROM ai_categorization_jobs j
-		LEFT JOIN ai_categorized_spendings acs ON acs.job_id = j.id
-		WHERE acs.job_id IS NULL
-		  AND j.status IN ('queued', 'pending', 'processing', 'failed')
-		ORDER BY j.id ASC
-	`)
+		UPDATE ai_categorization_jobs
+		SET status = ?, is_finished = 0, error_message = NULL, attempts = 0, next_attempt_at = NULL,
+			lease_owner = NULL, lease_expires_at = NULL, heartbeat_at = NULL, status_updated_at = CURRENT_TIMESTAMP
+		WHERE id NOT IN (SELECT job_id FROM ai_categorized_spendings)
+		  AND status IN ('queued', ?)
+		RETURNING id
+	`, jobStatusPending, jobStatusFailed)
 	if err != nil {
-		return 0, fmt.Errorf("querying uncategorized AI jobs: %w", err)
+		return 0, fmt.Errorf("resetting uncategorized AI jobs: %w", err)
 	}
 
-	var jobsToRequeue []Job
-	requeued := 0
+	var requeuedIDs []int64
 	for rows.Next() {
-		var job Job
-		var sharedWithID sql.NullInt64
-		var transactionDate sql.NullTime
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning requeued AI job: %w", err)
+		}
+		requeuedIDs = append(requeuedIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("iterating requeued AI jobs: %w", err)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, fmt.Errorf("closing requeued AI job rows: %w", err)
+	}
+
+	for _, id := range requeuedIDs {
+		p.publishJobEvent(id)
+	}
+	if len(requeuedIDs) > 0 {
+		p.wake()
+	}
+	return len(requeuedIDs), nil
+}
+
+// RetryJob makes a failed or dead-lettered job due immediately, with a fresh set of attempts.
+// Jobs waiting for a retry are made due as well; any other job gives ErrJobNotFailed.
+func (p *CategorizingPool) RetryJob(jobID int64) error {
+	res, err := p.db.Exec(`
+		UPDATE ai_categorization_jobs
+		SET status = ?, is_finished = 0, error_message = NULL, attempts = 0, next_attempt_at = NULL,
+			lease_owner = NULL, lease_expires_at = NULL, heartbeat_at = NULL, status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status IN ('queued', 'pending', 'failed', 'dead_letter')
+	`, jobStatusPending, jobID)
+	if err != nil {
+		return fmt.Errorf("resetting job for retry: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("resetting job for retry: %w", err)
+	} else if n == 0 {
+		return ErrJobNotFailed
+	}
+
+	p.publishJobEvent(jobID)
+	p.wake()
+	return nil
+}
+
+// Recategorize queues a completed job to be categorized again, e.g. after the categories'
+// notes were improved. The job keeps its spendings until the new ones replace them in the same
+// transaction that completes it, and their settlement carries over (see runJob), so jobs of
+// which only some spendings were settled give ErrPartlySettled. If categorizing fails, the
+// old spendings stay.
+func (p *CategorizingPool) Recategorize(jobID int64) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := jobSettlement(tx, jobID); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`
+		UPDATE ai_categorization_jobs
+		SET status = ?, is_finished = 0, is_ambiguity_flagged = 0, ambiguity_flag_reason = NULL, error_message = NULL,
+			attempts = 0, next_attempt_at = NULL, status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ?
+	`, jobStatusPending, jobID, jobStatusCompleted)
+	if err != nil {
+		return fmt.Errorf("resetting job for recategorization: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("resetting job for recategorization: %w", err)
+	} else if n == 0 {
+		return ErrJobNotCompleted
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	p.publishJobEvent(jobID)
+	p.wake()
+	return nil
+}
+
+// GetStatus returns the stored state of a job. For finished jobs, Result holds the
+// ambiguity flag and the spendings the job produced.
+func (p *CategorizingPool) GetStatus(id int64) (Job, error) {
+	var job Job
+	var sharedWithID sql.NullInt64
+	var transactionDate sql.NullTime
+	var isAmbiguous bool
+	var ambiguityReason, model, localDate, receiptSHA256, receiptMediaType, jobCurrency sql.NullString
+
+	err := p.db.QueryRow(`
+		SELECT id, status, is_finished, prompt, buyer, shared_with, total_amount, pre_settled, transaction_date,
+			is_ambiguity_flagged, ambiguity_flag_reason, attempts, model, local_date, receipt_sha256, receipt_media_type, currency
+		FROM ai_categorization_jobs WHERE id = ?
+	`, id).Scan(
+		&job.Id, &job.Status, &job.IsFinished, &job.Prompt, &job.Buyer, &sharedWithID, &job.TotalAmount, &job.PreSettled, &transactionDate,
+		&isAmbiguous, &ambiguityReason, &job.Attempts, &model, &localDate, &receiptSHA256, &receiptMediaType, &jobCurrency,
+	)
+	if err != nil {
+		return Job{}, err
+	}
+	if sharedWithID.Valid {
+		job.SharedWithId = &sharedWithID.Int64
+	}
+	if transactionDate.Valid {
+		job.TransactionDate = &transactionDate.Time
+	}
+	job.LocalDate = localDate.String
+	job.ReceiptSHA256, job.ReceiptMediaType = receiptSHA256.String, receiptMediaType.String
+	job.Currency = jobCurrency.String
 
-		if err := rows.Scan(&job.Id, &job.Prompt, &job.Buyer, &sharedWithID, &job.TotalAmount, &job.PreSettled, &transactionDate); err != nil {
-			return requeued, fmt.Errorf("scanning uncategorized AI job: %w", err)
+	if !job.IsFinished {
+		return job, nil
+	}
+
+	job.Result = &JobResult{
+		IsAmbiguityFlagged:  isAmbiguous,
+		AmbiguityFlagReason: ambiguityReason.String,
+		Spendings:           []Spendings{},
+		Model:               model.String,
+	}
+	// The amounts as the model gave them, in the job's currency
+	rows, err := p.db.Query(`
+		SELECT s.id, c.name, COALESCE(s.original_amount, s.amount), s.description
+		FROM spendings s
+		JOIN ai_categorized_spendings acs ON s.id = acs.spending_id
+		JOIN categories c ON s.category = c.id
+		WHERE acs.job_id = ?
+		ORDER BY s.id ASC
+	`, job.Id)
+	if err != nil {
+		return job, fmt.Errorf("querying spendings for job %d: %w", job.Id, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Spendings
+		if err := rows.Scan(&t.Id, &t.Category, &t.Amount, &t.Description); err != nil {
+			return job, fmt.Errorf("scanning spending for job %d: %w", job.Id, err)
 		}
+		job.Result.Spendings = append(job.Result.Spendings, t)
+	}
+	return job, rows.Err()
+}
 
-		job.Status = "pending"
-		if sharedWithID.Valid {
-			job.SharedWithId = &sharedWithID.Int64
+// worker is the main loop for a categorization worker goroutine. It leases due jobs
+// one at a time and waits for a wakeup or the poll interval when there are none.
+func (p *CategorizingPool) worker(id int) {
+	defer p.workers.Done()
+	owner := fmt.Sprintf("%s/%d", p.instance, id)
+	slog.Info("Starting worker", "worker_id", id, "lease_owner", owner)
+
+	poll := time.NewTicker(p.config.PollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-p.stopping:
+			slog.Info("Worker shutting down", "worker_id", id)
+			return
+		default:
 		}
-		if transactionDate.Valid {
-			job.TransactionDate = &transactionDate.Time
+
+		// Hold off while the model provider is down
+		if wait := p.breaker.wait(); wait > 0 {
+			select {
+			case <-p.stopping:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		job, ok, err := p.claimJob(owner)
+		if err != nil {
+			slog.Error("Worker failed to claim job", "worker_id", id, "err", err)
+		}
+		if ok {
+			p.processJob(id, owner, job)
+			continue // Look for the next job right away
+		}
+		p.breaker.release()
+
+		select {
+		case <-p.stopping:
+		case <-p.wakeup:
+		case <-poll.C:
 		}
-		jobsToRequeue = append(jobsToRequeue, job)
 	}
+}
 
-	if err := rows.Err(); err != nil {
-		return requeued, fmt.Errorf("iterating uncategorized AI jobs: %w", err)
+// claimJob leases the oldest due job to the owner and returns it. A job is due when it is
+// pending and its backoff has passed, or when it is processing but its lease has expired.
+// ok is false if no job is due.
+func (p *CategorizingPool) claimJob(owner string) (job Job, ok bool, err error) {
+	now := time.Now().UTC()
+	var jobID int64
+	err = p.db.QueryRow(`
+		UPDATE ai_categorization_jobs
+		SET status = ?, attempts = attempts + 1, lease_owner = ?, lease_expires_at = ?, heartbeat_at = ?,
+			status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM ai_categorization_jobs
+			WHERE (status IN ('queued', 'pending') AND (next_attempt_at IS NULL OR next_attempt_at <= ?))
+			   OR (status = 'processing' AND (lease_expires_at IS NULL OR lease_expires_at < ?))
+			ORDER BY id ASC
+			LIMIT 1
+		)
+		RETURNING id
+	`, jobStatusProcessing, owner, now.Add(p.config.LeaseDuration), now, now, now).Scan(&jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, false, nil
 	}
-	if err := rows.Close(); err != nil {
-		return requeued, fmt.Errorf("closing uncategorized AI job rows: %w", err)
+	if err != nil {
+		return Job{}, false, fmt.Errorf("leasing job: %w", err)
 	}
 
-	for _, job := range jobsToRequeue {
-		_, err := p.db.Exec(`
-			UPDATE ai_categorization_jobs
-			SET status = ?, is_finished = 0, error_message = NULL, status_updated_at = CURRENT_TIMESTAMP
-			WHERE id = ?
-		`, job.Status, job.Id)
-		if err != nil {
-			return requeued, fmt.Errorf("resetting AI job %d for backfill: %w", job.Id, err)
-		}
+	p.publishJobEvent(jobID)
+
+	job, err = p.GetStatus(jobID)
+	if err != nil {
+		// Leased but unreadable; the lease expires and the job is picked up again
+		return Job{}, false, fmt.Errorf("loading leased job %d: %w", jobID, err)
+	}
+	return job, true, nil
+}
+
+// processJob runs one attempt of a leased job, renewing the lease until it is done,
+// and records the outcome.
+func (p *CategorizingPool) processJob(workerID int, owner string, job Job) {
+	slog.Info("Worker picked up job", "worker_id", workerID, "job_id", job.Id, "attempt", job.Attempts)
 
-		p.unhandledJobs <- job
-		requeued++
+	done := make(chan struct{})
+	go p.heartbeat(owner, job.Id, done)
+
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.Error("Worker recovered from panic while processing job", "worker_id", workerID, "job_id", job.Id, "panic", r)
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		err = p.runJob(workerID, owner, job)
+	}()
+	close(done)
+	p.recordProviderOutcome(err)
+
+	switch {
+	case err == nil:
+		slog.Info("Worker finished processing job successfully", "worker_id", workerID, "job_id", job.Id)
+		p.publishJobEvent(job.Id)
+	case errors.Is(err, errLeaseLost):
+		slog.Warn("Worker lost lease on job, discarding result", "worker_id", workerID, "job_id", job.Id)
+	case p.jobCtx.Err() != nil:
+		slog.Info("Worker interrupted by shutdown, releasing job", "worker_id", workerID, "job_id", job.Id)
+		p.releaseJob(owner, job)
+	default:
+		slog.Error("Worker failed to process job", "worker_id", workerID, "job_id", job.Id, "attempt", job.Attempts, "err", err)
+		p.failAttempt(owner, job, err)
 	}
+}
 
-	return requeued, nil
+// recordProviderOutcome feeds the result of a job attempt to the circuit breaker.
+func (p *CategorizingPool) recordProviderOutcome(err error) {
+	var apiErr *ModelAPIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.Transient:
+		p.breaker.failure(apiErr.RetryAfter)
+	case err == nil, errors.Is(err, ErrInvalidModelOutput), errors.As(err, &apiErr):
+		p.breaker.success() // The provider answered, even if the answer was not usable
+	default:
+		p.breaker.release() // Failed before reaching the provider, or interrupted
+	}
 }
 
-func (p *CategorizingPool) GetStatus(id int64) (Job, error) {
-	var jobStatus Job
+// releaseJob hands a job the owner could not finish back to the queue. The interrupted attempt is
+// not counted, and the job is due immediately for the next worker (or this process after a restart).
+func (p *CategorizingPool) releaseJob(owner string, job Job) {
+	res, err := p.db.Exec(`
+		UPDATE ai_categorization_jobs
+		SET status = ?, attempts = MAX(attempts - 1, 0), next_attempt_at = NULL,
+			lease_owner = NULL, lease_expires_at = NULL, heartbeat_at = NULL, status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND lease_owner = ?
+	`, jobStatusPending, job.Id, owner)
+	if err != nil {
+		// The lease expires on its own, after which the job is picked up again
+		slog.Error("Failed to release job", "job_id", job.Id, "lease_owner", owner, "err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		p.publishJobEvent(job.Id)
+	}
+}
+
+// heartbeat renews the owner's lease on the job until done is closed.
+func (p *CategorizingPool) heartbeat(owner string, jobID int64, done <-chan struct{}) {
+	ticker := time.NewTicker(p.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			now := time.Now().UTC()
+			_, err := p.db.Exec(`UPDATE ai_categorization_jobs SET heartbeat_at = ?, lease_expires_at = ? WHERE id = ? AND lease_owner = ?`,
+				now, now.Add(p.config.LeaseDuration), jobID, owner)
+			if err != nil {
+				slog.Warn("Failed to renew job lease", "job_id", jobID, "lease_owner", owner, "err", err)
+			}
+		}
+	}
+}
+
+// failAttempt records a failed attempt. Transient failures are retried after a backoff (or the
+// provider's Retry-After, if longer) until the job has used up its attempts; permanent failures
+// are not retried. Either way, a job that is not retried is moved to the dead-letter status.
+// The error message is prefixed with "transient: " or "permanent: " accordingly.
+func (p *CategorizingPool) failAttempt(owner string, job Job, jobErr error) {
+	status := jobStatusPending
+	isFinished := false
+	var nextAttemptAt sql.NullTime
+	errMsg := "transient: " + jobErr.Error()
+	if IsPermanent(jobErr) {
+		errMsg = "permanent: " + jobErr.Error()
+		status = jobStatusDeadLetter
+		isFinished = true
+	} else if job.Attempts >= p.config.MaxAttempts {
+		status = jobStatusDeadLetter
+		isFinished = true
+	} else {
+		delay := backoff(job.Attempts, p.config.BaseBackoff, p.config.MaxBackoff)
+		var apiErr *ModelAPIError
+		if errors.As(jobErr, &apiErr) {
+			delay = max(delay, apiErr.RetryAfter)
+		}
+		nextAttemptAt = sql.NullTime{Time: time.Now().UTC().Add(delay), Valid: true}
+	}
 
-	// Use p.db directly as receiver is now a pointer
-	row := p.db.QueryRow("SELECT id, status, is_finished FROM ai_categorization_jobs WHERE id = ?", id)
+	res, err := p.db.Exec(`
+		UPDATE ai_categorization_jobs
+		SET status = ?, is_finished = ?, error_message = ?, next_attempt_at = ?,
+			lease_owner = NULL, lease_expires_at = NULL, heartbeat_at = NULL, status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND lease_owner = ?
+	`, status, isFinished, errMsg, nextAttemptAt, job.Id, owner)
+	if err != nil {
+		slog.Error("Failed to record failed job attempt", "job_id", job.Id, "new_status", status, "update_err", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		slog.Warn("Lease lost before failed attempt was recorded", "job_id", job.Id, "lease_owner", owner)
+		return
+	}
 
-	if err := row.Scan(&jobStatus.Id, &jobStatus.Status, &jobStatus.IsFinished); err != nil {
-		return jobStatus, err
+	if status == jobStatusDeadLetter {
+		slog.Error("Job moved to dead letter", "job_id", job.Id, "attempts", job.Attempts, "err", jobErr)
+	} else {
+		slog.Info("Job scheduled for retry", "job_id", job.Id, "attempts", job.Attempts, "next_attempt_at", nextAttemptAt.Time)
 	}
+	p.publishJobEvent(job.Id)
+}
 
-	if !jobStatus.IsFinished {
-		return jobStatus, nil
+// backoff returns the delay before retrying after the given number of attempts: base doubled
+// for every attempt after the first, capped at maxDelay, with jitter of up to half the delay
+// so jobs that failed together do not retry together.
+func backoff(attempts int, base, maxDelay time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
 	}
+	delay = min(delay, maxDelay)
+	half := delay / 2
+	return half + mathrand.N(half+1)
+}
 
-	// TODO: Populate JobResult more completely if needed by the GetStatus consumer.
-	// Currently, this function is not used by tested handlers.
-	// Fetch transaction_date as well if needed here.
-	// row := p.db.QueryRow("SELECT id, status, is_finished, transaction_date FROM ai_categorization_jobs WHERE id = ?", id)
-	// var sqlTransactionDate sql.NullTime
-	// ... scan &jobStatus.Id, &jobStatus.Status, &jobStatus.IsFinished, &sqlTransactionDate ...
-	// if sqlTransactionDate.Valid { jobStatus.TransactionDate = &sqlTransactionDate.Time }
+// runJob categorizes the job and stores the resulting spendings. The job is marked completed
+// in the same transaction, provided the owner still holds its lease, so spendings are never
+// created twice.
+func (p *CategorizingPool) runJob(id int, owner string, job Job) error {
+	paramsForProcessing, err := p.jobParams(job)
+	if err != nil {
+		return err
+	}
+	if job.ReceiptSHA256 != "" {
+		receipt, err := p.loadReceipt(job.ReceiptSHA256, job.ReceiptMediaType)
+		if err != nil {
+			return Permanent(err) // A lost receipt will not come back
+		}
+		paramsForProcessing.Receipt = &receipt
+	}
 
-	if !jobStatus.IsFinished {
-		return jobStatus, nil
+	// Pass the stored ModelAPI to ProcessCategorizationJob, recording the usage of every request
+	api := newUsageRecorder(p.db, p.api, p.config.ModelPrices, job.Id, job.Buyer)
+	jobResult, err := ProcessCategorizationJob(p.jobCtx, p.db, api, paramsForProcessing)
+	if err != nil {
+		return err
 	}
 
-	// Example of fetching associated spendings if needed (adapt query as necessary)
-	rows, err := p.db.Query(`SELECT s.id, s.amount, s.description -- Add other fields like category_name, spending_date if needed
-	FROM spendings s
-	INNER JOIN ai_categorized_spendings acs ON s.id = acs.spending_id
-	WHERE acs.job_id = ?`, jobStatus.Id)
+	// --- Insert Spendings into DB ---
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("db error: %w", err)
+	}
+	defer tx.Rollback()
 
+	// A recategorized job still has its earlier spendings. They are replaced, and their
+	// settlement carries over to the new ones; a partial settlement cannot be carried over.
+	settledAt, err := jobSettlement(tx, job.Id)
+	if errors.Is(err, ErrPartlySettled) {
+		return Permanent(err)
+	}
 	if err != nil {
-		return jobStatus, err
+		return err
+	}
+	if err := deleteJobSpendings(tx, job.Id); err != nil {
+		return err
 	}
 
-	for rows.Next() {
-		fmt.Println("one spending!")
-		t := Spendings{}
-		err := rows.Scan(&t.Id, &t.Amount, &t.Description)
+	// Otherwise determine settled_at based on job parameters
+	if !settledAt.Valid && job.PreSettled { // Use job.PreSettled from the Job struct
+		settledAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+
+	// Determine the transaction_date to use for all items in this job.
+	var transactionDateToUse time.Time
+	if job.TransactionDate != nil {
+		transactionDateToUse = *job.TransactionDate
+		slog.Debug("Worker using provided transaction date for job", "worker_id", id, "job_id", job.Id, "date", transactionDateToUse)
+	} else {
+		// transaction_date is NULL (or unreadable), fall back to the job creation time
+		err = tx.QueryRow("SELECT created_at FROM ai_categorization_jobs WHERE id = ?", job.Id).Scan(&transactionDateToUse)
 		if err != nil {
-			return jobStatus, err
+			slog.Error("Worker failed to query job creation time as fallback date, using current time", "worker_id", id, "job_id", job.Id, "err", err)
+			transactionDateToUse = time.Now().UTC() // Final fallback to now
+		} else {
+			slog.Debug("Worker using job creation date as transaction date", "worker_id", id, "job_id", job.Id, "date", transactionDateToUse)
+		}
+	}
+
+	// A date the model found in the prompt replaces the provisional one (validated when parsing)
+	if jobResult.TransactionDate != "" {
+		if extracted, err := time.Parse(dateLayout, jobResult.TransactionDate); err == nil {
+			transactionDateToUse = extracted
+		}
+	}
+
+	if err := p.insertSpendings(tx, job.Id, job.Buyer, paramsForProcessing.others(), jobResult.Spendings, job.Currency, transactionDateToUse, settledAt); err != nil {
+		if errors.Is(err, currency.ErrNoRate) {
+			// Rates are imported by hand, so waiting would only use up the attempts. The job is
+			// dead-lettered instead, and the user retries it once an admin has imported the rate.
+			return Permanent(fmt.Errorf("%w; retry the job once the rate is imported", err))
+		}
+		return err
+	}
+
+	// --- Finalize Job ---
+	// Mark the job completed and store the ambiguity flag/reason, along with the amount and date
+	// the model may have found, but only while we still hold the lease
+	var ambiguityReason sql.NullString
+	if jobResult.IsAmbiguityFlagged {
+		ambiguityReason = sql.NullString{String: jobResult.AmbiguityFlagReason, Valid: true}
+	}
+	res, err := tx.Exec(`
+		UPDATE ai_categorization_jobs
+		SET status = ?, is_finished = 1, error_message = NULL, is_ambiguity_flagged = ?, ambiguity_flag_reason = ?, model = ?,
+			prompt_template = ?, total_amount = ?, transaction_date = ?,
+			next_attempt_at = NULL, lease_owner = NULL, lease_expires_at = NULL, heartbeat_at = NULL,
+			status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND lease_owner = ?
+	`, jobStatusCompleted, jobResult.IsAmbiguityFlagged, ambiguityReason, sql.NullString{String: jobResult.Model, Valid: jobResult.Model != ""},
+		sql.NullString{String: jobResult.PromptTemplate, Valid: jobResult.PromptTemplate != ""}, jobResult.TotalAmount, transactionDateToUse, job.Id, owner)
+	if err != nil {
+		return fmt.Errorf("db error completing job: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("db error completing job: %w", err)
+	} else if n == 0 {
+		return errLeaseLost
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db commit error: %w", err)
+	}
+	return nil
+}
+
+// jobParams returns the parameters for categorizing a stored job.
+func (p *CategorizingPool) jobParams(job Job) (CategorizationParams, error) {
+	params := CategorizationParams{
+		TotalAmount: job.TotalAmount,
+		Buyer:       Person{Id: job.Buyer}, // Named by loadContext below
+		Prompt:      job.Prompt,
+		PreSettled:  job.PreSettled,
+		JobID:       job.Id,
+		Attempt:     job.Attempts,
+		LocalDate:   job.LocalDate,
+		Currency:    job.Currency,
+	}
+	if job.SharedWithId != nil {
+		params.SharedWith = &Person{Id: *job.SharedWithId}
+	}
+
+	// The household decides who a spending can be shared with
+	members, err := household.GetMembers(p.db, job.Buyer)
+	if err != nil {
+		return CategorizationParams{}, fmt.Errorf("db error fetching household: %w", err)
+	}
+	for _, m := range members {
+		if m.UserID != job.Buyer {
+			params.Household = append(params.Household, Person{Id: m.UserID, Name: m.FirstName})
 		}
-		jobStatus.Result.Spendings = append(jobStatus.Result.Spendings, t)
 	}
 
-	return jobStatus, nil
+	// The names are used throughout the prompt, so they are required here
+	if err := loadContext(p.db, &params); err != nil {
+		return CategorizationParams{}, fmt.Errorf("db error fetching AI context: %w", err)
+	}
+	return params, nil
 }
 
-// worker is the main loop for a categorization worker goroutine.
-func (p *CategorizingPool) worker(id int) {
-	slog.Info("Starting worker", "worker_id", id)
-	for job := range p.unhandledJobs {
-		slog.Info("Worker picked up job", "worker_id", id, "job_id", job.Id)
-		p.updateJobStatus(job.Id, "processing", nil) // Mark as processing
-
-		// --- Process Job ---
-		// Reconstruct CategorizationParams needed by ProcessCategorizationJob
-		// This assumes you have access to Buyer and SharedWith details if needed,
-		// or modify ProcessCategorizationJob to accept IDs/less info if sufficient.
-		// For now, let's assume ProcessCategorizationJob needs the full params.
-		// We might need to query user/partner names here based on IDs in the job struct
-		// if ProcessCategorizationJob requires them.
-		// Simplified: Assuming ProcessCategorizationJob is adapted or params are reconstructed.
-		// If ProcessCategorizationJob strictly needs the original params struct,
-		// we should pass it through the channel instead of individual fields.
-		// Let's assume for now ProcessCategorizationJob is flexible or adapted.
-		// We need to reconstruct the CategorizationParams for ProcessCategorizationJob
-		// This might require fetching user/partner names if the prompt generation needs them.
-		// Simplified example (assuming ProcessCategorizationJob adapted or names not needed):
-		paramsForProcessing := CategorizationParams{
-			TotalAmount: job.TotalAmount,
-			Buyer:       Person{Id: job.Buyer}, // Name might be missing here
-			// SharedWith needs reconstruction if ID exists
-			Prompt:     job.Prompt,
-			PreSettled: job.PreSettled,
-			// tries is handled internally
+// insertSpendings stores the spendings of a job, linked to it, with their shares among the
+// buyer and the other household members. Amounts in another currency (code, empty for the
+// household's) are converted with the rate of the transaction date; without one it fails with
+// currency.ErrNoRate.
+func (p *CategorizingPool) insertSpendings(tx *sql.Tx, jobID, buyer int64, others []Person, spendings []Spendings, code string, transactionDate time.Time, settledAt sql.NullTime) error {
+	// Pre-fetch category IDs needed for these spendings
+	categoryIDs, err := p.fetchCategoryIDs(tx, spendings)
+	if err != nil {
+		return fmt.Errorf("db error fetching categories: %w", err)
+	}
+
+	for _, spending := range spendings {
+		categoryID, ok := categoryIDs[spending.Category]
+		if !ok || categoryID == 0 { // Check if category was found and has a valid ID
+			return fmt.Errorf("%w '%s'", ErrUnknownCategory, spending.Category)
 		}
-		if job.SharedWithId != nil {
-			// Potentially fetch partner name here if needed by getPrompt
-			paramsForProcessing.SharedWith = &Person{Id: *job.SharedWithId} // Name might be missing
+
+		// 1. Insert into spendings
+		spendingDesc := spending.Description
+		if spendingDesc == "" {
+			spendingDesc = "AI Categorized" // Default description
+		}
+		amount, err := currency.ToBase(tx, buyer, spending.Amount, code, transactionDate)
+		if err != nil {
+			return fmt.Errorf("converting spending amount: %w", err)
+		}
+		res, err := tx.Exec(`INSERT INTO spendings (amount, description, category, made_by, spending_date, original_amount, currency)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			amount.Amount, spendingDesc, categoryID, buyer, transactionDate, amount.Original, amount.Currency)
+		if err != nil {
+			return fmt.Errorf("db error inserting spending: %w", err)
 		}
 
-		// Pass the stored ModelAPI to ProcessCategorizationJob
-		jobResult, err := ProcessCategorizationJob(p.db, p.api, paramsForProcessing)
+		spendingID, err := res.LastInsertId()
 		if err != nil {
-			slog.Error("Worker failed to process job", "worker_id", id, "job_id", job.Id, "err", err)
-			p.updateJobStatus(job.Id, "failed", err) // Update status with error
-			continue                                 // Move to the next job
+			return fmt.Errorf("db error getting spending ID: %w", err)
 		}
 
-		// --- Insert Spendings into DB ---
-		tx, err := p.db.Begin()
+		// 2. Insert into ai_categorized_spendings
+		if _, err := tx.Exec(`INSERT INTO ai_categorized_spendings (job_id, spending_id) VALUES (?, ?)`, jobID, spendingID); err != nil {
+			return fmt.Errorf("db error inserting categorized spending link: %w", err)
+		}
+
+		// 3. Insert into user_spendings, then record who bears the cost
+		participants, err := participantsFor(spending, buyer, others)
 		if err != nil {
-			slog.Error("worker failed to begin transaction", "worker_id", id, "job_id", job.Id, "err", err)
-			p.updateJobStatus(job.Id, "failed", fmt.Errorf("db error: %w", err))
-			continue
+			// This should have been caught during validation, but handle defensively
+			return err
 		}
-		// Use defer with a named return to handle rollback correctly on errors inside the loop
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					tx.Rollback()
-					slog.Error("Worker recovered from panic during transaction", "worker_id", id, "job_id", job.Id, "panic", r)
-					p.updateJobStatus(job.Id, "failed", fmt.Errorf("panic: %v", r))
-				} else if err != nil {
-					tx.Rollback() // Rollback if any error occurred before commit
-					slog.Error("Worker rolling back transaction due to error", "worker_id", id, "job_id", job.Id, "err", err)
-					// Status already updated where error occurred
-				}
-			}()
-
-			// Determine settled_at based on job parameters
-			var settledAt sql.NullTime
-			if job.PreSettled { // Use job.PreSettled from the Job struct
-				settledAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
-			}
 
-			// Determine the transaction_date to use for all items in this job.
-			var transactionDateToUse time.Time
-			if job.TransactionDate != nil {
-				transactionDateToUse = *job.TransactionDate
-				slog.Debug("Worker using provided transaction date for job", "worker_id", id, "job_id", job.Id, "date", transactionDateToUse)
-			} else {
-				// Fetch job creation time as fallback if specific date wasn't provided
-				// Note: The DB column is transaction_date, but we might still want creation_date as fallback?
-				// Let's try fetching transaction_date first, then created_at.
-				var dbTransactionDate sql.NullTime
-				err = tx.QueryRow("SELECT transaction_date FROM ai_categorization_jobs WHERE id = ?", job.Id).Scan(&dbTransactionDate)
-				if err == nil && dbTransactionDate.Valid {
-					transactionDateToUse = dbTransactionDate.Time
-					slog.Debug("Worker using job's transaction_date from DB", "worker_id", id, "job_id", job.Id, "date", transactionDateToUse)
-				} else {
-					// If transaction_date is NULL or query failed, fallback to created_at
-					slog.Warn("Worker could not get transaction_date from DB, falling back to created_at", "worker_id", id, "job_id", job.Id, "err", err)
-					err = tx.QueryRow("SELECT created_at FROM ai_categorization_jobs WHERE id = ?", job.Id).Scan(&transactionDateToUse)
-					if err != nil {
-						slog.Error("Worker failed to query job creation time as fallback date, using current time", "worker_id", id, "job_id", job.Id, "err", err)
-						transactionDateToUse = time.Now().UTC() // Final fallback to now
-						err = nil                               // Clear the error so we don't rollback unnecessarily
-					} else {
-						slog.Debug("Worker using job creation date as transaction date", "worker_id", id, "job_id", job.Id, "date", transactionDateToUse)
-					}
-				}
-			}
+		if _, err := tx.Exec(`INSERT INTO user_spendings (spending_id, buyer, shared_with, shared_user_takes_all, settled_at)
+		VALUES (?, ?, NULL, 0, ?)`,
+			spendingID, buyer, settledAt); err != nil {
+			return fmt.Errorf("db error inserting user_spending: %w", err)
+		}
 
-			// Pre-fetch category IDs needed for this job
-			var categoryIDs map[string]int64
-			categoryIDs, err = p.fetchCategoryIDs(tx, jobResult.Spendings)
-			if err != nil {
-				slog.Error("worker failed to fetch category IDs", "worker_id", id, "job_id", job.Id, "err", err)
-				p.updateJobStatus(job.Id, "failed", fmt.Errorf("db error fetching categories: %w", err))
-				return // Error will trigger rollback
-			}
+		if err := household.SetShares(tx, spendingID, buyer, participants); err != nil {
+			return fmt.Errorf("db error inserting spending shares: %w", err)
+		}
+		if err := ledger.RecordSpending(tx, spendingID); err != nil {
+			return fmt.Errorf("db error recording spending in the ledger: %w", err)
+		}
 
-			for _, spending := range jobResult.Spendings {
-				var categoryID int64
-				var ok bool
-				categoryID, ok = categoryIDs[spending.Category]
-				if !ok || categoryID == 0 { // Check if category was found and has a valid ID
-					err = fmt.Errorf("category '%s' not found or invalid", spending.Category)
-					slog.Error("worker category validation failed", "worker_id", id, "job_id", job.Id, "category", spending.Category, "err", err)
-					p.updateJobStatus(job.Id, "failed", err)
-					return // Error will trigger rollback
-				}
-
-				// 1. Insert into spendings
-				spendingDesc := spending.Description
-				if spendingDesc == "" {
-					spendingDesc = "AI Categorized" // Default description
-				}
-				var res sql.Result
-				// Use transactionDateToUse for the spending_date column in spendings table
-				res, err = tx.Exec(`INSERT INTO spendings (amount, description, category, made_by, spending_date)
-				VALUES (?, ?, ?, ?, ?)`,
-					spending.Amount, spendingDesc, categoryID, job.Buyer, transactionDateToUse) // Use job.Buyer and determined transactionDateToUse
-				if err != nil {
-					slog.Error("worker failed to insert spending", "worker_id", id, "job_id", job.Id, "err", err)
-					p.updateJobStatus(job.Id, "failed", fmt.Errorf("db error inserting spending: %w", err))
-					return // Error will trigger rollback
-				}
-
-				var spendingID int64
-				spendingID, err = res.LastInsertId()
-				if err != nil {
-					slog.Error("worker failed to get last insert ID for spending", "worker_id", id, "job_id", job.Id, "err", err)
-					p.updateJobStatus(job.Id, "failed", fmt.Errorf("db error getting spending ID: %w", err))
-					return // Error will trigger rollback
-				}
-
-				// 2. Insert into ai_categorized_spendings
-				_, err = tx.Exec(`INSERT INTO ai_categorized_spendings (job_id, spending_id) VALUES (?, ?)`, job.Id, spendingID)
-				if err != nil {
-					slog.Error("worker failed to insert ai_categorized_spending", "worker_id", id, "job_id", job.Id, "spending_id", spendingID, "err", err)
-					p.updateJobStatus(job.Id, "failed", fmt.Errorf("db error inserting categorized spending link: %w", err))
-					return // Error will trigger rollback
-				}
-
-				// 3. Insert into user_spendings
-				var sharedWithID sql.NullInt64
-				sharedUserTakesAll := false
-
-				// Determine sharedWithID and sharedUserTakesAll based on spending.ApportionMode and job.SharedWithId
-				switch spending.ApportionMode {
-				case "alone":
-					sharedWithID = sql.NullInt64{Valid: false} // No partner involved for this item
-					sharedUserTakesAll = false
-				case "shared":
-					if job.SharedWithId != nil {
-						sharedWithID = sql.NullInt64{Int64: *job.SharedWithId, Valid: true} // Shared with the job's partner
-						sharedUserTakesAll = false
-					} else {
-						// Error: 'shared' mode requires a partner associated with the job
-						err = fmt.Errorf("logic error: spending mode 'shared' found but no partner associated with job %d", job.Id)
-						slog.Error("worker invalid spending mode for non-shared job", "worker_id", id, "job_id", job.Id, "mode", spending.ApportionMode, "err", err)
-						p.updateJobStatus(job.Id, "failed", err)
-						return // Error will trigger rollback
-					}
-				case "other":
-					if job.SharedWithId != nil {
-						sharedWithID = sql.NullInt64{Int64: *job.SharedWithId, Valid: true} // Involves the job's partner
-						sharedUserTakesAll = true                                           // Partner pays all for this item
-					} else {
-						// Error: 'other' mode requires a partner associated with the job
-						err = fmt.Errorf("logic error: spending mode 'other' found but no partner associated with job %d", job.Id)
-						slog.Error("worker invalid spending mode for non-shared job", "worker_id", id, "job_id", job.Id, "mode", spending.ApportionMode, "err", err)
-						p.updateJobStatus(job.Id, "failed", err)
-						return // Error will trigger rollback
-					}
-				default:
-					// This case should have been caught earlier by validation, but handle defensively
-					err = fmt.Errorf("internal error: unvalidated apportion_mode '%s' encountered during user_spendings insertion for job %d", spending.ApportionMode, job.Id)
-					slog.Error("worker unvalidated spending mode", "worker_id", id, "job_id", job.Id, "mode", spending.ApportionMode, "err", err)
-					p.updateJobStatus(job.Id, "failed", err)
-					return // Error will trigger rollback
-				}
-
-				// Insert with the correctly determined values
-				_, err = tx.Exec(`INSERT INTO user_spendings (spending_id, buyer, shared_with, shared_user_takes_all, settled_at)
-				VALUES (?, ?, ?, ?, ?)`,
-					spendingID, job.Buyer, sharedWithID, sharedUserTakesAll, settledAt)
-				if err != nil {
-					slog.Error("worker failed to insert user_spending", "worker_id", id, "job_id", job.Id, "spending_id", spendingID, "err", err)
-					p.updateJobStatus(job.Id, "failed", fmt.Errorf("db error inserting user_spending: %w", err))
-					return // Error will trigger rollback
-				}
-			} // End loop through spendings
-
-			// --- Finalize Job ---
-			// Commit transaction if no errors occurred within the loop
-			err = tx.Commit()
-			if err != nil {
-				slog.Error("worker failed to commit transaction", "worker_id", id, "job_id", job.Id, "err", err)
-				p.updateJobStatus(job.Id, "failed", fmt.Errorf("db commit error: %w", err))
-				// Rollback already deferred
-				return
-			}
+		// 4. The first spending takes over the attachments of the spendings it replaces
+		if _, err := tx.Exec("UPDATE attachments SET spending_id = ?, job_id = NULL WHERE job_id = ?", spendingID, jobID); err != nil {
+			return fmt.Errorf("db error moving attachments to new spending: %w", err)
+		}
+	} // End loop through spendings
+	return nil
+}
 
-			// Update job status to completed and store ambiguity flag/reason AFTER successful commit
-			finalStatus := "completed"
-			var ambiguityReason sql.NullString
-			if jobResult.IsAmbiguityFlagged {
-				ambiguityReason = sql.NullString{String: jobResult.AmbiguityFlagReason, Valid: true}
-			}
-			p.updateJobStatusAndAmbiguity(job.Id, finalStatus, nil, jobResult.IsAmbiguityFlagged, ambiguityReason) // Pass nil error on success
+// jobSettlement returns when the spendings of a job were settled: the latest settlement if all of
+// them are settled, or NULL if none are. Spendings settled separately, or of which only some
+// shares are settled, give ErrPartlySettled.
+func jobSettlement(tx *sql.Tx, jobID int64) (sql.NullTime, error) {
+	var settledAt sql.NullTime
+	var total, settled, sharesSettled int
+	err := tx.QueryRow(`
+		SELECT COUNT(*), COUNT(us.settled_at),
+			COALESCE(SUM(us.settled_at IS NULL AND EXISTS (
+				SELECT 1 FROM spending_shares ss WHERE ss.spending_id = us.spending_id AND ss.settled_at IS NOT NULL
+			)), 0)
+		FROM user_spendings us
+		JOIN ai_categorized_spendings acs ON acs.spending_id = us.spending_id
+		WHERE acs.job_id = ?
+	`, jobID).Scan(&total, &settled, &sharesSettled)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("db error checking settlement: %w", err)
+	}
+	if sharesSettled > 0 {
+		return sql.NullTime{}, ErrPartlySettled
+	}
+	if settled == 0 {
+		return settledAt, nil
+	}
+	if settled < total {
+		return sql.NullTime{}, ErrPartlySettled
+	}
+	err = tx.QueryRow(`
+		SELECT us.settled_at
+		FROM user_spendings us
+		JOIN ai_categorized_spendings acs ON acs.spending_id = us.spending_id
+		WHERE acs.job_id = ?
+		ORDER BY us.settled_at DESC
+		LIMIT 1
+	`, jobID).Scan(&settledAt)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("db error checking settlement: %w", err)
+	}
+	return settledAt, nil
+}
 
-			slog.Info("Worker finished processing job successfully", "worker_id", id, "job_id", job.Id)
-		}() // End of func literal for defer tx.Rollback()
+// deleteJobSpendings deletes the spendings of a job with their shares, links and ledger
+// entries. Their attachments are kept with the job until insertSpendings attaches them to the
+// new spendings.
+func deleteJobSpendings(tx *sql.Tx, jobID int64) error {
+	// ai_categorized_spendings goes last, the other statements find the spendings through it
+	jobSpendings := "SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?"
+	if _, err := tx.Exec("UPDATE attachments SET spending_id = NULL, job_id = ? WHERE spending_id IN ("+jobSpendings+")", jobID, jobID); err != nil {
+		return fmt.Errorf("db error keeping attachments of job %d: %w", jobID, err)
+	}
+	for _, query := range []string{
+		"DELETE FROM user_spendings WHERE spending_id IN (" + jobSpendings + ")",
+		"DELETE FROM spending_shares WHERE spending_id IN (" + jobSpendings + ")",
+		"DELETE FROM spendings WHERE id IN (" + jobSpendings + ")",
+		"DELETE FROM ai_categorized_spendings WHERE job_id = ?",
+	} {
+		if _, err := tx.Exec(query, jobID); err != nil {
+			return fmt.Errorf("db error removing spendings of job %d: %w", jobID, err)
+		}
 	}
-	slog.Info("Worker shutting down", "worker_id", id)
+	if err := ledger.Prune(tx); err != nil {
+		return fmt.Errorf("db error removing ledger entries of job %d: %w", jobID, err)
+	}
+	return nil
 }
 
 // fetchCategoryIDs pre-fetches category IDs for the given spending items within a transaction.
@@ -513,44 +1140,49 @@ func (p *CategorizingPool) fetchCategoryIDs(tx *sql.Tx, spendings []Spendings) (
 	return categoryIDs, nil
 }
 
-// updateJobStatus updates the status and error message of a job in the database.
-func (p *CategorizingPool) updateJobStatus(jobID int64, status string, jobErr error) {
-	var errMsg sql.NullString
-	isFinished := false
-	if status == "completed" || status == "failed" {
-		isFinished = true
-		if jobErr != nil {
-			errMsg = sql.NullString{String: jobErr.Error(), Valid: true}
+// JobStateFor maps a stored job status and ambiguity flag to the state reported to clients.
+func JobStateFor(status string, isAmbiguous bool) types.JobState {
+	switch status {
+	case jobStatusCompleted, "finished":
+		if isAmbiguous {
+			return types.JobStateFlagged
 		}
-	}
-
-	_, err := p.db.Exec(`UPDATE ai_categorization_jobs SET status = ?, error_message = ?, is_finished = ?, status_updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
-		status, errMsg, isFinished, jobID)
-	if err != nil {
-		slog.Error("Failed to update job status in database", "job_id", jobID, "new_status", status, "update_err", err)
-	} else {
-		slog.Debug("Updated job status in database", "job_id", jobID, "new_status", status, "is_finished", isFinished)
+		return types.JobStateFinished
+	case jobStatusFailed, jobStatusDeadLetter:
+		return types.JobStateFailed
+	case jobStatusProcessing:
+		return types.JobStateProcessing
+	default: // queued, pending
+		return types.JobStatePending
 	}
 }
 
-// updateJobStatusAndAmbiguity updates status, error, finished flag, and ambiguity details.
-func (p *CategorizingPool) updateJobStatusAndAmbiguity(jobID int64, status string, jobErr error, isAmbiguous bool, ambiguityReason sql.NullString) {
-	var errMsg sql.NullString
-	isFinished := false
-	if status == "completed" || status == "failed" {
-		isFinished = true
-		if jobErr != nil {
-			errMsg = sql.NullString{String: jobErr.Error(), Valid: true}
-		}
+// publishJobEvent reads the job's current state and publishes it to the buyer's household.
+func (p *CategorizingPool) publishJobEvent(jobID int64) {
+	if p.events == nil {
+		return
 	}
 
-	_, err := p.db.Exec(`UPDATE ai_categorization_jobs
-		SET status = ?, error_message = ?, is_finished = ?, is_ambiguity_flagged = ?, ambiguity_flag_reason = ?, status_updated_at = CURRENT_TIMESTAMP
-		WHERE id = ?`,
-		status, errMsg, isFinished, isAmbiguous, ambiguityReason, jobID)
+	var event types.JobEvent
+	var status string
+	var isAmbiguous bool
+	var errMsg sql.NullString
+	var updatedAt sql.NullTime
+	err := p.db.QueryRow(`
+		SELECT j.id, j.buyer, COALESCE(u.first_name, u.username), j.status, j.is_ambiguity_flagged, j.error_message, j.status_updated_at
+		FROM ai_categorization_jobs j
+		JOIN users u ON u.id = j.buyer
+		WHERE j.id = ?
+	`, jobID).Scan(&event.JobID, &event.BuyerID, &event.BuyerName, &status, &isAmbiguous, &errMsg, &updatedAt)
 	if err != nil {
-		slog.Error("Failed to update job status and ambiguity in database", "job_id", jobID, "new_status", status, "update_err", err)
-	} else {
-		slog.Debug("Updated job status and ambiguity in database", "job_id", jobID, "new_status", status, "is_finished", isFinished, "is_ambiguous", isAmbiguous)
+		slog.Error("Failed to load job for event", "job_id", jobID, "err", err)
+		return
 	}
+	event.State = JobStateFor(status, isAmbiguous)
+	if errMsg.Valid {
+		event.ErrorMessage = &errMsg.String
+	}
+	event.UpdatedAt = updatedAt.Time
+
+	p.events.Publish(HouseholdKey(p.db, event.BuyerID), event)
 }
@@ -1,9 +1,16 @@
 package category
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
 
 	_ "modernc.org/sqlite"
 )
@@ -12,21 +19,18 @@ func TestRequeueBackfillJobs(t *testing.T) {
 	db := setupPoolTestDB(t)
 	defer db.Close()
 
-	var buyerID int64
-	if err := db.QueryRow("SELECT id FROM users WHERE username = 'demo_user'").Scan(&buyerID); err != nil {
-		t.Fatalf("querying buyer ID: %v", err)
-	}
-
-	var partnerID int64
-	if err := db.QueryRow("SELECT id FROM users WHERE username = 'partner_user'").Scan(&partnerID); err != nil {
-		t.Fatalf("querying partner ID: %v", err)
-	}
-
-	pool := NewCategorizingPool(db, 1, OpenRouterAPI{})
+	buyerID, partnerID := poolTestUsers(t, db)
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), OpenRouterAPI{})
 
 	failedJobID := insertAIJobForTest(t, db, buyerID, &partnerID, "failed prompt", 75, "failed", true)
 	pendingJobID := insertAIJobForTest(t, db, buyerID, &partnerID, "pending prompt", 50, "pending", false)
 	completedJobID := insertAIJobForTest(t, db, buyerID, &partnerID, "completed prompt", 25, "completed", true)
+	deadJobID := insertAIJobForTest(t, db, buyerID, &partnerID, "dead prompt", 10, jobStatusDeadLetter, true)
+	backoffJobID := insertAIJobForTest(t, db, buyerID, &partnerID, "backoff prompt", 20, "pending", false)
+	retryAt := time.Now().UTC().Add(time.Hour)
+	if _, err := db.Exec("UPDATE ai_categorization_jobs SET attempts = 2, next_attempt_at = ? WHERE id = ?", retryAt, backoffJobID); err != nil {
+		t.Fatalf("backing off job: %v", err)
+	}
 
 	var categoryID int64
 	if err := db.QueryRow("SELECT id FROM categories WHERE name = 'Groceries'").Scan(&categoryID); err != nil {
@@ -38,38 +42,44 @@ func TestRequeueBackfillJobs(t *testing.T) {
 	if err != nil {
 		t.Fatalf("RequeueBackfillJobs() error = %v", err)
 	}
-	if requeued != 2 {
-		t.Fatalf("RequeueBackfillJobs() requeued = %d, expected 2", requeued)
+	if requeued != 1 {
+		t.Fatalf("RequeueBackfillJobs() requeued = %d, expected 1", requeued)
 	}
 
-	requeuedIDs := map[int64]bool{}
-	for i := 0; i < requeued; i++ {
-		job := <-pool.unhandledJobs
-		requeuedIDs[job.Id] = true
-		if job.Status != "pending" {
-			t.Fatalf("requeued job status = %q, expected pending", job.Status)
-		}
+	// The pending job in backoff keeps its attempts and waits out its backoff
+	var attempts int
+	var nextAttemptAt sql.NullTime
+	if err := db.QueryRow("SELECT attempts, next_attempt_at FROM ai_categorization_jobs WHERE id = ?", backoffJobID).Scan(&attempts, &nextAttemptAt); err != nil {
+		t.Fatalf("querying job in backoff: %v", err)
 	}
-
-	if !requeuedIDs[failedJobID] {
-		t.Fatalf("failed job %d was not requeued", failedJobID)
+	if attempts != 2 || !nextAttemptAt.Valid {
+		t.Fatalf("job in backoff after requeue: attempts = %d, next_attempt_at = %v, expected 2 and kept", attempts, nextAttemptAt)
 	}
-	if !requeuedIDs[pendingJobID] {
-		t.Fatalf("pending job %d was not requeued", pendingJobID)
+
+	// The requeued and the due pending job are claimed oldest first; completed, dead-lettered
+	// and backed off jobs are not
+	for _, expectedID := range []int64{failedJobID, pendingJobID} {
+		job, ok, err := pool.claimJob("test-worker")
+		if err != nil || !ok {
+			t.Fatalf("claimJob() = %v, %v, expected job %d", ok, err, expectedID)
+		}
+		if job.Id != expectedID {
+			t.Fatalf("claimJob() claimed job %d, expected %d", job.Id, expectedID)
+		}
 	}
-	if requeuedIDs[completedJobID] {
-		t.Fatalf("completed job %d should not have been requeued", completedJobID)
+	if job, ok, err := pool.claimJob("test-worker"); err != nil || ok {
+		t.Fatalf("claimJob() = job %d, %v, %v, expected no due jobs (dead job %d)", job.Id, ok, err, deadJobID)
 	}
 
 	var status string
 	var isFinished bool
 	var errorMessage sql.NullString
-	err = db.QueryRow("SELECT status, is_finished, error_message FROM ai_categorization_jobs WHERE id = ?", failedJobID).Scan(&status, &isFinished, &errorMessage)
+	err = db.QueryRow("SELECT status, is_finished, error_message, attempts FROM ai_categorization_jobs WHERE id = ?", failedJobID).Scan(&status, &isFinished, &errorMessage, &attempts)
 	if err != nil {
 		t.Fatalf("querying failed job after requeue: %v", err)
 	}
-	if status != "pending" {
-		t.Fatalf("failed job status after requeue = %q, expected pending", status)
+	if status != jobStatusProcessing {
+		t.Fatalf("failed job status after requeue and claim = %q, expected processing", status)
 	}
 	if isFinished {
 		t.Fatalf("failed job should have been marked unfinished")
@@ -77,6 +87,498 @@ func TestRequeueBackfillJobs(t *testing.T) {
 	if errorMessage.Valid {
 		t.Fatalf("failed job error_message should have been cleared, got %q", errorMessage.String)
 	}
+	if attempts != 1 {
+		t.Fatalf("failed job attempts after requeue and claim = %d, expected 1", attempts)
+	}
+}
+
+func TestClaimJobLease(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), OpenRouterAPI{})
+	jobID := insertAIJobForTest(t, db, buyerID, nil, "lease prompt", 30, "pending", false)
+
+	job, ok, err := pool.claimJob("worker-a")
+	if err != nil || !ok || job.Id != jobID {
+		t.Fatalf("claimJob() = job %d, %v, %v, expected job %d", job.Id, ok, err, jobID)
+	}
+	if job.Status != jobStatusProcessing || job.Attempts != 1 {
+		t.Fatalf("claimed job status = %q, attempts = %d, expected processing and 1", job.Status, job.Attempts)
+	}
+
+	// Leased jobs are not handed out twice
+	if _, ok, err := pool.claimJob("worker-b"); err != nil || ok {
+		t.Fatalf("claimJob() while leased = %v, %v, expected no job", ok, err)
+	}
+
+	// Once the lease expires (e.g. the worker crashed), another worker takes over
+	if _, err := db.Exec("UPDATE ai_categorization_jobs SET lease_expires_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Second), jobID); err != nil {
+		t.Fatalf("expiring lease: %v", err)
+	}
+	job, ok, err = pool.claimJob("worker-b")
+	if err != nil || !ok || job.Id != jobID || job.Attempts != 2 {
+		t.Fatalf("claimJob() after expiry = job %d (attempts %d), %v, %v, expected job %d on attempt 2", job.Id, job.Attempts, ok, err, jobID)
+	}
+
+	// The first worker can no longer record an outcome
+	pool.failAttempt("worker-a", Job{Id: jobID, Attempts: 1}, errors.New("stale"))
+	var owner string
+	if err := db.QueryRow("SELECT lease_owner FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&owner); err != nil {
+		t.Fatalf("querying lease owner: %v", err)
+	}
+	if owner != "worker-b" {
+		t.Fatalf("lease owner = %q, expected worker-b", owner)
+	}
+}
+
+func TestFailAttemptRetriesThenDeadLetters(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	config := DefaultPoolConfig()
+	config.MaxAttempts = 2
+	pool := NewCategorizingPool(db, config, OpenRouterAPI{})
+	jobID := insertAIJobForTest(t, db, buyerID, nil, "retry prompt", 30, "pending", false)
+
+	// First attempt fails: back to pending with a backoff
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.failAttempt("worker", job, errors.New("model unavailable"))
+
+	var status string
+	var isFinished bool
+	var errorMessage sql.NullString
+	var nextAttemptAt sql.NullTime
+	queryJob := func() {
+		t.Helper()
+		err := db.QueryRow("SELECT status, is_finished, error_message, next_attempt_at FROM ai_categorization_jobs WHERE id = ?", jobID).
+			Scan(&status, &isFinished, &errorMessage, &nextAttemptAt)
+		if err != nil {
+			t.Fatalf("querying job: %v", err)
+		}
+	}
+	queryJob()
+	if status != jobStatusPending || isFinished || errorMessage.String != "transient: model unavailable" {
+		t.Fatalf("after first failure status = %q, finished = %v, error = %q", status, isFinished, errorMessage.String)
+	}
+	if !nextAttemptAt.Valid || !nextAttemptAt.Time.After(time.Now()) {
+		t.Fatalf("after first failure next_attempt_at = %v, expected a time in the future", nextAttemptAt)
+	}
+	if _, ok, _ := pool.claimJob("worker"); ok {
+		t.Fatalf("job was claimed before its backoff passed")
+	}
+
+	// Second attempt fails: out of attempts, dead-lettered
+	if _, err := db.Exec("UPDATE ai_categorization_jobs SET next_attempt_at = ? WHERE id = ?", time.Now().UTC().Add(-time.Second), jobID); err != nil {
+		t.Fatalf("skipping backoff: %v", err)
+	}
+	job, ok, err = pool.claimJob("worker")
+	if err != nil || !ok || job.Attempts != 2 {
+		t.Fatalf("claimJob() after backoff = attempts %d, %v, %v", job.Attempts, ok, err)
+	}
+	pool.failAttempt("worker", job, errors.New("model unavailable again"))
+
+	queryJob()
+	if status != jobStatusDeadLetter || !isFinished {
+		t.Fatalf("after last failure status = %q, finished = %v, expected dead_letter and finished", status, isFinished)
+	}
+	if state := JobStateFor(status, false); state != types.JobStateFailed {
+		t.Fatalf("JobStateFor(dead_letter) = %q, expected failed", state)
+	}
+	if _, ok, _ := pool.claimJob("worker"); ok {
+		t.Fatalf("dead-lettered job was claimed")
+	}
+}
+
+func TestFailAttemptPermanentAndRetryAfter(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), OpenRouterAPI{})
+
+	// A permanent failure is dead-lettered on the first attempt
+	permanentID := insertAIJobForTest(t, db, buyerID, nil, "permanent prompt", 30, "pending", false)
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok || job.Id != permanentID {
+		t.Fatalf("claimJob() = job %d, %v, %v", job.Id, ok, err)
+	}
+	pool.failAttempt("worker", job, &ModelAPIError{StatusCode: 400, Err: errors.New("bad request")})
+
+	var status string
+	var errorMessage string
+	if err := db.QueryRow("SELECT status, error_message FROM ai_categorization_jobs WHERE id = ?", permanentID).Scan(&status, &errorMessage); err != nil {
+		t.Fatalf("querying job: %v", err)
+	}
+	if status != jobStatusDeadLetter || errorMessage != "permanent: model API returned status 400: bad request" {
+		t.Fatalf("after permanent failure status = %q, error = %q", status, errorMessage)
+	}
+
+	// A rate limited job waits at least as long as the provider asked
+	limitedID := insertAIJobForTest(t, db, buyerID, nil, "limited prompt", 30, "pending", false)
+	job, ok, err = pool.claimJob("worker")
+	if err != nil || !ok || job.Id != limitedID {
+		t.Fatalf("claimJob() = job %d, %v, %v", job.Id, ok, err)
+	}
+	pool.failAttempt("worker", job, &ModelAPIError{StatusCode: 429, Transient: true, RetryAfter: time.Hour, Err: errors.New("slow down")})
+
+	var nextAttemptAt time.Time
+	if err := db.QueryRow("SELECT status, next_attempt_at FROM ai_categorization_jobs WHERE id = ?", limitedID).Scan(&status, &nextAttemptAt); err != nil {
+		t.Fatalf("querying job: %v", err)
+	}
+	if status != jobStatusPending || nextAttemptAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("after rate limit status = %q, next attempt at %v, expected pending in an hour", status, nextAttemptAt)
+	}
+}
+
+func TestProcessJobCompletes(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	api := stubModelAPI{content: `{"ambiguity_flag": "", "spendings": [
+		{"apportion_mode": "shared", "category": "Groceries", "amount": 30, "description": "Food"}
+	]}`}
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), api)
+	jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "food for us", 30, "pending", false)
+
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	job, err = pool.GetStatus(jobID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if job.Status != jobStatusCompleted || !job.IsFinished || job.Result == nil || len(job.Result.Spendings) != 1 {
+		t.Fatalf("after processing job = %+v, expected completed with one spending", job)
+	}
+
+	var leaseOwner sql.NullString
+	if err := db.QueryRow("SELECT lease_owner FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&leaseOwner); err != nil {
+		t.Fatalf("querying lease owner: %v", err)
+	}
+	if leaseOwner.Valid {
+		t.Fatalf("lease should have been released, owner = %q", leaseOwner.String)
+	}
+}
+
+func TestProcessJobPromptHasNamesAndNotes(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	api := NewFakeModelAPI(FakeAnswer(`{"ambiguity_flag": "", "spendings": [
+		{"apportion_mode": "alone", "category": "Groceries", "amount": 30, "description": "Energidrikk"}
+	]}`))
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), api)
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"UPDATE users SET ai_notes = 'drikker energidrikk' WHERE id = ?", []any{partnerID}},
+		{"UPDATE households SET ai_notes = 'Oda er katten vår' WHERE id = (SELECT household_id FROM household_members WHERE user_id = ?)", []any{buyerID}},
+	} {
+		if _, err := db.Exec(stmt.query, stmt.args...); err != nil {
+			t.Fatalf("setting AI notes: %v", err)
+		}
+	}
+	insertAIJobForTest(t, db, buyerID, &partnerID, "energidrikk", 30, "pending", false)
+
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	// The worker resolves the names itself, rather than leaving the examples blank
+	prompts := api.Prompts()
+	if len(prompts) != 1 {
+		t.Fatalf("expected one prompt, got %d", len(prompts))
+	}
+	for _, want := range []string{"heter Demo", "partneren Partner", "Kjøper: Demo, Partner: Partner", "- Partner: drikker energidrikk", "- Husstanden: Oda er katten vår"} {
+		if !strings.Contains(prompts[0], want) {
+			t.Errorf("expected the prompt to contain %q, got: %s", want, prompts[0])
+		}
+	}
+}
+
+func TestProcessJobConvertsCurrency(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	api := NewFakeModelAPI(FakeAnswer(`{"ambiguity_flag": "", "spendings": [
+		{"apportion_mode": "shared", "category": "Groceries", "amount": 30, "description": "Food"}
+	]}`))
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), api)
+	if _, err := db.Exec("INSERT INTO exchange_rates (date, from_currency, to_currency, rate) VALUES ('2025-07-01', 'EUR', 'NOK', 11.8)"); err != nil {
+		t.Fatalf("inserting exchange rate: %v", err)
+	}
+	insertForeignJob := func(transactionDate time.Time) int64 {
+		t.Helper()
+		jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "food in Berlin", 30, "pending", false)
+		if _, err := db.Exec("UPDATE ai_categorization_jobs SET currency = 'EUR', transaction_date = ? WHERE id = ?", transactionDate, jobID); err != nil {
+			t.Fatalf("setting job currency: %v", err)
+		}
+		return jobID
+	}
+
+	// Stored in the household's currency with the rate of the transaction date, shown as entered
+	jobID := insertForeignJob(time.Date(2025, 7, 5, 0, 0, 0, 0, time.UTC))
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	var amount, original money.Amount
+	var currency string
+	err = db.QueryRow(`
+		SELECT s.amount, s.original_amount, s.currency FROM spendings s
+		JOIN ai_categorized_spendings a ON a.spending_id = s.id WHERE a.job_id = ?
+	`, jobID).Scan(&amount, &original, &currency)
+	if err != nil {
+		t.Fatalf("querying spending: %v", err)
+	}
+	if amount != 35400 || original != 3000 || currency != "EUR" {
+		t.Fatalf("spending amount = %v, original = %v %s, expected 354 from 30 EUR", amount, original, currency)
+	}
+	job, err = pool.GetStatus(jobID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if job.Currency != "EUR" || job.Result == nil || len(job.Result.Spendings) != 1 || job.Result.Spendings[0].Amount != 3000 {
+		t.Fatalf("GetStatus() = %+v, expected one spending of 30 EUR", job)
+	}
+	if prompts := api.Prompts(); len(prompts) != 1 || !strings.Contains(prompts[0], "30 euro") {
+		t.Fatalf("expected one prompt with the amounts in EUR, got: %v", prompts)
+	}
+
+	// Without a rate for the date the job cannot be stored, however often it is retried
+	jobID = insertForeignJob(time.Date(2025, 6, 30, 0, 0, 0, 0, time.UTC))
+	job, ok, err = pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	var status string
+	var errMsg sql.NullString
+	if err := db.QueryRow("SELECT status, error_message FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&status, &errMsg); err != nil {
+		t.Fatalf("querying job: %v", err)
+	}
+	if status != jobStatusDeadLetter || !strings.Contains(errMsg.String, "retry the job") {
+		t.Fatalf("job without exchange rate status = %q (%q), expected dead_letter telling how to recover", status, errMsg.String)
+	}
+
+	// Retrying by hand succeeds once the rate is imported
+	if _, err := db.Exec("INSERT INTO exchange_rates (date, from_currency, to_currency, rate) VALUES ('2025-06-30', 'EUR', 'NOK', 11.7)"); err != nil {
+		t.Fatalf("inserting exchange rate: %v", err)
+	}
+	if err := pool.RetryJob(jobID); err != nil {
+		t.Fatalf("RetryJob() error = %v", err)
+	}
+	job, ok, err = pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() after retry = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+	if err := db.QueryRow("SELECT status FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&status); err != nil {
+		t.Fatalf("querying job: %v", err)
+	}
+	if status != jobStatusCompleted {
+		t.Fatalf("retried job status = %q, expected completed", status)
+	}
+}
+
+func TestRecategorizeKeepsSettlement(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	api := stubModelAPI{content: `{"ambiguity_flag": "", "spendings": [
+		{"apportion_mode": "shared", "category": "Groceries", "amount": 20, "description": "Food"},
+		{"apportion_mode": "alone", "category": "Alcohol", "amount": 5, "description": "Beer"}
+	]}`}
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), api)
+
+	var categoryID int64
+	if err := db.QueryRow("SELECT id FROM categories WHERE name = 'Groceries'").Scan(&categoryID); err != nil {
+		t.Fatalf("querying category ID: %v", err)
+	}
+	jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "food and beer", 25, jobStatusCompleted, true)
+	insertCategorizedSpendingForTest(t, db, buyerID, &partnerID, categoryID, jobID)
+	settledAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := db.Exec("UPDATE user_spendings SET settled_at = ?", settledAt); err != nil {
+		t.Fatalf("settling spending: %v", err)
+	}
+	// An attachment of the old spending moves to the first replacement
+	if _, err := db.Exec(`
+		INSERT INTO attachments (spending_id, uploaded_by, file_name, media_type, size, sha256)
+		SELECT spending_id, ?, 'invoice.pdf', 'application/pdf', 4, 'abc' FROM ai_categorized_spendings WHERE job_id = ?
+	`, buyerID, jobID); err != nil {
+		t.Fatalf("inserting attachment: %v", err)
+	}
+
+	if err := pool.RetryJob(jobID); !errors.Is(err, ErrJobNotFailed) {
+		t.Fatalf("RetryJob() of a completed job error = %v, expected ErrJobNotFailed", err)
+	}
+	if err := pool.Recategorize(jobID); err != nil {
+		t.Fatalf("Recategorize() error = %v", err)
+	}
+	if err := pool.Recategorize(jobID); !errors.Is(err, ErrJobNotCompleted) {
+		t.Fatalf("Recategorize() of a queued job error = %v, expected ErrJobNotCompleted", err)
+	}
+
+	// The old spending stays until the new ones replace it
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok || job.Id != jobID {
+		t.Fatalf("claimJob() = %d, %v, %v, expected job %d", job.Id, ok, err, jobID)
+	}
+	pool.processJob(1, "worker", job)
+
+	job, err = pool.GetStatus(jobID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if job.Status != jobStatusCompleted || job.Result == nil || len(job.Result.Spendings) != 2 {
+		t.Fatalf("after recategorizing job = %+v, expected completed with two spendings", job)
+	}
+	rows, err := db.Query("SELECT settled_at FROM user_spendings")
+	if err != nil {
+		t.Fatalf("querying settlements: %v", err)
+	}
+	defer rows.Close()
+	var count int
+	for rows.Next() {
+		var got sql.NullTime
+		if err := rows.Scan(&got); err != nil {
+			t.Fatalf("scanning settlement: %v", err)
+		}
+		if !got.Valid || !got.Time.Equal(settledAt) {
+			t.Fatalf("settled_at of replacement = %v, expected %v", got, settledAt)
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("found %d user spendings, expected only the two replacements", count)
+	}
+
+	var attachedTo, first sql.NullInt64
+	err = db.QueryRow(`
+		SELECT a.spending_id, (SELECT MIN(spending_id) FROM ai_categorized_spendings WHERE job_id = ?)
+		FROM attachments a WHERE a.job_id IS NULL
+	`, jobID).Scan(&attachedTo, &first)
+	if err != nil || !attachedTo.Valid || attachedTo != first {
+		t.Fatalf("attachment is on spending %v (err: %v), expected the first replacement %v", attachedTo, err, first)
+	}
+}
+
+func TestShutdownReleasesInterruptedJob(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	config := DefaultPoolConfig()
+	config.Workers = 1
+	config.PollInterval = 10 * time.Millisecond
+	started := make(chan struct{})
+	pool := NewCategorizingPool(db, config, blockingModelAPI{started: started})
+	jobID := insertAIJobForTest(t, db, buyerID, nil, "slow prompt", 30, "pending", false)
+
+	pool.StartPool()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker did not pick up the job")
+	}
+
+	// The model call never returns on its own, so the deadline is reached
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := pool.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() error = %v, expected deadline exceeded", err)
+	}
+
+	// The job is back in the queue, without the interrupted attempt counted
+	var status string
+	var attempts int
+	var leaseOwner sql.NullString
+	err := db.QueryRow("SELECT status, attempts, lease_owner FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&status, &attempts, &leaseOwner)
+	if err != nil {
+		t.Fatalf("querying job: %v", err)
+	}
+	if status != jobStatusPending || attempts != 0 || leaseOwner.Valid {
+		t.Fatalf("after shutdown status = %q, attempts = %d, lease owner = %v, expected pending, 0 and none", status, attempts, leaseOwner)
+	}
+
+	// Shutting down again is a no-op
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("second Shutdown() error = %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, maxDelay := 10*time.Second, time.Minute
+	tests := []struct {
+		attempts int
+		expected time.Duration // Before jitter
+	}{
+		{attempts: 1, expected: 10 * time.Second},
+		{attempts: 2, expected: 20 * time.Second},
+		{attempts: 3, expected: 40 * time.Second},
+		{attempts: 4, expected: time.Minute},
+		{attempts: 50, expected: time.Minute},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := backoff(tt.attempts, base, maxDelay)
+			if got < tt.expected/2 || got > tt.expected {
+				t.Fatalf("backoff(%d) = %v, expected between %v and %v", tt.attempts, got, tt.expected/2, tt.expected)
+			}
+		}
+	}
+}
+
+// stubModelAPI answers every prompt with the same content.
+type stubModelAPI struct {
+	content string
+}
+
+func (s stubModelAPI) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	return &ModelAPIResponse{Choices: []Choice{{Message: Message{Content: s.content}}}}, nil
+}
+
+// blockingModelAPI signals started and then waits until the call is cancelled.
+type blockingModelAPI struct {
+	started chan struct{}
+}
+
+func (b blockingModelAPI) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func poolTestUsers(t *testing.T, db *sql.DB) (buyerID, partnerID int64) {
+	t.Helper()
+
+	if err := db.QueryRow("SELECT id FROM users WHERE username = 'demo_user'").Scan(&buyerID); err != nil {
+		t.Fatalf("querying buyer ID: %v", err)
+	}
+	if err := db.QueryRow("SELECT id FROM users WHERE username = 'partner_user'").Scan(&partnerID); err != nil {
+		t.Fatalf("querying partner ID: %v", err)
+	}
+	return buyerID, partnerID
 }
 
 func setupPoolTestDB(t *testing.T) *sql.DB {
@@ -108,7 +610,7 @@ func insertAIJobForTest(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *i
 		INSERT INTO ai_categorization_jobs
 			(buyer, shared_with, prompt, total_amount, status, is_finished, error_message)
 		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, buyerID, sharedWithID, prompt, totalAmount, status, isFinished, "old error")
+	`, buyerID, sharedWithID, prompt, money.FromFloat(totalAmount), status, isFinished, "old error")
 	if err != nil {
 		t.Fatalf("inserting AI job: %v", err)
 	}
@@ -133,7 +635,7 @@ func insertCategorizedSpendingForTest(t *testing.T, db *sql.DB, buyerID int64, s
 	res, err := tx.Exec(`
 		INSERT INTO spendings (amount, description, category, made_by)
 		VALUES (?, ?, ?, ?)
-	`, 25.0, "already categorized", categoryID, buyerID)
+	`, money.FromFloat(25), "already categorized", categoryID, buyerID)
 	if err != nil {
 		t.Fatalf("inserting spending: %v", err)
 	}
@@ -0,0 +1,196 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// HandlePreviewCategorization categorizes a purchase synchronously and returns the proposed
+// spendings without storing anything. The client shows the proposal, lets the user edit it,
+// and stores it with HandleConfirmCategorization.
+func HandlePreviewCategorization(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for categorization preview", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate the payload, the same as for POST /v1/categorize
+		var payload types.AICategorizationPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode categorization preview request body", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Bad Request: Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if payload.Prompt == "" || payload.Amount < 0 {
+			http.Error(w, "Bad Request: Missing prompt or invalid amount", http.StatusBadRequest)
+			return
+		}
+		transactionDate := parseTransactionDate(r, userID, payload)
+		if !checkCurrency(w, r, db, userID, &payload, transactionDate) {
+			return
+		}
+
+		// 2. Previews use the model too, so they count against the quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 3. Categorize, bounded by the pool's preview timeout
+		params, err := categorizationParams(r, db, userID, payload)
+		if err != nil {
+			slog.Error("failed to prepare categorization preview", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if transactionDate == nil {
+			params.LocalDate = localDate(r, userID, payload)
+		}
+		result, err := pool.Preview(r.Context(), params)
+		if err != nil {
+			writeModelError(w, r, userID, "categorization preview", "AI could not categorize the purchase", err)
+			return
+		}
+
+		// 4. Respond with the proposal, including the amount and date the AI found, if any
+		preview := types.CategorizationPreview{
+			Amount:        result.TotalAmount,
+			Prompt:        payload.Prompt,
+			AmbiguityFlag: result.AmbiguityFlagReason,
+			Model:         result.Model,
+			Spendings:     make([]types.ProposedSpending, 0, len(result.Spendings)),
+		}
+		if transactionDate != nil {
+			date := transactionDate.Format(dateLayout)
+			preview.TransactionDate = &date
+		} else if result.TransactionDate != "" {
+			preview.TransactionDate = &result.TransactionDate
+		}
+		for _, s := range result.Spendings {
+			preview.Spendings = append(preview.Spendings, types.ProposedSpending{
+				Category:      s.Category,
+				Amount:        s.Amount,
+				ApportionMode: s.ApportionMode,
+				Description:   s.Description,
+				SharedWith:    s.SharedWith,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(preview); err != nil {
+			slog.Error("failed to encode categorization preview", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// HandleConfirmCategorization stores a preview, as proposed or edited by the user, as a
+// completed AI job with its spendings. The spendings are validated like model output.
+func HandleConfirmCategorization(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for categorization confirm", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate the payload
+		var payload types.ConfirmCategorizationPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode categorization confirm request body", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Bad Request: Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if payload.Prompt == "" || payload.Amount <= 0 {
+			http.Error(w, "Bad Request: Missing prompt or invalid amount", http.StatusBadRequest)
+			return
+		}
+		if len(payload.Spendings) == 0 {
+			http.Error(w, "Bad Request: No spendings", http.StatusBadRequest)
+			return
+		}
+		transactionDate := parseTransactionDate(r, userID, payload.AICategorizationPayload)
+		if !checkCurrency(w, r, db, userID, &payload.AICategorizationPayload, transactionDate) {
+			return
+		}
+
+		// 2. Build the result to store, for the user's household
+		params, err := categorizationParams(r, db, userID, payload.AICategorizationPayload)
+		if err != nil {
+			slog.Error("failed to prepare categorization confirm", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result := JobResult{
+			IsAmbiguityFlagged:  payload.AmbiguityFlag != "",
+			AmbiguityFlagReason: payload.AmbiguityFlag,
+			Model:               payload.Model,
+		}
+		for _, s := range payload.Spendings {
+			if s.Amount <= 0 {
+				http.Error(w, "Bad Request: Spending amounts must be positive", http.StatusBadRequest)
+				return
+			}
+			result.Spendings = append(result.Spendings, Spendings{
+				Category:      s.Category,
+				Amount:        s.Amount,
+				ApportionMode: s.ApportionMode,
+				Description:   s.Description,
+				SharedWith:    s.SharedWith,
+			})
+		}
+		if err := validateResult(result, params); err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// 3. Store the job and its spendings
+		jobID, err := pool.AddCompletedJob(params, transactionDate, result)
+		if errors.Is(err, ErrUnknownCategory) || errors.Is(err, currency.ErrNoRate) {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to store confirmed categorization", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Confirmed categorization stored", "url", r.URL, "user_id", userID, "job_id", jobID, "amount", payload.Amount, "spendings", len(result.Spendings))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
+	}
+}
+
+// writeModelError responds to a failed synchronous model request, such as a preview: what names
+// the request in logs, and invalidMessage is shown when the model's output never validated.
+func writeModelError(w http.ResponseWriter, r *http.Request, userID int64, what, invalidMessage string, err error) {
+	var apiErr *ModelAPIError
+	switch {
+	case r.Context().Err() != nil:
+		slog.Info(what+" abandoned by the client", "url", r.URL, "user_id", userID)
+	case errors.Is(err, context.DeadlineExceeded):
+		slog.Warn(what+" timed out", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Categorization timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, ErrInvalidModelOutput):
+		slog.Warn(what+" produced no valid output", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, invalidMessage, http.StatusUnprocessableEntity)
+	case errors.Is(err, ErrProviderPaused), errors.As(err, &apiErr):
+		slog.Warn(what+" failed, AI service unavailable", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "AI service unavailable", http.StatusServiceUnavailable)
+	default:
+		slog.Error(what+" failed", "url", r.URL, "user_id", userID, "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -3,135 +3,179 @@ package category
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+
+	"git.sr.ht/~relay/sapp-backend/household"
 )
 
-const preambleString string = "Du skal nå kategorisere et kjøp ut ifra en liste med kategorier og en beskrivelse på kjøpet. Dette er ET kjøp på EN butikk."
+// partnerNamePlaceholder stands in for a household member whose name could not be fetched.
+const partnerNamePlaceholder = "[Partner Name]"
+
+// promptData is what the prompt templates are rendered with, see promptTemplate.
+type promptData struct {
+	Buyer          string
+	Partner        string // Name of SharedWith, if HasPartner
+	ExamplePartner string // Partner in the examples, a generic name unless one is known
+	HasPartner     bool
+	MultiMember    bool   // The household has more than one other member, who can share in any subset
+	Members        string // Names of the other household members, if MultiMember
+
+	HouseholdNotes string
+	MemberNotes    []Person // Members with AI notes, each once
+
+	Prompt        string
+	Receipt       bool   // A photo of the receipt is sent along
+	TotalAmount   string // In major units, e.g. "30.5"
+	ExtractAmount bool   // The model should find the amount in the prompt or on the receipt
+	LocalDate     string // Set if the model should find the transaction date
+	Weekday       string // Of LocalDate
+	Currency      promptCurrency
+	Categories    []promptCategory
+	HasTypical    bool // Some category has typical amounts
+}
 
-// getPrompt requires the db connection.
-// CategorizationParams.SharedWith should be populated by the caller (handler) if a partner exists.
-func getPrompt(db *sql.DB, params CategorizationParams) (string, error) {
-	rows, err := db.Query("SELECT name, ai_notes FROM categories")
+// promptCategory is a category the model can choose, with the notes on when to use it.
+type promptCategory struct {
+	Name    string
+	Notes   string
+	Typical *typicalAmounts // What the household usually spends in the category, if known
+}
 
+// typicalAmounts are the statistics of a category formatted for the prompt.
+type typicalAmounts struct {
+	Low, High string // Quartiles
+	Median    string
+}
+
+// newPromptData prepares the parameters of a job for rendering with the template.
+func newPromptData(t *promptTemplate, params CategorizationParams) promptData {
+	data := promptData{
+		Buyer:          params.Buyer.Name,
+		Partner:        partnerNamePlaceholder,
+		ExamplePartner: "Partner", // Use generic name for examples unless specific one is available
+		HasPartner:     params.SharedWith != nil,
+		MultiMember:    len(params.Household) > 1,
+		Members:        householdNames(params.Household, partnerNamePlaceholder),
+		HouseholdNotes: params.HouseholdNotes,
+		MemberNotes:    notePeople(params),
+		Prompt:         params.Prompt,
+		Receipt:        params.Receipt != nil,
+		TotalAmount:    params.TotalAmount.Format(),
+		ExtractAmount:  params.TotalAmount <= 0,
+		LocalDate:      params.LocalDate,
+		Weekday:        t.weekday(params.LocalDate),
+		Currency:       t.currency(params.currency()),
+	}
+	if params.SharedWith != nil && params.SharedWith.Name != "" {
+		data.Partner = params.SharedWith.Name
+		data.ExamplePartner = params.SharedWith.Name
+	} else if len(params.Household) > 0 && params.Household[0].Name != "" {
+		data.ExamplePartner = params.Household[0].Name
+	}
+	return data
+}
+
+// getPrompt renders the categorization prompt for the job with the template, listing the
+// categories to choose from with their typical amounts in the household, see HouseholdStats.
+// CategorizationParams.SharedWith should be populated by the caller (handler) if a partner exists.
+func getPrompt(db *sql.DB, t *promptTemplate, params CategorizationParams, stats map[string]AmountStats) (string, error) {
+	data := newPromptData(t, params)
+	categories, err := promptCategories(db)
 	if err != nil {
 		return "", err
 	}
+	for i, c := range categories {
+		if s, ok := stats[c.Name]; ok && s.Count >= minStatsSamples {
+			categories[i].Typical = &typicalAmounts{Low: s.Q1.Format(), High: s.Q3.Format(), Median: s.Median.Format()}
+			data.HasTypical = true
+		}
+	}
+	data.Categories = categories
+	return t.render("categorize", data)
+}
 
+// promptCategories returns the categories with their notes for the prompt.
+func promptCategories(db *sql.DB) ([]promptCategory, error) {
+	rows, err := db.Query("SELECT name, COALESCE(ai_notes, '') FROM categories")
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	categoryListString := ""
-	var name string
-	var aiNotes string
-
+	var categories []promptCategory
 	for rows.Next() {
-		rows.Scan(&name, &aiNotes)
-		categoryListString = fmt.Sprintf("%v- %v", categoryListString, name)
-		if aiNotes != "" {
-			categoryListString = fmt.Sprintf("%v - \"%v\"", categoryListString, aiNotes)
+		var c promptCategory
+		if err := rows.Scan(&c.Name, &c.Notes); err != nil {
+			return nil, err
 		}
-
-		categoryListString = fmt.Sprintf("%v\n", categoryListString)
+		categories = append(categories, c)
 	}
+	return categories, rows.Err()
+}
 
-	// Updated baseString with clearer instructions for inferring apportion_mode
-	const baseString string = `%v
-%v
-Totalbeløpet på kjøpet er %v kroner.
-Beskrivelsen av kjøpet er: "%v".
-
-Du skal dele opp kjøpet i en eller flere deler basert på beskrivelsen og totalbeløpet.
-For HVER del skal du bestemme 'apportion_mode' basert KUN på beskrivelsen.
-Du skal returnere JSON i formatet:
-%v
-med en eller flere elementer i "spendings"-listen.
-
-VIKTIGE REGLER FOR 'apportion_mode':
-%v
-
-- ambiguity_flag: Hvis noe med kjøpet/oppdelingen/beskrivelsen er uklart, fyll strengen med en kort begrunnelse på norsk. Ellers la strengen være tom (""). Ikke bruk den for mye.
-- description: Kan være tom string ("") hvis kategorien er beskrivende nok (f.eks. "Dagligvarer").
-
-Eksempler på hvordan 'apportion_mode' skal bestemmes fra beskrivelsen:
-1. Beskrivelse: "Redbull til meg for 25kr, og resten er delt middag", Totalbeløp: 100kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"alone", "category":"...", "amount":25.0, "description":"Redbull"}, {"apportion_mode":"shared", "category":"...", "amount":75.0, "description":"Middag"}]
-2. Beskrivelse: "Billetter", Totalbeløp: 500kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"alone", "category":"...", "amount":500.0, "description":"Billetter"}] (Standard: Anta 'alone' hvis deling ikke er nevnt)
-3. Beskrivelse: "Brød til %s", Totalbeløp: 40kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"other", "category":"...", "amount":40.0, "description":"Brød"}] (Fordi det er spesifikt til partneren)
-4. Beskrivelse: "Delt lunsj", Totalbeløp: 200kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"shared", "category":"...", "amount":200.0, "description":"Lunsj"}]
-5. Beskrivelse: "Dagligvarer", Totalbeløp: 350kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"shared", "category":"Groceries", "amount":350.0, "description":"Dagligvarer"}] (Standard for Groceries: Anta 'shared' hvis partner finnes og ikke annet er spesifisert)
-6. Beskrivelse: "Genser", Totalbeløp: 600kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"alone", "category":"Shopping", "amount":600.0, "description":"Genser"}] (Standard for personlige ting: Anta 'alone' hvis deling ikke er nevnt)
-7. Beskrivelse: "Flybilletter til oss", Totalbeløp: 2000kr, Kjøper: %s, Partner: %s
-   -> [{"apportion_mode":"shared", "category":"Transport", "amount":2000.0, "description":"Flybilletter"}]
-
-Her er listen av kategorier du kan velge mellom (category_name står først, notater etterpå):
-%v
-Bruk den mest spesifikke kategorien. Bruk NØYAKTIG riktig category_name.
-
-Ekskluder sparing og investering fra svaret.
-Svaret skal KUN være gyldig JSON, UTEN markdown-formatering. Summen av 'amount' i svaret MÅ være lik totalbeløpet.
-`
-
-	// User info string, always includes buyer, includes partner if available.
-	var userInfo string
-	var partnerNamePlaceholder string = "[Partner Name]" // Placeholder if partner exists but name couldn't be fetched
+// loadContext fills in the names and AI notes of the buyer, partner and other household members
+// in params, the buyer's language, and the AI notes and currency of their household.
+func loadContext(q household.Querier, params *CategorizationParams) error {
+	people := []*Person{&params.Buyer}
 	if params.SharedWith != nil {
-		partnerName := params.SharedWith.Name
-		if partnerName == "" { // Handle case where partner exists but name fetch failed
-			partnerName = partnerNamePlaceholder
+		people = append(people, params.SharedWith)
+	}
+	for i := range params.Household {
+		people = append(people, &params.Household[i])
+	}
+	for _, person := range people {
+		err := q.QueryRow("SELECT COALESCE(first_name, username), COALESCE(ai_notes, '') FROM users WHERE id = ?", person.Id).
+			Scan(&person.Name, &person.Notes)
+		if err != nil {
+			return fmt.Errorf("failed to query user %d: %w", person.Id, err)
 		}
-		userInfo = fmt.Sprintf("Personen som har betalt (og oppgitt beskrivelsen) heter %s. Kjøpet kan potensielt involvere partneren %s.", params.Buyer.Name, partnerName)
-	} else {
-		userInfo = fmt.Sprintf("Personen som har betalt (og oppgitt beskrivelsen) heter %s. Det er ingen partner involvert.", params.Buyer.Name)
 	}
 
-	// JSON format string remains the same
-	const jsonFormatString string = `{"ambiguity_flag": "<string>", "spendings":[{"apportion_mode":"shared|alone|other", "category": "<category_name>", "amount": <float>, "description":"<string>"}]}`
+	if err := q.QueryRow("SELECT language FROM users WHERE id = ?", params.Buyer.Id).Scan(&params.Language); err != nil {
+		return fmt.Errorf("failed to query language of user %d: %w", params.Buyer.Id, err)
+	}
 
-	// Updated explanation of apportion_mode focusing on inference from the prompt
-	const apportionModeExplanation string = `- "alone": Brukes når beskrivelsen indikerer at varen KUN er til kjøperen (%s), ELLER når ingenting om deling/partner er nevnt. Dette er standard antagelse med mindre det er sterke indikasjoner på deling (f.eks. "felles", "oss", "delt", eller kategori som "Groceries").
-- "shared": Brukes når beskrivelsen eksplisitt sier at varen er delt ("felles", "oss", "delt"), ELLER når det er en typisk fellesutgift (som "Groceries") OG beskrivelsen ikke indikerer at det er personlig.
-- "other": Brukes KUN når beskrivelsen eksplisitt sier at varen er KUN til partneren (%s).`
+	notes, err := household.GetAINotes(q, params.Buyer.Id)
+	if err != nil {
+		return err
+	}
+	params.HouseholdNotes = notes
+	currency, err := household.GetCurrency(q, params.Buyer.Id)
+	if err != nil {
+		return err
+	}
+	params.BaseCurrency = currency
+	return nil
+}
 
-	var filledApportionModeExplanation string
-	buyerName := params.Buyer.Name
-	partnerName := partnerNamePlaceholder // Default placeholder
+// notePeople returns the buyer and household members who have AI notes, e.g. who drinks
+// energy drinks, each once.
+func notePeople(params CategorizationParams) []Person {
+	var people []Person
+	seen := map[int64]bool{}
+	candidates := append([]Person{params.Buyer}, params.Household...)
 	if params.SharedWith != nil {
-		if params.SharedWith.Name != "" {
-			partnerName = params.SharedWith.Name
+		candidates = append(candidates, *params.SharedWith)
+	}
+	for _, person := range candidates {
+		if person.Notes == "" || seen[person.Id] {
+			continue
 		}
-		filledApportionModeExplanation = fmt.Sprintf(apportionModeExplanation, buyerName, partnerName, partnerName)
-	} else {
-		// Simplified explanation if no partner exists. AI should only use 'alone'.
-		filledApportionModeExplanation = fmt.Sprintf("- \"alone\": Skal brukes for alle deler siden det ikke er noen partner å dele med.")
+		seen[person.Id] = true
+		people = append(people, person)
 	}
+	return people
+}
 
-	// Prepare example strings with actual names/placeholders
-	exampleBuyerName := params.Buyer.Name
-	examplePartnerName := "Partner" // Use generic name for examples unless specific one is available
-	if params.SharedWith != nil && params.SharedWith.Name != "" {
-		examplePartnerName = params.SharedWith.Name
+// householdNames joins the names of the given household members for use in the prompt.
+func householdNames(members []Person, placeholder string) string {
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		if m.Name == "" {
+			names = append(names, placeholder)
+		} else {
+			names = append(names, m.Name)
+		}
 	}
-
-
-	// Construct the final prompt string
-	return fmt.Sprintf(baseString,
-		preambleString,
-		userInfo,
-		params.TotalAmount,
-		params.Prompt,
-		jsonFormatString,
-		filledApportionModeExplanation,
-		// Examples injected here
-		exampleBuyerName, examplePartnerName, // Example 1
-		exampleBuyerName, examplePartnerName, // Example 2
-		examplePartnerName, exampleBuyerName, examplePartnerName, // Example 3
-		exampleBuyerName, examplePartnerName, // Example 4
-		exampleBuyerName, examplePartnerName, // Example 5
-		exampleBuyerName, examplePartnerName, // Example 6
-		exampleBuyerName, examplePartnerName, // Example 7
-		// Category list at the end
-		categoryListString), nil
+	return strings.Join(names, ", ")
 }
@@ -0,0 +1,286 @@
+package category
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// maxReceiptSize bounds the size of an uploaded receipt photo.
+const maxReceiptSize = 10 << 20 // 10 MiB
+
+// receiptTypes lists the image types accepted as receipts.
+var receiptTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// ErrReceiptsDisabled is returned when adding a receipt to a pool without PoolConfig.Receipts.
+var ErrReceiptsDisabled = errors.New("receipt uploads are not configured")
+
+// ErrNoReceipt is returned for the receipt of a job that has none.
+var ErrNoReceipt = errors.New("job has no receipt")
+
+// AddReceiptJob adds a job categorizing the photo of a receipt. The photo is kept in
+// PoolConfig.Receipts with the job, so it can be viewed from history. The prompt is optional;
+// the model splits the purchase by the receipt's line items.
+func (p *CategorizingPool) AddReceiptJob(params CategorizationParams, transactionDate *time.Time, receipt Image) (int64, error) {
+	if p.config.Receipts == nil {
+		return 0, ErrReceiptsDisabled
+	}
+	if !receiptTypes[receipt.MediaType] {
+		return 0, fmt.Errorf("unsupported receipt type %q", receipt.MediaType)
+	}
+
+	var jobID int64
+	hash, err := p.config.Receipts.Put(p.db, receipt.Data, func(hash string) error {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		jobID, err = insertJob(tx, params, transactionDate, sql.NullInt64{})
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE ai_categorization_jobs SET receipt_sha256 = ?, receipt_media_type = ? WHERE id = ?",
+			hash, receipt.MediaType, jobID); err != nil {
+			return fmt.Errorf("storing receipt of job: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	p.publishJobEvent(jobID)
+	p.wake()
+	slog.Debug("Receipt job queued", "job_id", jobID, "receipt", hash)
+	return jobID, nil
+}
+
+// Receipt returns the receipt photo of a job. Returns sql.ErrNoRows if the job does not exist
+// and ErrNoReceipt if it has no receipt.
+func (p *CategorizingPool) Receipt(jobID int64) (Image, error) {
+	var hash, mediaType sql.NullString
+	err := p.db.QueryRow("SELECT receipt_sha256, receipt_media_type FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&hash, &mediaType)
+	if err != nil {
+		return Image{}, err
+	}
+	if !hash.Valid {
+		return Image{}, ErrNoReceipt
+	}
+	return p.loadReceipt(hash.String, mediaType.String)
+}
+
+// JobReceipts returns the receipt_sha256 of the jobs selected by the query, which selects job
+// IDs. Read them before deleting the jobs, to remove the photos with RemoveReceipts afterwards.
+func JobReceipts(q household.Querier, jobsQuery string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query(`
+		SELECT receipt_sha256 FROM ai_categorization_jobs
+		WHERE receipt_sha256 IS NOT NULL AND id IN (`+jobsQuery+`)
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying receipts of jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("scanning receipt of job: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// RemoveReceipts removes the receipt photos of deleted jobs, unless another job or an
+// attachment has the same content. Call it once the transaction deleting the jobs has
+// committed. Failures are only logged; the store's Sweep removes the files later.
+func (p *CategorizingPool) RemoveReceipts(hashes []string) {
+	if p.config.Receipts == nil {
+		return
+	}
+	p.config.Receipts.Release(p.db, hashes)
+}
+
+// loadReceipt reads a receipt photo stored by AddReceiptJob.
+func (p *CategorizingPool) loadReceipt(hash, mediaType string) (Image, error) {
+	if p.config.Receipts == nil {
+		return Image{}, ErrReceiptsDisabled
+	}
+	file, err := p.config.Receipts.Open(hash)
+	if err != nil {
+		return Image{}, fmt.Errorf("opening receipt: %w", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return Image{}, fmt.Errorf("reading receipt: %w", err)
+	}
+	return Image{MediaType: mediaType, Data: data}, nil
+}
+
+// HandleAICategorizeReceipt accepts a photo of a receipt for AI categorization (protected).
+// The request is multipart/form-data with the photo in the "receipt" field (JPEG, PNG or WebP)
+// and optionally the fields of POST /v1/categorize: prompt, amount, transaction_date,
+// local_date, pre_settled and currency. The amount and date are read from the receipt unless given.
+func HandleAICategorizeReceipt(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for receipt categorization", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Read the photo, bounding the size of the whole request
+		r.Body = http.MaxBytesReader(w, r.Body, maxReceiptSize+1<<20)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Receipt too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			slog.Warn("failed to parse receipt upload", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Bad Request: Expected multipart/form-data", http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile("receipt")
+		if err != nil {
+			http.Error(w, "Bad Request: Missing receipt", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(io.LimitReader(file, maxReceiptSize+1))
+		if err != nil {
+			slog.Error("failed to read receipt upload", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(data) > maxReceiptSize {
+			http.Error(w, "Receipt too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Go by the content rather than the client's word
+		mediaType := http.DetectContentType(data)
+		if !receiptTypes[mediaType] {
+			http.Error(w, "Unsupported receipt type, expected JPEG, PNG or WebP", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// 2. Read the optional fields
+		payload := types.AICategorizationPayload{
+			Prompt:     strings.TrimSpace(r.FormValue("prompt")),
+			PreSettled: r.FormValue("pre_settled") == "true",
+		}
+		if amount := r.FormValue("amount"); amount != "" {
+			payload.Amount, err = money.Parse(amount)
+			if err != nil || payload.Amount < 0 {
+				http.Error(w, "Bad Request: Invalid amount", http.StatusBadRequest)
+				return
+			}
+		}
+		if date := r.FormValue("transaction_date"); date != "" {
+			payload.TransactionDate = &date
+		}
+		if date := r.FormValue("local_date"); date != "" {
+			payload.LocalDate = &date
+		}
+		if code := r.FormValue("currency"); code != "" {
+			payload.Currency = &code
+		}
+		transactionDate := parseTransactionDate(r, userID, payload)
+		if !checkCurrency(w, r, db, userID, &payload, transactionDate) {
+			return
+		}
+
+		// 3. Reject the job if the household used up its monthly AI quota
+		if !checkLLMQuota(w, r, db, userID) {
+			return
+		}
+
+		// 4. Store the receipt with a new job
+		params, err := categorizationParams(r, db, userID, payload)
+		if err != nil {
+			slog.Error("failed to prepare receipt categorization", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if transactionDate == nil {
+			params.LocalDate = localDate(r, userID, payload)
+		}
+		jobID, err := pool.AddReceiptJob(params, transactionDate, Image{MediaType: mediaType, Data: data})
+		if err != nil {
+			if errors.Is(err, ErrReceiptsDisabled) {
+				http.Error(w, "Receipt uploads are not available", http.StatusServiceUnavailable)
+				return
+			}
+			slog.Error("failed to add receipt categorization job", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Receipt categorization job added", "url", r.URL, "user_id", userID, "job_id", jobID, "size", len(data), "media_type", mediaType)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]int64{"job_id": jobID})
+	}
+}
+
+// HandleGetReceipt serves the receipt photo of an AI job to the buyer's household.
+func HandleGetReceipt(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for getting receipt", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		jobID, ok := householdJobFromPath(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		receipt, err := pool.Receipt(jobID)
+		if err != nil {
+			if errors.Is(err, ErrNoReceipt) || errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, "Receipt not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("failed to load receipt", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", receipt.MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(receipt.Data)))
+		w.Header().Set("Cache-Control", "private, max-age=86400") // Receipts never change
+		if _, err := w.Write(receipt.Data); err != nil {
+			slog.Warn("failed to write receipt", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package category
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~relay/sapp-backend/attachment"
+)
+
+// testReceipt is the start of a PNG file, enough for content sniffing.
+var testReceipt = Image{MediaType: "image/png", Data: []byte("\x89PNG\r\n\x1a\nreceipt")}
+
+func TestProcessReceiptJob(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	api := NewFakeModelAPI(FakeAnswer(`{"ambiguity_flag": "", "total_amount": 45, "spendings": [
+		{"apportion_mode": "shared", "category": "Groceries", "amount": 30, "description": "Melk"},
+		{"apportion_mode": "alone", "category": "Groceries", "amount": 15, "description": "Sjokolade"}
+	]}`))
+	config := DefaultPoolConfig()
+	config.Receipts = attachment.NewStore(t.TempDir())
+	pool := NewCategorizingPool(db, config, api)
+
+	params := CategorizationParams{Buyer: Person{Id: buyerID, Name: "Demo"}, SharedWith: &Person{Id: partnerID, Name: "Partner"}, Prompt: "sjokoladen er min"}
+	jobID, err := pool.AddReceiptJob(params, nil, testReceipt)
+	if err != nil {
+		t.Fatalf("AddReceiptJob() error = %v", err)
+	}
+
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	job, err = pool.GetStatus(jobID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if job.Status != jobStatusCompleted || job.Result == nil || len(job.Result.Spendings) != 2 || job.TotalAmount != 4500 {
+		t.Fatalf("after processing job = %+v, expected completed with two spendings of 45", job)
+	}
+
+	// The receipt was sent to the model along with the prompt
+	images := api.Images()
+	if len(images) != 1 || len(images[0]) != 1 || !bytes.Equal(images[0][0].Data, testReceipt.Data) {
+		t.Fatalf("expected the receipt to be sent once, got %v", images)
+	}
+	if prompt := api.Prompts()[0]; !strings.Contains(prompt, "kvitteringen") || !strings.Contains(prompt, "sjokoladen er min") {
+		t.Errorf("expected the prompt to mention the receipt and the description, got: %s", prompt)
+	}
+
+	receipt, err := pool.Receipt(jobID)
+	if err != nil || receipt.MediaType != "image/png" || !bytes.Equal(receipt.Data, testReceipt.Data) {
+		t.Errorf("Receipt() = %v, %v, expected the uploaded receipt", receipt.MediaType, err)
+	}
+}
+
+func TestProcessReceiptJobWithoutVision(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	config := DefaultPoolConfig()
+	config.Receipts = attachment.NewStore(t.TempDir())
+	pool := NewCategorizingPool(db, config, stubModelAPI{content: `{}`}) // Text only
+
+	jobID, err := pool.AddReceiptJob(CategorizationParams{Buyer: Person{Id: buyerID, Name: "Demo"}}, nil, testReceipt)
+	if err != nil {
+		t.Fatalf("AddReceiptJob() error = %v", err)
+	}
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	job, err = pool.GetStatus(jobID)
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	if job.Status != jobStatusDeadLetter {
+		t.Fatalf("job status = %q, expected %q for a model that cannot read images", job.Status, jobStatusDeadLetter)
+	}
+
+	pool.config.Receipts = nil
+	if _, err := pool.AddReceiptJob(CategorizationParams{Buyer: Person{Id: buyerID}}, nil, testReceipt); err != ErrReceiptsDisabled {
+		t.Errorf("AddReceiptJob() without receipt store error = %v, expected ErrReceiptsDisabled", err)
+	}
+}
+
+func TestRemoveReceipts(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, _ := poolTestUsers(t, db)
+	config := DefaultPoolConfig()
+	config.Receipts = attachment.NewStore(t.TempDir())
+	pool := NewCategorizingPool(db, config, NewFakeModelAPI())
+
+	// The same photo uploaded twice is stored once
+	var jobIDs []int64
+	for range 2 {
+		jobID, err := pool.AddReceiptJob(CategorizationParams{Buyer: Person{Id: buyerID, Name: "Demo"}}, nil, testReceipt)
+		if err != nil {
+			t.Fatalf("AddReceiptJob() error = %v", err)
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	job, err := pool.GetStatus(jobIDs[0])
+	if err != nil {
+		t.Fatalf("GetStatus() error = %v", err)
+	}
+	hash := job.ReceiptSHA256
+
+	// remove deletes a job and its receipt, as deleting a job from history does
+	remove := func(jobID int64) {
+		t.Helper()
+		hashes, err := JobReceipts(db, "SELECT ?", jobID)
+		if err != nil || len(hashes) != 1 || hashes[0] != hash {
+			t.Fatalf("JobReceipts() = %v, %v, expected [%s]", hashes, err, hash)
+		}
+		if _, err := db.Exec("DELETE FROM ai_categorization_jobs WHERE id = ?", jobID); err != nil {
+			t.Fatalf("deleting job: %v", err)
+		}
+		pool.RemoveReceipts(hashes)
+	}
+
+	remove(jobIDs[0])
+	if _, err := pool.Receipt(jobIDs[1]); err != nil {
+		t.Errorf("expected the other job to keep the receipt, got %v", err)
+	}
+
+	remove(jobIDs[1])
+	if _, err := config.Receipts.Open(hash); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the receipt to be removed with its last job, got %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package category
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// ErrNotInReview is returned when resolving a job that is not flagged as ambiguous.
+var ErrNotInReview = errors.New("job is not awaiting review")
+
+// ErrJobSettled is returned when changing the spendings of a job after they were settled.
+var ErrJobSettled = errors.New("job's spendings are already settled")
+
+// ErrInvalidSpendings is returned when spendings given by the user do not fit the job.
+var ErrInvalidSpendings = errors.New("invalid spendings")
+
+// ReviewEdit corrects what the model made of a job in review.
+type ReviewEdit struct {
+	Spendings       []Spendings  // Replace the job's spendings
+	TotalAmount     money.Amount // Corrected total, 0 to keep the job's
+	TransactionDate *time.Time   // Corrected date, nil to keep the job's
+}
+
+// ResolveReview clears the ambiguity flag of a completed job, keeping it as it is if edit is
+// nil and applying the edit otherwise. The edited spendings are validated like model output.
+func (p *CategorizingPool) ResolveReview(jobID int64, edit *ReviewEdit) error {
+	job, err := p.reviewedJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if edit != nil {
+		params, err := p.jobParams(job)
+		if err != nil {
+			return err
+		}
+		if edit.TotalAmount > 0 {
+			params.TotalAmount = edit.TotalAmount
+		}
+		if err := validateResult(JobResult{Spendings: edit.Spendings}, params); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSpendings, err)
+		}
+
+		settledAt, err := removeJobSpendings(tx, job)
+		if err != nil {
+			return err
+		}
+		transactionDate := time.Now().UTC()
+		if edit.TransactionDate != nil {
+			transactionDate = *edit.TransactionDate
+		} else if job.TransactionDate != nil {
+			transactionDate = *job.TransactionDate
+		}
+		if err := p.insertSpendings(tx, job.Id, job.Buyer, params.others(), edit.Spendings, job.Currency, transactionDate, settledAt); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE ai_categorization_jobs SET total_amount = ?, transaction_date = ? WHERE id = ?",
+			params.TotalAmount, transactionDate, job.Id); err != nil {
+			return fmt.Errorf("db error updating job: %w", err)
+		}
+	}
+
+	// Only while still flagged, so a concurrent resolution is not applied twice
+	res, err := tx.Exec(`
+		UPDATE ai_categorization_jobs
+		SET is_ambiguity_flagged = 0, ambiguity_resolved_at = ?, status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ? AND is_ambiguity_flagged = 1
+	`, time.Now().UTC(), job.Id, jobStatusCompleted)
+	if err := requireReviewUpdate(res, err); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	p.publishJobEvent(job.Id)
+	return nil
+}
+
+// Clarify appends the user's answer to the model's question to the prompt of a flagged job,
+// in the buyer's language, removes the spendings it produced and queues it to be categorized
+// again, with a fresh set of attempts.
+func (p *CategorizingPool) Clarify(jobID int64, clarification string) error {
+	job, err := p.reviewedJob(jobID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := removeJobSpendings(tx, job); err != nil {
+		return err
+	}
+
+	// Labelled in the language the job is categorized in again
+	var language string
+	if err := tx.QueryRow("SELECT language FROM users WHERE id = ?", job.Buyer).Scan(&language); err != nil {
+		return fmt.Errorf("failed to query language of buyer: %w", err)
+	}
+	prompt, err := promptTemplateFor(language).render("clarification", clarificationData{Prompt: job.Prompt, Clarification: clarification})
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`
+		UPDATE ai_categorization_jobs
+		SET prompt = ?, status = ?, is_finished = 0, is_ambiguity_flagged = 0, ambiguity_flag_reason = NULL,
+			ambiguity_resolved_at = ?, error_message = NULL, attempts = 0, next_attempt_at = NULL,
+			status_updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = ? AND is_ambiguity_flagged = 1
+	`, prompt, jobStatusPending, time.Now().UTC(), job.Id, jobStatusCompleted)
+	if err := requireReviewUpdate(res, err); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	p.publishJobEvent(job.Id)
+	p.wake()
+	return nil
+}
+
+// clarificationData is what the "clarification" template is rendered with.
+type clarificationData struct {
+	Prompt        string // The job's prompt so far
+	Clarification string // The user's answer
+}
+
+// reviewedJob loads a job that is in the review queue: completed and flagged as ambiguous.
+func (p *CategorizingPool) reviewedJob(jobID int64) (Job, error) {
+	job, err := p.GetStatus(jobID)
+	if err != nil {
+		return Job{}, err
+	}
+	if job.Status != jobStatusCompleted || job.Result == nil || !job.Result.IsAmbiguityFlagged {
+		return Job{}, ErrNotInReview
+	}
+	return job, nil
+}
+
+// requireReviewUpdate checks that the update of a job in review changed it, i.e. that it
+// was still flagged.
+func requireReviewUpdate(res sql.Result, err error) error {
+	if err != nil {
+		return fmt.Errorf("db error resolving job: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("db error resolving job: %w", err)
+	} else if n == 0 {
+		return ErrNotInReview
+	}
+	return nil
+}
+
+// removeJobSpendings deletes the spendings of a job, so they can be replaced. Settled spendings
+// are kept (ErrJobSettled) unless the job was pre-settled, in which case the settlement time is
+// returned for the replacements.
+func removeJobSpendings(tx *sql.Tx, job Job) (sql.NullTime, error) {
+	settledAt, err := jobSettlement(tx, job.Id)
+	if errors.Is(err, ErrPartlySettled) || (err == nil && settledAt.Valid && !job.PreSettled) {
+		return sql.NullTime{}, ErrJobSettled
+	}
+	if err != nil {
+		return sql.NullTime{}, err
+	}
+	if job.PreSettled && !settledAt.Valid {
+		settledAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+	if err := deleteJobSpendings(tx, job.Id); err != nil {
+		return sql.NullTime{}, err
+	}
+	return settledAt, nil
+}
+
+// HandleGetReviewQueue lists the household's jobs that the AI flagged as ambiguous and that
+// no one has resolved yet, oldest first, with their spendings.
+func HandleGetReviewQueue(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for review queue", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Find the flagged jobs of the household's members
+		memberIDs, err := household.OtherMemberIDs(db, userID)
+		if err != nil {
+			slog.Error("failed to query household members for review queue", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		memberIDs = append(memberIDs, userID)
+		placeholders := make([]string, len(memberIDs))
+		args := []interface{}{jobStatusCompleted}
+		for i, id := range memberIDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		rows, err := db.Query(fmt.Sprintf(`
+			SELECT id FROM ai_categorization_jobs
+			WHERE status = ? AND is_ambiguity_flagged = 1 AND buyer IN (%s)
+			ORDER BY id ASC
+		`, strings.Join(placeholders, ",")), args...)
+		if err != nil {
+			slog.Error("failed to query review queue", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		var jobIDs []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				slog.Error("failed to scan review queue job", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			jobIDs = append(jobIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			slog.Error("failed to iterate review queue", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// 2. Load each job as GET /v1/jobs/{job_id} shows it
+		queue := make([]types.JobResponse, 0, len(jobIDs))
+		for _, id := range jobIDs {
+			resp, err := loadJobResponse(db, id, userID)
+			if err != nil {
+				slog.Error("failed to load job for review queue", "url", r.URL, "user_id", userID, "job_id", id, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			queue = append(queue, resp)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(queue); err != nil {
+			slog.Error("failed to encode review queue", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// HandleResolveReview resolves a job in the review queue. Any household member may accept the
+// spendings as they are, replace them with edited ones, or answer the model's question, which
+// categorizes the purchase again with the answer appended to the prompt.
+func HandleResolveReview(db *sql.DB, pool CategorizingPoolStrategy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for resolving review", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Get the job from the path, if it is the household's
+		jobID, ok := householdJobFromPath(w, r, db, userID)
+		if !ok {
+			return
+		}
+
+		// 2. Decode the payload and apply the action
+		var payload types.ResolveReviewPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode review resolution request body", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Bad Request: Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch payload.Action {
+		case types.ReviewActionAccept:
+			err = pool.ResolveReview(jobID, nil)
+		case types.ReviewActionEdit:
+			if len(payload.Spendings) == 0 {
+				http.Error(w, "Bad Request: No spendings", http.StatusBadRequest)
+				return
+			}
+			edit := &ReviewEdit{Spendings: make([]Spendings, 0, len(payload.Spendings))}
+			if payload.Amount != nil {
+				if *payload.Amount <= 0 {
+					http.Error(w, "Bad Request: Invalid amount", http.StatusBadRequest)
+					return
+				}
+				edit.TotalAmount = *payload.Amount
+			}
+			if payload.TransactionDate != nil {
+				date, err := time.Parse(dateLayout, *payload.TransactionDate)
+				if err != nil {
+					http.Error(w, "Bad Request: Invalid transaction_date, expected YYYY-MM-DD", http.StatusBadRequest)
+					return
+				}
+				edit.TransactionDate = &date
+			}
+			for _, s := range payload.Spendings {
+				if s.Amount <= 0 {
+					http.Error(w, "Bad Request: Spending amounts must be positive", http.StatusBadRequest)
+					return
+				}
+				edit.Spendings = append(edit.Spendings, Spendings{
+					Category:      s.Category,
+					Amount:        s.Amount,
+					ApportionMode: s.ApportionMode,
+					Description:   s.Description,
+					SharedWith:    s.SharedWith,
+				})
+			}
+			err = pool.ResolveReview(jobID, edit)
+		case types.ReviewActionClarify:
+			clarification := strings.TrimSpace(payload.Clarification)
+			if clarification == "" {
+				http.Error(w, "Bad Request: Missing clarification", http.StatusBadRequest)
+				return
+			}
+			// Clarifying categorizes the purchase again, so it counts against the quota
+			if !checkLLMQuota(w, r, db, userID) {
+				return
+			}
+			err = pool.Clarify(jobID, clarification)
+		default:
+			http.Error(w, "Bad Request: Action must be accept, edit or clarify", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNotInReview), errors.Is(err, ErrJobSettled):
+			http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, ErrInvalidSpendings), errors.Is(err, ErrUnknownCategory), errors.Is(err, currency.ErrNoRate):
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		default:
+			slog.Error("failed to resolve AI job review", "url", r.URL, "user_id", userID, "job_id", jobID, "action", payload.Action, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("AI job review resolved", "url", r.URL, "user_id", userID, "job_id", jobID, "action", payload.Action)
+
+		// 3. Respond with the job's new state
+		resp, err := loadJobResponse(db, jobID, userID)
+		if err != nil {
+			slog.Error("failed to load resolved AI job", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode resolved AI job", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+const (
+	// statsWindow is how far back the spendings the typical amounts are based on go.
+	statsWindow = 365 * 24 * time.Hour
+	// minStatsSamples is how many spendings a category needs before its typical amounts are used.
+	minStatsSamples = 5
+	// outlierFence is how many interquartile ranges outside the quartiles an amount is flagged at.
+	outlierFence = 3.0
+)
+
+// AmountStats are the typical amounts of the spendings in a category of a household.
+type AmountStats struct {
+	Count  int // Spendings the statistics are based on
+	Median money.Amount
+	Q1     money.Amount // First quartile
+	Q3     money.Amount // Third quartile
+}
+
+// IsOutlier reports whether the amount is far outside the usual range. The spread is at least
+// a quarter of the median, so categories that always cost the same, like rent, are not flagged
+// over small changes.
+func (s AmountStats) IsOutlier(amount money.Amount) bool {
+	spread := max(s.Q3-s.Q1, s.Median/4)
+	return amount > s.Q3+outlierFence*spread || amount < s.Q1-outlierFence*spread
+}
+
+// RecomputeStats replaces the typical amounts of every household's categories with those of
+// the spendings of the last year. Categories with fewer than minStatsSamples spendings get none.
+func RecomputeStats(db *sql.DB) error {
+	// 1. Collect the amounts by household and category. Spendings belong to the household of
+	// whoever made them.
+	rows, err := db.Query(`
+		SELECT m.household_id, s.category, s.amount, s.spending_date
+		FROM spendings s
+		JOIN household_members m ON m.user_id = s.made_by
+	`)
+	if err != nil {
+		return fmt.Errorf("querying spendings: %w", err)
+	}
+	defer rows.Close()
+
+	type key struct{ householdID, categoryID int64 }
+	amounts := map[key][]money.Amount{}
+	since := time.Now().UTC().Add(-statsWindow)
+	for rows.Next() {
+		var k key
+		var amount money.Amount
+		var date time.Time
+		if err := rows.Scan(&k.householdID, &k.categoryID, &amount, &date); err != nil {
+			return fmt.Errorf("scanning spending: %w", err)
+		}
+		if date.Before(since) {
+			continue
+		}
+		amounts[k] = append(amounts[k], amount)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterating spendings: %w", err)
+	}
+
+	// 2. Replace the statistics
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM category_stats"); err != nil {
+		return fmt.Errorf("deleting category stats: %w", err)
+	}
+	now := time.Now().UTC()
+	for k, values := range amounts {
+		if len(values) < minStatsSamples {
+			continue
+		}
+		s := amountStats(values)
+		_, err := tx.Exec(`
+			INSERT INTO category_stats (household_id, category_id, count, median, q1, q3, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, k.householdID, k.categoryID, s.Count, s.Median, s.Q1, s.Q3, now)
+		if err != nil {
+			return fmt.Errorf("inserting stats of category %d in household %d: %w", k.categoryID, k.householdID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// RecomputeStatsEvery recomputes the typical amounts right away and then at every interval,
+// until ctx is done.
+func RecomputeStatsEvery(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := RecomputeStats(db); err != nil {
+			slog.Error("failed to recompute category stats", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// amountStats computes the statistics of the amounts, interpolating between the closest
+// amounts for the quartiles and rounding to the minor unit.
+func amountStats(values []money.Amount) AmountStats {
+	sorted := append([]money.Amount(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	quantile := func(q float64) money.Amount {
+		pos := q * float64(len(sorted)-1)
+		lower := int(math.Floor(pos))
+		if lower+1 >= len(sorted) {
+			return sorted[lower]
+		}
+		return sorted[lower] + money.Amount(math.Round((pos-float64(lower))*float64(sorted[lower+1]-sorted[lower])))
+	}
+	return AmountStats{Count: len(sorted), Median: quantile(0.5), Q1: quantile(0.25), Q3: quantile(0.75)}
+}
+
+// HouseholdStats returns the typical amounts of the categories of the user's household, by
+// category name. Empty if the user is not in a household.
+func HouseholdStats(q household.Querier, userID int64) (map[string]AmountStats, error) {
+	stats := map[string]AmountStats{}
+	householdID, ok := household.GetHouseholdID(q, userID)
+	if !ok {
+		return stats, nil
+	}
+	rows, err := q.Query(`
+		SELECT c.name, cs.count, cs.median, cs.q1, cs.q3
+		FROM category_stats cs
+		JOIN categories c ON c.id = cs.category_id
+		WHERE cs.household_id = ?
+	`, householdID)
+	if err != nil {
+		return nil, fmt.Errorf("querying category stats: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var s AmountStats
+		if err := rows.Scan(&name, &s.Count, &s.Median, &s.Q1, &s.Q3); err != nil {
+			return nil, fmt.Errorf("scanning category stats: %w", err)
+		}
+		stats[name] = s
+	}
+	return stats, rows.Err()
+}
+
+// flagOutliers flags the result as ambiguous for every spending far outside the usual range of
+// its category, so a 4000 kr coffee gets a second look. The reasons are in the language of the
+// prompts and added to any the model gave.
+func flagOutliers(t *promptTemplate, params CategorizationParams, stats map[string]AmountStats, result *JobResult) {
+	var reasons []string
+	if result.AmbiguityFlagReason != "" {
+		reasons = append(reasons, result.AmbiguityFlagReason)
+	}
+	currency := t.currency(params.currency())
+	for _, spending := range result.Spendings {
+		s, ok := stats[spending.Category]
+		if !ok || s.Count < minStatsSamples || !s.IsOutlier(spending.Amount) {
+			continue
+		}
+		reason, err := t.render("outlier", outlierData{
+			Category: spending.Category,
+			Amount:   spending.Amount.Format(),
+			Low:      s.Q1.Format(),
+			High:     s.Q3.Format(),
+			Currency: currency,
+		})
+		if err != nil {
+			slog.Error("failed to render outlier reason", "job_id", params.JobID, "err", err)
+			continue
+		}
+		reasons = append(reasons, reason)
+		result.IsAmbiguityFlagged = true
+	}
+	result.AmbiguityFlagReason = strings.Join(reasons, " ")
+}
+
+// outlierData is what the "outlier" template is rendered with.
+type outlierData struct {
+	Category  string
+	Amount    string
+	Low, High string // Usual range, the quartiles
+	Currency  promptCurrency
+}
@@ -0,0 +1,85 @@
+package category
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+func TestAmountStats(t *testing.T) {
+	s := amountStats([]money.Amount{6000, 4000, 5000, 4500, 5500})
+	if s.Count != 5 || s.Median != 5000 || s.Q1 != 4500 || s.Q3 != 5500 {
+		t.Fatalf("amountStats() = %+v, expected median 50 between 45 and 55", s)
+	}
+	for _, tt := range []struct {
+		amount  money.Amount
+		outlier bool
+	}{
+		{5000, false},
+		{8500, false}, // Within three spreads of the third quartile
+		{400000, true},
+	} {
+		if got := s.IsOutlier(tt.amount); got != tt.outlier {
+			t.Errorf("IsOutlier(%v) = %v, expected %v", tt.amount, got, tt.outlier)
+		}
+	}
+
+	// Categories that always cost the same still tolerate small changes
+	rent := amountStats([]money.Amount{1000000, 1000000, 1000000, 1000000, 1000000})
+	if rent.IsOutlier(1050000) || !rent.IsOutlier(3000000) {
+		t.Errorf("unexpected outliers for a constant category: %+v", rent)
+	}
+}
+
+func TestProcessJobFlagsOutliers(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	var coffeeID int64
+	if err := db.QueryRow("SELECT id FROM categories WHERE name = 'Coffee'").Scan(&coffeeID); err != nil {
+		t.Fatalf("querying category: %v", err)
+	}
+	now := time.Now().UTC()
+	for _, amount := range []money.Amount{4000, 4500, 5000, 5500, 6000} {
+		if _, err := db.Exec("INSERT INTO spendings (amount, category, made_by, spending_date) VALUES (?, ?, ?, ?)", amount, coffeeID, partnerID, now); err != nil {
+			t.Fatalf("inserting spending: %v", err)
+		}
+	}
+	// Too old to count
+	if _, err := db.Exec("INSERT INTO spendings (amount, category, made_by, spending_date) VALUES (?, ?, ?, ?)", money.Amount(900000), coffeeID, buyerID, now.Add(-2*statsWindow)); err != nil {
+		t.Fatalf("inserting spending: %v", err)
+	}
+	if err := RecomputeStats(db); err != nil {
+		t.Fatalf("RecomputeStats() error = %v", err)
+	}
+
+	api := NewFakeModelAPI(FakeAnswer(`{"ambiguity_flag": "", "spendings": [
+		{"apportion_mode": "alone", "category": "Coffee", "amount": 4000, "description": "Kaffe"},
+		{"apportion_mode": "alone", "category": "Coffee", "amount": 50, "description": "Kaffe"}
+	]}`))
+	pool := NewCategorizingPool(db, DefaultPoolConfig(), api)
+	jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "kaffe", 4050, "pending", false)
+
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	prompts := api.Prompts()
+	if len(prompts) != 1 || !strings.Contains(prompts[0], "- Coffee (vanligvis 45–55 kr, median 50 kr)") {
+		t.Fatalf("expected the prompt to have the typical amounts, got: %v", prompts)
+	}
+
+	var flagged bool
+	var reason string
+	if err := db.QueryRow("SELECT is_ambiguity_flagged, ambiguity_flag_reason FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&flagged, &reason); err != nil {
+		t.Fatalf("querying job: %v", err)
+	}
+	if expected := "4000 kr er uvanlig for Coffee, som vanligvis koster 45–55 kr."; !flagged || reason != expected {
+		t.Fatalf("job flagged = %v with reason %q, expected %q", flagged, reason, expected)
+	}
+}
@@ -0,0 +1,197 @@
+package category
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultLanguage is the language of the prompts unless the buyer chose another one.
+const DefaultLanguage = "nb"
+
+// promptFiles holds the prompt templates as prompts/<language>/v<version>.tmpl. A changed
+// wording goes into a new version, so the template a job was categorized with stays known.
+// Every version is kept and loaded: new jobs use the latest, and the version recorded on an
+// older job can still be rendered, e.g. to evaluate it against the latest.
+//
+//go:embed prompts
+var promptFiles embed.FS
+
+// promptTemplate is one version of the prompts in a language. The latest version defines the
+// templates "system", "categorize" and "segment", rendered with promptData, "outlier", rendered
+// with outlierData, and "clarification", rendered with clarificationData. Along with those come
+// "weekdays" (the names from Sunday, space-separated), "currency <code>" for the name of each
+// currency it knows and the plain "flag ..." reasons for flagging a result, see checkExtracted.
+type promptTemplate struct {
+	ID       string // Recorded on the jobs it categorizes, e.g. "nb/v2"
+	Language string
+	Version  int
+	tmpl     *template.Template
+}
+
+// promptVersions holds every version of the prompts by ID, and promptTemplates the latest
+// version of each language.
+var promptVersions, promptTemplates = loadPromptTemplates()
+
+// loadPromptTemplates parses the embedded prompt templates. The latest version of a language
+// must define every template; an older version takes the templates added since from it, so it
+// renders with the same data. The templates are part of the binary, so they must parse.
+func loadPromptTemplates() (versions, latest map[string]*promptTemplate) {
+	files, err := fs.Glob(promptFiles, "prompts/*/v*.tmpl")
+	if err != nil {
+		panic(err)
+	}
+	versions = map[string]*promptTemplate{}
+	latest = map[string]*promptTemplate{}
+	for _, file := range files {
+		language := path.Base(path.Dir(file))
+		version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path.Base(file), "v"), ".tmpl"))
+		if err != nil {
+			panic(fmt.Sprintf("prompt template %s: version is not a number", file))
+		}
+		t := &promptTemplate{
+			ID:       fmt.Sprintf("%s/v%d", language, version),
+			Language: language,
+			Version:  version,
+			tmpl:     template.Must(template.ParseFS(promptFiles, file)),
+		}
+		versions[t.ID] = t
+		if l, ok := latest[language]; !ok || l.Version < version {
+			latest[language] = t
+		}
+	}
+
+	for _, t := range latest {
+		for _, name := range []string{"system", "categorize", "segment", "outlier", "weekdays", "clarification", "flag no total", "flag future date", "flag old date"} {
+			if t.tmpl.Lookup(name) == nil {
+				panic(fmt.Sprintf("prompt template %s does not define %q", t.ID, name))
+			}
+		}
+	}
+	for _, t := range versions {
+		l := latest[t.Language]
+		if t == l {
+			continue
+		}
+		for _, added := range l.tmpl.Templates() {
+			if added.Name() == l.tmpl.Name() || t.tmpl.Lookup(added.Name()) != nil {
+				continue // The file itself, or a template the version has its own wording of
+			}
+			if _, err := t.tmpl.AddParseTree(added.Name(), added.Tree); err != nil {
+				panic(fmt.Sprintf("prompt template %s: adding %q of %s: %v", t.ID, added.Name(), l.ID, err))
+			}
+		}
+	}
+	if latest[DefaultLanguage] == nil {
+		panic("no prompt template for the default language " + DefaultLanguage)
+	}
+	return versions, latest
+}
+
+// PromptLanguages returns the languages there are prompts for, sorted.
+func PromptLanguages() []string {
+	languages := make([]string, 0, len(promptTemplates))
+	for language := range promptTemplates {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// HasPromptLanguage reports whether there are prompts in the language.
+func HasPromptLanguage(language string) bool {
+	return promptTemplates[language] != nil
+}
+
+// HasPromptTemplate reports whether there is a version of the prompts with the ID, e.g. "nb/v1".
+func HasPromptTemplate(id string) bool {
+	return promptVersions[id] != nil
+}
+
+// promptTemplateFor returns the latest prompts in the language, or in DefaultLanguage if
+// there are none in it.
+func promptTemplateFor(language string) *promptTemplate {
+	if t, ok := promptTemplates[language]; ok {
+		return t
+	}
+	return promptTemplates[DefaultLanguage]
+}
+
+// render executes the named template.
+func (t *promptTemplate) render(name string, data any) (string, error) {
+	var sb strings.Builder
+	if err := t.tmpl.ExecuteTemplate(&sb, name, data); err != nil {
+		return "", fmt.Errorf("rendering prompt template %s %q: %w", t.ID, name, err)
+	}
+	return sb.String(), nil
+}
+
+// system returns the system message sent before the prompts.
+func (t *promptTemplate) system() string {
+	return t.text("system")
+}
+
+// text renders one of the templates that are plain text, such as the system message and the
+// flag reasons.
+func (t *promptTemplate) text(name string) string {
+	s, err := t.render(name, nil)
+	if err != nil {
+		panic(err) // Plain text, checked when loading
+	}
+	return s
+}
+
+// weekday returns the name of the weekday of a YYYY-MM-DD date, so the model can resolve
+// dates like "på fredag". Empty if the date is invalid.
+func (t *promptTemplate) weekday(date string) string {
+	d, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return ""
+	}
+	names, err := t.render("weekdays", nil)
+	if err != nil {
+		return ""
+	}
+	if days := strings.Fields(names); len(days) == 7 {
+		return days[d.Weekday()]
+	}
+	return ""
+}
+
+// currency returns how the prompts refer to the currency with the ISO 4217 code.
+func (t *promptTemplate) currency(code string) promptCurrency {
+	c := promptCurrency{Code: code, Name: code, Unit: code}
+	if unit, ok := currencyUnits[code]; ok {
+		c.Unit = unit
+	}
+	if t.tmpl.Lookup("currency "+code) != nil {
+		if name, err := t.render("currency "+code, nil); err == nil {
+			c.Name = name
+		}
+	}
+	return c
+}
+
+// currencyUnits are the short forms of amounts in the examples of the prompts, e.g. "45 kr".
+// Other currencies use their code.
+var currencyUnits = map[string]string{
+	"NOK": "kr",
+	"SEK": "kr",
+	"DKK": "kr",
+	"EUR": "€",
+	"USD": "$",
+	"GBP": "£",
+}
+
+// promptCurrency is the household's currency as the prompts refer to it.
+type promptCurrency struct {
+	Code string // ISO 4217, e.g. "SEK"
+	Name string // In the language of the prompts, e.g. "kroner"
+	Unit string // Short form after amounts, e.g. "kr"
+}
@@ -0,0 +1,128 @@
+package category
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestPromptTemplatesLoad(t *testing.T) {
+	for _, language := range []string{"nb", "sv", "de"} {
+		if !HasPromptLanguage(language) {
+			t.Errorf("expected prompts in %q", language)
+		}
+	}
+	if got := promptTemplateFor("xx"); got.Language != DefaultLanguage {
+		t.Errorf("promptTemplateFor(unknown) = %s, expected the default language", got.ID)
+	}
+	if got := promptTemplateFor("nb").weekday("2024-05-03"); got != "fredag" {
+		t.Errorf("weekday() = %q, expected fredag", got)
+	}
+	if got := promptTemplateFor("de").currency("CHF"); got.Name != "Schweizer Franken" || got.Unit != "CHF" {
+		t.Errorf("currency(CHF) = %+v", got)
+	}
+	if got := promptTemplateFor("sv").currency("JPY"); got.Name != "JPY" {
+		t.Errorf("currency() of an unnamed currency = %+v, expected the code", got)
+	}
+	got, err := promptTemplateFor("de").render("clarification", clarificationData{Prompt: "Wein", Clarification: "nur für mich"})
+	if want := "Wein\n\nKlarstellung: nur für mich"; err != nil || got != want {
+		t.Errorf("render(clarification) = %q, %v, expected %q", got, err, want)
+	}
+}
+
+func TestPromptTemplateVersions(t *testing.T) {
+	for _, id := range []string{"nb/v1", "sv/v1", "de/v1"} {
+		if !HasPromptTemplate(id) {
+			t.Errorf("expected the prompts %q to be kept", id)
+		}
+	}
+	if HasPromptTemplate("nb/v99") {
+		t.Error("HasPromptTemplate(nb/v99) = true, expected false")
+	}
+
+	// An older version takes the templates added since from the latest
+	v1, latest := promptVersions["nb/v1"], promptTemplateFor("nb")
+	if got, want := v1.text("flag no total"), latest.text("flag no total"); got != want {
+		t.Errorf("nb/v1 text(flag no total) = %q, expected %q", got, want)
+	}
+
+	db := setupPoolTestDB(t)
+	defer db.Close()
+	buyerID, _ := poolTestUsers(t, db)
+	api := NewFakeModelAPI(FakeSpendings(Spendings{Category: "Groceries", Amount: 3000, ApportionMode: "alone"}))
+	params := CategorizationParams{TotalAmount: 3000, Buyer: Person{Id: buyerID, Name: "Demo"}, Prompt: "food", PromptTemplate: "nb/v1"}
+	result, err := ProcessCategorizationJob(context.Background(), db, api, params)
+	if err != nil {
+		t.Fatalf("ProcessCategorizationJob() error = %v", err)
+	}
+	if result.PromptTemplate != "nb/v1" {
+		t.Errorf("PromptTemplate = %q, expected nb/v1", result.PromptTemplate)
+	}
+	want, err := getPrompt(db, v1, params, nil)
+	if err != nil {
+		t.Fatalf("rendering nb/v1: %v", err)
+	}
+	if prompts := api.Prompts(); len(prompts) != 1 || prompts[0] != want {
+		t.Errorf("expected the nb/v1 prompt, got %q", prompts)
+	}
+}
+
+func TestProcessJobPromptLanguage(t *testing.T) {
+	tests := []struct {
+		language, currency string
+		expected           []string
+		system             string
+		template           string
+	}{
+		{"nb", "NOK", []string{"Totalbeløpet på kjøpet er 30 kroner.", "Kjøper: Demo"}, "Du er norsk og tenker på norsk.", "nb/v2"},
+		{"sv", "SEK", []string{"Totalbeloppet för köpet är 30 kronor.", "Köpare: Demo", "Totalbelopp: 100 kr"}, "Du är svensk och tänker på svenska.", "sv/v2"},
+		{"de", "EUR", []string{"Der Gesamtbetrag des Einkaufs ist 30 Euro.", "Käufer: Demo", "Gesamtbetrag: 100 €"}, "Du bist Deutscher und denkst auf Deutsch.", "de/v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			db := setupPoolTestDB(t)
+			defer db.Close()
+
+			buyerID, partnerID := poolTestUsers(t, db)
+			if _, err := db.Exec("UPDATE users SET language = ? WHERE id = ?", tt.language, buyerID); err != nil {
+				t.Fatalf("setting language: %v", err)
+			}
+			if _, err := db.Exec("UPDATE households SET currency = ?", tt.currency); err != nil {
+				t.Fatalf("setting currency: %v", err)
+			}
+			api := NewFakeModelAPI(FakeAnswer(`{"ambiguity_flag": "", "spendings": [
+				{"apportion_mode": "alone", "category": "Groceries", "amount": 30, "description": ""}
+			]}`))
+			pool := NewCategorizingPool(db, DefaultPoolConfig(), api)
+			jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "food", 30, "pending", false)
+
+			job, ok, err := pool.claimJob("worker")
+			if err != nil || !ok {
+				t.Fatalf("claimJob() = %v, %v", ok, err)
+			}
+			pool.processJob(1, "worker", job)
+
+			prompts, systems := api.Prompts(), api.Systems()
+			if len(prompts) != 1 || len(systems) != 1 {
+				t.Fatalf("expected one prompt, got %d", len(prompts))
+			}
+			for _, want := range tt.expected {
+				if !strings.Contains(prompts[0], want) {
+					t.Errorf("expected the prompt to contain %q, got: %s", want, prompts[0])
+				}
+			}
+			if systems[0] != tt.system {
+				t.Errorf("system message = %q, expected %q", systems[0], tt.system)
+			}
+
+			// The job records the template it was categorized with
+			var template string
+			if err := db.QueryRow("SELECT prompt_template FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&template); err != nil {
+				t.Fatalf("querying prompt template: %v", err)
+			}
+			if template != tt.template {
+				t.Errorf("prompt_template = %q, expected %q", template, tt.template)
+			}
+		})
+	}
+}
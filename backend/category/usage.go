@@ -0,0 +1,361 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// usageDateLayout is the format of the from/to parameters of the usage report.
+const usageDateLayout = "2006-01-02"
+
+// defaultUsageDays is the length of the usage report unless from is given.
+const defaultUsageDays = 30
+
+// ModelPrice is the price of a model in USD per million tokens.
+type ModelPrice struct {
+	Prompt     float64
+	Completion float64
+}
+
+// ParseModelPrices reads prices from a comma separated list of "model=prompt/completion"
+// entries in USD per million tokens, e.g. "openrouter:x-ai/grok-4-fast=0.20/0.50".
+// Model names are those of the model chain.
+func ParseModelPrices(spec string) (map[string]ModelPrice, error) {
+	prices := make(map[string]ModelPrice)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("price %q must have the form model=prompt/completion", entry)
+		}
+		promptPrice, completionPrice, ok := strings.Cut(entry[i+1:], "/")
+		if !ok {
+			return nil, fmt.Errorf("price %q must have the form model=prompt/completion", entry)
+		}
+		var price ModelPrice
+		var err1, err2 error
+		price.Prompt, err1 = strconv.ParseFloat(strings.TrimSpace(promptPrice), 64)
+		price.Completion, err2 = strconv.ParseFloat(strings.TrimSpace(completionPrice), 64)
+		if err := errors.Join(err1, err2); err != nil || price.Prompt < 0 || price.Completion < 0 {
+			return nil, fmt.Errorf("price %q is not a pair of non-negative numbers", entry)
+		}
+		prices[strings.TrimSpace(entry[:i])] = price
+	}
+	return prices, nil
+}
+
+// requestCost returns the cost of a request in USD: the cost reported by the provider if any,
+// otherwise the cost computed from the model's price. Unpriced models are free (e.g. local ones).
+func requestCost(model string, usage *Usage, prices map[string]ModelPrice) float64 {
+	if usage == nil {
+		return 0
+	}
+	if usage.Cost != nil {
+		return *usage.Cost
+	}
+	price := prices[model]
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1_000_000
+}
+
+// usageRecorder is a ModelAPI recording every request of a job in llm_usage.
+type usageRecorder struct {
+	api         ModelAPI
+	db          *sql.DB
+	prices      map[string]ModelPrice
+	jobID       sql.NullInt64 // NULL for requests outside a job, such as previews
+	userID      int64
+	householdID sql.NullInt64
+}
+
+// newUsageRecorder wraps api to record the requests made for the job of the buyer. A jobID of 0
+// records requests that belong to no job.
+func newUsageRecorder(db *sql.DB, api ModelAPI, prices map[string]ModelPrice, jobID, buyerID int64) *usageRecorder {
+	r := &usageRecorder{api: api, db: db, prices: prices, jobID: sql.NullInt64{Int64: jobID, Valid: jobID != 0}, userID: buyerID}
+	if householdID, ok := household.GetHouseholdID(db, buyerID); ok {
+		r.householdID = sql.NullInt64{Int64: householdID, Valid: true}
+	}
+	return r
+}
+
+func (r *usageRecorder) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	return r.record(func() (*ModelAPIResponse, error) { return r.api.Prompt(ctx, system, prompt) })
+}
+
+// PromptWithImages records requests with images like Prompt; they fail if the wrapped ModelAPI
+// cannot send images.
+func (r *usageRecorder) PromptWithImages(ctx context.Context, system, prompt string, images []Image) (*ModelAPIResponse, error) {
+	return r.record(func() (*ModelAPIResponse, error) { return promptModel(ctx, r.api, system, prompt, images) })
+}
+
+// record makes the request and records its usage.
+func (r *usageRecorder) record(request func() (*ModelAPIResponse, error)) (*ModelAPIResponse, error) {
+	start := time.Now()
+	res, err := request()
+	latency := time.Since(start)
+
+	var model, errMsg sql.NullString
+	var usage *Usage
+	if err != nil {
+		errMsg = sql.NullString{String: err.Error(), Valid: true}
+	} else {
+		usage = res.Usage
+		model = sql.NullString{String: modelName(res), Valid: modelName(res) != ""}
+	}
+	var promptTokens, completionTokens int
+	if usage != nil {
+		promptTokens, completionTokens = usage.PromptTokens, usage.CompletionTokens
+	}
+
+	// Accounting must not fail the job, so errors are only logged
+	_, dbErr := r.db.Exec(`
+		INSERT INTO llm_usage (job_id, user_id, household_id, model, prompt_tokens, completion_tokens, latency_ms, cost, error_message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, r.jobID, r.userID, r.householdID, model, promptTokens, completionTokens, latency.Milliseconds(),
+		requestCost(model.String, usage, r.prices), errMsg)
+	if dbErr != nil {
+		slog.Error("failed to record LLM usage", "job_id", r.jobID.Int64, "user_id", r.userID, "err", dbErr)
+	}
+	return res, err
+}
+
+// monthlyLLMCost returns what the household spent on model requests since the start of the month (UTC).
+func monthlyLLMCost(q household.Querier, householdID int64) (float64, error) {
+	var spent float64
+	err := q.QueryRow(`
+		SELECT COALESCE(SUM(cost), 0) FROM llm_usage
+		WHERE household_id = ? AND created_at >= datetime('now', 'start of month')
+	`, householdID).Scan(&spent)
+	return spent, err
+}
+
+// LLMQuotaExceeded reports whether the user's household has used up its monthly AI quota.
+// Users without a household, and households without a quota, are never limited.
+func LLMQuotaExceeded(q household.Querier, userID int64) (bool, error) {
+	householdID, ok := household.GetHouseholdID(q, userID)
+	if !ok {
+		return false, nil
+	}
+	var limit sql.NullFloat64
+	if err := q.QueryRow("SELECT llm_monthly_cost_limit FROM households WHERE id = ?", householdID).Scan(&limit); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("querying household quota: %w", err)
+	}
+	if !limit.Valid {
+		return false, nil
+	}
+	spent, err := monthlyLLMCost(q, householdID)
+	if err != nil {
+		return false, fmt.Errorf("querying household AI spending: %w", err)
+	}
+	return spent >= limit.Float64, nil
+}
+
+// HandleGetLLMUsage reports model usage per day and per user. The optional from and to
+// query parameters (YYYY-MM-DD, inclusive) default to the last 30 days. Admins only.
+func HandleGetLLMUsage(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := auth.GetUserIDFromContext(r.Context())
+
+		// 1. Parse the date range
+		to := time.Now().UTC()
+		if s := r.URL.Query().Get("to"); s != "" {
+			parsed, err := time.Parse(usageDateLayout, s)
+			if err != nil {
+				http.Error(w, "Invalid 'to' date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			to = parsed
+		}
+		from := to.AddDate(0, 0, -(defaultUsageDays - 1))
+		if s := r.URL.Query().Get("from"); s != "" {
+			parsed, err := time.Parse(usageDateLayout, s)
+			if err != nil {
+				http.Error(w, "Invalid 'from' date, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			from = parsed
+		}
+		if from.After(to) {
+			http.Error(w, "'from' must not be after 'to'", http.StatusBadRequest)
+			return
+		}
+		resp := types.LLMUsageResponse{
+			From:   from.Format(usageDateLayout),
+			To:     to.Format(usageDateLayout),
+			ByDay:  []types.LLMUsageDay{},
+			ByUser: []types.LLMUsageUser{},
+		}
+
+		// 2. Aggregate in total, per day and per user
+		const aggregates = `COUNT(*), COALESCE(SUM(u.error_message IS NOT NULL), 0), COALESCE(SUM(u.prompt_tokens), 0),
+			COALESCE(SUM(u.completion_tokens), 0), COALESCE(SUM(u.cost), 0), COALESCE(AVG(u.latency_ms), 0)`
+		const inRange = `date(u.created_at) BETWEEN ? AND ?`
+		statDest := func(s *types.LLMUsageStat) []any {
+			return []any{&s.Requests, &s.Failures, &s.PromptTokens, &s.CompletionTokens, &s.Cost, &s.AvgLatencyMs}
+		}
+
+		err := db.QueryRow(`SELECT `+aggregates+` FROM llm_usage u WHERE `+inRange, resp.From, resp.To).Scan(statDest(&resp.Total)...)
+		if err != nil {
+			slog.Error("failed to query total LLM usage", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		rows, err := db.Query(`SELECT date(u.created_at) AS day, `+aggregates+` FROM llm_usage u WHERE `+inRange+`
+			GROUP BY day ORDER BY day`, resp.From, resp.To)
+		if err != nil {
+			slog.Error("failed to query LLM usage per day", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var day types.LLMUsageDay
+			if err := rows.Scan(append([]any{&day.Day}, statDest(&day.LLMUsageStat)...)...); err != nil {
+				slog.Error("failed to scan LLM usage per day", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			resp.ByDay = append(resp.ByDay, day)
+		}
+		if err := rows.Err(); err != nil {
+			slog.Error("failed to iterate LLM usage per day", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		userRows, err := db.Query(`SELECT u.user_id, COALESCE(us.username, ''), `+aggregates+`
+			FROM llm_usage u LEFT JOIN users us ON us.id = u.user_id
+			WHERE `+inRange+` GROUP BY u.user_id ORDER BY SUM(u.cost) DESC, u.user_id`, resp.From, resp.To)
+		if err != nil {
+			slog.Error("failed to query LLM usage per user", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer userRows.Close()
+		for userRows.Next() {
+			var user types.LLMUsageUser
+			if err := userRows.Scan(append([]any{&user.UserID, &user.Username}, statDest(&user.LLMUsageStat)...)...); err != nil {
+				slog.Error("failed to scan LLM usage per user", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			resp.ByUser = append(resp.ByUser, user)
+		}
+		if err := userRows.Err(); err != nil {
+			slog.Error("failed to iterate LLM usage per user", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.Error("failed to encode LLM usage response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// HandleGetLLMQuota returns a household's monthly AI quota and what it spent this month. Admins only.
+func HandleGetLLMQuota(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		householdID, ok := householdIDFromPath(w, r)
+		if !ok {
+			return
+		}
+		writeLLMQuota(w, r, db, householdID)
+	}
+}
+
+// HandleSetLLMQuota sets or removes a household's monthly AI quota. Once the household's
+// model requests cost more than the quota in a calendar month, categorization requests of
+// its members are rejected until the next month. Admins only.
+func HandleSetLLMQuota(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := auth.GetUserIDFromContext(r.Context())
+
+		// 1. Parse the household ID and payload
+		householdID, ok := householdIDFromPath(w, r)
+		if !ok {
+			return
+		}
+		var payload types.SetLLMQuotaPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			slog.Warn("failed to decode LLM quota payload", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if payload.MonthlyCostLimit != nil && *payload.MonthlyCostLimit < 0 {
+			http.Error(w, "Monthly cost limit must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Update the household
+		res, err := db.Exec("UPDATE households SET llm_monthly_cost_limit = ? WHERE id = ?", payload.MonthlyCostLimit, householdID)
+		if err != nil {
+			slog.Error("failed to set LLM quota", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Household not found", http.StatusNotFound)
+			return
+		}
+		slog.Info("LLM quota set", "user_id", userID, "household_id", householdID, "monthly_cost_limit", payload.MonthlyCostLimit)
+
+		writeLLMQuota(w, r, db, householdID)
+	}
+}
+
+// householdIDFromPath parses the household_id path value, writing a 400 response if it is invalid.
+func householdIDFromPath(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	householdID, err := strconv.ParseInt(r.PathValue("household_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid household ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return householdID, true
+}
+
+// writeLLMQuota responds with the household's quota and spending this month.
+func writeLLMQuota(w http.ResponseWriter, r *http.Request, db *sql.DB, householdID int64) {
+	resp := types.LLMQuotaResponse{HouseholdID: householdID}
+	var limit sql.NullFloat64
+	err := db.QueryRow("SELECT llm_monthly_cost_limit FROM households WHERE id = ?", householdID).Scan(&limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Household not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		resp.SpentThisMonth, err = monthlyLLMCost(db, householdID)
+	}
+	if err != nil {
+		slog.Error("failed to query LLM quota", "url", r.URL, "household_id", householdID, "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if limit.Valid {
+		resp.MonthlyCostLimit = &limit.Float64
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("failed to encode LLM quota response", "url", r.URL, "household_id", householdID, "err", err)
+	}
+}
@@ -0,0 +1,146 @@
+package category
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+// usageModelAPI answers every prompt with the same content and token usage.
+type usageModelAPI struct {
+	content string
+	usage   *Usage
+}
+
+func (u usageModelAPI) Prompt(ctx context.Context, system, prompt string) (*ModelAPIResponse, error) {
+	return &ModelAPIResponse{Choices: []Choice{{Message: Message{Content: u.content}}}, Usage: u.usage}, nil
+}
+
+func TestParseModelPrices(t *testing.T) {
+	prices, err := ParseModelPrices("openrouter:x-ai/grok-4-fast=0.20/0.50, local:llama3.1=0/0,")
+	if err != nil {
+		t.Fatalf("ParseModelPrices() error = %v", err)
+	}
+	if len(prices) != 2 || prices["openrouter:x-ai/grok-4-fast"] != (ModelPrice{Prompt: 0.2, Completion: 0.5}) {
+		t.Fatalf("ParseModelPrices() = %v", prices)
+	}
+	if prices, err := ParseModelPrices(""); err != nil || len(prices) != 0 {
+		t.Fatalf("ParseModelPrices(\"\") = %v, %v", prices, err)
+	}
+
+	for _, spec := range []string{"model", "model=1", "=1/2", "model=a/2", "model=-1/2"} {
+		if _, err := ParseModelPrices(spec); err == nil {
+			t.Errorf("ParseModelPrices(%q) succeeded, expected an error", spec)
+		}
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	prices := map[string]ModelPrice{"priced": {Prompt: 2, Completion: 10}}
+	reported := 0.5
+
+	tests := []struct {
+		name  string
+		model string
+		usage *Usage
+		want  float64
+	}{
+		{"NoUsage", "priced", nil, 0},
+		{"Computed", "priced", &Usage{PromptTokens: 1000, CompletionTokens: 100}, 0.003},
+		{"Reported", "priced", &Usage{PromptTokens: 1000, Cost: &reported}, 0.5},
+		{"Unpriced", "local", &Usage{PromptTokens: 1000, CompletionTokens: 100}, 0},
+	}
+	for _, tt := range tests {
+		if got := requestCost(tt.model, tt.usage, prices); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%s: requestCost() = %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProcessJobRecordsUsage(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	api := usageModelAPI{
+		content: `{"ambiguity_flag": "", "spendings": [{"apportion_mode": "alone", "category": "Groceries", "amount": 10, "description": "Bread"}]}`,
+		usage:   &Usage{PromptTokens: 1200, CompletionTokens: 80, TotalTokens: 1280},
+	}
+	chain, _ := NewModelChain(ModelBackend{Name: "priced", API: api})
+	config := DefaultPoolConfig()
+	config.ModelPrices = map[string]ModelPrice{"priced": {Prompt: 1, Completion: 5}}
+	pool := NewCategorizingPool(db, config, chain)
+	jobID := insertAIJobForTest(t, db, buyerID, &partnerID, "bread", 10, "pending", false)
+
+	job, ok, err := pool.claimJob("worker")
+	if err != nil || !ok {
+		t.Fatalf("claimJob() = %v, %v", ok, err)
+	}
+	pool.processJob(1, "worker", job)
+
+	var model string
+	var promptTokens, completionTokens int
+	var householdID int64
+	var cost float64
+	err = db.QueryRow(`
+		SELECT model, prompt_tokens, completion_tokens, household_id, cost FROM llm_usage WHERE job_id = ?
+	`, jobID).Scan(&model, &promptTokens, &completionTokens, &householdID, &cost)
+	if err != nil {
+		t.Fatalf("querying usage: %v", err)
+	}
+	if model != "priced" || promptTokens != 1200 || completionTokens != 80 || householdID == 0 || math.Abs(cost-0.0016) > 1e-12 {
+		t.Fatalf("usage = %s %d/%d household %d cost %v", model, promptTokens, completionTokens, householdID, cost)
+	}
+}
+
+func TestLLMQuotaExceeded(t *testing.T) {
+	db := setupPoolTestDB(t)
+	defer db.Close()
+
+	buyerID, partnerID := poolTestUsers(t, db)
+	var householdID int64
+	if err := db.QueryRow("SELECT household_id FROM household_members WHERE user_id = ?", buyerID).Scan(&householdID); err != nil {
+		t.Fatalf("querying household: %v", err)
+	}
+
+	// Without a quota the household is never limited
+	if _, err := db.Exec("INSERT INTO llm_usage (user_id, household_id, latency_ms, cost) VALUES (?, ?, 10, 3)", partnerID, householdID); err != nil {
+		t.Fatalf("inserting usage: %v", err)
+	}
+	if exceeded, err := LLMQuotaExceeded(db, buyerID); err != nil || exceeded {
+		t.Fatalf("LLMQuotaExceeded() without quota = %v, %v", exceeded, err)
+	}
+
+	// The partner's usage counts against the shared household quota
+	if _, err := db.Exec("UPDATE households SET llm_monthly_cost_limit = 5 WHERE id = ?", householdID); err != nil {
+		t.Fatalf("setting quota: %v", err)
+	}
+	if exceeded, err := LLMQuotaExceeded(db, buyerID); err != nil || exceeded {
+		t.Fatalf("LLMQuotaExceeded() below quota = %v, %v", exceeded, err)
+	}
+	if _, err := db.Exec("INSERT INTO llm_usage (user_id, household_id, latency_ms, cost) VALUES (?, ?, 10, 2)", partnerID, householdID); err != nil {
+		t.Fatalf("inserting usage: %v", err)
+	}
+	if exceeded, err := LLMQuotaExceeded(db, buyerID); err != nil || !exceeded {
+		t.Fatalf("LLMQuotaExceeded() at quota = %v, %v", exceeded, err)
+	}
+
+	// Usage of earlier months does not count
+	if _, err := db.Exec("UPDATE llm_usage SET created_at = datetime('now', 'start of month', '-1 day')"); err != nil {
+		t.Fatalf("backdating usage: %v", err)
+	}
+	if exceeded, err := LLMQuotaExceeded(db, buyerID); err != nil || exceeded {
+		t.Fatalf("LLMQuotaExceeded() with last month's usage = %v, %v", exceeded, err)
+	}
+
+	// Failed requests are recorded too, without cost
+	recorder := newUsageRecorder(db, scriptedModelAPI{calls: new(int), results: []scriptedResult{{err: errors.New("down")}}}, nil, 0, partnerID)
+	if _, err := recorder.Prompt(context.Background(), "system", "prompt"); err == nil {
+		t.Fatal("Prompt() succeeded, expected the scripted error")
+	}
+	var errMsg string
+	if err := db.QueryRow("SELECT error_message FROM llm_usage WHERE model IS NULL AND error_message IS NOT NULL").Scan(&errMsg); err != nil || errMsg != "down" {
+		t.Fatalf("failed request usage = %q, %v", errMsg, err)
+	}
+}
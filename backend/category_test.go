@@ -1,13 +1,20 @@
 package main_test
 
 import (
+	"bytes"
 	"database/sql"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/testutil"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
@@ -167,6 +174,26 @@ func TestAICategorize(t *testing.T) {
 		// A separate integration test involving the worker would be needed for full verification.
 	})
 
+	// --- Test Case: Amount and Date Left to the AI ---
+	t.Run("SuccessWithoutAmountOrDate", func(t *testing.T) {
+		payload := map[string]interface{}{"prompt": "kaffe 45 kr i går", "local_date": "2024-05-21"}
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize", env.AuthToken, payload)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+
+		var respBody map[string]int64
+		testutil.DecodeJSONResponse(t, rr, &respBody)
+		var dbAmount float64
+		var dbLocalDate sql.NullString
+		err := env.DB.QueryRow("SELECT total_amount, local_date FROM ai_categorization_jobs WHERE id = ?", respBody["job_id"]).Scan(&dbAmount, &dbLocalDate)
+		if err != nil {
+			t.Fatalf("Failed to query created job: %v", err)
+		}
+		if dbAmount != 0 || dbLocalDate.String != "2024-05-21" {
+			t.Errorf("Expected job without amount and with the local date, got %v and %v", dbAmount, dbLocalDate)
+		}
+	})
+
 	// --- Test Cases: Bad Requests ---
 	t.Run("BadRequests", func(t *testing.T) {
 		testCases := []struct {
@@ -181,12 +208,6 @@ func TestAICategorize(t *testing.T) {
 				expectedStatus: http.StatusBadRequest,
 				expectedBody:   "Missing prompt or invalid amount",
 			},
-			{
-				name:           "ZeroAmount",
-				payload:        map[string]interface{}{"amount": 0.0, "prompt": "test"},
-				expectedStatus: http.StatusBadRequest,
-				expectedBody:   "Missing prompt or invalid amount",
-			},
 			{
 				name:           "NegativeAmount",
 				payload:        map[string]interface{}{"amount": -50.0, "prompt": "test"},
@@ -232,3 +253,306 @@ func TestAICategorize(t *testing.T) {
 		testutil.AssertBodyContains(t, rr, "Invalid token")
 	})
 }
+
+// TestCategorizePreview tests the /v1/categorize/preview and /v1/categorize/confirm endpoints.
+func TestCategorizePreview(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	countJobs := func() int {
+		var n int
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM ai_categorization_jobs").Scan(&n); err != nil {
+			t.Fatalf("Failed to count jobs: %v", err)
+		}
+		return n
+	}
+	jobsBefore := countJobs()
+	purchase := types.AICategorizationPayload{Amount: 7500, Prompt: "Milk, bread and a cinema ticket", TransactionDate: ptr("2024-05-21")}
+
+	// --- Test Case: Preview Writes Nothing ---
+	t.Run("Preview", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/preview", env.AuthToken, purchase)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var preview types.CategorizationPreview
+		testutil.DecodeJSONResponse(t, rr, &preview)
+		if len(preview.Spendings) != 2 || preview.Spendings[0].Category != "Groceries" || preview.Model != "mock:primary" {
+			t.Errorf("Unexpected preview: %+v", preview)
+		}
+		if n := countJobs(); n != jobsBefore {
+			t.Errorf("Expected no new jobs after preview, got %d more", n-jobsBefore)
+		}
+
+		// The request counts against the quota, without a job
+		var usage int
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM llm_usage WHERE job_id IS NULL AND user_id = ?", env.UserID).Scan(&usage); err != nil || usage != 1 {
+			t.Errorf("Expected one usage row without job, got %d (err: %v)", usage, err)
+		}
+	})
+
+	// --- Test Case: Model Failures ---
+	t.Run("ErrorModelFailures", func(t *testing.T) {
+		env.FakeAPI.Script(category.FakeWrongSum(75))
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/preview", env.AuthToken, purchase)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusUnprocessableEntity)
+
+		env.FakeAPI.Script(category.FakeRateLimited(time.Second))
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/preview", env.AuthToken, purchase)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusServiceUnavailable)
+	})
+
+	// --- Test Case: Confirm an Edited Proposal ---
+	var jobID int64
+	t.Run("Confirm", func(t *testing.T) {
+		payload := types.ConfirmCategorizationPayload{
+			AICategorizationPayload: purchase,
+			Model:                   "mock:primary",
+			Spendings: []types.ProposedSpending{
+				{Category: "Groceries", Amount: 6000, ApportionMode: "shared", Description: "Milk & Bread"},
+				{Category: "Entertainment (general)", Amount: 1500, ApportionMode: "alone", Description: "Cinema"},
+			},
+		}
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/confirm", env.AuthToken, payload)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusCreated)
+
+		var resp map[string]int64
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		jobID = resp["job_id"]
+
+		var status string
+		var spendings int
+		var total money.Amount
+		err := env.DB.QueryRow(`
+			SELECT j.status, COUNT(s.id), SUM(s.amount)
+			FROM ai_categorization_jobs j
+			JOIN ai_categorized_spendings acs ON acs.job_id = j.id
+			JOIN spendings s ON s.id = acs.spending_id
+			WHERE j.id = ?
+		`, jobID).Scan(&status, &spendings, &total)
+		if err != nil || status != "completed" || spendings != 2 || total != 7500 {
+			t.Errorf("Expected completed job with two spendings of 75, got %s %d %v (err: %v)", status, spendings, total, err)
+		}
+		var shares int
+		if err := env.DB.QueryRow(`
+			SELECT COUNT(*) FROM spending_shares WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)
+		`, jobID).Scan(&shares); err != nil || shares != 2 {
+			t.Errorf("Expected the shared spending split between two users, got %d shares (err: %v)", shares, err)
+		}
+	})
+
+	// --- Test Case: Invalid Proposals ---
+	t.Run("ErrorInvalidProposal", func(t *testing.T) {
+		for name, spendings := range map[string][]types.ProposedSpending{
+			"WrongSum":        {{Category: "Groceries", Amount: 7000, ApportionMode: "alone"}},
+			"UnknownCategory": {{Category: "Yachts", Amount: 7500, ApportionMode: "alone"}},
+			"InvalidMode":     {{Category: "Groceries", Amount: 7500, ApportionMode: "everyone"}},
+		} {
+			payload := types.ConfirmCategorizationPayload{AICategorizationPayload: purchase, Spendings: spendings}
+			req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/confirm", env.AuthToken, payload)
+			rr := testutil.ExecuteRequest(t, env.Handler, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", name, rr.Code)
+			}
+		}
+		if n := countJobs(); n != jobsBefore+1 {
+			t.Errorf("Expected only the confirmed job to be stored, got %d new jobs", n-jobsBefore)
+		}
+	})
+
+	for _, stmt := range []string{
+		"DELETE FROM spending_shares WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+		"DELETE FROM user_spendings WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+		"DELETE FROM spendings WHERE id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+		"DELETE FROM ai_categorized_spendings WHERE job_id = ?",
+		"DELETE FROM ai_categorization_jobs WHERE id = ?",
+	} {
+		if _, err := env.DB.Exec(stmt, jobID); err != nil {
+			t.Fatalf("Failed to clean up (%s): %v", stmt, err)
+		}
+	}
+	if _, err := env.DB.Exec("DELETE FROM llm_usage"); err != nil {
+		t.Fatalf("Failed to clean up usage: %v", err)
+	}
+}
+
+// TestCategorizeBatch tests splitting a message into purchases with POST /v1/categorize/batch.
+func TestCategorizeBatch(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	message := types.AICategorizationPayload{Prompt: "Rema 312, kaffe 45 i går, kino 280 delt", LocalDate: ptr("2024-05-21")}
+	segments := `{"purchases": [
+		{"prompt": "Rema", "total_amount": 312},
+		{"prompt": "kaffe i går", "total_amount": 45, "transaction_date": "2024-05-20"},
+		{"prompt": "kino delt", "total_amount": 280, "transaction_date": "2025-01-01"}
+	]}`
+
+	// --- Test Case: Success ---
+	var batch types.BatchResponse
+	t.Run("Success", func(t *testing.T) {
+		env.FakeAPI.Script(category.FakeAnswer(segments))
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/batch", env.AuthToken, message)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+
+		testutil.DecodeJSONResponse(t, rr, &batch)
+		if batch.Prompt != message.Prompt || batch.Done || len(batch.Purchases) != 3 {
+			t.Fatalf("Unexpected batch: %+v", batch)
+		}
+		for i, want := range []money.Amount{31200, 4500, 28000} {
+			if p := batch.Purchases[i]; p.TotalAmount != want || p.State != types.JobStatePending {
+				t.Errorf("Purchase %d: expected pending job of %v, got %v %s", i, want, p.TotalAmount, p.State)
+			}
+		}
+		if !strings.Contains(env.FakeAPI.Prompts()[0], "Dagens dato er 2024-05-21 (tirsdag)") {
+			t.Errorf("Expected the local date in the segmentation prompt, got: %s", env.FakeAPI.Prompts()[0])
+		}
+
+		// The date found is used; the implausible one is left for the job to find and flag
+		var date time.Time
+		var localDate sql.NullString
+		if err := env.DB.QueryRow("SELECT transaction_date, local_date FROM ai_categorization_jobs WHERE id = ?", batch.Purchases[1].JobID).Scan(&date, &localDate); err != nil {
+			t.Fatalf("Failed to query job: %v", err)
+		}
+		if date.Format("2006-01-02") != "2024-05-20" || localDate.Valid {
+			t.Errorf("Expected job dated 2024-05-20 without local date, got %v %v", date, localDate)
+		}
+		if err := env.DB.QueryRow("SELECT local_date FROM ai_categorization_jobs WHERE id = ?", batch.Purchases[2].JobID).Scan(&localDate); err != nil || localDate.String != "2024-05-21" {
+			t.Errorf("Expected future-dated job to keep the local date, got %v (err: %v)", localDate, err)
+		}
+	})
+
+	// --- Test Case: Get the Batch as Partner ---
+	t.Run("GetAsPartner", func(t *testing.T) {
+		partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+		if err != nil {
+			t.Fatalf("Failed to generate partner token: %v", err)
+		}
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, fmt.Sprintf("/v1/categorize/batch/%d", batch.BatchID), partnerToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var got types.BatchResponse
+		testutil.DecodeJSONResponse(t, rr, &got)
+		if got.BatchID != batch.BatchID || len(got.Purchases) != 3 || got.Purchases[0].JobID != batch.Purchases[0].JobID {
+			t.Errorf("Unexpected batch: %+v", got)
+		}
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/categorize/batch/999999", env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+
+	// --- Test Case: Purchases Not Adding Up to the Given Total ---
+	t.Run("ErrorWrongTotal", func(t *testing.T) {
+		env.FakeAPI.Script(category.FakeAnswer(segments))
+		wrongTotal := message
+		wrongTotal.Amount = 60000
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/batch", env.AuthToken, wrongTotal)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusUnprocessableEntity)
+
+		var batches int
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM ai_job_batches").Scan(&batches); err != nil || batches != 1 {
+			t.Errorf("Expected only the first batch to be stored, got %d (err: %v)", batches, err)
+		}
+	})
+
+	for _, stmt := range []string{
+		"DELETE FROM ai_categorization_jobs WHERE batch_id IS NOT NULL",
+		"DELETE FROM ai_job_batches",
+		"DELETE FROM llm_usage",
+	} {
+		if _, err := env.DB.Exec(stmt); err != nil {
+			t.Fatalf("Failed to clean up (%s): %v", stmt, err)
+		}
+	}
+}
+
+// TestCategorizeReceipt tests uploading a receipt photo with POST /v1/categorize/receipt and
+// viewing it with GET /v1/jobs/{job_id}/receipt.
+func TestCategorizeReceipt(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	receipt := []byte("\x89PNG\r\n\x1a\nreceipt")
+	upload := func(t *testing.T, fields map[string]string, file []byte) *httptest.ResponseRecorder {
+		t.Helper()
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for name, value := range fields {
+			form.WriteField(name, value)
+		}
+		if file != nil {
+			part, err := form.CreateFormFile("receipt", "receipt.png")
+			if err != nil {
+				t.Fatalf("Failed to create form file: %v", err)
+			}
+			part.Write(file)
+		}
+		form.Close()
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize/receipt", env.AuthToken, nil)
+		req.Body = io.NopCloser(&body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		return testutil.ExecuteRequest(t, env.Handler, req)
+	}
+
+	// --- Test Case: Success ---
+	var jobID int64
+	t.Run("Success", func(t *testing.T) {
+		rr := upload(t, map[string]string{"prompt": "Sjokoladen er min", "local_date": "2024-05-21"}, receipt)
+		testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+
+		var resp map[string]int64
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		jobID = resp["job_id"]
+
+		var prompt string
+		var amount float64
+		var mediaType sql.NullString
+		err := env.DB.QueryRow("SELECT prompt, total_amount, receipt_media_type FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&prompt, &amount, &mediaType)
+		if err != nil || prompt != "Sjokoladen er min" || amount != 0 || mediaType.String != "image/png" {
+			t.Errorf("Unexpected job: %q %v %v (err: %v)", prompt, amount, mediaType, err)
+		}
+	})
+
+	// --- Test Case: View the Receipt ---
+	t.Run("GetReceipt", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, fmt.Sprintf("/v1/jobs/%d/receipt", jobID), env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		if rr.Header().Get("Content-Type") != "image/png" || !bytes.Equal(rr.Body.Bytes(), receipt) {
+			t.Errorf("Unexpected receipt: %s, %d bytes", rr.Header().Get("Content-Type"), rr.Body.Len())
+		}
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, fmt.Sprintf("/v1/jobs/%d", jobID), env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var job types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &job)
+		if !job.HasReceipt {
+			t.Errorf("Expected the job to have a receipt")
+		}
+	})
+
+	// --- Test Case: Invalid Uploads ---
+	t.Run("ErrorInvalidUpload", func(t *testing.T) {
+		rr := upload(t, map[string]string{"prompt": "Kaffe"}, nil)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+
+		rr = upload(t, nil, []byte("not an image"))
+		testutil.AssertStatusCode(t, rr, http.StatusUnsupportedMediaType)
+
+		rr = upload(t, map[string]string{"amount": "-5"}, receipt)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	})
+
+	if _, err := env.DB.Exec("DELETE FROM ai_categorization_jobs WHERE id = ?", jobID); err != nil {
+		t.Fatalf("Failed to clean up job: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// answer is what the model said in one request of a case.
+type answer struct {
+	sumMismatch bool // Decoded, but the amounts do not add up to the total
+	malformed   bool // Not the expected JSON
+}
+
+// countingAPI keeps the answers of the current case, to count retries and sum mismatches.
+type countingAPI struct {
+	api   category.ModelAPI
+	total money.Amount // Amount of the current case
+
+	answers []answer
+	errors  int // Failed requests
+}
+
+func (c *countingAPI) reset(total money.Amount) {
+	c.total = total
+	c.answers = nil
+	c.errors = 0
+}
+
+func (c *countingAPI) Prompt(ctx context.Context, system, prompt string) (*category.ModelAPIResponse, error) {
+	res, err := c.api.Prompt(ctx, system, prompt)
+	if err != nil {
+		c.errors++
+		return nil, err
+	}
+	if len(res.Choices) == 0 {
+		c.answers = append(c.answers, answer{malformed: true})
+		return res, nil
+	}
+
+	var result category.JobResult
+	if err := json.Unmarshal([]byte(res.Choices[0].Message.Content), &result); err != nil {
+		c.answers = append(c.answers, answer{malformed: true})
+		return res, nil
+	}
+	var sum money.Amount
+	for _, s := range result.Spendings {
+		sum += s.Amount
+	}
+	// Exact, like the validation in category.ProcessCategorizationJob
+	c.answers = append(c.answers, answer{sumMismatch: sum != c.total})
+	return res, nil
+}
@@ -0,0 +1,465 @@
+// Command eval measures the quality of AI categorization offline, on a labeled dataset.
+//
+// Usage:
+//
+//	eval [-db PATH] <command> [flags]
+//
+// The database provides the categories the prompt is built from, and the history exported by
+// "export". It is taken from -db or the DATABASE_PATH environment variable; "run" only reads it.
+//
+// A dataset has one JSON case per line:
+//
+//	{"prompt": "Groceries and a movie ticket for me", "amount": 250, "partner": true,
+//	 "expected": [{"category": "Groceries", "amount": 150, "apportion_mode": "shared"},
+//	              {"category": "Entertainment", "amount": 100, "apportion_mode": "alone"}]}
+//
+// "run" sends every case through category.ProcessCategorizationJob, against the models of
+// -models or the answers recorded in a -replay directory (see category.Cassette), and reports
+// category and apportion_mode accuracy, how often the model's amounts did not add up, and how
+// many retries were needed. -prompts evaluates an older version of the prompts, e.g. "nb/v1",
+// instead of the latest.
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log" // Use standard log for simplicity here, like cmd/migrate
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/money"
+	_ "modernc.org/sqlite"
+)
+
+type command struct {
+	usage string
+	run   func(db *sql.DB, args []string) error
+}
+
+var commands = map[string]command{
+	"run":    {"-dataset FILE [-models SPEC | -replay DIR] [-record DIR] [-prompts VERSION] [-timeout DUR] [-v]", runEval},
+	"export": {"-username NAME [-out FILE]", runExport},
+}
+
+// evalCase is one labeled example of a dataset.
+type evalCase struct {
+	Prompt   string             `json:"prompt"`
+	Amount   money.Amount       `json:"amount"`
+	Partner  bool               `json:"partner"` // Whether the buyer has a partner to share with
+	Expected []expectedSpending `json:"expected"`
+}
+
+// params returns what the case is categorized with.
+func (c evalCase) params() category.CategorizationParams {
+	params := category.CategorizationParams{TotalAmount: c.Amount, Buyer: evalBuyer, Prompt: c.Prompt}
+	if c.Partner {
+		partner := evalPartner
+		params.SharedWith = &partner
+		params.Household = []category.Person{partner}
+	}
+	return params
+}
+
+// expectedSpending is a spending the case should be split into.
+type expectedSpending struct {
+	Category      string       `json:"category"`
+	Amount        money.Amount `json:"amount"`
+	ApportionMode string       `json:"apportion_mode"`
+	Description   string       `json:"description,omitempty"` // For reading the dataset only, not scored
+}
+
+// Names used in the prompts of evaluation cases.
+var (
+	evalBuyer   = category.Person{Id: 1, Name: "Buyer"}
+	evalPartner = category.Person{Id: 2, Name: "Partner"}
+)
+
+func main() {
+	log.SetFlags(0)
+
+	// Allow -db before the command
+	args := os.Args[1:]
+	dbPath := os.Getenv("DATABASE_PATH")
+	if len(args) >= 2 && (args[0] == "-db" || args[0] == "--db") {
+		dbPath, args = args[1], args[2:]
+	}
+
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return
+	}
+
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		log.Fatalf("unknown command %q", name)
+	}
+	if dbPath == "" {
+		log.Fatal("DATABASE_PATH environment variable or -db flag must be set")
+	}
+
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := cmd.run(db, args[1:]); err != nil {
+		db.Close()
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: eval [-db PATH] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range []string{"run", "export"} {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+}
+
+// caseOutcome is the result of running one case.
+type caseOutcome struct {
+	index     int
+	err       error // Set when the job failed, e.g. out of tries or the model is down
+	result    category.JobResult
+	tries     int // Model requests made
+	answers   []answer
+	catHits   int
+	modeHits  int
+	itemCount int
+}
+
+// runEval runs a dataset through the categorizer and prints a report.
+func runEval(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	datasetPath := fs.String("dataset", "", "labeled dataset (JSONL)")
+	modelSpec := fs.String("models", category.DefaultModelSpec, "models to evaluate, like AI_MODELS")
+	replayPath := fs.String("replay", "", "answer from the recordings in this directory instead of calling models")
+	recordPath := fs.String("record", "", "record the models' answers in this directory, for -replay")
+	promptVersion := fs.String("prompts", "", "version of the prompts to evaluate, e.g. nb/v1 (default the latest)")
+	timeout := fs.Duration("timeout", 2*time.Minute, "time allowed per case")
+	verbose := fs.Bool("v", false, "list every case that was not categorized perfectly")
+	fs.Parse(args)
+
+	if *datasetPath == "" {
+		return errors.New("-dataset is required")
+	}
+	if *replayPath != "" && *recordPath != "" {
+		return errors.New("-replay and -record cannot be combined")
+	}
+	if *promptVersion != "" && !category.HasPromptTemplate(*promptVersion) {
+		return fmt.Errorf("no prompts with version %q", *promptVersion)
+	}
+	cases, err := loadDataset(*datasetPath)
+	if err != nil {
+		return err
+	}
+
+	// 1. Pick the model: recorded answers, or the configured chain
+	var api category.ModelAPI
+	if *replayPath != "" {
+		cassette, err := category.NewCassette(*replayPath, category.CassetteReplay, nil)
+		if err != nil {
+			return err
+		}
+		api = cassette
+	} else {
+		localModelURL := os.Getenv("LOCAL_MODEL_URL")
+		if localModelURL == "" {
+			localModelURL = category.DefaultLocalModelEndpoint
+		}
+		chain, err := category.ParseModelChain(*modelSpec, os.Getenv("OPENROUTER_KEY"), localModelURL)
+		if err != nil {
+			return err
+		}
+		api = chain
+		if *recordPath != "" {
+			cassette, err := category.NewCassette(*recordPath, category.CassetteRecord, chain)
+			if err != nil {
+				return err
+			}
+			api = cassette
+		}
+	}
+	counter := &countingAPI{api: api}
+
+	// 2. Run every case. JobID stays 0, so nothing is written to the database.
+	outcomes := make([]caseOutcome, 0, len(cases))
+	for i, c := range cases {
+		counter.reset(c.Amount)
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		params := c.params()
+		params.PromptTemplate = *promptVersion
+		result, err := category.ProcessCategorizationJob(ctx, db, counter, params)
+		cancel()
+
+		outcome := caseOutcome{index: i + 1, err: err, result: result, tries: len(counter.answers) + counter.errors, answers: counter.answers}
+		if err == nil {
+			outcome.catHits, outcome.modeHits = score(c.Expected, result.Spendings)
+		}
+		outcome.itemCount = len(c.Expected)
+		outcomes = append(outcomes, outcome)
+	}
+
+	printReport(cases, outcomes, *verbose)
+	return nil
+}
+
+// loadDataset reads a JSONL dataset, skipping empty lines.
+func loadDataset(path string) ([]evalCase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cases []evalCase
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var c evalCase
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if c.Prompt == "" || c.Amount <= 0 || len(c.Expected) == 0 {
+			return nil, fmt.Errorf("%s line %d: a case needs a prompt, a positive amount and expected spendings", path, line)
+		}
+		cases = append(cases, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("%s has no cases", path)
+	}
+	return cases, nil
+}
+
+// score pairs the expected spendings with the categorized ones and counts how many got the
+// right category and the right apportion_mode. Each expected spending is paired with the
+// closest unused spending in amount, preferring one of the same category, so a split that is
+// merely in another order is not penalized. Expected spendings left without a pair count as wrong.
+func score(expected []expectedSpending, got []category.Spendings) (categoryHits, modeHits int) {
+	used := make([]bool, len(got))
+	for _, want := range expected {
+		best := -1
+		for i, s := range got {
+			if used[i] {
+				continue
+			}
+			if best == -1 {
+				best = i
+				continue
+			}
+			sameCategory := strings.EqualFold(s.Category, want.Category)
+			bestSameCategory := strings.EqualFold(got[best].Category, want.Category)
+			closer := (s.Amount - want.Amount).Abs() < (got[best].Amount - want.Amount).Abs()
+			if (sameCategory && !bestSameCategory) || (sameCategory == bestSameCategory && closer) {
+				best = i
+			}
+		}
+		if best == -1 {
+			continue
+		}
+		used[best] = true
+		if strings.EqualFold(got[best].Category, want.Category) {
+			categoryHits++
+		}
+		if got[best].ApportionMode == want.ApportionMode {
+			modeHits++
+		}
+	}
+	return categoryHits, modeHits
+}
+
+// printReport prints the aggregate metrics, and with verbose the imperfect cases.
+func printReport(cases []evalCase, outcomes []caseOutcome, verbose bool) {
+	var failed, items, catHits, modeHits, answers, mismatches, malformed, retries, retried, maxRetries int
+	for _, o := range outcomes {
+		if o.err != nil {
+			failed++
+		}
+		items += o.itemCount
+		catHits += o.catHits
+		modeHits += o.modeHits
+		answers += len(o.answers)
+		for _, a := range o.answers {
+			if a.sumMismatch {
+				mismatches++
+			}
+			if a.malformed {
+				malformed++
+			}
+		}
+		if r := o.tries - 1; r > 0 {
+			retries += r
+			retried++
+			maxRetries = max(maxRetries, r)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Cases\t%d\n", len(outcomes))
+	fmt.Fprintf(w, "Failed cases\t%d\t(%s)\n", failed, percent(failed, len(outcomes)))
+	fmt.Fprintf(w, "Category accuracy\t%s\t(%d/%d spendings)\n", percent(catHits, items), catHits, items)
+	fmt.Fprintf(w, "Apportion mode accuracy\t%s\t(%d/%d spendings)\n", percent(modeHits, items), modeHits, items)
+	fmt.Fprintf(w, "Sum mismatch rate\t%s\t(%d/%d answers)\n", percent(mismatches, answers), mismatches, answers)
+	fmt.Fprintf(w, "Malformed answers\t%s\t(%d/%d answers)\n", percent(malformed, answers), malformed, answers)
+	fmt.Fprintf(w, "Retries\t%d\t(%d cases retried, at most %d)\n", retries, retried, maxRetries)
+	w.Flush()
+
+	if !verbose {
+		return
+	}
+	for _, o := range outcomes {
+		c := cases[o.index-1]
+		if o.err == nil && o.catHits == o.itemCount && o.modeHits == o.itemCount && o.tries == 1 {
+			continue
+		}
+		fmt.Printf("\n#%d %q (%s)\n", o.index, c.Prompt, c.Amount)
+		for _, e := range c.Expected {
+			fmt.Printf("  expected  %-20s %10s  %s\n", e.Category, e.Amount, e.ApportionMode)
+		}
+		if o.err != nil {
+			fmt.Printf("  failed after %d requests: %v\n", o.tries, o.err)
+			continue
+		}
+		for _, s := range o.result.Spendings {
+			fmt.Printf("  got       %-20s %10s  %s\n", s.Category, s.Amount, s.ApportionMode)
+		}
+		if o.tries > 1 {
+			fmt.Printf("  needed %d requests\n", o.tries)
+		}
+	}
+}
+
+// percent formats n/total as a percentage, or "-" without a total.
+func percent(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// runExport writes the AI categorized history of a user's household as a dataset. The expected
+// spendings are the spendings as they are now, so corrections made by the household since the
+// job ran become the labels.
+func runExport(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	username := fs.String("username", "", "member of the household to export")
+	outPath := fs.String("out", "", "dataset file to write (default stdout)")
+	fs.Parse(args)
+
+	var userID int64
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", strings.TrimSpace(*username)).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("user %q not found", *username)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 1. The completed jobs of everyone in the household, with their current spendings
+	rows, err := db.Query(`
+		SELECT j.id, j.prompt, j.total_amount, j.shared_with IS NOT NULL,
+			c.name, s.amount, COALESCE(s.description, ''),
+			CASE
+				WHEN us.shared_with IS NULL THEN 'alone'
+				WHEN us.shared_user_takes_all = 1 THEN 'other'
+				ELSE 'shared'
+			END
+		FROM ai_categorization_jobs j
+		JOIN ai_categorized_spendings acs ON acs.job_id = j.id
+		JOIN spendings s ON s.id = acs.spending_id
+		JOIN categories c ON c.id = s.category
+		JOIN user_spendings us ON us.spending_id = s.id
+		WHERE j.status = 'completed'
+			AND j.buyer IN (
+				SELECT user_id FROM household_members
+				WHERE household_id = (SELECT household_id FROM household_members WHERE user_id = ?)
+			)
+		ORDER BY j.id, s.id
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("querying history: %w", err)
+	}
+	defer rows.Close()
+
+	var cases []evalCase
+	lastJobID := int64(-1)
+	for rows.Next() {
+		var jobID int64
+		var c evalCase
+		var e expectedSpending
+		if err := rows.Scan(&jobID, &c.Prompt, &c.Amount, &c.Partner, &e.Category, &e.Amount, &e.Description, &e.ApportionMode); err != nil {
+			return fmt.Errorf("scanning history: %w", err)
+		}
+		if jobID != lastJobID {
+			cases = append(cases, c)
+			lastJobID = jobID
+		}
+		last := &cases[len(cases)-1]
+		last.Expected = append(last.Expected, e)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+
+	// 2. Write the cases. Spendings edited to no longer add up are labels the model cannot
+	// match, so those jobs are left out.
+	out := os.Stdout
+	if *outPath != "" {
+		f, err := os.Create(*outPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	written := 0
+	for _, c := range cases {
+		var sum money.Amount
+		for _, e := range c.Expected {
+			sum += e.Amount
+		}
+		if sum != c.Amount {
+			continue
+		}
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+		written++
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d of %d categorized jobs\n", written, len(cases))
+	return nil
+}
+
+func sqliteDSN(path string) string {
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", "busy_timeout(5000)")
+	pragmas.Add("_pragma", "journal_mode(WAL)")
+	pragmas.Add("_pragma", "synchronous(NORMAL)")
+	pragmas.Add("_pragma", "foreign_keys(ON)")
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	return path + separator + pragmas.Encode()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~relay/sapp-backend/category"
+)
+
+func TestScore(t *testing.T) {
+	groceries := expectedSpending{Category: "Groceries", Amount: 15000, ApportionMode: "shared"}
+	movie := expectedSpending{Category: "Entertainment", Amount: 10000, ApportionMode: "alone"}
+
+	tests := []struct {
+		name         string
+		expected     []expectedSpending
+		got          []category.Spendings
+		wantCategory int
+		wantMode     int
+	}{
+		{
+			name:         "perfect",
+			expected:     []expectedSpending{groceries, movie},
+			got:          []category.Spendings{{Category: "Groceries", Amount: 15000, ApportionMode: "shared"}, {Category: "Entertainment", Amount: 10000, ApportionMode: "alone"}},
+			wantCategory: 2, wantMode: 2,
+		},
+		{
+			name:         "other order",
+			expected:     []expectedSpending{groceries, movie},
+			got:          []category.Spendings{{Category: "Entertainment", Amount: 10000, ApportionMode: "alone"}, {Category: "Groceries", Amount: 15000, ApportionMode: "shared"}},
+			wantCategory: 2, wantMode: 2,
+		},
+		{
+			name:         "category case ignored",
+			expected:     []expectedSpending{groceries},
+			got:          []category.Spendings{{Category: "groceries", Amount: 15000, ApportionMode: "shared"}},
+			wantCategory: 1, wantMode: 1,
+		},
+		{
+			name:         "wrong category paired by amount",
+			expected:     []expectedSpending{groceries, movie},
+			got:          []category.Spendings{{Category: "Coffee", Amount: 9000, ApportionMode: "alone"}, {Category: "Eating Out", Amount: 16000, ApportionMode: "alone"}},
+			wantCategory: 0, wantMode: 1,
+		},
+		{
+			name:         "same category preferred over closer amount",
+			expected:     []expectedSpending{groceries},
+			got:          []category.Spendings{{Category: "Coffee", Amount: 15000, ApportionMode: "shared"}, {Category: "Groceries", Amount: 5000, ApportionMode: "alone"}},
+			wantCategory: 1, wantMode: 0,
+		},
+		{
+			name:         "merged into one spending",
+			expected:     []expectedSpending{groceries, movie},
+			got:          []category.Spendings{{Category: "Groceries", Amount: 25000, ApportionMode: "shared"}},
+			wantCategory: 1, wantMode: 1,
+		},
+		{
+			name:     "nothing categorized",
+			expected: []expectedSpending{groceries},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			categoryHits, modeHits := score(tt.expected, tt.got)
+			if categoryHits != tt.wantCategory || modeHits != tt.wantMode {
+				t.Errorf("score() = %d, %d, expected %d, %d", categoryHits, modeHits, tt.wantCategory, tt.wantMode)
+			}
+		})
+	}
+}
+
+// TestRunEvalReplay runs a dataset against recorded answers: the first case is answered
+// perfectly, the second with the wrong category after an answer that did not add up.
+func TestRunEvalReplay(t *testing.T) {
+	db := setupEvalTestDB(t)
+	dir := t.TempDir()
+
+	cases := []evalCase{
+		{Prompt: "Groceries and a movie ticket for me", Amount: 25000, Partner: true, Expected: []expectedSpending{
+			{Category: "Groceries", Amount: 15000, ApportionMode: "shared"},
+			{Category: "Entertainment (general)", Amount: 10000, ApportionMode: "alone"},
+		}},
+		{Prompt: "Coffee", Amount: 4500, Expected: []expectedSpending{
+			{Category: "Coffee", Amount: 4500, ApportionMode: "alone"},
+		}},
+	}
+	datasetPath := filepath.Join(dir, "dataset.jsonl")
+	var dataset strings.Builder
+	for _, c := range cases {
+		line, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("encoding case: %v", err)
+		}
+		dataset.Write(line)
+		dataset.WriteString("\n")
+	}
+	if err := os.WriteFile(datasetPath, []byte(dataset.String()), 0o644); err != nil {
+		t.Fatalf("writing dataset: %v", err)
+	}
+
+	// Record the answers of a fake model, as -record would of a real one
+	cassetteDir := filepath.Join(dir, "cassette")
+	answers := [][]category.FakeReply{
+		{category.FakeSpendings(
+			category.Spendings{Category: "Groceries", Amount: 15000, ApportionMode: "shared"},
+			category.Spendings{Category: "Entertainment (general)", Amount: 10000, ApportionMode: "alone"},
+		)},
+		{category.FakeWrongSum(4500), category.FakeSpendings(category.Spendings{Category: "Eating Out", Amount: 4500, ApportionMode: "alone"})},
+	}
+	for i, c := range cases {
+		recorder, err := category.NewCassette(cassetteDir, category.CassetteRecord, category.NewFakeModelAPI(answers[i]...))
+		if err != nil {
+			t.Fatalf("NewCassette() error = %v", err)
+		}
+		if _, err := category.ProcessCategorizationJob(context.Background(), db, recorder, c.params()); err != nil {
+			t.Fatalf("recording case %d: %v", i+1, err)
+		}
+	}
+
+	report := captureStdout(t, func() {
+		if err := runEval(db, []string{"-dataset", datasetPath, "-replay", cassetteDir, "-v"}); err != nil {
+			t.Fatalf("runEval() error = %v", err)
+		}
+	})
+
+	words := strings.Join(strings.Fields(report), " ") // Regardless of the column widths
+	for _, want := range []string{
+		"Cases 2 Failed cases 0 (0.0%)",
+		"Category accuracy 66.7% (2/3 spendings)",
+		"Apportion mode accuracy 100.0% (3/3 spendings)",
+		"Sum mismatch rate 33.3% (1/3 answers)",
+		"Retries 1 (1 cases retried, at most 1)",
+		`#2 "Coffee" (45.00) expected Coffee 45.00 alone got Eating Out 45.00 alone needed 2 requests`,
+	} {
+		if !strings.Contains(words, want) {
+			t.Errorf("expected the report to contain %q, got:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "#1 ") {
+		t.Errorf("expected the perfect case to be left out of the verbose report, got:\n%s", report)
+	}
+}
+
+// setupEvalTestDB creates an in-memory database with the schema and its seeded categories.
+func setupEvalTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("opening in-memory database: %v", err)
+	}
+	db.SetMaxOpenConns(1) // Every connection to :memory: is a database of its own
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile("../migrate/schema.sql")
+	if err != nil {
+		t.Fatalf("reading schema: %v", err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("running schema: %v", err)
+	}
+	return db
+}
+
+// captureStdout returns what run writes to standard output.
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+
+	defer func() { os.Stdout = stdout }()
+	run()
+	w.Close()
+	return <-done
+}
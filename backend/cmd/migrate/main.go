@@ -2,11 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"log" // Use standard log for simplicity here
 	"net/url"
 	"os"
 	"strings"
 
+	"git.sr.ht/~relay/sapp-backend/ledger"
 	_ "modernc.org/sqlite"
 )
 
@@ -31,6 +34,18 @@ func main() {
 	}
 	defer tx.Rollback() // Ensure rollback happens if commit fails or panics occur
 
+	log.Printf("Adding columns missing from existing tables...")
+	if err := addMissingColumns(tx); err != nil {
+		tx.Rollback()
+		log.Fatalf("Error adding columns: %v", err)
+	}
+
+	log.Printf("Converting amounts to minor units...")
+	if err := convertMoneyColumns(tx); err != nil {
+		tx.Rollback()
+		log.Fatalf("Error converting amounts: %v", err)
+	}
+
 	log.Printf("Reading schema file: %s", schemaPath)
 	query, err := os.ReadFile(schemaPath)
 	if err != nil {
@@ -46,6 +61,16 @@ func main() {
 	}
 	log.Printf("Schema SQL executed successfully.")
 
+	// Fill the ledger of databases from before it existed, and bring it in step with the
+	// spendings and deposits tables if anything changed them without recording it
+	log.Printf("Recording spendings and deposits in the ledger...")
+	changed, err := ledger.Sync(tx)
+	if err != nil {
+		tx.Rollback()
+		log.Fatalf("Error recording the ledger: %v", err)
+	}
+	log.Printf("Ledger entries written or removed: %d", changed)
+
 	log.Printf("Committing transaction...")
 	if err = tx.Commit(); err != nil {
 		// Rollback already deferred, but log the commit error before panicking
@@ -68,3 +93,127 @@ func sqliteDSN(path string) string {
 
 	return path + separator + pragmas.Encode()
 }
+
+// addedColumns lists columns added to tables after their first release. CREATE TABLE IF NOT EXISTS
+// leaves existing tables alone, so these are added before the schema runs (which may index them).
+// Definitions must be valid for ALTER TABLE ADD COLUMN, i.e. without non-constant defaults.
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"ai_categorization_jobs", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"ai_categorization_jobs", "next_attempt_at", "DATETIME"},
+	{"ai_categorization_jobs", "lease_owner", "TEXT"},
+	{"ai_categorization_jobs", "lease_expires_at", "DATETIME"},
+	{"ai_categorization_jobs", "heartbeat_at", "DATETIME"},
+	{"ai_categorization_jobs", "model", "TEXT"},
+	{"ai_categorization_jobs", "ambiguity_resolved_at", "DATETIME"},
+	{"ai_categorization_jobs", "local_date", "TEXT"},
+	{"ai_categorization_jobs", "batch_id", "INTEGER"},
+	{"ai_categorization_jobs", "receipt_sha256", "TEXT"},
+	{"ai_categorization_jobs", "receipt_media_type", "TEXT"},
+	{"ai_categorization_jobs", "prompt_template", "TEXT"},
+	{"ai_categorization_jobs", "currency", "TEXT"},
+	{"spending_shares", "settled_at", "DATETIME"},
+	{"spendings", "original_amount", "INTEGER"},
+	{"spendings", "currency", "TEXT"},
+	{"deposits", "original_amount", "INTEGER"},
+	{"deposits", "currency", "TEXT"},
+	{"users", "is_admin", "BOOLEAN NOT NULL DEFAULT 0"},
+	{"users", "ai_notes", "TEXT"},
+	{"users", "language", "TEXT NOT NULL DEFAULT 'nb'"},
+	{"households", "llm_monthly_cost_limit", "REAL"},
+	{"households", "ai_notes", "TEXT"},
+	{"households", "currency", "TEXT NOT NULL DEFAULT 'NOK'"},
+}
+
+// addMissingColumns adds the columns in addedColumns to tables that exist but lack them.
+// Tables that do not exist yet are created by the schema with all columns.
+func addMissingColumns(tx *sql.Tx) error {
+	existing := map[string]map[string]bool{}
+	for _, c := range addedColumns {
+		if existing[c.table] == nil {
+			columns, err := tableColumns(tx, c.table)
+			if err != nil {
+				return err
+			}
+			existing[c.table] = columns
+		}
+		if len(existing[c.table]) == 0 || existing[c.table][c.column] {
+			continue // Table not created yet, or column already there
+		}
+		log.Printf("Adding column %s.%s", c.table, c.column)
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return fmt.Errorf("adding column %s.%s: %w", c.table, c.column, err)
+		}
+		existing[c.table][c.column] = true
+	}
+	return nil
+}
+
+// moneyColumns lists the columns of amounts. They were REAL in major units (kroner) before
+// amounts became INTEGER minor units (øre), see package money. Definitions are as in the schema,
+// but with a default where NOT NULL, as ALTER TABLE ADD COLUMN requires one.
+var moneyColumns = []struct {
+	table, column, definition string
+}{
+	{"spendings", "amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"spendings", "original_amount", "INTEGER"},
+	{"ai_categorization_jobs", "total_amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"deposits", "amount", "INTEGER NOT NULL DEFAULT 0"},
+	{"deposits", "original_amount", "INTEGER"},
+	{"category_stats", "median", "INTEGER NOT NULL DEFAULT 0"},
+	{"category_stats", "q1", "INTEGER NOT NULL DEFAULT 0"},
+	{"category_stats", "q3", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// convertMoneyColumns converts the columns in moneyColumns that are still REAL to INTEGER minor
+// units, rounding half away from zero. SQLite cannot change the type of a column, so each one
+// is renamed, added again with the new type, filled from the old one and the old one dropped.
+func convertMoneyColumns(tx *sql.Tx) error {
+	for _, c := range moneyColumns {
+		var declared string
+		err := tx.QueryRow("SELECT type FROM pragma_table_info(?) WHERE name = ?", c.table, c.column).Scan(&declared)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue // Table not created yet, the schema creates it with INTEGER
+		}
+		if err != nil {
+			return fmt.Errorf("reading type of %s.%s: %w", c.table, c.column, err)
+		}
+		if !strings.EqualFold(declared, "REAL") {
+			continue // Already converted
+		}
+
+		log.Printf("Converting %s.%s to minor units", c.table, c.column)
+		old := c.column + "_real"
+		for _, stmt := range []string{
+			fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", c.table, c.column, old),
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition),
+			fmt.Sprintf("UPDATE %s SET %s = CAST(ROUND(%s * 100) AS INTEGER) WHERE %s IS NOT NULL", c.table, c.column, old, old),
+			fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", c.table, old),
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("converting %s.%s: %w", c.table, c.column, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the set of column names of the table, empty if it does not exist.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, fmt.Errorf("reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("scanning column of %s: %w", table, err)
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
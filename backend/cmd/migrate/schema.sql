@@ -3,7 +3,10 @@ CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     username TEXT NOT NULL UNIQUE,
     password_hash TEXT NOT NULL,
-    first_name TEXT -- Added first_name as it's used in categorization
+    first_name TEXT, -- Added first_name as it's used in categorization
+    is_admin BOOLEAN NOT NULL DEFAULT 0, -- May change instance settings, see auth.RequireAdmin. Set with sappadmin set-admin
+    ai_notes TEXT, -- Free-text context about the user for AI categorization, e.g. "drinks energy drinks"
+    language TEXT NOT NULL DEFAULT 'nb' -- Language of the AI categorization prompts, see category.PromptLanguages
 );
 
 -- Categories table stores spending categories
@@ -11,18 +14,37 @@ CREATE TABLE IF NOT EXISTS categories (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name TEXT NOT NULL UNIQUE,
     ai_notes TEXT -- Added ai_notes used in prompt generation
-        -- Removed unused mean/variation columns for now
+        -- Typical amounts are kept per household in category_stats
+);
+
+-- Category_stats holds the typical amounts of the spendings in each category of a household over
+-- the last year. Recomputed periodically by category.RecomputeStats; the AI gets them as hints,
+-- and spendings far outside them are flagged as ambiguous. Like every amount, in minor units
+-- (øre, cents) of the household's currency, see package money.
+CREATE TABLE IF NOT EXISTS category_stats (
+    household_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    count INTEGER NOT NULL, -- Spendings the statistics are based on
+    median INTEGER NOT NULL,
+    q1 INTEGER NOT NULL, -- First quartile
+    q3 INTEGER NOT NULL, -- Third quartile
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (household_id, category_id),
+    FOREIGN KEY(household_id) REFERENCES households(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY(category_id) REFERENCES categories(id) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
 -- Spendings table stores individual spending items, often created by AI categorization
 CREATE TABLE IF NOT EXISTS spendings (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    amount REAL NOT NULL,
+    amount INTEGER NOT NULL, -- In minor units (øre, cents) of the currency of the buyer's household
     description TEXT,
     category INTEGER NOT NULL,
     made_by INTEGER NOT NULL, -- References the user who made the purchase
     spending_date DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Date the spending actually occurred
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP, -- Date the record was created
+    original_amount INTEGER, -- Amount as entered in minor units, if in another currency; converted with the rate of spending_date
+    currency TEXT, -- ISO 4217 code of original_amount, NULL if entered in the household's currency
     FOREIGN KEY(category) REFERENCES categories(id) ON UPDATE CASCADE ON DELETE RESTRICT,
     FOREIGN KEY(made_by) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE
 );
@@ -43,12 +65,12 @@ CREATE TABLE IF NOT EXISTS user_spendings (
 -- AI Categorization Jobs table tracks the status of AI categorization requests
 CREATE TABLE IF NOT EXISTS ai_categorization_jobs (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    status TEXT NOT NULL DEFAULT 'queued', -- e.g., queued, processing, finished, failed
+    status TEXT NOT NULL DEFAULT 'queued', -- pending, processing, completed, dead_letter (legacy: queued, failed)
     prompt TEXT NOT NULL,
     buyer INTEGER NOT NULL, -- User who initiated the job (references users.id)
     -- shared_mode TEXT NOT NULL, -- Removed: AI now infers apportionment from prompt
     shared_with INTEGER, -- User potentially sharing (references users.id), NULL if alone
-    total_amount REAL NOT NULL,
+    total_amount INTEGER NOT NULL, -- In minor units of currency, or of the buyer's household's if NULL
     is_finished BOOLEAN DEFAULT 0,
     is_ambiguity_flagged BOOLEAN DEFAULT 0,
     ambiguity_flag_reason TEXT,
@@ -57,8 +79,45 @@ CREATE TABLE IF NOT EXISTS ai_categorization_jobs (
     transaction_date DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Date the transaction(s) in the prompt occurred
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     status_updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    -- Queue state. Workers lease a job while processing it and extend the lease with heartbeats;
+    -- a job whose lease expired is picked up again. Added later, see addedColumns in cmd/migrate.
+    attempts INTEGER NOT NULL DEFAULT 0, -- Processing attempts started so far
+    next_attempt_at DATETIME, -- Earliest time a pending job may be retried, NULL if immediately
+    lease_owner TEXT, -- Worker currently processing the job
+    lease_expires_at DATETIME, -- When the lease lapses unless renewed
+    heartbeat_at DATETIME, -- Last lease renewal
+    model TEXT, -- Backend of the model chain that produced the result, e.g. 'openrouter:x-ai/grok-4-fast'
+    ambiguity_resolved_at DATETIME, -- When the user last resolved the ambiguity flag in the review queue
+    local_date TEXT, -- Buyer's date when the job was added (YYYY-MM-DD), if the AI should find the transaction date in the prompt
+    batch_id INTEGER, -- Batch the job was split from, NULL if submitted on its own
+    receipt_sha256 TEXT, -- SHA-256 of the receipt photo in the attachment store, NULL if none
+    receipt_media_type TEXT, -- e.g. 'image/jpeg'
+    prompt_template TEXT, -- Version of the prompt templates that categorized the job, e.g. 'nb/v1'
+    currency TEXT, -- ISO 4217 code of total_amount and the prompt's amounts, NULL if the household's
     FOREIGN KEY(buyer) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
-    FOREIGN KEY(shared_with) REFERENCES users(id) ON UPDATE CASCADE ON DELETE SET NULL
+    FOREIGN KEY(shared_with) REFERENCES users(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    FOREIGN KEY(batch_id) REFERENCES ai_job_batches(id) ON UPDATE CASCADE ON DELETE SET NULL
+);
+
+-- Index for workers looking for due jobs
+CREATE INDEX IF NOT EXISTS idx_ai_jobs_queue ON ai_categorization_jobs (status, next_attempt_at);
+
+-- AI job batches keep free-text messages describing several purchases, like "Rema 312, kaffe 45,
+-- kino 280 delt". The AI splits a batch into purchases and each one gets its own job (batch_id).
+CREATE TABLE IF NOT EXISTS ai_job_batches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    buyer INTEGER NOT NULL, -- User who submitted the batch (references users.id)
+    prompt TEXT NOT NULL, -- Message as submitted
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(buyer) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+-- App settings holds instance-wide settings changed at runtime by admins, as key/value pairs.
+-- Keys in use: default_model (name of the preferred backend in the model chain)
+CREATE TABLE IF NOT EXISTS app_settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
 -- AI Categorized Spendings links spendings created by AI back to the job
@@ -70,6 +129,46 @@ CREATE TABLE IF NOT EXISTS ai_categorized_spendings (
     FOREIGN KEY(job_id) REFERENCES ai_categorization_jobs(id) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
+-- AI job attempts keeps every model request made for a job: the rendered prompt, the raw answer
+-- and whether it validated. Used to debug odd categorizations and to improve categories.ai_notes.
+CREATE TABLE IF NOT EXISTS ai_job_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id INTEGER NOT NULL,
+    attempt INTEGER NOT NULL, -- Processing attempt of the job (ai_categorization_jobs.attempts at the time)
+    try INTEGER NOT NULL, -- Request within the attempt; the model is asked again when its output does not validate
+    model TEXT, -- Model that answered, NULL if the request failed
+    prompt TEXT NOT NULL, -- Prompt as sent to the model
+    raw_response TEXT, -- Text generated by the model, NULL if the request failed
+    outcome TEXT NOT NULL, -- accepted, invalid_output, model_error
+    error_message TEXT, -- Why the output was rejected or the request failed, i.e. the reason for any retry
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(job_id) REFERENCES ai_categorization_jobs(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_ai_job_attempts_job ON ai_job_attempts (job_id);
+
+-- LLM usage records every model request made for an AI job: tokens, latency and cost.
+-- Kept when the job is deleted, as the request was still paid for.
+CREATE TABLE IF NOT EXISTS llm_usage (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id INTEGER, -- NULL once the job is deleted
+    user_id INTEGER NOT NULL, -- Buyer of the job
+    household_id INTEGER, -- Buyer's household at the time of the request, counted against its quota
+    model TEXT, -- Model that answered, NULL if the request failed
+    prompt_tokens INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    latency_ms INTEGER NOT NULL,
+    cost REAL NOT NULL DEFAULT 0, -- USD, as reported by the provider or computed from AI_MODEL_PRICES
+    error_message TEXT, -- NULL if the request succeeded
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(job_id) REFERENCES ai_categorization_jobs(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY(household_id) REFERENCES households(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_llm_usage_created ON llm_usage (created_at);
+CREATE INDEX IF NOT EXISTS idx_llm_usage_household ON llm_usage (household_id, created_at);
+
 -- Transfers table logs when settlements occur between partners
 CREATE TABLE IF NOT EXISTS transfers (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -90,20 +189,126 @@ CREATE TABLE IF NOT EXISTS partnerships (
     CHECK (user1_id < user2_id) -- Ensures consistent ordering (user1 always lower ID) and prevents self-partnership
 );
 
+-- Households group users who share expenses. Replaces partnerships for more than two members.
+CREATE TABLE IF NOT EXISTS households (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    llm_monthly_cost_limit REAL, -- USD per calendar month (UTC) for AI categorization, NULL if unlimited
+    ai_notes TEXT, -- Free-text context about the household for AI categorization, e.g. "groceries are always shared"
+    currency TEXT NOT NULL DEFAULT 'NOK' -- ISO 4217 code of the household's amounts
+);
+
+-- Household_members links users to their household. A user belongs to at most one household.
+CREATE TABLE IF NOT EXISTS household_members (
+    household_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL UNIQUE,
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (household_id, user_id),
+    FOREIGN KEY(household_id) REFERENCES households(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Spending_shares lists the users who bear the cost of a spending, split equally between them.
+-- No rows means the buyer bears the full amount alone. user_spendings.shared_with and
+-- shared_user_takes_all are kept as a two-person projection of these rows.
+-- Settled_at is when the user paid their share back to the buyer, NULL on the buyer's own row;
+-- user_spendings.settled_at is set once every share of the spending is settled.
+CREATE TABLE IF NOT EXISTS spending_shares (
+    spending_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    settled_at DATETIME,
+    PRIMARY KEY (spending_id, user_id),
+    FOREIGN KEY(spending_id) REFERENCES spendings(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_spending_shares_user_id ON spending_shares (user_id);
+
 -- Deposits table stores income/deposit information
 CREATE TABLE IF NOT EXISTS deposits (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     user_id INTEGER NOT NULL, -- User who received the deposit
-    amount REAL NOT NULL,
+    amount INTEGER NOT NULL, -- In minor units (øre, cents) of the currency of the user's household
     description TEXT,
     deposit_date DATETIME NOT NULL, -- Date the deposit was received/effective
     is_recurring BOOLEAN DEFAULT 0,
     recurrence_period TEXT, -- e.g., 'monthly', 'weekly', 'yearly', NULL if not recurring
     end_date DATETIME DEFAULT NULL, -- Date after which recurring deposit should stop generating occurrences, NULL if indefinite or not recurring
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    original_amount INTEGER, -- Amount as entered in minor units, if in another currency; converted with the rate of deposit_date
+    currency TEXT, -- ISO 4217 code of original_amount, NULL if entered in the household's currency
     FOREIGN KEY(user_id) REFERENCES users(id) ON UPDATE CASCADE ON DELETE CASCADE
 );
 
+-- Ledger_entries records every spending, settlement of a spending and deposit as postings between
+-- per-user accounts that add up to zero (double entry), see package ledger. Balances, who owes
+-- whom and everyone's share of a spending are derived from the ledger. It is kept in step with
+-- the tables above by ledger.RecordSpending and ledger.RecordDeposit, and compared with them by
+-- "sappadmin check-ledger".
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL, -- spending, settlement or deposit
+    spending_id INTEGER, -- Spending a spending or settlement entry records, NULL for deposits
+    deposit_id INTEGER, -- Deposit a deposit entry records, NULL otherwise
+    occurred_at DATETIME NOT NULL, -- Spending date, settlement time or (first) deposit date
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(spending_id) REFERENCES spendings(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    FOREIGN KEY(deposit_id) REFERENCES deposits(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_spending ON ledger_entries (spending_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_deposit ON ledger_entries (deposit_id);
+
+-- Ledger_postings holds the amounts of the ledger entries. Users are not foreign keys: deleting a
+-- user must not silently unbalance entries, account.Purge removes them with the spendings.
+CREATE TABLE IF NOT EXISTS ledger_postings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entry_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL, -- Owner of the account (references users.id)
+    account TEXT NOT NULL, -- funds, expenses, income or receivable, see package ledger
+    counterparty_id INTEGER, -- User a receivable account is held against (references users.id), NULL for other accounts
+    amount INTEGER NOT NULL, -- In minor units; positive is a debit, negative a credit
+    FOREIGN KEY(entry_id) REFERENCES ledger_entries(id) ON UPDATE CASCADE ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_postings_entry ON ledger_postings (entry_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_postings_account ON ledger_postings (user_id, account);
+
+-- Exchange_rates holds the value of one unit of from_currency in to_currency on a date, imported
+-- by an admin (there is no live feed). Amounts are converted with the latest rate on or before
+-- their date, see currency.Rate; a rate is also used inverted.
+CREATE TABLE IF NOT EXISTS exchange_rates (
+    date TEXT NOT NULL, -- YYYY-MM-DD
+    from_currency TEXT NOT NULL, -- ISO 4217 code
+    to_currency TEXT NOT NULL,
+    rate REAL NOT NULL,
+    PRIMARY KEY (date, from_currency, to_currency)
+);
+
+-- Attachments table stores files (invoices, warranty cards) attached to a spending or deposit.
+-- The content is kept in the attachment store under its SHA-256, so identical files are stored once.
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    spending_id INTEGER, -- Exactly one of spending_id, deposit_id and job_id is set
+    deposit_id INTEGER,
+    job_id INTEGER, -- Set while the spendings of an AI job are replaced, e.g. when recategorizing
+    uploaded_by INTEGER, -- User who uploaded the file, NULL once their account is deleted
+    file_name TEXT NOT NULL, -- Name of the file as uploaded, used for downloads
+    media_type TEXT NOT NULL,
+    size INTEGER NOT NULL, -- In bytes
+    sha256 TEXT NOT NULL, -- Hex digest of the content, its key in the attachment store
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(spending_id) REFERENCES spendings(id) ON DELETE CASCADE,
+    FOREIGN KEY(deposit_id) REFERENCES deposits(id) ON DELETE CASCADE,
+    FOREIGN KEY(job_id) REFERENCES ai_categorization_jobs(id) ON DELETE CASCADE,
+    FOREIGN KEY(uploaded_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_spending ON attachments (spending_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_deposit ON attachments (deposit_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_sha256 ON attachments (sha256);
+
 -- Refresh Tokens table stores hashed refresh tokens for users
 CREATE TABLE IF NOT EXISTS refresh_tokens (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -158,3 +363,37 @@ INSERT OR IGNORE INTO users (id, username, password_hash, first_name) VALUES (2,
 
 -- Seed partnership for demo users (ensure user1_id < user2_id)
 INSERT OR IGNORE INTO partnerships (user1_id, user2_id) VALUES (1, 2);
+
+-- Migrate partnerships into households. Each partnership without a household becomes one,
+-- using the lower user ID as the household ID so the members can be attached below.
+INSERT OR IGNORE INTO households (id, name)
+SELECT p.user1_id, 'Household'
+FROM partnerships p
+WHERE NOT EXISTS (SELECT 1 FROM household_members m WHERE m.user_id IN (p.user1_id, p.user2_id))
+  AND NOT EXISTS (SELECT 1 FROM household_members m WHERE m.household_id = p.user1_id);
+
+INSERT OR IGNORE INTO household_members (household_id, user_id)
+SELECT p.user1_id, p.user1_id FROM partnerships p
+WHERE NOT EXISTS (SELECT 1 FROM household_members m WHERE m.user_id IN (p.user1_id, p.user2_id))
+  AND NOT EXISTS (SELECT 1 FROM household_members m WHERE m.household_id = p.user1_id)
+UNION ALL
+SELECT p.user1_id, p.user2_id FROM partnerships p
+WHERE NOT EXISTS (SELECT 1 FROM household_members m WHERE m.user_id IN (p.user1_id, p.user2_id))
+  AND NOT EXISTS (SELECT 1 FROM household_members m WHERE m.household_id = p.user1_id);
+
+-- Backfill spending_shares from the two-person user_spendings columns. Idempotent thanks to the
+-- primary key, and consistent with rows written by the application (which keeps both in sync).
+INSERT OR IGNORE INTO spending_shares (spending_id, user_id)
+SELECT us.spending_id, us.buyer FROM user_spendings us
+WHERE us.shared_with IS NOT NULL AND us.shared_user_takes_all = 0;
+
+INSERT OR IGNORE INTO spending_shares (spending_id, user_id)
+SELECT us.spending_id, us.shared_with FROM user_spendings us
+WHERE us.shared_with IS NOT NULL;
+
+-- Shares of spendings settled before shares were settled one by one take the spending's settlement.
+UPDATE spending_shares
+SET settled_at = (SELECT us.settled_at FROM user_spendings us WHERE us.spending_id = spending_shares.spending_id)
+WHERE settled_at IS NULL
+  AND user_id != (SELECT us.buyer FROM user_spendings us WHERE us.spending_id = spending_shares.spending_id)
+  AND (SELECT us.settled_at FROM user_spendings us WHERE us.spending_id = spending_shares.spending_id) IS NOT NULL;
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -8,14 +9,21 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"git.sr.ht/~relay/sapp-backend/account"
+	"git.sr.ht/~relay/sapp-backend/attachment"
 	"git.sr.ht/~relay/sapp-backend/auth"
 	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/currency"
 	"git.sr.ht/~relay/sapp-backend/deposit"
 	"git.sr.ht/~relay/sapp-backend/export" // Import the export package
+	"git.sr.ht/~relay/sapp-backend/household"
 	"git.sr.ht/~relay/sapp-backend/pay"
 	"git.sr.ht/~relay/sapp-backend/spendings"
 	"git.sr.ht/~relay/sapp-backend/stats"
@@ -27,6 +35,16 @@ import (
 
 const defaultDatabasePath = "/data/sapp.db"
 
+// shutdownTimeout bounds draining requests and jobs on shutdown. It is below Docker's
+// default 10 second grace period, after which the container is killed.
+const shutdownTimeout = 8 * time.Second
+
+// attachmentSweepInterval is how often files of deleted attachments and receipts are removed.
+const attachmentSweepInterval = time.Hour
+
+// categoryStatsInterval is how often the typical amounts of the categories are recomputed.
+const categoryStatsInterval = 6 * time.Hour
+
 // Logging middleware
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -73,7 +91,6 @@ func main() {
 		slog.Error("failed to open database", "path", dbPath, "err", err)
 		os.Exit(1)
 	}
-	defer db.Close()
 	// Test connection
 	if err := db.Ping(); err != nil {
 		slog.Error("failed to ping database", "path", dbPath, "err", err)
@@ -82,32 +99,80 @@ func main() {
 	slog.Info("Database connection successful", "path", dbPath)
 
 	// --- AI Categorization Pool ---
-	// Determine number of workers (e.g., based on CPU cores)
-	numWorkers := runtime.NumCPU()
-	if numWorkers < 1 {
-		numWorkers = 1 // Ensure at least one worker
+	// Workers default to one per CPU core; AI_WORKERS and AI_MAX_ATTEMPTS override the defaults
+	poolConfig := category.DefaultPoolConfig()
+	if n, ok := positiveIntEnv("AI_WORKERS"); ok {
+		poolConfig.Workers = n
 	}
-	slog.Info("Initializing AI categorization pool", "workers", numWorkers)
+	if n, ok := positiveIntEnv("AI_MAX_ATTEMPTS"); ok {
+		poolConfig.MaxAttempts = n
+	}
+	slog.Info("Initializing AI categorization pool", "workers", poolConfig.Workers, "max_attempts", poolConfig.MaxAttempts)
 
-	// --- Create the real ModelAPI implementation ---
+	// --- Create the model chain ---
+	// AI_MODELS lists the models to try in order, e.g. a primary model, a cheaper fallback and a
+	// local model: "openrouter:x-ai/grok-4-fast,openrouter:mistralai/mistral-small,local:llama3.1".
+	// Admins can switch which one is tried first at runtime; the others remain fallbacks.
 	openRouterAPIKey := os.Getenv("OPENROUTER_KEY")
-	// Note: Consider adding more robust configuration for model name
-	openRouterModel := "x-ai/grok-4-fast"
-	if openRouterAPIKey == "" {
-		slog.Warn("OPENROUTER_KEY environment variable not set. AI categorization will likely fail.")
-		// Depending on requirements, you might want to os.Exit(1) here
-		// or allow the app to run with a non-functional AI component.
+	modelSpec := os.Getenv("AI_MODELS")
+	if modelSpec == "" {
+		modelSpec = category.DefaultModelSpec
+	}
+	localModelURL := os.Getenv("LOCAL_MODEL_URL")
+	if localModelURL == "" {
+		localModelURL = category.DefaultLocalModelEndpoint
+	}
+	modelChain, err := category.ParseModelChain(modelSpec, openRouterAPIKey, localModelURL)
+	if err != nil {
+		slog.Error("invalid AI_MODELS", "value", modelSpec, "err", err)
+		os.Exit(1)
+	}
+	if err := modelChain.LoadDefault(db); err != nil {
+		slog.Error("failed to load default AI model, using the first configured", "err", err)
+	}
+	if openRouterAPIKey == "" && strings.Contains(modelSpec, "openrouter:") {
+		slog.Warn("OPENROUTER_KEY environment variable not set. OpenRouter models will fail.")
+	}
+	slog.Info("AI model chain configured", "models", modelChain.Models(), "default", modelChain.Default())
+	// AI_MODEL_PRICES prices models whose provider does not report the cost of a request,
+	// in USD per million prompt/completion tokens: "openrouter:x-ai/grok-4-fast=0.20/0.50"
+	modelPrices, err := category.ParseModelPrices(os.Getenv("AI_MODEL_PRICES"))
+	if err != nil {
+		slog.Error("invalid AI_MODEL_PRICES", "err", err)
+		os.Exit(1)
+	}
+	poolConfig.ModelPrices = modelPrices
+	// --- End model chain ---
+
+	// Attachments and receipt photos are kept in DATA_DIR/attachments; DATA_DIR defaults to
+	// the database's directory
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = filepath.Dir(dbPath)
+	}
+	attachmentStore := attachment.NewStore(filepath.Join(dataDir, "attachments"))
+	poolConfig.Receipts = attachmentStore
+
+	// AI_RECORD_DIR records the models' answers, to develop and test offline later with
+	// AI_MODELS=replay:<dir>. Answers recorded earlier for the same prompts are replaced.
+	var modelAPI category.ModelAPI = modelChain
+	if recordDir := os.Getenv("AI_RECORD_DIR"); recordDir != "" {
+		cassette, err := category.NewCassette(recordDir, category.CassetteRecord, modelChain)
+		if err != nil {
+			slog.Error("invalid AI_RECORD_DIR", "value", recordDir, "err", err)
+			os.Exit(1)
+		}
+		modelAPI = cassette
+		slog.Info("Recording AI model answers", "dir", recordDir)
 	}
-	modelAPI := category.NewOpenRouterAPI(openRouterAPIKey, openRouterModel)
-	// --- End ModelAPI creation ---
 
-	// Pass the ModelAPI implementation to the pool
-	categorizationPool := category.NewCategorizingPool(db, numWorkers, modelAPI)
+	// Pass the model chain to the pool
+	categorizationPool := category.NewCategorizingPool(db, poolConfig, modelAPI)
 
 	// Start the pool workers in the background
-	go categorizationPool.StartPool()
+	categorizationPool.StartPool()
 	slog.Info("AI categorization pool started")
-	if category.IsLikelyValidOpenRouterAPIKey(openRouterAPIKey) {
+	if category.IsLikelyValidOpenRouterAPIKey(openRouterAPIKey) || strings.Contains(modelSpec, "local:") || strings.Contains(modelSpec, "replay:") {
 		requeuedJobs, err := categorizationPool.RequeueBackfillJobs()
 		if err != nil {
 			slog.Error("failed to requeue uncategorized AI jobs", "err", err)
@@ -115,7 +180,7 @@ func main() {
 			slog.Info("requeued uncategorized AI jobs for backfill", "count", requeuedJobs)
 		}
 	} else {
-		slog.Info("skipping AI backfill because OPENROUTER_KEY is missing or invalid")
+		slog.Info("skipping AI backfill because OPENROUTER_KEY is missing or invalid and no local or replayed model is configured")
 	}
 	// --- End AI Categorization Pool ---
 
@@ -133,29 +198,83 @@ func main() {
 	payHandler := http.HandlerFunc(pay.HandlePayRoute(db))
 	getCategoriesHandler := http.HandlerFunc(category.HandleGetCategories(db))
 	categorizeHandler := http.HandlerFunc(category.HandleAICategorize(db, &categorizationPool)) // Pass pointer to pool
-	getHistoryHandler := http.HandlerFunc(spendings.HandleGetHistory(db))                       // Use spendings.HandleGetHistory which internally uses history service
+	previewCategorizationHandler := http.HandlerFunc(category.HandlePreviewCategorization(db, &categorizationPool))
+	categorizeBatchHandler := http.HandlerFunc(category.HandleAICategorizeBatch(db, &categorizationPool)) // Several purchases in one message
+	getBatchHandler := http.HandlerFunc(category.HandleGetBatch(db))
+	categorizeReceiptHandler := http.HandlerFunc(category.HandleAICategorizeReceipt(db, &categorizationPool)) // Photo of a receipt
+	confirmCategorizationHandler := http.HandlerFunc(category.HandleConfirmCategorization(db, &categorizationPool))
+	getHistoryHandler := http.HandlerFunc(spendings.HandleGetHistory(db)) // Use spendings.HandleGetHistory which internally uses history service
 	updateSpendingHandler := http.HandlerFunc(spendings.HandleUpdateSpending(db))
-	getTransferStatusHandler := http.HandlerFunc(transfer.HandleGetTransferStatus(db)) // Create handler for transfer status
-	recordTransferHandler := http.HandlerFunc(transfer.HandleRecordTransfer(db))       // Create handler for recording transfer
-	deleteAIJobHandler := http.HandlerFunc(spendings.HandleDeleteAIJob(db))            // Create handler for deleting AI job
+	getTransferStatusHandler := http.HandlerFunc(transfer.HandleGetTransferStatus(db))                      // Create handler for transfer status
+	recordTransferHandler := http.HandlerFunc(transfer.HandleRecordTransfer(db))                            // Create handler for recording transfer
+	deleteAIJobHandler := http.HandlerFunc(spendings.HandleDeleteAIJob(db, &categorizationPool))            // Create handler for deleting AI job
+	getAIJobHandler := http.HandlerFunc(category.HandleGetJob(db))                                          // Full state of one AI job
+	getAIJobAttemptsHandler := http.HandlerFunc(category.HandleGetJobAttempts(db))                          // Model requests made for one AI job
+	getAIJobReceiptHandler := http.HandlerFunc(category.HandleGetReceipt(db, &categorizationPool))          // Receipt photo of one AI job
+	retryAIJobHandler := http.HandlerFunc(category.HandleRetryJob(db, &categorizationPool))                 // Retry a failed AI job
+	recategorizeAIJobHandler := http.HandlerFunc(category.HandleRecategorizeJob(db, &categorizationPool))   // Categorize a finished AI job again
+	recategorizeAIJobsHandler := http.HandlerFunc(category.HandleRecategorizeJobs(db, &categorizationPool)) // Same for a date range or category
+	getReviewQueueHandler := http.HandlerFunc(category.HandleGetReviewQueue(db))                            // Flagged AI jobs awaiting review
+	resolveReviewHandler := http.HandlerFunc(category.HandleResolveReview(db, &categorizationPool))         // Accept, edit or clarify a flagged job
+	jobEventsHandler := http.HandlerFunc(category.HandleJobEvents(db, &categorizationPool))                 // SSE stream of job state changes
 	// Deposit Handlers
-	addDepositHandler := http.HandlerFunc(deposit.HandleAddDeposit(db))           // Create handler for adding deposit
-	getDepositsHandler := http.HandlerFunc(deposit.HandleGetDeposits(db))         // Create handler for getting deposit templates
-	getDepositByIDHandler := http.HandlerFunc(deposit.HandleGetDepositByID(db))   // Create handler for getting single deposit template
-	updateDepositHandler := http.HandlerFunc(deposit.HandleUpdateDeposit(db))     // Create handler for updating deposit template
-	deleteDepositHandler := http.HandlerFunc(deposit.HandleDeleteDeposit(db))     // Create handler for deleting deposit template
-	getSpendingStatsHandler := http.HandlerFunc(stats.HandleGetSpendingStats(db)) // Spending stats handler
-	getDepositStatsHandler := http.HandlerFunc(stats.HandleGetDepositStats(db))   // Deposit stats handler
-	exportAllDataHandler := http.HandlerFunc(export.HandleExportAllData(db))      // Export handler
+	addDepositHandler := http.HandlerFunc(deposit.HandleAddDeposit(db))                       // Create handler for adding deposit
+	getDepositsHandler := http.HandlerFunc(deposit.HandleGetDeposits(db))                     // Create handler for getting deposit templates
+	getDepositByIDHandler := http.HandlerFunc(deposit.HandleGetDepositByID(db))               // Create handler for getting single deposit template
+	updateDepositHandler := http.HandlerFunc(deposit.HandleUpdateDeposit(db))                 // Create handler for updating deposit template
+	deleteDepositHandler := http.HandlerFunc(deposit.HandleDeleteDeposit(db))                 // Create handler for deleting deposit template
+	getSpendingStatsHandler := http.HandlerFunc(stats.HandleGetSpendingStats(db))             // Spending stats handler
+	getLastMonthStatsHandler := http.HandlerFunc(stats.HandleGetLastMonthSpendingStats(db))   // Spending stats of the last 30 days
+	getDepositStatsHandler := http.HandlerFunc(stats.HandleGetDepositStats(db))               // Deposit stats handler
+	exportAllDataHandler := http.HandlerFunc(export.HandleExportAllData(db))                  // Export handler
+	getHouseholdHandler := http.HandlerFunc(household.HandleGetHousehold(db))                 // Household handler
+	updateHouseholdHandler := http.HandlerFunc(household.HandleUpdateHousehold(db))           // Edit the household's AI notes
+	exportArchiveHandler := http.HandlerFunc(export.HandleExportArchive(db, attachmentStore)) // Export with attached files
+	getExchangeRatesHandler := http.HandlerFunc(currency.HandleGetRates(db))                  // Imported exchange rates
+	// Attachment Handlers
+	addSpendingAttachmentHandler := http.HandlerFunc(attachment.HandleAddSpendingAttachment(db, attachmentStore)) // Attach a file to a spending
+	getSpendingAttachmentsHandler := http.HandlerFunc(attachment.HandleGetSpendingAttachments(db))                // Files attached to a spending
+	addDepositAttachmentHandler := http.HandlerFunc(attachment.HandleAddDepositAttachment(db, attachmentStore))   // Attach a file to a deposit
+	getDepositAttachmentsHandler := http.HandlerFunc(attachment.HandleGetDepositAttachments(db))                  // Files attached to a deposit
+	downloadAttachmentHandler := http.HandlerFunc(attachment.HandleDownloadAttachment(db, attachmentStore))       // Content of one attachment
+	deleteAttachmentHandler := http.HandlerFunc(attachment.HandleDeleteAttachment(db, attachmentStore))           // Delete one attachment
+	// Account Handlers
+	getProfileHandler := http.HandlerFunc(account.HandleGetProfile(db))                            // Get profile
+	updateProfileHandler := http.HandlerFunc(account.HandleUpdateProfile(db))                      // Edit username / first name
+	changePasswordHandler := http.HandlerFunc(account.HandleChangePassword(db))                    // Change password
+	deleteAccountHandler := http.HandlerFunc(account.HandleDeleteAccount(db, &categorizationPool)) // Export, then delete account
+	// Admin Handlers
+	getModelsHandler := http.HandlerFunc(category.HandleGetModels(modelChain))                 // Configured AI models
+	setDefaultModelHandler := http.HandlerFunc(category.HandleSetDefaultModel(db, modelChain)) // Switch the default AI model
+	getLLMUsageHandler := http.HandlerFunc(category.HandleGetLLMUsage(db))                     // Tokens, latency and cost of model requests
+	getLLMQuotaHandler := http.HandlerFunc(category.HandleGetLLMQuota(db))                     // Household's monthly AI quota
+	setLLMQuotaHandler := http.HandlerFunc(category.HandleSetLLMQuota(db))                     // Set or remove the quota
+	importExchangeRatesHandler := http.HandlerFunc(currency.HandleImportRates(db))             // Import exchange rates as JSON or CSV
 
 	// Apply AuthMiddleware to protected handlers
 	mux.Handle("GET /v1/verify", applyMiddleware(verifyHandler, auth.AuthMiddleware)) // Verify endpoint
 	mux.Handle("POST /v1/pay", applyMiddleware(payHandler, auth.AuthMiddleware))
 	mux.Handle("GET /v1/categories", applyMiddleware(getCategoriesHandler, auth.AuthMiddleware))
 	mux.Handle("POST /v1/categorize", applyMiddleware(categorizeHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/preview", applyMiddleware(previewCategorizationHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/confirm", applyMiddleware(confirmCategorizationHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/batch", applyMiddleware(categorizeBatchHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/categorize/batch/{batch_id}", applyMiddleware(getBatchHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/receipt", applyMiddleware(categorizeReceiptHandler, auth.AuthMiddleware))
 	mux.Handle("GET /v1/history", applyMiddleware(getHistoryHandler, auth.AuthMiddleware)) // Updated route and handler
 	mux.Handle("PUT /v1/spendings/{spending_id}", applyMiddleware(updateSpendingHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/spendings/{spending_id}/attachments", applyMiddleware(addSpendingAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/spendings/{spending_id}/attachments", applyMiddleware(getSpendingAttachmentsHandler, auth.AuthMiddleware))
 	mux.Handle("DELETE /v1/jobs/{job_id}", applyMiddleware(deleteAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/{job_id}", applyMiddleware(getAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/{job_id}/attempts", applyMiddleware(getAIJobAttemptsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/{job_id}/receipt", applyMiddleware(getAIJobReceiptHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/events", applyMiddleware(jobEventsHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/jobs/{job_id}/retry", applyMiddleware(retryAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/jobs/{job_id}/recategorize", applyMiddleware(recategorizeAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/jobs/recategorize", applyMiddleware(recategorizeAIJobsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/review", applyMiddleware(getReviewQueueHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/review/{job_id}/resolve", applyMiddleware(resolveReviewHandler, auth.AuthMiddleware))
 	// Transfer Routes
 	mux.Handle("GET /v1/transfer/status", applyMiddleware(getTransferStatusHandler, auth.AuthMiddleware))
 	mux.Handle("POST /v1/transfer/record", applyMiddleware(recordTransferHandler, auth.AuthMiddleware))
@@ -165,11 +284,34 @@ func main() {
 	mux.Handle("GET /v1/deposits/{deposit_id}", applyMiddleware(getDepositByIDHandler, auth.AuthMiddleware))
 	mux.Handle("PUT /v1/deposits/{deposit_id}", applyMiddleware(updateDepositHandler, auth.AuthMiddleware))
 	mux.Handle("DELETE /v1/deposits/{deposit_id}", applyMiddleware(deleteDepositHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/deposits/{deposit_id}/attachments", applyMiddleware(addDepositAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/deposits/{deposit_id}/attachments", applyMiddleware(getDepositAttachmentsHandler, auth.AuthMiddleware))
+	// Attachment Routes
+	mux.Handle("GET /v1/attachments/{attachment_id}", applyMiddleware(downloadAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("DELETE /v1/attachments/{attachment_id}", applyMiddleware(deleteAttachmentHandler, auth.AuthMiddleware))
 	// Stats Routes
 	mux.Handle("GET /v1/stats/spending", applyMiddleware(getSpendingStatsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/stats/spending/last-month", applyMiddleware(getLastMonthStatsHandler, auth.AuthMiddleware))
 	mux.Handle("GET /v1/stats/deposits", applyMiddleware(getDepositStatsHandler, auth.AuthMiddleware))
+	// Household Route
+	mux.Handle("GET /v1/household", applyMiddleware(getHouseholdHandler, auth.AuthMiddleware))
+	mux.Handle("PUT /v1/household", applyMiddleware(updateHouseholdHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/exchange-rates", applyMiddleware(getExchangeRatesHandler, auth.AuthMiddleware))
 	// Export Route
 	mux.Handle("GET /v1/export/all", applyMiddleware(exportAllDataHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/export/archive", applyMiddleware(exportArchiveHandler, auth.AuthMiddleware))
+	// Account Routes
+	mux.Handle("GET /v1/profile", applyMiddleware(getProfileHandler, auth.AuthMiddleware))
+	mux.Handle("PUT /v1/profile", applyMiddleware(updateProfileHandler, auth.AuthMiddleware))
+	mux.Handle("PUT /v1/profile/password", applyMiddleware(changePasswordHandler, auth.AuthMiddleware))
+	mux.Handle("DELETE /v1/account", applyMiddleware(deleteAccountHandler, auth.AuthMiddleware))
+	// Admin Routes
+	mux.Handle("GET /v1/admin/models", applyMiddleware(getModelsHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("PUT /v1/admin/models/default", applyMiddleware(setDefaultModelHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("GET /v1/admin/llm-usage", applyMiddleware(getLLMUsageHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("GET /v1/admin/households/{household_id}/llm-quota", applyMiddleware(getLLMQuotaHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("PUT /v1/admin/households/{household_id}/llm-quota", applyMiddleware(setLLMQuotaHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("POST /v1/admin/exchange-rates", applyMiddleware(importExchangeRatesHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
 
 	// CORS handler - Apply CORS *after* routing but *before* auth potentially
 	// Or apply CORS as the outermost layer if auth doesn't rely on headers modified by CORS
@@ -200,14 +342,79 @@ func main() {
 	}
 
 	serverAddr := fmt.Sprintf(":%s", port)
-	slog.Info("Starting HTTP server", "address", serverAddr)
+	server := &http.Server{
+		Addr:              serverAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		// No WriteTimeout: it would cut off the job event stream, which stays open indefinitely
+	}
+	// Event streams never go idle, so end them when shutting down or Shutdown would wait for them
+	server.RegisterOnShutdown(categorizationPool.Events().Close)
+
+	// Stop on SIGINT (Ctrl+C) and SIGTERM (docker stop)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Remove the files of attachments deleted along with their spending, deposit or account,
+	// and receipt photos whose job is gone
+	go attachmentStore.SweepEvery(ctx, db, attachmentSweepInterval)
+
+	// Keep the typical amounts given to the AI up to date
+	go category.RecomputeStatsEvery(ctx, db, categoryStatsInterval)
 
 	// Start the server
-	err = http.ListenAndServe(serverAddr, handler)
-	if err != nil {
+	slog.Info("Starting HTTP server", "address", serverAddr)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	exitCode := 0
+	select {
+	case err := <-serverErr:
 		slog.Error("HTTP server failed", "err", err)
-		os.Exit(1)
+		exitCode = 1
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received, draining requests and jobs", "timeout", shutdownTimeout)
+	}
+	stop() // A second signal kills the process right away
+
+	// --- Graceful Shutdown ---
+	// 1. Stop accepting requests and wait for in-flight ones, so no new jobs are queued
+	// 2. Let workers finish their current job, or release it back to the queue at the deadline
+	// 3. Close the database
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server did not shut down cleanly", "err", err)
+		exitCode = 1
+	}
+	if err := categorizationPool.Shutdown(shutdownCtx); err != nil {
+		slog.Error("AI categorization pool did not shut down cleanly", "err", err)
+		exitCode = 1
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("failed to close database", "err", err)
+		exitCode = 1
+	}
+	slog.Info("Shutdown complete")
+	os.Exit(exitCode)
+}
+
+// positiveIntEnv reads a positive integer from the environment variable, warning about invalid values.
+func positiveIntEnv(name string) (int, bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		slog.Warn("ignoring invalid environment variable, expected a positive integer", "name", name, "value", value)
+		return 0, false
 	}
+	return n, true
 }
 
 func ensureDir(path string) error {
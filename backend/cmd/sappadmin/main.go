@@ -0,0 +1,522 @@
+// Command sappadmin manages users and households directly in the database.
+//
+// Usage:
+//
+//	sappadmin [-db PATH] <command> [flags]
+//
+// The database is taken from -db or the DATABASE_PATH environment variable.
+// Run "sappadmin help" for the list of commands.
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log" // Use standard log for simplicity here, like cmd/migrate
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"git.sr.ht/~relay/sapp-backend/account"
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/types"
+	_ "modernc.org/sqlite"
+)
+
+type command struct {
+	usage string
+	run   func(db *sql.DB, args []string) error
+}
+
+var commands = map[string]command{
+	"create-user":     {"-username NAME -first-name NAME [-password PW]", runCreateUser},
+	"reset-password":  {"-username NAME [-password PW]", runResetPassword},
+	"link":            {"-user USERNAME -with USERNAME [-name HOUSEHOLD]", runLink},
+	"unlink":          {"-username NAME [-force]", runUnlink},
+	"list-households": {"", runListHouseholds},
+	"revoke-sessions": {"-username NAME", runRevokeSessions},
+	"set-admin":       {"-username NAME [-revoke]", runSetAdmin},
+	"seed-categories": {"-file categories.json", runSeedCategories},
+	"import-rates":    {"-file rates.csv", runImportRates},
+	"check-ledger":    {"[-repair]", runCheckLedger},
+}
+
+func main() {
+	log.SetFlags(0)
+
+	// Allow -db before the command
+	args := os.Args[1:]
+	dbPath := os.Getenv("DATABASE_PATH")
+	if len(args) >= 2 && (args[0] == "-db" || args[0] == "--db") {
+		dbPath, args = args[1], args[2:]
+	}
+
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return
+	}
+
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		log.Fatalf("unknown command %q", name)
+	}
+	if dbPath == "" {
+		log.Fatal("DATABASE_PATH environment variable or -db flag must be set")
+	}
+
+	db, err := sql.Open("sqlite", sqliteDSN(dbPath))
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := cmd.run(db, args[1:]); err != nil {
+		db.Close()
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: sappadmin [-db PATH] <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, name := range []string{"create-user", "reset-password", "link", "unlink", "list-households", "revoke-sessions", "set-admin", "seed-categories", "import-rates", "check-ledger"} {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].usage)
+	}
+}
+
+// runCreateUser creates a user with the same validation as registration.
+func runCreateUser(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ExitOnError)
+	username := fs.String("username", "", "username to log in with")
+	firstName := fs.String("first-name", "", "first name, used by the AI categorizer")
+	password := fs.String("password", "", "password (prompted for if omitted)")
+	fs.Parse(args)
+
+	if *password == "" {
+		*password = promptPassword()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := auth.CreateUser(tx, types.UserRegistrationDetails{
+		Username:  strings.TrimSpace(*username),
+		Password:  *password,
+		FirstName: strings.TrimSpace(*firstName),
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created user %q with ID %d\n", *username, userID)
+	return nil
+}
+
+// runResetPassword sets a new password and revokes the user's sessions.
+func runResetPassword(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	username := fs.String("username", "", "user to reset")
+	password := fs.String("password", "", "new password (prompted for if omitted)")
+	fs.Parse(args)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := userIDByUsername(tx, *username)
+	if err != nil {
+		return err
+	}
+	if *password == "" {
+		*password = promptPassword()
+	}
+	if err := auth.SetPassword(tx, userID, *password); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Password reset for %q; existing sessions revoked\n", *username)
+	return nil
+}
+
+// runLink puts two users in the same household. If one of them already has a
+// household the other joins it, otherwise a new household is created.
+func runLink(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("link", flag.ExitOnError)
+	username := fs.String("user", "", "first user")
+	withUsername := fs.String("with", "", "user to link with")
+	name := fs.String("name", "", "name for a new household (defaults to the first names)")
+	fs.Parse(args)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := userIDByUsername(tx, *username)
+	if err != nil {
+		return err
+	}
+	withID, err := userIDByUsername(tx, *withUsername)
+	if err != nil {
+		return err
+	}
+	if userID == withID {
+		return errors.New("cannot link a user with themselves")
+	}
+
+	userHousehold, userHas := household.GetHouseholdID(tx, userID)
+	withHousehold, withHas := household.GetHouseholdID(tx, withID)
+
+	var householdID int64
+	switch {
+	case userHas && withHas:
+		return fmt.Errorf("both users already belong to a household (%d and %d); unlink one first", userHousehold, withHousehold)
+	case userHas:
+		householdID = userHousehold
+		err = household.AddMember(tx, householdID, withID)
+	case withHas:
+		householdID = withHousehold
+		err = household.AddMember(tx, householdID, userID)
+	default:
+		if *name == "" {
+			*name = firstName(tx, userID) + " & " + firstName(tx, withID)
+		}
+		householdID, err = household.Create(tx, *name, []int64{userID, withID})
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Linked %q and %q in household %d\n", *username, *withUsername, householdID)
+	return nil
+}
+
+// runUnlink removes a user from their household. Unsettled shared spendings would
+// drop out of the household balance, so this is refused unless -force is given.
+func runUnlink(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("unlink", flag.ExitOnError)
+	username := fs.String("username", "", "user to remove from their household")
+	force := fs.Bool("force", false, "unlink even if shared spendings are unsettled")
+	fs.Parse(args)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := userIDByUsername(tx, *username)
+	if err != nil {
+		return err
+	}
+	if err := account.CheckSettled(tx, userID); err != nil {
+		if !errors.Is(err, account.ErrUnsettledShares) || !*force {
+			return fmt.Errorf("%w (settle up first, or pass -force)", err)
+		}
+		log.Printf("warning: %v; unlinking anyway", err)
+	}
+	if err := household.RemoveMember(tx, userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed %q from their household\n", *username)
+	return nil
+}
+
+// runListHouseholds prints every household with its members.
+func runListHouseholds(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("list-households", flag.ExitOnError)
+	fs.Parse(args)
+
+	rows, err := db.Query(`
+		SELECT h.id, h.name, u.id, u.username, COALESCE(u.first_name, '')
+		FROM households h
+		LEFT JOIN household_members m ON m.household_id = h.id
+		LEFT JOIN users u ON u.id = m.user_id
+		ORDER BY h.id, u.id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOUSEHOLD\tNAME\tUSER ID\tUSERNAME\tFIRST NAME")
+	for rows.Next() {
+		var householdID int64
+		var name string
+		var userID sql.NullInt64
+		var username, first sql.NullString
+		if err := rows.Scan(&householdID, &name, &userID, &username, &first); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", householdID, name, userID.Int64, username.String, first.String)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// runRevokeSessions deletes the user's refresh tokens. Access tokens remain valid until they expire.
+func runRevokeSessions(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("revoke-sessions", flag.ExitOnError)
+	username := fs.String("username", "", "user whose sessions to revoke")
+	fs.Parse(args)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := userIDByUsername(tx, *username)
+	if err != nil {
+		return err
+	}
+	revoked, err := auth.RevokeSessions(tx, userID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Revoked %d session(s) for %q\n", revoked, *username)
+	return nil
+}
+
+// runSetAdmin grants or revokes the right to change instance-wide settings, such as the default AI model.
+func runSetAdmin(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("set-admin", flag.ExitOnError)
+	username := fs.String("username", "", "user to make an admin")
+	revoke := fs.Bool("revoke", false, "revoke admin rights instead")
+	fs.Parse(args)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := userIDByUsername(tx, *username)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET is_admin = ? WHERE id = ?", !*revoke, userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if *revoke {
+		fmt.Printf("Revoked admin rights of %q\n", *username)
+	} else {
+		fmt.Printf("Made %q an admin\n", *username)
+	}
+	return nil
+}
+
+// runSeedCategories inserts categories from a JSON file shaped like
+// [{"name": "Groceries", "ai_notes": "..."}]. Existing categories keep their
+// ID; their AI notes are updated when the file provides them.
+func runSeedCategories(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("seed-categories", flag.ExitOnError)
+	file := fs.String("file", "", "JSON file with categories")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	var categories []types.Category
+	if err := json.Unmarshal(data, &categories); err != nil {
+		return fmt.Errorf("parsing %s: %w", *file, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var created, updated int
+	for _, c := range categories {
+		name := strings.TrimSpace(c.Name)
+		if name == "" {
+			return errors.New("category name cannot be empty")
+		}
+		res, err := tx.Exec("INSERT OR IGNORE INTO categories (name, ai_notes) VALUES (?, NULLIF(?, ''))", name, c.AINotes)
+		if err != nil {
+			return fmt.Errorf("inserting category %q: %w", name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			created++
+			continue
+		}
+		if c.AINotes != "" {
+			if _, err := tx.Exec("UPDATE categories SET ai_notes = ? WHERE name = ?", c.AINotes, name); err != nil {
+				return fmt.Errorf("updating category %q: %w", name, err)
+			}
+			updated++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Seeded categories: %d created, %d updated\n", created, updated)
+	return nil
+}
+
+// runImportRates imports exchange rates from a CSV file with the header "date,from,to,rate",
+// replacing those already imported for the same date and currencies.
+func runImportRates(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("import-rates", flag.ExitOnError)
+	file := fs.String("file", "", "CSV file with exchange rates")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rates, err := currency.ParseCSV(f)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", *file, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := currency.Import(tx, rates); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d exchange rates\n", len(rates))
+	return nil
+}
+
+// runCheckLedger compares the ledger with the spendings and deposits tables and lists the
+// differences. With -repair, the ledger is brought in step with the tables afterwards.
+func runCheckLedger(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("check-ledger", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "record the spendings and deposits again where the ledger differs")
+	fs.Parse(args)
+
+	discrepancies, err := ledger.Check(db)
+	if err != nil {
+		return err
+	}
+	for _, d := range discrepancies {
+		fmt.Println(d)
+	}
+	if len(discrepancies) == 0 {
+		fmt.Println("The ledger matches the spendings and deposits")
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("%d discrepancies, run with -repair to fix them", len(discrepancies))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	changed, err := ledger.Sync(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Repaired %d discrepancies: %d entries written or removed\n", len(discrepancies), changed)
+	return nil
+}
+
+// --- Helpers ---
+
+func userIDByUsername(tx *sql.Tx, username string) (int64, error) {
+	if username == "" {
+		return 0, errors.New("a username is required")
+	}
+	var userID int64
+	err := tx.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("user %q not found", username)
+	}
+	return userID, err
+}
+
+func firstName(tx *sql.Tx, userID int64) string {
+	var name sql.NullString
+	tx.QueryRow("SELECT COALESCE(first_name, username) FROM users WHERE id = ?", userID).Scan(&name)
+	return name.String
+}
+
+// promptPassword reads a password from standard input. The input is echoed, so
+// prefer piping it in over typing it on a shared screen.
+func promptPassword() string {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Error reading password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func sqliteDSN(path string) string {
+	pragmas := url.Values{}
+	pragmas.Add("_pragma", "busy_timeout(5000)")
+	pragmas.Add("_pragma", "journal_mode(WAL)")
+	pragmas.Add("_pragma", "synchronous(NORMAL)")
+	pragmas.Add("_pragma", "foreign_keys(ON)")
+
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	return path + separator + pragmas.Encode()
+}
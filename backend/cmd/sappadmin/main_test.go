@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+)
+
+// TestCommands runs every command against an in-memory database, in the order an admin
+// setting up an instance would.
+func TestCommands(t *testing.T) {
+	db := setupAdminTestDB(t)
+	dir := t.TempDir()
+
+	// run runs the command and returns what it printed.
+	run := func(t *testing.T, name string, args ...string) (string, error) {
+		t.Helper()
+		var err error
+		out := captureStdout(t, func() { err = commands[name].run(db, args) })
+		return out, err
+	}
+	userID := func(t *testing.T, username string) int64 {
+		t.Helper()
+		var id int64
+		if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&id); err != nil {
+			t.Fatalf("querying user %q: %v", username, err)
+		}
+		return id
+	}
+
+	// --- Test Case: Create Users ---
+	t.Run("CreateUser", func(t *testing.T) {
+		out, err := run(t, "create-user", "-username", "alice", "-first-name", "Alice", "-password", "password123")
+		if err != nil || !strings.Contains(out, `Created user "alice"`) {
+			t.Fatalf("create-user = %q, %v", out, err)
+		}
+		if _, err := run(t, "create-user", "-username", "bob", "-first-name", "Bob", "-password", "password123"); err != nil {
+			t.Fatalf("create-user bob: %v", err)
+		}
+
+		if _, err := run(t, "create-user", "-username", "alice", "-first-name", "Alice", "-password", "password123"); err == nil {
+			t.Error("Expected a taken username to be refused")
+		}
+	})
+
+	// --- Test Case: Reset Password ---
+	t.Run("ResetPassword", func(t *testing.T) {
+		if _, err := db.Exec("INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?, 'before-reset', ?)", userID(t, "alice"), time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("inserting refresh token: %v", err)
+		}
+		if _, err := run(t, "reset-password", "-username", "alice", "-password", "newpassword123"); err != nil {
+			t.Fatalf("reset-password: %v", err)
+		}
+
+		var hash string
+		var sessions int
+		db.QueryRow("SELECT password_hash FROM users WHERE username = 'alice'").Scan(&hash)
+		db.QueryRow("SELECT COUNT(*) FROM refresh_tokens WHERE user_id = ?", userID(t, "alice")).Scan(&sessions)
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte("newpassword123")) != nil || sessions != 0 {
+			t.Errorf("Expected the new password and no sessions, got %d sessions", sessions)
+		}
+
+		if _, err := run(t, "reset-password", "-username", "nobody", "-password", "newpassword123"); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("Expected an unknown user to be reported, got %v", err)
+		}
+	})
+
+	// --- Test Case: Link and List Households ---
+	t.Run("Link", func(t *testing.T) {
+		if _, err := run(t, "link", "-user", "alice", "-with", "alice"); err == nil {
+			t.Error("Expected linking a user with themselves to be refused")
+		}
+		if _, err := run(t, "link", "-user", "alice", "-with", "bob"); err != nil {
+			t.Fatalf("link: %v", err)
+		}
+		aliceHousehold, _ := household.GetHouseholdID(db, userID(t, "alice"))
+		bobHousehold, ok := household.GetHouseholdID(db, userID(t, "bob"))
+		if !ok || aliceHousehold != bobHousehold {
+			t.Fatalf("Expected alice and bob in the same household, got %d and %d", aliceHousehold, bobHousehold)
+		}
+
+		out, err := run(t, "list-households")
+		if err != nil || !strings.Contains(out, "Alice & Bob") || !strings.Contains(out, "alice") || !strings.Contains(out, "bob") {
+			t.Errorf("list-households = %q, %v, expected the household \"Alice & Bob\" with both users", out, err)
+		}
+	})
+
+	// --- Test Case: Revoke Sessions ---
+	t.Run("RevokeSessions", func(t *testing.T) {
+		for _, hash := range []string{"first", "second"} {
+			if _, err := db.Exec("INSERT INTO refresh_tokens (user_id, token_hash, expires_at) VALUES (?, ?, ?)", userID(t, "bob"), hash, time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("inserting refresh token: %v", err)
+			}
+		}
+		out, err := run(t, "revoke-sessions", "-username", "bob")
+		if err != nil || !strings.Contains(out, "Revoked 2 session(s)") {
+			t.Errorf("revoke-sessions = %q, %v, expected 2 sessions revoked", out, err)
+		}
+	})
+
+	// --- Test Case: Set Admin ---
+	t.Run("SetAdmin", func(t *testing.T) {
+		isAdmin := func() bool {
+			var admin bool
+			db.QueryRow("SELECT is_admin FROM users WHERE username = 'alice'").Scan(&admin)
+			return admin
+		}
+		if _, err := run(t, "set-admin", "-username", "alice"); err != nil || !isAdmin() {
+			t.Errorf("Expected alice to be an admin (err: %v)", err)
+		}
+		if _, err := run(t, "set-admin", "-username", "alice", "-revoke"); err != nil || isAdmin() {
+			t.Errorf("Expected alice to no longer be an admin (err: %v)", err)
+		}
+	})
+
+	// --- Test Case: Seed Categories ---
+	t.Run("SeedCategories", func(t *testing.T) {
+		file := filepath.Join(dir, "categories.json")
+		data := `[{"name": "Groceries", "ai_notes": "food for home"}, {"name": "Pets", "ai_notes": "the cat"}, {"name": "Coffee"}]`
+		if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+			t.Fatalf("writing categories: %v", err)
+		}
+		out, err := run(t, "seed-categories", "-file", file)
+		if err != nil || !strings.Contains(out, "1 created, 1 updated") {
+			t.Fatalf("seed-categories = %q, %v, expected Pets created and Groceries updated", out, err)
+		}
+		var notes string
+		db.QueryRow("SELECT ai_notes FROM categories WHERE name = 'Groceries'").Scan(&notes)
+		if notes != "food for home" {
+			t.Errorf("Expected the notes of Groceries to be updated, got %q", notes)
+		}
+
+		if err := os.WriteFile(file, []byte(`[{"name": " "}]`), 0o644); err != nil {
+			t.Fatalf("writing categories: %v", err)
+		}
+		if _, err := run(t, "seed-categories", "-file", file); err == nil {
+			t.Error("Expected a category without a name to be refused")
+		}
+	})
+
+	// --- Test Case: Import Rates ---
+	t.Run("ImportRates", func(t *testing.T) {
+		file := filepath.Join(dir, "rates.csv")
+		if err := os.WriteFile(file, []byte("date,from,to,rate\n2025-07-01,EUR,NOK,11.83\n2025-07-02,EUR,NOK,11.9\n"), 0o644); err != nil {
+			t.Fatalf("writing rates: %v", err)
+		}
+		out, err := run(t, "import-rates", "-file", file)
+		if err != nil || !strings.Contains(out, "Imported 2 exchange rates") {
+			t.Fatalf("import-rates = %q, %v", out, err)
+		}
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM exchange_rates WHERE from_currency = 'EUR' AND to_currency = 'NOK'").Scan(&count)
+		if count != 2 {
+			t.Errorf("Expected 2 rates, found %d", count)
+		}
+
+		if _, err := run(t, "import-rates"); err == nil {
+			t.Error("Expected -file to be required")
+		}
+	})
+
+	// --- Test Case: Check and Repair the Ledger ---
+	t.Run("CheckLedger", func(t *testing.T) {
+		groceriesID := testutil.GetCategoryID(t, db, "Groceries")
+		bobID := userID(t, "bob")
+		spendingID := testutil.InsertSpending(t, db, userID(t, "alice"), &bobID, groceriesID, 50.0, "Shared", false, nil, nil)
+
+		out, err := run(t, "check-ledger")
+		if err != nil || !strings.Contains(out, "The ledger matches") {
+			t.Fatalf("check-ledger = %q, %v, expected a clean ledger", out, err)
+		}
+
+		if _, err := db.Exec("UPDATE spendings SET amount = 6000 WHERE id = ?", spendingID); err != nil {
+			t.Fatalf("changing spending: %v", err)
+		}
+		if _, err := run(t, "check-ledger"); err == nil || !strings.Contains(err.Error(), "-repair") {
+			t.Fatalf("Expected the changed amount to be reported, got %v", err)
+		}
+		if out, err := run(t, "check-ledger", "-repair"); err != nil || !strings.Contains(out, "Repaired 1 discrepancies") {
+			t.Fatalf("check-ledger -repair = %q, %v", out, err)
+		}
+		if out, err := run(t, "check-ledger"); err != nil || !strings.Contains(out, "The ledger matches") {
+			t.Errorf("check-ledger after repair = %q, %v, expected a clean ledger", out, err)
+		}
+	})
+
+	// --- Test Case: Unlink ---
+	t.Run("Unlink", func(t *testing.T) {
+		// The spending shared in CheckLedger is not settled yet
+		if _, err := run(t, "unlink", "-username", "alice"); err == nil || !strings.Contains(err.Error(), "settle up first") {
+			t.Fatalf("Expected unlinking with unsettled shares to be refused, got %v", err)
+		}
+		if _, ok := household.GetHouseholdID(db, userID(t, "alice")); !ok {
+			t.Fatal("Expected alice to still be in the household")
+		}
+
+		if _, err := run(t, "unlink", "-username", "alice", "-force"); err != nil {
+			t.Fatalf("unlink -force: %v", err)
+		}
+		if _, ok := household.GetHouseholdID(db, userID(t, "alice")); ok {
+			t.Error("Expected alice to be removed from the household")
+		}
+	})
+}
+
+// setupAdminTestDB creates an in-memory database with the schema and its seeded categories.
+func setupAdminTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("opening in-memory database: %v", err)
+	}
+	db.SetMaxOpenConns(1) // Every connection to :memory: is a database of its own
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile("../migrate/schema.sql")
+	if err != nil {
+		t.Fatalf("reading schema: %v", err)
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		t.Fatalf("running schema: %v", err)
+	}
+	return db
+}
+
+// captureStdout returns what run writes to standard output.
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("creating pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+
+	defer func() { os.Stdout = stdout }()
+	run()
+	w.Close()
+	return <-done
+}
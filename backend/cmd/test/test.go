@@ -6,7 +6,6 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"runtime"
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
@@ -18,37 +17,6 @@ import (
 	_ "modernc.org/sqlite"
 )
 
-// MockModelAPI provides a mock implementation of the category.ModelAPI interface.
-type MockModelAPI struct {
-	// You can add fields here to control the mock's behavior, e.g., predefined responses.
-	Response *category.ModelAPIResponse
-	Error    error
-}
-
-// Prompt implements the category.ModelAPI interface for the mock.
-func (m *MockModelAPI) Prompt(prompt string) (*category.ModelAPIResponse, error) {
-	slog.Info("MockModelAPI: Prompt called", "prompt_substring", prompt[:min(100, len(prompt))]) // Log subset of prompt
-	if m.Error != nil {
-		slog.Warn("MockModelAPI: Returning predefined error", "error", m.Error)
-		return nil, m.Error
-	}
-	if m.Response != nil {
-		slog.Info("MockModelAPI: Returning predefined response")
-		return m.Response, nil
-	}
-	// Default response if nothing is set
-	slog.Warn("MockModelAPI: Returning default empty response (no predefined response or error set)")
-	return &category.ModelAPIResponse{
-		Choices: []category.Choice{
-			{
-				Message: category.Message{
-					Content: `{"ambiguity_flag": "mock default response", "spendings":[]}`, // Default valid JSON
-				},
-			},
-		},
-	}, nil
-}
-
 // Helper function to apply middleware (copied from sapp/main.go)
 func applyMiddleware(h http.Handler, middleware ...func(http.Handler) http.Handler) http.Handler {
 	for i := len(middleware) - 1; i >= 0; i-- {
@@ -136,36 +104,22 @@ func main() {
 		os.Exit(1)
 	}
 
-	// --- Setup Mock AI API ---
-	slog.Info("Setting up Mock Model API")
-	// Configure the mock response as needed for your tests
-	mockAPI := &MockModelAPI{
-		// Example: Predefine a successful response
-		Response: &category.ModelAPIResponse{
-			Choices: []category.Choice{
-				{
-					Message: category.Message{
-						Content: `{
-							"ambiguity_flag": "",
-							"spendings": [
-								{"apportion_mode": "shared", "category": "Groceries", "amount": 50.0, "description": "Milk & Bread"},
-								{"apportion_mode": "alone", "category": "Entertainment", "amount": 25.0, "description": "Cinema Ticket"}
-							]
-						}`,
-					},
-				},
-			},
-		},
-		Error: nil, // Set to an error to simulate API failure
-	}
-
-	// --- Initialize AI Categorization Pool with Mock API ---
-	numWorkers := runtime.NumCPU()
-	if numWorkers < 1 {
-		numWorkers = 1
-	}
-	slog.Info("Initializing AI categorization pool with mock API", "workers", numWorkers)
-	categorizationPool := category.NewCategorizingPool(db, numWorkers, mockAPI)
+	// --- Setup Fake AI API ---
+	slog.Info("Setting up fake Model API")
+	// Configure the answers as needed for your tests, e.g. category.FakeRateLimited to
+	// simulate API failure
+	fakeAPI := category.NewFakeModelAPI(category.FakeAnswer(`{
+		"ambiguity_flag": "",
+		"spendings": [
+			{"apportion_mode": "shared", "category": "Groceries", "amount": 50.0, "description": "Milk & Bread"},
+			{"apportion_mode": "alone", "category": "Entertainment", "amount": 25.0, "description": "Cinema Ticket"}
+		]
+	}`))
+
+	// --- Initialize AI Categorization Pool with Fake API ---
+	poolConfig := category.DefaultPoolConfig()
+	slog.Info("Initializing AI categorization pool with fake API", "workers", poolConfig.Workers)
+	categorizationPool := category.NewCategorizingPool(db, poolConfig, fakeAPI)
 	// Note: We don't start the pool workers in this test setup unless needed for specific tests.
 	// go categorizationPool.StartPool() // Uncomment if background processing is part of the test
 
@@ -178,12 +132,12 @@ func main() {
 	// --- Protected Routes ---
 	payHandler := http.HandlerFunc(pay.HandlePayRoute(db))
 	getCategoriesHandler := http.HandlerFunc(category.HandleGetCategories(db))
-	categorizeHandler := http.HandlerFunc(category.HandleAICategorize(db, categorizationPool)) // Use pool with mock API
-	getHistoryHandler := http.HandlerFunc(spendings.HandleGetHistory(db))                      // Correctly declare getHistoryHandler
+	categorizeHandler := http.HandlerFunc(category.HandleAICategorize(db, &categorizationPool)) // Use pool with fake API
+	getHistoryHandler := http.HandlerFunc(spendings.HandleGetHistory(db))                       // Correctly declare getHistoryHandler
 	updateSpendingHandler := http.HandlerFunc(spendings.HandleUpdateSpending(db))
 	getTransferStatusHandler := http.HandlerFunc(transfer.HandleGetTransferStatus(db))
 	recordTransferHandler := http.HandlerFunc(transfer.HandleRecordTransfer(db))
-	deleteAIJobHandler := http.HandlerFunc(spendings.HandleDeleteAIJob(db))
+	deleteAIJobHandler := http.HandlerFunc(spendings.HandleDeleteAIJob(db, &categorizationPool))
 	addDepositHandler := http.HandlerFunc(deposit.HandleAddDeposit(db))
 	getDepositsHandler := http.HandlerFunc(deposit.HandleGetDeposits(db))
 
@@ -0,0 +1,206 @@
+// Package currency converts amounts in other currencies to the currency of a household, using
+// exchange rates imported by an admin. There is no live rate feed, so the rates are whatever was
+// imported last; an amount is converted with the latest rate on or before its date.
+package currency
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// dateLayout is the layout of the dates of exchange rates.
+const dateLayout = "2006-01-02"
+
+// ErrNoRate is returned when no exchange rate between two currencies was imported for the date
+// or any date before it.
+var ErrNoRate = errors.New("no exchange rate")
+
+// ErrInvalidRate is returned by Import when a rate is malformed.
+var ErrInvalidRate = errors.New("invalid exchange rate")
+
+// Rate returns the value of one unit of from in to on the date: that of the latest rate imported
+// for it or an earlier date. A rate imported the other way round is used inverted.
+func Rate(q household.Querier, from, to string, date time.Time) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	var rate float64
+	var rateFrom string
+	err := q.QueryRow(`
+		SELECT rate, from_currency FROM exchange_rates
+		WHERE ((from_currency = ? AND to_currency = ?) OR (from_currency = ? AND to_currency = ?)) AND date <= ?
+		ORDER BY date DESC, from_currency = ? DESC
+		LIMIT 1
+	`, from, to, to, from, date.UTC().Format(dateLayout), from).Scan(&rate, &rateFrom)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("%w from %s to %s on %s", ErrNoRate, from, to, date.UTC().Format(dateLayout))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("querying exchange rate from %s to %s: %w", from, to, err)
+	}
+	if rateFrom != from {
+		rate = 1 / rate
+	}
+	return rate, nil
+}
+
+// Converted is an amount in the currency of a household, and the amount as entered if that was
+// in another currency. Original and Currency are NULL otherwise, as stored with the amount.
+type Converted struct {
+	Amount   money.Amount
+	Original sql.Null[money.Amount]
+	Currency sql.NullString // ISO 4217 code of Original
+}
+
+// ToBase converts an amount in the currency with the ISO 4217 code to the currency of the user's
+// household, with the rate on the date. An empty code means the amount already is in it. The
+// result is rounded half away from zero to whole minor units.
+func ToBase(q household.Querier, userID int64, amount money.Amount, code string, date time.Time) (Converted, error) {
+	base, err := household.GetCurrency(q, userID)
+	if err != nil {
+		return Converted{}, err
+	}
+	if code == "" || code == base {
+		return Converted{Amount: amount}, nil
+	}
+	rate, err := Rate(q, code, base, date)
+	if err != nil {
+		return Converted{}, err
+	}
+	return Converted{
+		Amount:   money.Amount(math.Round(float64(amount) * rate)),
+		Original: sql.Null[money.Amount]{V: amount, Valid: true},
+		Currency: sql.NullString{String: code, Valid: true},
+	}, nil
+}
+
+// ParseCode returns the ISO 4217 code of an optional currency field of a request, upper-cased,
+// and whether it is well-formed. Nil or empty gives "", meaning the household's currency.
+func ParseCode(code *string) (string, bool) {
+	if code == nil || strings.TrimSpace(*code) == "" {
+		return "", true
+	}
+	return household.NormalizeCurrency(*code)
+}
+
+// normalizeRate validates an exchange rate and returns it with upper-case codes.
+func normalizeRate(r types.ExchangeRate) (types.ExchangeRate, error) {
+	if _, err := time.Parse(dateLayout, r.Date); err != nil {
+		return r, fmt.Errorf("date %q is not YYYY-MM-DD", r.Date)
+	}
+	from, ok := household.NormalizeCurrency(r.From)
+	if !ok {
+		return r, fmt.Errorf("%q is not a three-letter ISO 4217 code", r.From)
+	}
+	to, ok := household.NormalizeCurrency(r.To)
+	if !ok {
+		return r, fmt.Errorf("%q is not a three-letter ISO 4217 code", r.To)
+	}
+	if from == to {
+		return r, fmt.Errorf("rate from %s to itself", from)
+	}
+	if !(r.Rate > 0) || math.IsInf(r.Rate, 0) {
+		return r, fmt.Errorf("rate %v from %s to %s is not positive", r.Rate, from, to)
+	}
+	r.From, r.To = from, to
+	return r, nil
+}
+
+// Import validates the exchange rates and stores them, replacing those imported before for the
+// same date and currencies. Nothing is stored if any rate is invalid.
+func Import(tx *sql.Tx, rates []types.ExchangeRate) error {
+	normalized := make([]types.ExchangeRate, len(rates))
+	for i, r := range rates {
+		n, err := normalizeRate(r)
+		if err != nil {
+			return fmt.Errorf("%w %d: %w", ErrInvalidRate, i+1, err)
+		}
+		normalized[i] = n
+	}
+	for _, r := range normalized {
+		_, err := tx.Exec(`
+			INSERT INTO exchange_rates (date, from_currency, to_currency, rate) VALUES (?, ?, ?, ?)
+			ON CONFLICT (date, from_currency, to_currency) DO UPDATE SET rate = excluded.rate
+		`, r.Date, r.From, r.To, r.Rate)
+		if err != nil {
+			return fmt.Errorf("storing rate from %s to %s on %s: %w", r.From, r.To, r.Date, err)
+		}
+	}
+	return nil
+}
+
+// ParseCSV reads exchange rates from CSV with the header "date,from,to,rate", in any order of
+// the columns, e.g. "2025-07-01,EUR,NOK,11.83". The rates are validated by Import.
+func ParseCSV(r io.Reader) ([]types.ExchangeRate, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"date", "from", "to", "rate"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("header lacks the column %q", name)
+		}
+	}
+
+	rates := []types.ExchangeRate{}
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rates, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[columns["rate"]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: rate %q is not a number", line, record[columns["rate"]])
+		}
+		rates = append(rates, types.ExchangeRate{
+			Date: strings.TrimSpace(record[columns["date"]]),
+			From: record[columns["from"]],
+			To:   record[columns["to"]],
+			Rate: rate,
+		})
+	}
+}
+
+// List returns the imported exchange rates, newest first, optionally only those from and to the
+// currencies with the ISO 4217 codes.
+func List(q household.Querier, from, to string) ([]types.ExchangeRate, error) {
+	rows, err := q.Query(`
+		SELECT date, from_currency, to_currency, rate FROM exchange_rates
+		WHERE (? = '' OR from_currency = ?) AND (? = '' OR to_currency = ?)
+		ORDER BY date DESC, from_currency, to_currency
+	`, from, from, to, to)
+	if err != nil {
+		return nil, fmt.Errorf("querying exchange rates: %w", err)
+	}
+	defer rows.Close()
+
+	rates := []types.ExchangeRate{}
+	for rows.Next() {
+		var r types.ExchangeRate
+		if err := rows.Scan(&r.Date, &r.From, &r.To, &r.Rate); err != nil {
+			return nil, fmt.Errorf("scanning exchange rate: %w", err)
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
@@ -0,0 +1,104 @@
+package currency
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// maxImportSize bounds the body of an exchange rate import, a few years of daily rates.
+const maxImportSize = 8 << 20
+
+// HandleImportRates imports exchange rates (admin only), as a JSON array of types.ExchangeRate
+// or, with the Content-Type text/csv, as CSV with the header "date,from,to,rate".
+func HandleImportRates(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := auth.GetUserIDFromContext(r.Context())
+
+		// 1. Parse the rates
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+		var rates []types.ExchangeRate
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "text/csv" {
+			parsed, err := ParseCSV(r.Body)
+			if err != nil {
+				slog.Warn("failed to parse exchange rate CSV", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Invalid CSV: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			rates = parsed
+		} else if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+			slog.Warn("failed to decode exchange rates", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// 2. Store them
+		tx, err := db.Begin()
+		if err != nil {
+			slog.Error("failed to begin transaction for importing exchange rates", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		if err := Import(tx, rates); err != nil {
+			if errors.Is(err, ErrInvalidRate) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.Error("failed to import exchange rates", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			slog.Error("failed to commit exchange rates", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Exchange rates imported", "user_id", userID, "count", len(rates))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.ImportExchangeRatesResponse{Imported: len(rates)})
+	}
+}
+
+// HandleGetRates lists the imported exchange rates, newest first. The query parameters from and
+// to optionally restrict them to those between two currencies.
+func HandleGetRates(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := auth.GetUserIDFromContext(r.Context())
+
+		var codes [2]string
+		for i, name := range []string{"from", "to"} {
+			value := r.URL.Query().Get(name)
+			if value == "" {
+				continue
+			}
+			code, ok := household.NormalizeCurrency(value)
+			if !ok {
+				http.Error(w, "Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+				return
+			}
+			codes[i] = code
+		}
+
+		rates, err := List(db, codes[0], codes[1])
+		if err != nil {
+			slog.Error("failed to list exchange rates", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rates); err != nil {
+			slog.Error("failed to encode exchange rates", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
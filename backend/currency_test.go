@@ -0,0 +1,229 @@
+package main_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+	"git.sr.ht/~relay/sapp-backend/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// importRates imports exchange rates as the test user, who must be an admin.
+func importRates(t *testing.T, env *testutil.TestEnv, rates []types.ExchangeRate) {
+	t.Helper()
+	req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/admin/exchange-rates", env.AuthToken, rates)
+	rr := testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+}
+
+// TestImportExchangeRates tests the POST /v1/admin/exchange-rates and GET /v1/exchange-rates endpoints.
+func TestImportExchangeRates(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	rates := []types.ExchangeRate{{Date: "2025-06-01", From: "eur", To: "nok", Rate: 11.5}}
+
+	t.Run("RequiresAdmin", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/admin/exchange-rates", env.AuthToken, rates)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusForbidden)
+	})
+
+	_, err := env.DB.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", env.UserID)
+	require.NoError(t, err)
+
+	t.Run("JSON", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/admin/exchange-rates", env.AuthToken, rates)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.ImportExchangeRatesResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		assert.Equal(t, 1, resp.Imported)
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		body := "rate,date,from,to\n11.8,2025-07-01,EUR,NOK\n0.95,2025-07-01,NOK,SEK\n11.6,2025-06-01,EUR,NOK\n"
+		req, err := http.NewRequest(http.MethodPost, "/v1/admin/exchange-rates", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+env.AuthToken)
+		req.Header.Set("Content-Type", "text/csv")
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.ImportExchangeRatesResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		assert.Equal(t, 3, resp.Imported)
+	})
+
+	t.Run("InvalidRate", func(t *testing.T) {
+		invalid := []types.ExchangeRate{
+			{Date: "2025-08-01", From: "EUR", To: "NOK", Rate: 12},
+			{Date: "2025-08-01", From: "EUR", To: "NOK", Rate: -1},
+		}
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/admin/exchange-rates", env.AuthToken, invalid)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "invalid exchange rate 2")
+
+		var count int
+		require.NoError(t, env.DB.QueryRow("SELECT COUNT(*) FROM exchange_rates WHERE date = '2025-08-01'").Scan(&count))
+		assert.Zero(t, count, "Nothing is stored when a rate is invalid")
+	})
+
+	t.Run("List", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/exchange-rates?from=eur", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var listed []types.ExchangeRate
+		testutil.DecodeJSONResponse(t, rr, &listed)
+		assert.Equal(t, []types.ExchangeRate{
+			{Date: "2025-07-01", From: "EUR", To: "NOK", Rate: 11.8},
+			{Date: "2025-06-01", From: "EUR", To: "NOK", Rate: 11.6}, // Replaced by the CSV
+		}, listed)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/exchange-rates?to=euro", env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+	})
+}
+
+// TestForeignCurrencyAmounts tests that spendings and deposits in other currencies are converted
+// to the household's currency with the rate of their date, and keep the amount as entered.
+func TestForeignCurrencyAmounts(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	_, err := env.DB.Exec("UPDATE users SET is_admin = 1 WHERE id = ?", env.UserID)
+	require.NoError(t, err)
+	importRates(t, env, []types.ExchangeRate{
+		{Date: "2025-06-01", From: "EUR", To: "NOK", Rate: 11.5},
+		{Date: "2025-07-01", From: "EUR", To: "NOK", Rate: 11.8},
+		{Date: "2025-07-01", From: "NOK", To: "SEK", Rate: 0.95},
+	})
+
+	pay := func(t *testing.T, payload types.PayPayload) *int64 {
+		t.Helper()
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, payload)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var id int64
+		require.NoError(t, env.DB.QueryRow("SELECT MAX(id) FROM spendings").Scan(&id))
+		return &id
+	}
+	assertStored := func(t *testing.T, table string, id int64, amount, original money.Amount, currency string) {
+		t.Helper()
+		var gotAmount, gotOriginal money.Amount
+		var gotCurrency string
+		err := env.DB.QueryRow("SELECT amount, original_amount, currency FROM "+table+" WHERE id = ?", id).Scan(&gotAmount, &gotOriginal, &gotCurrency)
+		require.NoError(t, err)
+		assert.Equal(t, amount, gotAmount)
+		assert.Equal(t, original, gotOriginal)
+		assert.Equal(t, currency, gotCurrency)
+	}
+
+	t.Run("SpendingUsesRateOfItsDate", func(t *testing.T) {
+		id := pay(t, types.PayPayload{SharedStatus: "alone", Amount: 1000, Category: "Groceries", SpendingDate: testutil.Ptr("2025-06-20"), Currency: testutil.Ptr("eur")})
+		assertStored(t, "spendings", *id, 11500, 1000, "EUR")
+
+		id = pay(t, types.PayPayload{SharedStatus: "alone", Amount: 1000, Category: "Groceries", SpendingDate: testutil.Ptr("2025-07-15"), Currency: testutil.Ptr("EUR")})
+		assertStored(t, "spendings", *id, 11800, 1000, "EUR")
+	})
+
+	t.Run("InverseRate", func(t *testing.T) {
+		id := pay(t, types.PayPayload{SharedStatus: "alone", Amount: 9500, Category: "Groceries", SpendingDate: testutil.Ptr("2025-07-02"), Currency: testutil.Ptr("SEK")})
+		assertStored(t, "spendings", *id, 10000, 9500, "SEK")
+	})
+
+	t.Run("HouseholdCurrencyIsNotConverted", func(t *testing.T) {
+		id := pay(t, types.PayPayload{SharedStatus: "alone", Amount: 4200, Category: "Groceries", Currency: testutil.Ptr("NOK")})
+		var original, currency any
+		require.NoError(t, env.DB.QueryRow("SELECT original_amount, currency FROM spendings WHERE id = ?", *id).Scan(&original, &currency))
+		assert.Nil(t, original)
+		assert.Nil(t, currency)
+	})
+
+	t.Run("SharedBalanceInHouseholdCurrency", func(t *testing.T) {
+		_ = pay(t, types.PayPayload{SharedStatus: "shared", Amount: 2000, Category: "Groceries", SpendingDate: testutil.Ptr("2025-07-03"), Currency: testutil.Ptr("EUR")})
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/transfer/status", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var status types.TransferStatusResponse
+		testutil.DecodeJSONResponse(t, rr, &status)
+		assert.Equal(t, money.Amount(11800), status.AmountOwed, "Half of 20 EUR at 11.8")
+	})
+
+	t.Run("NoRate", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken,
+			types.PayPayload{SharedStatus: "alone", Amount: 1000, Category: "Groceries", SpendingDate: testutil.Ptr("2025-05-31"), Currency: testutil.Ptr("EUR")})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "No exchange rate")
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken,
+			types.PayPayload{SharedStatus: "alone", Amount: 1000, Category: "Groceries", Currency: testutil.Ptr("EURO")})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize", env.AuthToken,
+			types.AICategorizationPayload{Prompt: "Lunch in London", Amount: 2000, TransactionDate: testutil.Ptr("2025-07-05"), Currency: testutil.Ptr("GBP")})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "No exchange rate")
+	})
+
+	t.Run("Deposit", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/deposits", env.AuthToken,
+			types.AddDepositPayload{Amount: 10000, Description: "Refund", DepositDate: "2025-07-05", Currency: testutil.Ptr("EUR")})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusCreated)
+		var resp types.AddDepositResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		assertStored(t, "deposits", resp.DepositID, 118000, 10000, "EUR")
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/deposits", env.AuthToken,
+			types.AddDepositPayload{Amount: 10000, Description: "Refund", DepositDate: "2025-07-05", Currency: testutil.Ptr("GBP")})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/history", env.AuthToken, nil)
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		testutil.AssertBodyContains(t, rr, `"amount":1180`, `"original_amount":100`, `"currency":"EUR"`)
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/export/all", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var export types.FullExport
+		testutil.DecodeJSONResponse(t, rr, &export)
+
+		var converted int
+		for _, s := range export.ManualSpendings {
+			if s.Currency != nil && *s.Currency == "EUR" && s.OriginalAmount != nil && *s.OriginalAmount == 1000 {
+				converted++
+				assert.Contains(t, []money.Amount{11500, 11800}, s.Amount)
+			}
+		}
+		assert.Equal(t, 2, converted, "Both 10 EUR spendings are exported with their original amount")
+		require.Len(t, export.Deposits, 1)
+		require.NotNil(t, export.Deposits[0].OriginalAmount)
+		assert.Equal(t, money.Amount(10000), *export.Deposits[0].OriginalAmount)
+	})
+
+	t.Run("HouseholdCurrencyIsFixed", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/household", env.AuthToken, types.UpdateHouseholdPayload{Currency: testutil.Ptr("SEK")})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusConflict)
+
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPut, "/v1/household", env.AuthToken, types.UpdateHouseholdPayload{Currency: testutil.Ptr("NOK")})
+		rr = testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+	})
+}
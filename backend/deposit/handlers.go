@@ -12,6 +12,8 @@ import (
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/ledger"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
@@ -74,6 +76,11 @@ func HandleAddDeposit(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Bad Request: invalid date format", http.StatusBadRequest)
 			return
 		}
+		code, ok := currency.ParseCode(payload.Currency)
+		if !ok {
+			http.Error(w, "Bad Request: Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+			return
+		}
 		// Validate recurrence period if recurring
 		if payload.IsRecurring {
 			if payload.RecurrencePeriod == nil || *payload.RecurrencePeriod == "" {
@@ -106,10 +113,24 @@ func HandleAddDeposit(db *sql.DB) http.HandlerFunc {
 		}
 		defer tx.Rollback() // Rollback on error
 
+		// Convert the amount to the household's currency with the rate of the deposit date.
+		// Occurrences of recurring deposits keep it.
+		amount, err := currency.ToBase(tx, userID, payload.Amount, code, depositDate)
+		if err != nil {
+			if errors.Is(err, currency.ErrNoRate) {
+				slog.Warn("no exchange rate for deposit", "url", r.URL, "user_id", userID, "currency", code, "err", err)
+				http.Error(w, "Bad Request: No exchange rate for the currency on the deposit date", http.StatusBadRequest)
+				return
+			}
+			slog.Error("failed to convert deposit amount", "url", r.URL, "user_id", userID, "currency", code, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		// Note: end_date is not set during initial creation, it's NULL by default
 		insertQuery := `
-			INSERT INTO deposits (user_id, amount, description, deposit_date, is_recurring, recurrence_period, created_at)
-			VALUES (?, ?, ?, ?, ?, ?, ?)
+			INSERT INTO deposits (user_id, amount, description, deposit_date, is_recurring, recurrence_period, created_at, original_amount, currency)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
 		`
 		// Use UTC time for consistency
 		now := time.Now().UTC()
@@ -118,7 +139,7 @@ func HandleAddDeposit(db *sql.DB) http.HandlerFunc {
 		depositDateUTC := depositDate.UTC()
 		depositDateStr := depositDateUTC.Format(time.RFC3339)
 
-		result, err := tx.Exec(insertQuery, userID, payload.Amount, payload.Description, depositDateStr, payload.IsRecurring, payload.RecurrencePeriod, now)
+		result, err := tx.Exec(insertQuery, userID, amount.Amount, payload.Description, depositDateStr, payload.IsRecurring, payload.RecurrencePeriod, now, amount.Original, amount.Currency)
 		if err != nil {
 			slog.Error("failed to insert deposit", "url", r.URL, "user_id", userID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -131,6 +152,11 @@ func HandleAddDeposit(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		if err := ledger.RecordDeposit(tx, depositID); err != nil {
+			slog.Error("failed to record deposit in the ledger", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
 		// 4. Commit transaction
 		if err = tx.Commit(); err != nil {
@@ -170,7 +196,7 @@ func HandleGetDepositByID(db *sql.DB) http.HandlerFunc {
 		}
 
 		query := `
-			SELECT id, user_id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at
+			SELECT id, user_id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at, original_amount, currency
 			FROM deposits
 			WHERE id = ? AND user_id = ?;
 		`
@@ -191,6 +217,8 @@ func HandleGetDepositByID(db *sql.DB) http.HandlerFunc {
 			&recurrencePeriod, // Scan into sql.NullString
 			&endDate,          // Scan into sql.NullTime
 			&d.CreatedAt,
+			&d.OriginalAmount,
+			&d.Currency,
 		); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				slog.Warn("deposit not found or access denied", "url", r.URL, "user_id", userID, "deposit_id", depositID)
@@ -257,10 +285,11 @@ func HandleUpdateDeposit(db *sql.DB) http.HandlerFunc {
 		var current types.Deposit
 		var currentEndDate sql.NullTime
 		var currentRecurrencePeriod sql.NullString
-		query := `SELECT user_id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at FROM deposits WHERE id = ?`
+		query := `SELECT user_id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at, original_amount, currency FROM deposits WHERE id = ?`
 		err = tx.QueryRow(query, depositID).Scan(
 			&current.UserID, &current.Amount, &current.Description, &current.DepositDate,
 			&current.IsRecurring, &currentRecurrencePeriod, &currentEndDate, &current.CreatedAt,
+			&current.OriginalAmount, &current.Currency,
 		)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
@@ -289,13 +318,28 @@ func HandleUpdateDeposit(db *sql.DB) http.HandlerFunc {
 		updateFields := make(map[string]interface{})
 		var newDepositDate *time.Time // Store parsed date if provided
 
+		// The amount as entered and its currency, converted again below if either or the date changes
+		enteredAmount := current.Amount
+		if current.OriginalAmount != nil {
+			enteredAmount = *current.OriginalAmount
+		}
+		code := ""
+		if current.Currency != nil {
+			code = *current.Currency
+		}
 		if payload.Amount != nil {
 			if *payload.Amount <= 0 {
 				http.Error(w, "Bad Request: Amount must be positive", http.StatusBadRequest)
 				return
 			}
-			updateFields["amount"] = *payload.Amount
-			current.Amount = *payload.Amount // Update current state for response
+			enteredAmount = *payload.Amount
+		}
+		if payload.Currency != nil {
+			var ok bool
+			if code, ok = currency.ParseCode(payload.Currency); !ok {
+				http.Error(w, "Bad Request: Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+				return
+			}
 		}
 		if payload.Description != nil {
 			if *payload.Description == "" {
@@ -322,6 +366,29 @@ func HandleUpdateDeposit(db *sql.DB) http.HandlerFunc {
 			current.DepositDate = *newDepositDate // Update current state
 		}
 
+		if payload.Amount != nil || payload.Currency != nil || newDepositDate != nil {
+			amount, err := currency.ToBase(tx, userID, enteredAmount, code, current.DepositDate)
+			if err != nil {
+				if errors.Is(err, currency.ErrNoRate) {
+					slog.Warn("no exchange rate for updated deposit", "url", r.URL, "user_id", userID, "deposit_id", depositID, "currency", code, "err", err)
+					http.Error(w, "Bad Request: No exchange rate for the currency on the deposit date", http.StatusBadRequest)
+					return
+				}
+				slog.Error("failed to convert updated deposit amount", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			updateFields["amount"] = amount.Amount
+			updateFields["original_amount"] = amount.Original
+			updateFields["currency"] = amount.Currency
+			// Update current state for response
+			current.Amount = amount.Amount
+			current.OriginalAmount, current.Currency = nil, nil
+			if amount.Original.Valid {
+				current.OriginalAmount, current.Currency = &amount.Original.V, &amount.Currency.String
+			}
+		}
+
 		// Handle recurrence logic carefully
 		newIsRecurring := current.IsRecurring // Start with current value
 		if payload.IsRecurring != nil {
@@ -427,6 +494,11 @@ func HandleUpdateDeposit(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		if err := ledger.RecordDeposit(tx, depositID); err != nil {
+			slog.Error("failed to record updated deposit in the ledger", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
 		// 6. Commit Transaction
 		if err = tx.Commit(); err != nil {
@@ -493,7 +565,13 @@ func HandleDeleteDeposit(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// 3. Execute Delete (Hard Delete)
+		// 3. Execute Delete (Hard Delete), with the deposit's attachments. Their files are
+		// removed by the attachment store's sweep.
+		if _, err := tx.Exec("DELETE FROM attachments WHERE deposit_id = ?", depositID); err != nil {
+			slog.Error("failed to delete deposit attachments", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		result, err := tx.Exec("DELETE FROM deposits WHERE id = ?", depositID)
 		if err != nil {
 			slog.Error("failed to execute deposit delete", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
@@ -513,6 +591,11 @@ func HandleDeleteDeposit(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Deposit not found", http.StatusNotFound) // Treat as not found if nothing deleted
 			return
 		}
+		if err := ledger.RecordDeposit(tx, depositID); err != nil {
+			slog.Error("failed to remove deposit from the ledger", "url", r.URL, "user_id", userID, "deposit_id", depositID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
 		// 4. Commit Transaction
 		if err = tx.Commit(); err != nil {
@@ -544,7 +627,7 @@ func HandleGetDeposits(db *sql.DB) http.HandlerFunc {
 
 		// Fetch deposit templates, including the new end_date
 		query := `
-			SELECT id, user_id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at
+			SELECT id, user_id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at, original_amount, currency
 			FROM deposits
 			WHERE user_id = ? -- Removed is_active filter, assuming hard delete
 			ORDER BY deposit_date DESC, created_at DESC;
@@ -574,6 +657,8 @@ func HandleGetDeposits(db *sql.DB) http.HandlerFunc {
 				&recurrencePeriod, // Scan into sql.NullString
 				&endDate,          // Scan into sql.NullTime
 				&d.CreatedAt,
+				&d.OriginalAmount,
+				&d.Currency,
 			); err != nil {
 				slog.Error("failed to scan deposit template row", "url", r.URL, "user_id", userID, "err", err)
 				http.Error(w, "Internal server error during data retrieval", http.StatusInternalServerError)
@@ -2,11 +2,11 @@ package main_test
 
 import (
 	"database/sql"
-	"math"
 	"net/http"
 	"testing"
 	"time"
 
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/testutil"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
@@ -27,7 +27,7 @@ func TestAddDeposit(t *testing.T) {
 		{
 			name: "SuccessOneOff",
 			payload: types.AddDepositPayload{ // Use types.AddDepositPayload
-				Amount:      1000.00,
+				Amount:      100000,
 				Description: "Salary",
 				DepositDate: "2024-05-15",
 				IsRecurring: false,
@@ -35,7 +35,7 @@ func TestAddDeposit(t *testing.T) {
 			expectedStatus: http.StatusCreated,
 			expectedBody:   "Deposit added successfully",
 			verifyFunc: func(t *testing.T, id int64) {
-				var dbAmount float64
+				var dbAmount money.Amount
 				var dbDesc string
 				var dbDate string
 				var dbRecurring bool
@@ -44,8 +44,8 @@ func TestAddDeposit(t *testing.T) {
 				if err != nil {
 					t.Fatalf("Verification query failed: %v", err)
 				}
-				if math.Abs(dbAmount-1000.00) > 0.001 {
-					t.Errorf("Expected amount 1000.00, got %f", dbAmount)
+				if dbAmount != 100000 {
+					t.Errorf("Expected amount 1000.00, got %s", dbAmount)
 				}
 				if dbDesc != "Salary" {
 					t.Errorf("Expected description 'Salary', got '%s'", dbDesc)
@@ -64,7 +64,7 @@ func TestAddDeposit(t *testing.T) {
 		{
 			name: "SuccessRecurring",
 			payload: types.AddDepositPayload{ // Use types.AddDepositPayload
-				Amount:           50.00,
+				Amount:           5000,
 				Description:      "Pocket Money",
 				DepositDate:      "2024-05-10",
 				IsRecurring:      true,
@@ -90,7 +90,7 @@ func TestAddDeposit(t *testing.T) {
 		{
 			name: "ErrorNegativeAmount",
 			payload: types.AddDepositPayload{ // Use types.AddDepositPayload
-				Amount:      -100.00,
+				Amount:      -10000,
 				Description: "Invalid",
 				DepositDate: "2024-05-15",
 				IsRecurring: false,
@@ -101,7 +101,7 @@ func TestAddDeposit(t *testing.T) {
 		{
 			name: "ErrorMissingDescription",
 			payload: types.AddDepositPayload{ // Use types.AddDepositPayload
-				Amount:      100.00,
+				Amount:      10000,
 				Description: "", // Missing
 				DepositDate: "2024-05-15",
 				IsRecurring: false,
@@ -112,7 +112,7 @@ func TestAddDeposit(t *testing.T) {
 		{
 			name: "ErrorInvalidDateFormat",
 			payload: types.AddDepositPayload{ // Use types.AddDepositPayload
-				Amount:      100.00,
+				Amount:      10000,
 				Description: "Bad Date",
 				DepositDate: "15-05-2024", // Wrong format
 				IsRecurring: false,
@@ -123,7 +123,7 @@ func TestAddDeposit(t *testing.T) {
 		{
 			name: "ErrorMissingRecurrencePeriod",
 			payload: types.AddDepositPayload{ // Use types.AddDepositPayload
-				Amount:      100.00,
+				Amount:      10000,
 				Description: "Recurring No Period",
 				DepositDate: "2024-05-15",
 				IsRecurring: true,
@@ -157,7 +157,7 @@ func TestAddDeposit(t *testing.T) {
 
 	// --- Test Case: Unauthorized ---
 	t.Run("Unauthorized", func(t *testing.T) {
-		payload := types.AddDepositPayload{Amount: 100, Description: "Test", DepositDate: "2024-01-01"} // Use types.AddDepositPayload
+		payload := types.AddDepositPayload{Amount: 10000, Description: "Test", DepositDate: "2024-01-01"} // Use types.AddDepositPayload
 		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/deposits", "invalid-token", payload)
 		rr := testutil.ExecuteRequest(t, env.Handler, req)
 		testutil.AssertStatusCode(t, rr, http.StatusUnauthorized)
@@ -165,7 +165,7 @@ func TestAddDeposit(t *testing.T) {
 
 	// --- Test Case: Unauthorized ---
 	t.Run("Unauthorized", func(t *testing.T) {
-		payload := types.AddDepositPayload{Amount: 100, Description: "Test", DepositDate: "2024-01-01"} // Use types.AddDepositPayload
+		payload := types.AddDepositPayload{Amount: 10000, Description: "Test", DepositDate: "2024-01-01"} // Use types.AddDepositPayload
 		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/deposits", "invalid-token", payload)
 		rr := testutil.ExecuteRequest(t, env.Handler, req)
 		testutil.AssertStatusCode(t, rr, http.StatusUnauthorized)
@@ -221,7 +221,7 @@ func TestGetDeposits(t *testing.T) {
 		}
 
 		// Check content of one deposit
-		if resp[0].Description != "Bonus" || math.Abs(resp[0].Amount-1500.0) > 0.001 {
+		if resp[0].Description != "Bonus" || resp[0].Amount != 150000 {
 			t.Errorf("Deposit 1 content mismatch: got %+v", resp[0])
 		}
 		// Check date (ignoring time part for simplicity)
@@ -0,0 +1,141 @@
+package export
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/attachment"
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// ArchiveAttachmentPath is where the export archive holds the content of an attachment or
+// receipt photo. Files with the same content are held once.
+func ArchiveAttachmentPath(sha256 string) string {
+	return "attachments/" + sha256
+}
+
+// HandleExportArchive generates a zip archive with the JSON export of HandleExportAllData as
+// export.json, along with the files attached to the exported spendings and deposits and the
+// receipt photos of the AI jobs.
+func HandleExportArchive(db *sql.DB, store *attachment.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for export archive", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Starting export archive process", "user_id", userID)
+
+		// 1. Collect everything the user can see
+		tx, err := beginExport(r, db, userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		exportData, err := BuildFullExport(tx, userID)
+		tx.Rollback() // Read-only; the files are read after releasing the database
+		if err != nil {
+			handleExportError(w, "building export", userID, err)
+			return
+		}
+		jsonData, err := json.MarshalIndent(exportData, "", "  ")
+		if err != nil {
+			handleExportError(w, "marshalling data to JSON", userID, err)
+			return
+		}
+
+		// 2. Stream the archive. Once started, failures can only be logged.
+		filename := fmt.Sprintf("sapp_export_%s.zip", time.Now().UTC().Format("20060102_150405"))
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+		w.Header().Set("Content-Type", "application/zip")
+		w.WriteHeader(http.StatusOK)
+
+		archive := zip.NewWriter(w)
+		if err := writeArchive(archive, store, jsonData, exportedAttachments(exportData)); err != nil {
+			slog.Error("failed to write export archive", "user_id", userID, "err", err)
+			return
+		}
+		if err := archive.Close(); err != nil {
+			slog.Error("failed to finish export archive", "user_id", userID, "err", err)
+			return
+		}
+
+		slog.Info("Export archive completed successfully", "user_id", userID, "filename", filename)
+	}
+}
+
+// exportedAttachments returns the hashes of all attachments and receipt photos in the export,
+// each once.
+func exportedAttachments(data types.FullExport) []string {
+	seen := map[string]bool{}
+	var hashes []string
+	addHash := func(hash string) {
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	add := func(attachments []types.AttachmentExport) {
+		for _, a := range attachments {
+			addHash(a.SHA256)
+		}
+	}
+	for _, job := range data.AIJobs {
+		if job.Receipt != nil {
+			addHash(job.Receipt.SHA256)
+		}
+		for _, item := range job.Spendings {
+			add(item.Attachments)
+		}
+	}
+	for _, spending := range data.ManualSpendings {
+		add(spending.Attachments)
+	}
+	for _, deposit := range data.Deposits {
+		add(deposit.Attachments)
+	}
+	return hashes
+}
+
+// writeArchive writes export.json and the attachment files to the archive.
+func writeArchive(archive *zip.Writer, store *attachment.Store, jsonData []byte, hashes []string) error {
+	f, err := archive.Create("export.json")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(jsonData); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if err := writeArchiveFile(archive, store, hash); err != nil {
+			return fmt.Errorf("adding attachment %s: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+func writeArchiveFile(archive *zip.Writer, store *attachment.Store, hash string) error {
+	file, err := store.Open(hash)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// PDFs and photos are compressed already
+	f, err := archive.CreateHeader(&zip.FileHeader{Name: ArchiveAttachmentPath(hash), Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, file)
+	return err
+}
@@ -7,13 +7,15 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
-// HandleExportAllData generates a JSON export of all data for the user and their partner.
+// HandleExportAllData generates a JSON export of all data for the user and their household.
 func HandleExportAllData(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := auth.GetUserIDFromContext(r.Context())
@@ -25,88 +27,20 @@ func HandleExportAllData(db *sql.DB) http.HandlerFunc {
 
 		slog.Info("Starting data export process", "user_id", userID)
 
-		// Use a single transaction for consistency, although it might be long-running.
-		// Consider read-only transaction if supported and sufficient.
-		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true}) // Attempt read-only transaction
+		tx, err := beginExport(r, db, userID)
 		if err != nil {
-			slog.Error("failed to begin read-only transaction for export", "user_id", userID, "err", err)
-			// Fallback to regular transaction if read-only is not supported/fails
-			tx, err = db.Begin()
-			if err != nil {
-				slog.Error("failed to begin transaction for export", "user_id", userID, "err", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-		}
-		defer tx.Rollback() // Ensure rollback happens, although it's read-only ideally
-
-		// 1. Get User and Partner Info
-		user, err := fetchUserExport(tx, userID)
-		if err != nil {
-			handleExportError(w, "fetching user details", userID, err)
-			return
-		}
-
-		partnerID, partnerFound := auth.GetPartnerUserID(tx, userID)
-		var partner types.UserExport
-		if partnerFound {
-			partner, err = fetchUserExport(tx, partnerID)
-			if err != nil {
-				handleExportError(w, "fetching partner details", userID, err)
-				return
-			}
-		} else {
-			slog.Warn("No partner found for user during export", "user_id", userID)
-			// Partner will be an empty struct, which is fine for JSON marshalling
-		}
-
-		// 2. Get Categories (Global)
-		categories, err := fetchCategoriesExport(tx)
-		if err != nil {
-			handleExportError(w, "fetching categories", userID, err)
-			return
-		}
-
-		// 3. Get AI Jobs (for both user and partner)
-		aiJobs, err := fetchAIJobsExport(tx, userID, partnerID)
-		if err != nil {
-			handleExportError(w, "fetching AI jobs", userID, err)
-			return
-		}
-
-		// 4. Get Manual Spendings (for both user and partner)
-		manualSpendings, err := fetchManualSpendingsExport(tx, userID, partnerID)
-		if err != nil {
-			handleExportError(w, "fetching manual spendings", userID, err)
-			return
-		}
-
-		// 5. Get Deposits (for both user and partner)
-		deposits, err := fetchDepositsExport(tx, userID, partnerID)
-		if err != nil {
-			handleExportError(w, "fetching deposits", userID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		defer tx.Rollback() // Ensure rollback happens, although it's read-only ideally
 
-		// 6. Get Transfers (between user and partner)
-		transfers, err := fetchTransfersExport(tx, userID, partnerID)
+		// 1-7. Collect everything the user can see
+		exportData, err := BuildFullExport(tx, userID)
 		if err != nil {
-			handleExportError(w, "fetching transfers", userID, err)
+			handleExportError(w, "building export", userID, err)
 			return
 		}
 
-		// 7. Assemble Full Export Data
-		exportData := types.FullExport{
-			ExportedAt:      time.Now().UTC(),
-			User:            user,
-			Partner:         partner,
-			Categories:      categories,
-			AIJobs:          aiJobs,
-			ManualSpendings: manualSpendings,
-			Deposits:        deposits,
-			Transfers:       transfers,
-		}
-
 		// 8. Marshal to JSON
 		jsonData, err := json.MarshalIndent(exportData, "", "  ") // Use indent for readability
 		if err != nil {
@@ -131,6 +65,109 @@ func HandleExportAllData(db *sql.DB) http.HandlerFunc {
 
 // --- Helper Functions for Fetching Data ---
 
+// beginExport begins the transaction an export reads from.
+func beginExport(r *http.Request, db *sql.DB, userID int64) (*sql.Tx, error) {
+	// Use a single transaction for consistency, although it might be long-running.
+	// Consider read-only transaction if supported and sufficient.
+	tx, err := db.BeginTx(r.Context(), &sql.TxOptions{ReadOnly: true}) // Attempt read-only transaction
+	if err != nil {
+		slog.Error("failed to begin read-only transaction for export", "user_id", userID, "err", err)
+		// Fallback to regular transaction if read-only is not supported/fails
+		tx, err = db.Begin()
+		if err != nil {
+			slog.Error("failed to begin transaction for export", "user_id", userID, "err", err)
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// BuildFullExport collects all data visible to the user: their own details, their
+// household, and everything bought by or exchanged between household members.
+func BuildFullExport(tx *sql.Tx, userID int64) (types.FullExport, error) {
+	// 1. Get User and Partner Info
+	user, err := fetchUserExport(tx, userID)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching user details: %w", err)
+	}
+
+	partnerID, partnerFound := auth.GetPartnerUserID(tx, userID)
+	var partner types.UserExport
+	if partnerFound {
+		partner, err = fetchUserExport(tx, partnerID)
+		if err != nil {
+			return types.FullExport{}, fmt.Errorf("fetching partner details: %w", err)
+		}
+	} else {
+		slog.Warn("No partner found for user during export", "user_id", userID)
+		// Partner will be an empty struct, which is fine for JSON marshalling
+	}
+
+	// The rest of the household; data bought by any member is included
+	otherIDs, err := household.OtherMemberIDs(tx, userID)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching household members: %w", err)
+	}
+	householdExport := []types.UserExport{}
+	for _, otherID := range otherIDs {
+		member, err := fetchUserExport(tx, otherID)
+		if err != nil {
+			return types.FullExport{}, fmt.Errorf("fetching household member details: %w", err)
+		}
+		householdExport = append(householdExport, member)
+	}
+	memberIDs := append([]int64{userID}, otherIDs...)
+
+	// 2. Get Categories (Global)
+	categories, err := fetchCategoriesExport(tx)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching categories: %w", err)
+	}
+
+	// Attachments go with the spendings and deposits below
+	attachments, err := fetchAttachmentsExport(tx, memberIDs)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching attachments: %w", err)
+	}
+
+	// 3. Get AI Jobs (for all household members)
+	aiJobs, err := fetchAIJobsExport(tx, memberIDs, attachments)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching AI jobs: %w", err)
+	}
+
+	// 4. Get Manual Spendings (for all household members)
+	manualSpendings, err := fetchManualSpendingsExport(tx, memberIDs, attachments)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching manual spendings: %w", err)
+	}
+
+	// 5. Get Deposits (for all household members)
+	deposits, err := fetchDepositsExport(tx, memberIDs, attachments)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching deposits: %w", err)
+	}
+
+	// 6. Get Transfers (between household members)
+	transfers, err := fetchTransfersExport(tx, memberIDs)
+	if err != nil {
+		return types.FullExport{}, fmt.Errorf("fetching transfers: %w", err)
+	}
+
+	// 7. Assemble Full Export Data
+	return types.FullExport{
+		ExportedAt:      time.Now().UTC(),
+		User:            user,
+		Partner:         partner,
+		Household:       householdExport,
+		Categories:      categories,
+		AIJobs:          aiJobs,
+		ManualSpendings: manualSpendings,
+		Deposits:        deposits,
+		Transfers:       transfers,
+	}, nil
+}
+
 func handleExportError(w http.ResponseWriter, step string, userID int64, err error) {
 	slog.Error(fmt.Sprintf("Export failed during %s", step), "user_id", userID, "err", err)
 	if errors.Is(err, sql.ErrNoRows) {
@@ -140,12 +177,41 @@ func handleExportError(w http.ResponseWriter, step string, userID int64, err err
 	}
 }
 
+// inClause builds a placeholder list and arguments for an SQL IN clause.
+func inClause(ids []int64) (string, []interface{}) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	return strings.Join(placeholders, ","), args
+}
+
+// splitParticipants splits the usernames aggregated by participantsColumn.
+func splitParticipants(participants sql.NullString) []string {
+	if !participants.Valid || participants.String == "" {
+		return nil
+	}
+	return strings.Split(participants.String, "\x1f")
+}
+
+// participantsColumn aggregates the usernames sharing the cost of spending s, separated by char(31).
+const participantsColumn = `(
+			SELECT GROUP_CONCAT(username, char(31)) FROM (
+				SELECT pu.username FROM spending_shares ss JOIN users pu ON ss.user_id = pu.id
+				WHERE ss.spending_id = s.id ORDER BY ss.user_id
+			)
+		) AS participants`
+
 func fetchUserExport(q auth.Querier, userID int64) (types.UserExport, error) {
 	var user types.UserExport
-	err := q.QueryRow("SELECT username, first_name FROM users WHERE id = ?", userID).Scan(&user.Username, &user.FirstName)
+	var aiNotes sql.NullString
+	err := q.QueryRow("SELECT username, first_name, ai_notes FROM users WHERE id = ?", userID).Scan(&user.Username, &user.FirstName, &aiNotes)
 	if err != nil {
 		return types.UserExport{}, fmt.Errorf("querying user %d: %w", userID, err)
 	}
+	user.AINotes = aiNotes.String
 	return user, nil
 }
 
@@ -174,18 +240,67 @@ func fetchCategoriesExport(tx *sql.Tx) ([]types.CategoryExport, error) {
 	return categories, nil
 }
 
-func fetchAIJobsExport(tx *sql.Tx, userID, partnerID int64) ([]types.AIJobExport, error) {
+// attachmentsExport holds the exported attachments by what they are attached to.
+type attachmentsExport struct {
+	spendings map[int64][]types.AttachmentExport
+	deposits  map[int64][]types.AttachmentExport
+}
+
+// fetchAttachmentsExport fetches the attachments of spendings bought by, and deposits of,
+// household members.
+func fetchAttachmentsExport(tx *sql.Tx, memberIDs []int64) (attachmentsExport, error) {
+	attachments := attachmentsExport{
+		spendings: map[int64][]types.AttachmentExport{},
+		deposits:  map[int64][]types.AttachmentExport{},
+	}
+	members, args := inClause(memberIDs)
+	query := fmt.Sprintf(`
+		SELECT a.spending_id, a.deposit_id, a.file_name, a.media_type, a.size, a.sha256, a.created_at
+		FROM attachments a
+		LEFT JOIN user_spendings us ON us.spending_id = a.spending_id
+		LEFT JOIN deposits d ON d.id = a.deposit_id
+		WHERE us.buyer IN (%[1]s) OR d.user_id IN (%[1]s)
+		ORDER BY a.id ASC;
+	`, members)
+	rows, err := tx.Query(query, append(args, args...)...)
+	if err != nil {
+		return attachmentsExport{}, fmt.Errorf("querying attachments: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a types.AttachmentExport
+		var spendingID, depositID sql.NullInt64
+		if err := rows.Scan(&spendingID, &depositID, &a.FileName, &a.MediaType, &a.Size, &a.SHA256, &a.CreatedAt); err != nil {
+			return attachmentsExport{}, fmt.Errorf("scanning attachment row: %w", err)
+		}
+		a.Path = ArchiveAttachmentPath(a.SHA256)
+		if spendingID.Valid {
+			attachments.spendings[spendingID.Int64] = append(attachments.spendings[spendingID.Int64], a)
+		} else if depositID.Valid {
+			attachments.deposits[depositID.Int64] = append(attachments.deposits[depositID.Int64], a)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return attachmentsExport{}, fmt.Errorf("iterating attachment rows: %w", err)
+	}
+	return attachments, nil
+}
+
+func fetchAIJobsExport(tx *sql.Tx, memberIDs []int64, attachments attachmentsExport) ([]types.AIJobExport, error) {
 	jobs := []types.AIJobExport{}
-	jobQuery := `
+	members, args := inClause(memberIDs)
+	jobQuery := fmt.Sprintf(`
 		SELECT
 			j.id, j.prompt, j.total_amount, j.transaction_date, j.pre_settled,
-			u.username AS buyer_username, j.is_ambiguity_flagged, j.ambiguity_flag_reason
+			u.username AS buyer_username, j.is_ambiguity_flagged, j.ambiguity_flag_reason, j.currency,
+			j.receipt_sha256, j.receipt_media_type
 		FROM ai_categorization_jobs j
 		JOIN users u ON j.buyer = u.id
-		WHERE j.buyer = ? OR j.buyer = ?
+		WHERE j.buyer IN (%s)
 		ORDER BY j.transaction_date DESC, j.created_at DESC;
-	`
-	jobRows, err := tx.Query(jobQuery, userID, partnerID)
+	`, members)
+	jobRows, err := tx.Query(jobQuery, args...)
 	if err != nil {
 		return nil, fmt.Errorf("querying AI jobs: %w", err)
 	}
@@ -193,8 +308,8 @@ func fetchAIJobsExport(tx *sql.Tx, userID, partnerID int64) ([]types.AIJobExport
 
 	spendingQuery := `
 		SELECT
-			c.name AS category_name, s.amount, s.description,
-			us.shared_with, us.shared_user_takes_all
+			s.id, c.name AS category_name, s.amount, s.original_amount, s.currency, s.description,
+			us.shared_with, us.shared_user_takes_all, ` + participantsColumn + `
 		FROM spendings s
 		JOIN ai_categorized_spendings acs ON s.id = acs.spending_id
 		JOIN user_spendings us ON s.id = us.spending_id
@@ -211,17 +326,25 @@ func fetchAIJobsExport(tx *sql.Tx, userID, partnerID int64) ([]types.AIJobExport
 	for jobRows.Next() {
 		var job types.AIJobExport
 		var jobID int64 // Need the ID to query spendings
-		var ambiguityReason sql.NullString
+		var ambiguityReason, receiptSHA256, receiptMediaType sql.NullString
 
 		if err := jobRows.Scan(
 			&jobID, &job.Prompt, &job.TotalAmount, &job.TransactionDate, &job.PreSettled,
-			&job.BuyerUsername, &job.IsAmbiguous, &ambiguityReason,
+			&job.BuyerUsername, &job.IsAmbiguous, &ambiguityReason, &job.Currency,
+			&receiptSHA256, &receiptMediaType,
 		); err != nil {
 			return nil, fmt.Errorf("scanning AI job row: %w", err)
 		}
 		if ambiguityReason.Valid {
 			job.AmbiguityReason = &ambiguityReason.String
 		}
+		if receiptSHA256.Valid {
+			job.Receipt = &types.ReceiptExport{
+				MediaType: receiptMediaType.String,
+				SHA256:    receiptSHA256.String,
+				Path:      ArchiveAttachmentPath(receiptSHA256.String),
+			}
+		}
 
 		spendingRows, err := spendingStmt.Query(jobID)
 		if err != nil {
@@ -231,12 +354,14 @@ func fetchAIJobsExport(tx *sql.Tx, userID, partnerID int64) ([]types.AIJobExport
 		job.Spendings = []types.SpendingItemExport{}
 		for spendingRows.Next() {
 			var item types.SpendingItemExport
+			var spendingID int64
 			var sharedWith sql.NullInt64
 			var sharedUserTakesAll bool
+			var participants sql.NullString
 
 			if err := spendingRows.Scan(
-				&item.CategoryName, &item.Amount, &item.Description,
-				&sharedWith, &sharedUserTakesAll,
+				&spendingID, &item.CategoryName, &item.Amount, &item.OriginalAmount, &item.Currency, &item.Description,
+				&sharedWith, &sharedUserTakesAll, &participants,
 			); err != nil {
 				spendingRows.Close()
 				return nil, fmt.Errorf("scanning spending item row for job %d: %w", jobID, err)
@@ -250,6 +375,8 @@ func fetchAIJobsExport(tx *sql.Tx, userID, partnerID int64) ([]types.AIJobExport
 			} else {
 				item.ApportionMode = "Shared"
 			}
+			item.Participants = splitParticipants(participants)
+			item.Attachments = attachments.spendings[spendingID]
 			job.Spendings = append(job.Spendings, item)
 		}
 		spendingRows.Close()
@@ -264,12 +391,13 @@ func fetchAIJobsExport(tx *sql.Tx, userID, partnerID int64) ([]types.AIJobExport
 	return jobs, nil
 }
 
-func fetchManualSpendingsExport(tx *sql.Tx, userID, partnerID int64) ([]types.ManualSpendingExport, error) {
+func fetchManualSpendingsExport(tx *sql.Tx, memberIDs []int64, attachments attachmentsExport) ([]types.ManualSpendingExport, error) {
 	spendings := []types.ManualSpendingExport{}
-	query := `
+	members, args := inClause(memberIDs)
+	query := fmt.Sprintf(`
 		SELECT
-			s.amount, s.description, c.name AS category_name, s.spending_date,
-			u.username AS buyer_username, us.shared_with, us.shared_user_takes_all, us.settled_at
+			s.id, s.amount, s.original_amount, s.currency, s.description, c.name AS category_name, s.spending_date,
+			u.username AS buyer_username, us.shared_with, us.shared_user_takes_all, us.settled_at, `+participantsColumn+`
 		FROM spendings s
 		JOIN user_spendings us ON s.id = us.spending_id
 		JOIN categories c ON s.category = c.id
@@ -277,10 +405,10 @@ func fetchManualSpendingsExport(tx *sql.Tx, userID, partnerID int64) ([]types.Ma
 		LEFT JOIN ai_categorized_spendings acs ON s.id = acs.spending_id
 		WHERE
 			acs.job_id IS NULL -- Only include spendings NOT linked to an AI job
-			AND (us.buyer = ? OR us.buyer = ?) -- Include if bought by user or partner
+			AND us.buyer IN (%s) -- Include if bought by a household member
 		ORDER BY s.spending_date DESC, s.created_at DESC;
-	`
-	rows, err := tx.Query(query, userID, partnerID)
+	`, members)
+	rows, err := tx.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("querying manual spendings: %w", err)
 	}
@@ -288,13 +416,15 @@ func fetchManualSpendingsExport(tx *sql.Tx, userID, partnerID int64) ([]types.Ma
 
 	for rows.Next() {
 		var sp types.ManualSpendingExport
+		var spendingID int64
 		var sharedWith sql.NullInt64
 		var sharedUserTakesAll bool
 		var settledAt sql.NullTime
+		var participants sql.NullString
 
 		if err := rows.Scan(
-			&sp.Amount, &sp.Description, &sp.CategoryName, &sp.SpendingDate,
-			&sp.BuyerUsername, &sharedWith, &sharedUserTakesAll, &settledAt,
+			&spendingID, &sp.Amount, &sp.OriginalAmount, &sp.Currency, &sp.Description, &sp.CategoryName, &sp.SpendingDate,
+			&sp.BuyerUsername, &sharedWith, &sharedUserTakesAll, &settledAt, &participants,
 		); err != nil {
 			return nil, fmt.Errorf("scanning manual spending row: %w", err)
 		}
@@ -307,6 +437,8 @@ func fetchManualSpendingsExport(tx *sql.Tx, userID, partnerID int64) ([]types.Ma
 		} else {
 			sp.SharedStatus = "Shared"
 		}
+		sp.Participants = splitParticipants(participants)
+		sp.Attachments = attachments.spendings[spendingID]
 
 		if settledAt.Valid {
 			sp.SettledAt = &settledAt.Time
@@ -320,18 +452,19 @@ func fetchManualSpendingsExport(tx *sql.Tx, userID, partnerID int64) ([]types.Ma
 	return spendings, nil
 }
 
-func fetchDepositsExport(tx *sql.Tx, userID, partnerID int64) ([]types.DepositExport, error) {
+func fetchDepositsExport(tx *sql.Tx, memberIDs []int64, attachments attachmentsExport) ([]types.DepositExport, error) {
 	deposits := []types.DepositExport{}
-	query := `
+	members, args := inClause(memberIDs)
+	query := fmt.Sprintf(`
 		SELECT
-			d.description, d.amount, d.deposit_date, d.is_recurring, d.recurrence_period, d.end_date,
+			d.id, d.description, d.amount, d.original_amount, d.currency, d.deposit_date, d.is_recurring, d.recurrence_period, d.end_date,
 			u.username AS owner_username
 		FROM deposits d
 		JOIN users u ON d.user_id = u.id
-		WHERE d.user_id = ? OR d.user_id = ?
+		WHERE d.user_id IN (%s)
 		ORDER BY d.deposit_date DESC, d.created_at DESC;
-	`
-	rows, err := tx.Query(query, userID, partnerID)
+	`, members)
+	rows, err := tx.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("querying deposits: %w", err)
 	}
@@ -339,11 +472,12 @@ func fetchDepositsExport(tx *sql.Tx, userID, partnerID int64) ([]types.DepositEx
 
 	for rows.Next() {
 		var dep types.DepositExport
+		var depositID int64
 		var recurrencePeriod sql.NullString
 		var endDate sql.NullTime
 
 		if err := rows.Scan(
-			&dep.Description, &dep.Amount, &dep.DepositDate, &dep.IsRecurring,
+			&depositID, &dep.Description, &dep.Amount, &dep.OriginalAmount, &dep.Currency, &dep.DepositDate, &dep.IsRecurring,
 			&recurrencePeriod, &endDate, &dep.OwnerUsername,
 		); err != nil {
 			return nil, fmt.Errorf("scanning deposit row: %w", err)
@@ -355,6 +489,7 @@ func fetchDepositsExport(tx *sql.Tx, userID, partnerID int64) ([]types.DepositEx
 		if endDate.Valid {
 			dep.EndDate = &endDate.Time
 		}
+		dep.Attachments = attachments.deposits[depositID]
 		deposits = append(deposits, dep)
 	}
 	if err = rows.Err(); err != nil {
@@ -363,18 +498,18 @@ func fetchDepositsExport(tx *sql.Tx, userID, partnerID int64) ([]types.DepositEx
 	return deposits, nil
 }
 
-func fetchTransfersExport(tx *sql.Tx, userID, partnerID int64) ([]types.TransferExport, error) {
+func fetchTransfersExport(tx *sql.Tx, memberIDs []int64) ([]types.TransferExport, error) {
 	transfers := []types.TransferExport{}
-	query := `
+	members, args := inClause(memberIDs)
+	query := fmt.Sprintf(`
 		SELECT
 			t.settlement_time, u.username AS settled_by_username
 		FROM transfers t
 		JOIN users u ON t.settled_by_user_id = u.id
-		WHERE (t.settled_by_user_id = ? AND t.settled_with_user_id = ?)
-		   OR (t.settled_by_user_id = ? AND t.settled_with_user_id = ?)
+		WHERE t.settled_by_user_id IN (%[1]s) AND t.settled_with_user_id IN (%[1]s)
 		ORDER BY t.settlement_time DESC;
-	`
-	rows, err := tx.Query(query, userID, partnerID, partnerID, userID)
+	`, members)
+	rows, err := tx.Query(query, append(args, args...)...)
 	if err != nil {
 		return nil, fmt.Errorf("querying transfers: %w", err)
 	}
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/testutil"
 	"git.sr.ht/~relay/sapp-backend/types"
 	"github.com/stretchr/testify/assert"
@@ -20,7 +21,7 @@ func TestExportAllData(t *testing.T) {
 	// --- Setup Additional Test Data ---
 	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
 	transportID := testutil.GetCategoryID(t, env.DB, "Transport")
-	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping")
+	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping (general)")
 
 	// AI Job 1 (User buys, shared)
 	job1Date := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
@@ -28,7 +29,7 @@ func TestExportAllData(t *testing.T) {
 	_, err := env.DB.Exec("UPDATE ai_categorization_jobs SET transaction_date = ?, created_at = ? WHERE id = ?", job1Date, job1Date, job1ID)
 	require.NoError(t, err)
 	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 50.0, "Milk & Bread", false, &job1ID, nil) // Assign to _
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 25.0, "Bus Ticket", false, &job1ID, nil)             // Assign to _
+	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 25.0, "Bus Ticket", false, &job1ID, nil)              // Assign to _
 
 	// AI Job 2 (Partner buys, user takes all)
 	job2Date := time.Date(2024, 5, 5, 11, 0, 0, 0, time.UTC)
@@ -103,19 +104,19 @@ func TestExportAllData(t *testing.T) {
 	}
 	// Job 2 (Partner bought)
 	assert.Equal(t, "Gift for User", exportData.AIJobs[0].Prompt)
-	assert.Equal(t, 100.0, exportData.AIJobs[0].TotalAmount)
+	assert.Equal(t, money.Amount(10000), exportData.AIJobs[0].TotalAmount)
 	assert.Equal(t, job2Date, exportData.AIJobs[0].TransactionDate)
 	assert.False(t, exportData.AIJobs[0].PreSettled)
 	assert.Equal(t, "partner_user", exportData.AIJobs[0].BuyerUsername)
 	require.Len(t, exportData.AIJobs[0].Spendings, 1)
-	assert.Equal(t, "Shopping", exportData.AIJobs[0].Spendings[0].CategoryName)
-	assert.Equal(t, 100.0, exportData.AIJobs[0].Spendings[0].Amount)
+	assert.Equal(t, "Shopping (general)", exportData.AIJobs[0].Spendings[0].CategoryName)
+	assert.Equal(t, money.Amount(10000), exportData.AIJobs[0].Spendings[0].Amount)
 	assert.Equal(t, "Gift", exportData.AIJobs[0].Spendings[0].Description)
 	assert.Equal(t, "PaidByPartner", exportData.AIJobs[0].Spendings[0].ApportionMode) // User takes all -> PaidByPartner
 
 	// Job 1 (User bought)
 	assert.Equal(t, "Groceries and bus ticket", exportData.AIJobs[1].Prompt)
-	assert.Equal(t, 75.0, exportData.AIJobs[1].TotalAmount)
+	assert.Equal(t, money.Amount(7500), exportData.AIJobs[1].TotalAmount)
 	assert.Equal(t, job1Date, exportData.AIJobs[1].TransactionDate)
 	assert.False(t, exportData.AIJobs[1].PreSettled)
 	assert.Equal(t, "demo_user", exportData.AIJobs[1].BuyerUsername)
@@ -125,20 +126,20 @@ func TestExportAllData(t *testing.T) {
 		exportData.AIJobs[1].Spendings[0], exportData.AIJobs[1].Spendings[1] = exportData.AIJobs[1].Spendings[1], exportData.AIJobs[1].Spendings[0]
 	}
 	assert.Equal(t, "Groceries", exportData.AIJobs[1].Spendings[0].CategoryName)
-	assert.Equal(t, 50.0, exportData.AIJobs[1].Spendings[0].Amount)
+	assert.Equal(t, money.Amount(5000), exportData.AIJobs[1].Spendings[0].Amount)
 	assert.Equal(t, "Milk & Bread", exportData.AIJobs[1].Spendings[0].Description)
 	assert.Equal(t, "Shared", exportData.AIJobs[1].Spendings[0].ApportionMode) // Shared with partner
 	assert.Equal(t, "Transport", exportData.AIJobs[1].Spendings[1].CategoryName)
-	assert.Equal(t, 25.0, exportData.AIJobs[1].Spendings[1].Amount)
+	assert.Equal(t, money.Amount(2500), exportData.AIJobs[1].Spendings[1].Amount)
 	assert.Equal(t, "Bus Ticket", exportData.AIJobs[1].Spendings[1].Description)
 	assert.Equal(t, "Alone", exportData.AIJobs[1].Spendings[1].ApportionMode) // User alone
 
 	// Verify Manual Spendings
 	require.Len(t, exportData.ManualSpendings, 1, "Expected 1 manual spending")
 	ms := exportData.ManualSpendings[0]
-	assert.Equal(t, 30.0, ms.Amount)
+	assert.Equal(t, money.Amount(3000), ms.Amount)
 	assert.Equal(t, "Manual Alone Settled", ms.Description)
-	assert.Equal(t, "Shopping", ms.CategoryName)
+	assert.Equal(t, "Shopping (general)", ms.CategoryName)
 	assert.Equal(t, manualDate, ms.SpendingDate)
 	assert.Equal(t, "demo_user", ms.BuyerUsername)
 	assert.Equal(t, "Alone", ms.SharedStatus)
@@ -153,7 +154,7 @@ func TestExportAllData(t *testing.T) {
 	}
 	// Deposit 2 (Partner)
 	assert.Equal(t, "Partner Bonus", exportData.Deposits[0].Description)
-	assert.Equal(t, 50.0, exportData.Deposits[0].Amount)
+	assert.Equal(t, money.Amount(5000), exportData.Deposits[0].Amount)
 	assert.Equal(t, deposit2Date, exportData.Deposits[0].DepositDate)
 	assert.False(t, exportData.Deposits[0].IsRecurring)
 	assert.Nil(t, exportData.Deposits[0].RecurrencePeriod)
@@ -161,7 +162,7 @@ func TestExportAllData(t *testing.T) {
 	assert.Equal(t, "partner_user", exportData.Deposits[0].OwnerUsername)
 	// Deposit 1 (User)
 	assert.Equal(t, "Salary", exportData.Deposits[1].Description)
-	assert.Equal(t, 2000.0, exportData.Deposits[1].Amount)
+	assert.Equal(t, money.Amount(200000), exportData.Deposits[1].Amount)
 	assert.Equal(t, deposit1Date, exportData.Deposits[1].DepositDate)
 	assert.True(t, exportData.Deposits[1].IsRecurring)
 	require.NotNil(t, exportData.Deposits[1].RecurrencePeriod)
@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"log/slog"
 	"sort"
+	"strings"
 	"time"
 
-	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/ledger"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
@@ -81,51 +82,119 @@ func GenerateHistory(db *sql.DB, userID int64, endDate time.Time) ([]HistoryList
 	return allHistoryItems, nil
 }
 
-// fetchSpendingGroups fetches transaction groups (as types.TransactionGroup) initiated by the user OR their partner.
+// fetchSpendingGroups fetches transaction groups (as types.TransactionGroup) initiated by the user
+// OR by another household member where the user shares in at least one item.
 func fetchSpendingGroups(db *sql.DB, userID int64) ([]types.TransactionGroup, error) {
-	// Get partner ID first
-	partnerID, partnerOk := auth.GetPartnerUserID(db, userID)
-	if !partnerOk {
-		// If no partner, proceed as before, only fetching user's jobs
-		partnerID = -1 // Use an invalid ID to ensure partner clause doesn't match
-		slog.Debug("No partner found, fetching only user's spending groups", "user_id", userID)
-	}
-
 	groups := []types.TransactionGroup{} // Use types.TransactionGroup
 
 	// Query Explanation:
 	// Selects jobs where:
 	// 1. The buyer is the requesting user (j.buyer = userID)
 	// OR
-	// 2. The buyer is the partner (j.buyer = partnerID) AND there exists at least one spending item
-	//    in that job (linked via ai_categorized_spendings) where the requesting user is the
-	//    'shared_with' participant (us.shared_with = userID).
-	// This ensures we only get partner's jobs if the requesting user is actually involved.
+	// 2. There exists at least one spending item in the job (linked via ai_categorized_spendings)
+	//    where the requesting user is among the users sharing the cost (spending_shares).
+	// This ensures we only get other members' jobs if the requesting user is actually involved.
 	jobQuery := `
-		SELECT DISTINCT
-			j.id, j.prompt, j.total_amount, j.transaction_date AS date, j.is_ambiguity_flagged, j.ambiguity_flag_reason, u.first_name AS buyer_name, j.buyer
+		SELECT
+			j.id, j.prompt, j.total_amount, j.transaction_date AS date, j.is_ambiguity_flagged, j.ambiguity_flag_reason, u.first_name AS buyer_name, j.buyer,
+			j.receipt_sha256 IS NOT NULL AS has_receipt, j.currency
 		FROM ai_categorization_jobs j
 		JOIN users u ON j.buyer = u.id
-		LEFT JOIN ai_categorized_spendings acs ON j.id = acs.job_id
-		LEFT JOIN user_spendings us ON acs.spending_id = us.spending_id
-		WHERE j.buyer = ? OR (j.buyer = ? AND us.shared_with = ?)
+		WHERE j.buyer = ? OR EXISTS (
+			SELECT 1 FROM ai_categorized_spendings acs
+			JOIN spending_shares ss ON ss.spending_id = acs.spending_id
+			WHERE acs.job_id = j.id AND ss.user_id = ?
+		)
 		ORDER BY j.transaction_date DESC, j.created_at DESC; -- Sort primarily by transaction date
 	`
-	// Note: Using LEFT JOINs and DISTINCT because a job might have multiple spendings involving the user.
-	// We only need to know *if* the user is involved in *any* spending for partner-bought jobs.
 
-	jobRows, err := db.Query(jobQuery, userID, partnerID, userID) // Pass userID, partnerID, userID
+	jobRows, err := db.Query(jobQuery, userID, userID)
 	if err != nil {
-		slog.Error("failed to query AI categorization jobs for user and involved partner jobs", "user_id", userID, "partner_id", partnerID, "err", err)
+		slog.Error("failed to query AI categorization jobs for user and involved household jobs", "user_id", userID, "err", err)
 		return nil, err
 	}
 	defer jobRows.Close()
 
+	spendingStmt, shareStmt, err := prepareSpendingStmts(db)
+	if err != nil {
+		slog.Error("failed to prepare spending statements for history", "user_id", userID, "err", err)
+		return nil, err
+	}
+	defer spendingStmt.Close()
+	defer shareStmt.Close()
+
+	// Fetch requesting user's name once for determineSharingStatus
+	requestingUserName := fetchRequestingUserName(db, userID)
+
+	for jobRows.Next() {
+		var group types.TransactionGroup // Use types.TransactionGroup
+		var ambiguityReason sql.NullString
+		var jobBuyerID int64 // To store the buyer ID from the job
+
+		if err := jobRows.Scan(
+			&group.JobID, &group.Prompt, &group.TotalAmount, &group.TransactionDate, // Scan directly into TransactionDate field
+			&group.IsAmbiguityFlagged, &ambiguityReason, &group.BuyerName, &jobBuyerID, // Scan jobBuyerID
+			&group.HasReceipt, &group.Currency,
+		); err != nil {
+			slog.Error("failed to scan AI job row for history", "user_id", userID, "err", err)
+			return nil, err
+		}
+		group.AmbiguityFlagReason = sqlNullStringToPointer(ambiguityReason)
+
+		group.Spendings, err = fetchGroupSpendings(spendingStmt, shareStmt, group.JobID, userID, requestingUserName)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	if err := jobRows.Err(); err != nil {
+		slog.Error("error iterating AI job rows for history", "user_id", userID, "err", err)
+		return nil, err
+	}
+	return groups, nil
+}
+
+// FetchTransactionGroup fetches a single job with its spendings, from the perspective
+// of the requesting user. Returns sql.ErrNoRows if the job does not exist.
+func FetchTransactionGroup(db *sql.DB, jobID, userID int64) (types.TransactionGroup, error) {
+	var group types.TransactionGroup
+	var ambiguityReason sql.NullString
+	err := db.QueryRow(`
+		SELECT j.id, j.prompt, j.total_amount, j.transaction_date, j.is_ambiguity_flagged, j.ambiguity_flag_reason, u.first_name,
+			j.receipt_sha256 IS NOT NULL, j.currency
+		FROM ai_categorization_jobs j
+		JOIN users u ON j.buyer = u.id
+		WHERE j.id = ?
+	`, jobID).Scan(
+		&group.JobID, &group.Prompt, &group.TotalAmount, &group.TransactionDate,
+		&group.IsAmbiguityFlagged, &ambiguityReason, &group.BuyerName, &group.HasReceipt, &group.Currency,
+	)
+	if err != nil {
+		return types.TransactionGroup{}, err
+	}
+	group.AmbiguityFlagReason = sqlNullStringToPointer(ambiguityReason)
+
+	spendingStmt, shareStmt, err := prepareSpendingStmts(db)
+	if err != nil {
+		return types.TransactionGroup{}, err
+	}
+	defer spendingStmt.Close()
+	defer shareStmt.Close()
+
+	group.Spendings, err = fetchGroupSpendings(spendingStmt, shareStmt, jobID, userID, fetchRequestingUserName(db, userID))
+	if err != nil {
+		return types.TransactionGroup{}, err
+	}
+	return group, nil
+}
+
+// prepareSpendingStmts prepares the statements used to load a job's spendings and their shares.
+func prepareSpendingStmts(db *sql.DB) (*sql.Stmt, *sql.Stmt, error) {
 	spendingQuery := `
 		SELECT
-			s.id, s.amount, s.description, c.name AS category_name,
+			s.id, s.amount, s.original_amount, s.currency, s.description, c.name AS category_name,
 			u_buyer.first_name AS buyer_name, u_partner.first_name AS partner_name,
-			us.shared_user_takes_all, us.shared_with, us.buyer -- Select buyer ID from user_spendings
+			us.shared_user_takes_all, us.buyer -- Select buyer ID from user_spendings
 		FROM spendings s
 		JOIN ai_categorized_spendings acs ON s.id = acs.spending_id
 		JOIN user_spendings us ON s.id = us.spending_id
@@ -137,74 +206,96 @@ func fetchSpendingGroups(db *sql.DB, userID int64) ([]types.TransactionGroup, er
 	`
 	spendingStmt, err := db.Prepare(spendingQuery)
 	if err != nil {
-		slog.Error("failed to prepare spending query statement for history", "user_id", userID, "err", err)
-		return nil, err
+		return nil, nil, fmt.Errorf("preparing spending query: %w", err)
 	}
-	defer spendingStmt.Close()
 
-	// Fetch requesting user's name once for determineSharingStatus
+	// Who bears a spending's cost comes from the ledger: every participant has an expenses
+	// posting, the buyer paying alone too
+	shareQuery := `
+		SELECT p.user_id, COALESCE(u.first_name, u.username)
+		FROM ledger_postings p
+		JOIN ledger_entries e ON e.id = p.entry_id
+		JOIN users u ON p.user_id = u.id
+		WHERE e.spending_id = ? AND e.kind = ? AND p.account = ?
+		ORDER BY p.user_id ASC;
+	`
+	shareStmt, err := db.Prepare(shareQuery)
+	if err != nil {
+		spendingStmt.Close()
+		return nil, nil, fmt.Errorf("preparing share query: %w", err)
+	}
+	return spendingStmt, shareStmt, nil
+}
+
+// fetchRequestingUserName returns the user's first name, or "You" if it cannot be loaded.
+func fetchRequestingUserName(db *sql.DB, userID int64) string {
 	var requestingUserName string
-	err = db.QueryRow("SELECT first_name FROM users WHERE id = ?", userID).Scan(&requestingUserName)
+	err := db.QueryRow("SELECT first_name FROM users WHERE id = ?", userID).Scan(&requestingUserName)
 	if err != nil {
 		slog.Error("failed to fetch requesting user's name for history", "user_id", userID, "err", err)
 		// Proceed without name, status strings might be less specific
 		requestingUserName = "You"
 	}
+	return requestingUserName
+}
 
-	for jobRows.Next() {
-		var group types.TransactionGroup // Use types.TransactionGroup
-		var ambiguityReason sql.NullString
-		var jobBuyerID int64 // To store the buyer ID from the job
+// fetchGroupSpendings loads the spendings of a job, with sharing status from the requesting user's perspective.
+func fetchGroupSpendings(spendingStmt, shareStmt *sql.Stmt, jobID, userID int64, requestingUserName string) ([]types.SpendingItem, error) {
+	spendingRows, err := spendingStmt.Query(jobID)
+	if err != nil {
+		slog.Error("failed to query spendings for job", "user_id", userID, "job_id", jobID, "err", err)
+		return nil, err
+	}
 
-		if err := jobRows.Scan(
-			&group.JobID, &group.Prompt, &group.TotalAmount, &group.TransactionDate, // Scan directly into TransactionDate field
-			&group.IsAmbiguityFlagged, &ambiguityReason, &group.BuyerName, &jobBuyerID, // Scan jobBuyerID
+	spendings := []types.SpendingItem{} // Use types.SpendingItem
+	var buyerIDs []int64                // Buyer of each spending item, by index
+	for spendingRows.Next() {
+		var item types.SpendingItem // Use types.SpendingItem
+		var partnerName sql.NullString
+		var itemBuyerID int64 // To store the buyer ID from user_spendings
+
+		if err := spendingRows.Scan(
+			&item.ID, &item.Amount, &item.OriginalAmount, &item.Currency, &item.Description, &item.CategoryName,
+			&item.BuyerName, &partnerName, &item.SharedUserTakesAll, &itemBuyerID, // Scan itemBuyerID
 		); err != nil {
-			slog.Error("failed to scan AI job row for history", "user_id", userID, "err", err)
+			slog.Error("failed to scan spending item row for history", "user_id", userID, "job_id", jobID, "err", err)
+			spendingRows.Close()
 			return nil, err
 		}
-		group.AmbiguityFlagReason = sqlNullStringToPointer(ambiguityReason)
 
-		spendingRows, err := spendingStmt.Query(group.JobID)
+		item.PartnerName = sqlNullStringToPointer(partnerName)
+		spendings = append(spendings, item)
+		buyerIDs = append(buyerIDs, itemBuyerID)
+	}
+	spendingRows.Close()
+	if err := spendingRows.Err(); err != nil {
+		slog.Error("error iterating spending item rows for history", "user_id", userID, "job_id", jobID, "err", err)
+		return nil, err
+	}
+
+	// Determine status from the perspective of the requesting user (userID),
+	// using who shares each item's cost according to the ledger.
+	for i := range spendings {
+		item := &spendings[i]
+		buyerPays, others, err := fetchShareNames(shareStmt, item.ID, buyerIDs[i], userID, requestingUserName)
 		if err != nil {
-			slog.Error("failed to query spendings for job", "user_id", userID, "job_id", group.JobID, "err", err)
+			slog.Error("failed to query spending shares for history", "user_id", userID, "spending_id", item.ID, "err", err)
 			return nil, err
 		}
-
-		group.Spendings = []types.SpendingItem{} // Use types.SpendingItem
-		for spendingRows.Next() {
-			var item types.SpendingItem // Use types.SpendingItem
-			var partnerName sql.NullString
-			var sharedWithID sql.NullInt64
-			var itemBuyerID int64 // To store the buyer ID from user_spendings
-
-			if err := spendingRows.Scan(
-				&item.ID, &item.Amount, &item.Description, &item.CategoryName,
-				&item.BuyerName, &partnerName, &item.SharedUserTakesAll, &sharedWithID, &itemBuyerID, // Scan itemBuyerID
-			); err != nil {
-				slog.Error("failed to scan spending item row for history", "user_id", userID, "job_id", group.JobID, "err", err)
-				spendingRows.Close()
-				return nil, err
+		if len(others) > 1 {
+			item.SharingStatus = determineHouseholdSharingStatus(buyerPays, others)
+			for _, o := range others {
+				item.SharedWithNames = append(item.SharedWithNames, o.name)
+			}
+		} else {
+			// Shared with one other user, or not at all
+			item.SharingStatus = determineSharingStatus(userID, buyerIDs[i], len(others) == 1, !buyerPays, item.PartnerName, requestingUserName)
+			if len(others) == 1 {
+				item.SharedWithNames = []string{others[0].name}
 			}
-
-			item.PartnerName = sqlNullStringToPointer(partnerName)
-			// Determine status from the perspective of the requesting user (userID)
-			// Use itemBuyerID (from user_spendings) and sharedWithID for accurate status
-			item.SharingStatus = determineSharingStatus(userID, itemBuyerID, sharedWithID.Valid, item.SharedUserTakesAll, item.PartnerName, requestingUserName)
-			group.Spendings = append(group.Spendings, item)
-		}
-		spendingRows.Close()
-		if err := spendingRows.Err(); err != nil {
-			slog.Error("error iterating spending item rows for history", "user_id", userID, "job_id", group.JobID, "err", err)
-			return nil, err
 		}
-		groups = append(groups, group)
 	}
-	if err := jobRows.Err(); err != nil {
-		slog.Error("error iterating AI job rows for history", "user_id", userID, "err", err)
-		return nil, err
-	}
-	return groups, nil
+	return spendings, nil
 }
 
 // fetchDeposits fetches all deposit records (as types.DepositItem) for the user.
@@ -215,7 +306,7 @@ func fetchDeposits(db *sql.DB, userID int64) ([]types.DepositItem, error) {
 	// The history service will generate occurrences based on these templates.
 	// Fetch deposit templates including the end_date
 	depositQuery := `
-		SELECT id, amount, description, deposit_date, is_recurring, recurrence_period, end_date, created_at
+		SELECT id, amount, original_amount, currency, description, deposit_date, is_recurring, recurrence_period, end_date, created_at
 		FROM deposits
 		WHERE user_id = ? -- Removed is_active filter, assuming hard delete for now
 		ORDER BY deposit_date DESC, created_at DESC;
@@ -234,6 +325,8 @@ func fetchDeposits(db *sql.DB, userID int64) ([]types.DepositItem, error) {
 		if err := depositRows.Scan(
 			&d.ID,
 			&d.Amount,
+			&d.OriginalAmount,
+			&d.Currency,
 			&d.Description,
 			&d.Date, // Scan directly into d.Date
 			&d.IsRecurring,
@@ -303,6 +396,8 @@ func createOccurrence(template types.DepositItem, occurrenceDate time.Time) type
 	return types.DepositItem{
 		ID:               template.ID, // Link back to the original template ID
 		Amount:           template.Amount,
+		OriginalAmount:   template.OriginalAmount,
+		Currency:         template.Currency,
 		Description:      template.Description,
 		Date:             occurrenceDate,       // This specific occurrence's date
 		IsRecurring:      template.IsRecurring, // Keep original template flag
@@ -340,6 +435,53 @@ func sqlNullStringToPointer(ns sql.NullString) *string {
 }
 
 // determineSharingStatus calculates the sharing status string from the perspective of the requesting user.
+// shareName is a participant of a spending, as shown in history.
+type shareName struct {
+	name    string // First name
+	display string // Name from the requesting user's perspective ("You (Name)" for themselves)
+}
+
+// fetchShareNames returns whether the buyer bears part of a spending's cost, and the other
+// participants in user ID order.
+func fetchShareNames(stmt *sql.Stmt, spendingID, buyerID, requestingUserID int64, requestingUserName string) (bool, []shareName, error) {
+	rows, err := stmt.Query(spendingID, ledger.KindSpending, ledger.AccountExpenses)
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	buyerPays := false
+	var others []shareName
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return false, nil, err
+		}
+		switch {
+		case id == buyerID:
+			buyerPays = true
+		case id == requestingUserID:
+			others = append(others, shareName{name: name, display: fmt.Sprintf("You (%s)", requestingUserName)})
+		default:
+			others = append(others, shareName{name: name, display: name})
+		}
+	}
+	return buyerPays, others, rows.Err()
+}
+
+// determineHouseholdSharingStatus describes an item shared with several household members.
+func determineHouseholdSharingStatus(buyerPays bool, others []shareName) string {
+	names := make([]string, len(others))
+	for i, o := range others {
+		names[i] = o.display
+	}
+	if buyerPays {
+		return fmt.Sprintf("Shared with %s", strings.Join(names, ", "))
+	}
+	return fmt.Sprintf("Paid by %s", strings.Join(names, ", "))
+}
+
 func determineSharingStatus(requestingUserID, buyerID int64, isShared bool, takesAll bool, partnerName *string, requestingUserName string) string {
 	partner := "Partner" // Default partner name
 	if partnerName != nil && *partnerName != "" {
@@ -0,0 +1,159 @@
+package household
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// HandleGetHousehold returns the authenticated user's household and its members.
+func HandleGetHousehold(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for household", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		householdID, ok := GetHouseholdID(db, userID)
+		if !ok {
+			http.Error(w, "Household not found for this user.", http.StatusNotFound)
+			return
+		}
+
+		response, err := fetchHousehold(db, householdID, userID)
+		if err != nil {
+			slog.Error("failed to fetch household", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			slog.Error("failed to encode household response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// HandleUpdateHousehold changes the AI notes and currency of the authenticated user's household.
+// Any member may edit them; they are given to the AI when categorizing the purchases of every member.
+func HandleUpdateHousehold(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for household update", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
+			return
+		}
+
+		// 1. Decode and validate payload
+		var payload types.UpdateHouseholdPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if payload.AINotes == nil && payload.Currency == nil {
+			http.Error(w, "Bad Request: Nothing to update", http.StatusBadRequest)
+			return
+		}
+		if payload.AINotes != nil {
+			notes := strings.TrimSpace(*payload.AINotes)
+			if utf8.RuneCountInString(notes) > MaxAINotesLength {
+				http.Error(w, fmt.Sprintf("Bad Request: AI notes cannot be longer than %d characters", MaxAINotesLength), http.StatusBadRequest)
+				return
+			}
+			payload.AINotes = &notes
+		}
+		if payload.Currency != nil {
+			currency, ok := NormalizeCurrency(*payload.Currency)
+			if !ok {
+				http.Error(w, "Bad Request: Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+				return
+			}
+			payload.Currency = &currency
+		}
+
+		householdID, ok := GetHouseholdID(db, userID)
+		if !ok {
+			http.Error(w, "Household not found for this user.", http.StatusNotFound)
+			return
+		}
+		if payload.Currency != nil {
+			// Amounts are stored converted to the currency, so it is fixed once there are any
+			current, err := GetCurrency(db, userID)
+			if err != nil {
+				slog.Error("failed to get household currency", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			hasAmounts, err := HasAmounts(db, householdID)
+			if err != nil {
+				slog.Error("failed to check household amounts", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if hasAmounts && current != *payload.Currency {
+				http.Error(w, "Currency cannot change once the household has spendings or deposits", http.StatusConflict)
+				return
+			}
+		}
+
+		// 2. Store them, removing empty notes
+		if payload.AINotes != nil {
+			notes := sql.NullString{String: *payload.AINotes, Valid: *payload.AINotes != ""}
+			if _, err := db.Exec("UPDATE households SET ai_notes = ? WHERE id = ?", notes, householdID); err != nil {
+				slog.Error("failed to update household AI notes", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if payload.Currency != nil {
+			if _, err := db.Exec("UPDATE households SET currency = ? WHERE id = ?", *payload.Currency, householdID); err != nil {
+				slog.Error("failed to update household currency", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		response, err := fetchHousehold(db, householdID, userID)
+		if err != nil {
+			slog.Error("failed to fetch updated household", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Household updated", "user_id", userID, "household_id", householdID)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			slog.Error("failed to encode household response", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// fetchHousehold loads the household of the user, with its members.
+func fetchHousehold(q Querier, householdID, userID int64) (types.HouseholdResponse, error) {
+	response := types.HouseholdResponse{ID: householdID}
+	var aiNotes sql.NullString
+	err := q.QueryRow("SELECT name, ai_notes, currency FROM households WHERE id = ?", householdID).Scan(&response.Name, &aiNotes, &response.Currency)
+	if err != nil {
+		return types.HouseholdResponse{}, fmt.Errorf("failed to query household: %w", err)
+	}
+	response.AINotes = aiNotes.String
+
+	members, err := GetMembers(q, userID)
+	if err != nil {
+		return types.HouseholdResponse{}, err
+	}
+	response.Members = members
+	return response, nil
+}
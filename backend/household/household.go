@@ -0,0 +1,421 @@
+package household
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// Querier defines the query methods needed by this package, satisfied by *sql.DB and *sql.Tx.
+type Querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Execer defines the Exec method, satisfied by *sql.DB and *sql.Tx.
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ErrNotMember is returned when a requested participant is not in the buyer's household.
+var ErrNotMember = errors.New("user is not a member of the household")
+
+// MaxAINotesLength bounds the free-text context given to the AI about a user or household, in
+// characters. The notes go into every categorization prompt of the household.
+const MaxAINotesLength = 1000
+
+// DefaultCurrency is the currency of households that did not choose one, as an ISO 4217 code.
+const DefaultCurrency = "NOK"
+
+// NormalizeCurrency returns the ISO 4217 code in upper case, and whether it is well-formed
+// (three letters). Whether the code is actually assigned is not checked.
+func NormalizeCurrency(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if len(code) != 3 {
+		return "", false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", false
+		}
+	}
+	return code, true
+}
+
+// GetHouseholdID returns the household the user belongs to.
+func GetHouseholdID(q Querier, userID int64) (int64, bool) {
+	var householdID int64
+	err := q.QueryRow("SELECT household_id FROM household_members WHERE user_id = ?", userID).Scan(&householdID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("Error querying household ID", "user_id", userID, "err", err)
+		}
+		return 0, false
+	}
+	return householdID, true
+}
+
+// GetMembers returns all members of the user's household (including the user), ordered by user ID.
+// Returns an empty slice if the user is not in a household.
+func GetMembers(q Querier, userID int64) ([]types.HouseholdMember, error) {
+	rows, err := q.Query(`
+		SELECT u.id, u.username, COALESCE(u.first_name, u.username)
+		FROM household_members m
+		JOIN users u ON u.id = m.user_id
+		WHERE m.household_id = (SELECT household_id FROM household_members WHERE user_id = ?)
+		ORDER BY u.id
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query household members: %w", err)
+	}
+	defer rows.Close()
+
+	members := []types.HouseholdMember{}
+	for rows.Next() {
+		var m types.HouseholdMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.FirstName); err != nil {
+			return nil, fmt.Errorf("failed to scan household member: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating household members: %w", err)
+	}
+	return members, nil
+}
+
+// GetAINotes returns the AI notes of the user's household, empty if it has none or the user is
+// not in a household.
+func GetAINotes(q Querier, userID int64) (string, error) {
+	var notes sql.NullString
+	err := q.QueryRow(`
+		SELECT h.ai_notes FROM households h
+		JOIN household_members m ON m.household_id = h.id
+		WHERE m.user_id = ?
+	`, userID).Scan(&notes)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("failed to query household AI notes: %w", err)
+	}
+	return notes.String, nil
+}
+
+// GetCurrency returns the currency of the user's household, DefaultCurrency if the user is not
+// in a household.
+func GetCurrency(q Querier, userID int64) (string, error) {
+	var currency string
+	err := q.QueryRow(`
+		SELECT h.currency FROM households h
+		JOIN household_members m ON m.household_id = h.id
+		WHERE m.user_id = ?
+	`, userID).Scan(&currency)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DefaultCurrency, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query household currency: %w", err)
+	}
+	return currency, nil
+}
+
+// HasAmounts reports whether any member of the household has spendings or deposits.
+func HasAmounts(q Querier, householdID int64) (bool, error) {
+	var has bool
+	err := q.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM spendings s JOIN household_members m ON m.user_id = s.made_by WHERE m.household_id = ?
+		) OR EXISTS (
+			SELECT 1 FROM deposits d JOIN household_members m ON m.user_id = d.user_id WHERE m.household_id = ?
+		)
+	`, householdID, householdID).Scan(&has)
+	if err != nil {
+		return false, fmt.Errorf("failed to query household amounts: %w", err)
+	}
+	return has, nil
+}
+
+// OtherMemberIDs returns the IDs of everyone in the user's household except the user.
+func OtherMemberIDs(q Querier, userID int64) ([]int64, error) {
+	members, err := GetMembers(q, userID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, m := range members {
+		if m.UserID != userID {
+			ids = append(ids, m.UserID)
+		}
+	}
+	return ids, nil
+}
+
+// ResolveOthers validates the requested co-participants against the buyer's household.
+// An empty request means every other member of the household.
+func ResolveOthers(q Querier, buyerID int64, requested []int64) ([]int64, error) {
+	others, err := OtherMemberIDs(q, buyerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(requested) == 0 {
+		return others, nil
+	}
+
+	allowed := make(map[int64]bool, len(others))
+	for _, id := range others {
+		allowed[id] = true
+	}
+	seen := make(map[int64]bool, len(requested))
+	var resolved []int64
+	for _, id := range requested {
+		if !allowed[id] {
+			return nil, fmt.Errorf("%w: %d", ErrNotMember, id)
+		}
+		if !seen[id] {
+			seen[id] = true
+			resolved = append(resolved, id)
+		}
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i] < resolved[j] })
+	return resolved, nil
+}
+
+// SetShares replaces the set of users bearing the cost of a spending.
+// An empty participant list (or only the buyer) means the buyer pays alone.
+// The two-person columns on user_spendings are kept in sync: shared_with is the
+// lowest-ID participant other than the buyer, and shared_user_takes_all is set
+// when the buyer is not among the participants.
+// Participants who remain keep their settlement. New ones are settled if the
+// spending is, and the spending is settled once all remaining shares are.
+func SetShares(e Execer, spendingID, buyerID int64, participants []int64) error {
+	buyerPays := false
+	var others []int64
+	seen := make(map[int64]bool, len(participants))
+	for _, id := range participants {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if id == buyerID {
+			buyerPays = true
+		} else {
+			others = append(others, id)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i] < others[j] })
+
+	// Alone: no share rows, no legacy partner.
+	if len(others) == 0 {
+		if _, err := e.Exec("DELETE FROM spending_shares WHERE spending_id = ?", spendingID); err != nil {
+			return fmt.Errorf("failed to clear spending shares: %w", err)
+		}
+		if _, err := e.Exec("UPDATE user_spendings SET shared_with = NULL, shared_user_takes_all = 0 WHERE spending_id = ?", spendingID); err != nil {
+			return fmt.Errorf("failed to update user_spendings sharing: %w", err)
+		}
+		return nil
+	}
+
+	keep := others
+	if buyerPays {
+		keep = append([]int64{buyerID}, others...)
+	}
+	args := []interface{}{spendingID}
+	for _, id := range keep {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keep)), ", ")
+	if _, err := e.Exec("DELETE FROM spending_shares WHERE spending_id = ? AND user_id NOT IN ("+placeholders+")", args...); err != nil {
+		return fmt.Errorf("failed to clear spending shares: %w", err)
+	}
+	for _, id := range keep {
+		if _, err := e.Exec("INSERT OR IGNORE INTO spending_shares (spending_id, user_id) VALUES (?, ?)", spendingID, id); err != nil {
+			return fmt.Errorf("failed to insert share for user %d: %w", id, err)
+		}
+	}
+
+	// The buyer owes no one; shares of a settled spending are settled
+	if _, err := e.Exec("UPDATE spending_shares SET settled_at = NULL WHERE spending_id = ? AND user_id = ?", spendingID, buyerID); err != nil {
+		return fmt.Errorf("failed to update buyer share: %w", err)
+	}
+	_, err := e.Exec(`
+		UPDATE spending_shares
+		SET settled_at = (SELECT us.settled_at FROM user_spendings us WHERE us.spending_id = spending_shares.spending_id)
+		WHERE spending_id = ? AND user_id != ? AND settled_at IS NULL
+	`, spendingID, buyerID)
+	if err != nil {
+		return fmt.Errorf("failed to settle new shares: %w", err)
+	}
+
+	if _, err := e.Exec("UPDATE user_spendings SET shared_with = ?, shared_user_takes_all = ? WHERE spending_id = ?", others[0], !buyerPays, spendingID); err != nil {
+		return fmt.Errorf("failed to update user_spendings sharing: %w", err)
+	}
+	return settleIfComplete(e, spendingID)
+}
+
+// settleIfComplete marks the spending settled, as of its last share settlement, once every user
+// other than the buyer has settled their share.
+func settleIfComplete(e Execer, spendingID int64) error {
+	_, err := e.Exec(`
+		UPDATE user_spendings
+		SET settled_at = (
+			SELECT MAX(ss.settled_at) FROM spending_shares ss
+			WHERE ss.spending_id = user_spendings.spending_id AND ss.user_id != user_spendings.buyer
+		)
+		WHERE spending_id = ? AND settled_at IS NULL
+		  AND EXISTS (
+			SELECT 1 FROM spending_shares ss
+			WHERE ss.spending_id = user_spendings.spending_id AND ss.user_id != user_spendings.buyer
+		  )
+		  AND NOT EXISTS (
+			SELECT 1 FROM spending_shares ss
+			WHERE ss.spending_id = user_spendings.spending_id AND ss.user_id != user_spendings.buyer AND ss.settled_at IS NULL
+		  )
+	`, spendingID)
+	if err != nil {
+		return fmt.Errorf("failed to update spending settlement: %w", err)
+	}
+	return nil
+}
+
+// SettleShares marks the unsettled shares between two users as settled at the given time: the
+// shares of each in spendings the other bought. Shares involving other members are left alone.
+// It returns the IDs of the spendings changed, for the caller to record in the ledger.
+func SettleShares(tx *sql.Tx, userID, otherID int64, at time.Time) ([]int64, error) {
+	type share struct{ spendingID, userID int64 }
+	rows, err := tx.Query(`
+		SELECT ss.spending_id, ss.user_id
+		FROM spending_shares ss
+		JOIN user_spendings us ON us.spending_id = ss.spending_id
+		WHERE ss.settled_at IS NULL
+		  AND ((us.buyer = ? AND ss.user_id = ?) OR (us.buyer = ? AND ss.user_id = ?))
+		ORDER BY ss.spending_id
+	`, userID, otherID, otherID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unsettled shares: %w", err)
+	}
+	var shares []share
+	for rows.Next() {
+		var s share
+		if err := rows.Scan(&s.spendingID, &s.userID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan unsettled share: %w", err)
+		}
+		shares = append(shares, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating unsettled shares: %w", err)
+	}
+
+	var spendingIDs []int64
+	for _, s := range shares {
+		if _, err := tx.Exec("UPDATE spending_shares SET settled_at = ? WHERE spending_id = ? AND user_id = ?", at, s.spendingID, s.userID); err != nil {
+			return nil, fmt.Errorf("failed to settle share of spending %d: %w", s.spendingID, err)
+		}
+		if err := settleIfComplete(tx, s.spendingID); err != nil {
+			return nil, err
+		}
+		spendingIDs = append(spendingIDs, s.spendingID)
+	}
+	return spendingIDs, nil
+}
+
+// GetShares returns the IDs of the users bearing the cost of a spending, ordered by user ID.
+// An empty result means the buyer pays alone.
+func GetShares(q Querier, spendingID int64) ([]int64, error) {
+	rows, err := q.Query("SELECT user_id FROM spending_shares WHERE spending_id = ? ORDER BY user_id", spendingID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query spending shares: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan spending share: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// SplitAmount divides the amount of a spending between the users bearing its cost, as returned
+// by GetShares: equally, to the minor unit. The odd minor units go one each to the buyer first, if
+// among them, and then to the others by ascending user ID, so the buyer absorbs the rounding
+// rather than being owed it. No participants means the buyer bears the full amount.
+func SplitAmount(amount money.Amount, buyerID int64, participants []int64) map[int64]money.Amount {
+	if len(participants) == 0 {
+		return map[int64]money.Amount{buyerID: amount}
+	}
+	ordered := append([]int64(nil), participants...)
+	sort.Slice(ordered, func(i, j int) bool {
+		if (ordered[i] == buyerID) != (ordered[j] == buyerID) {
+			return ordered[i] == buyerID
+		}
+		return ordered[i] < ordered[j]
+	})
+	shares := make(map[int64]money.Amount, len(ordered))
+	for i, part := range amount.Split(len(ordered)) {
+		shares[ordered[i]] = part
+	}
+	return shares
+}
+
+// ErrAlreadyMember is returned when adding a user who already belongs to a household.
+var ErrAlreadyMember = errors.New("user already belongs to a household")
+
+// Create makes a new household with the given members and returns its ID.
+// None of the members may already belong to a household.
+func Create(tx *sql.Tx, name string, memberIDs []int64) (int64, error) {
+	res, err := tx.Exec("INSERT INTO households (name) VALUES (?)", name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert household: %w", err)
+	}
+	householdID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get household ID: %w", err)
+	}
+	for _, userID := range memberIDs {
+		if err := AddMember(tx, householdID, userID); err != nil {
+			return 0, err
+		}
+	}
+	return householdID, nil
+}
+
+// AddMember adds a user who is not yet in any household to the household.
+func AddMember(tx *sql.Tx, householdID, userID int64) error {
+	if current, ok := GetHouseholdID(tx, userID); ok {
+		return fmt.Errorf("%w: user %d is in household %d", ErrAlreadyMember, userID, current)
+	}
+	if _, err := tx.Exec("INSERT INTO household_members (household_id, user_id) VALUES (?, ?)", householdID, userID); err != nil {
+		return fmt.Errorf("failed to add user %d to household %d: %w", userID, householdID, err)
+	}
+	return nil
+}
+
+// RemoveMember takes the user out of their household. The legacy partnership rows of
+// the user are removed too, otherwise the schema backfill would put them back on the
+// next migration. Households left without members are deleted.
+func RemoveMember(tx *sql.Tx, userID int64) error {
+	householdID, ok := GetHouseholdID(tx, userID)
+	if !ok {
+		return fmt.Errorf("%w: user %d", ErrNotMember, userID)
+	}
+	if _, err := tx.Exec("DELETE FROM household_members WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("failed to remove user %d from household: %w", userID, err)
+	}
+	if _, err := tx.Exec("DELETE FROM partnerships WHERE user1_id = ? OR user2_id = ?", userID, userID); err != nil {
+		return fmt.Errorf("failed to remove partnerships of user %d: %w", userID, err)
+	}
+	if _, err := tx.Exec("DELETE FROM households WHERE id = ? AND NOT EXISTS (SELECT 1 FROM household_members WHERE household_id = ?)", householdID, householdID); err != nil {
+		return fmt.Errorf("failed to delete empty household %d: %w", householdID, err)
+	}
+	return nil
+}
@@ -0,0 +1,491 @@
+package main_test
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// TestGetJob tests the GET /v1/jobs/{job_id} endpoint.
+func TestGetJob(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
+
+	// --- Setup Data ---
+	// A finished, ambiguous job bought by the partner with one shared spending
+	reason := "Unclear who ate"
+	jobID := testutil.InsertAIJob(t, env.DB, env.PartnerID, &env.UserID, "Dinner", 60.0, "completed", true, true, &reason)
+	_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, groceriesID, 60.0, "Dinner", false, &jobID, nil)
+	// A pending job
+	pendingJobID := testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Taxi", 20.0, "pending", false, false, nil)
+
+	// --- Test Case: Finished Job of a Household Member ---
+	t.Run("FlaggedPartnerJob", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/jobs/"+strconv.FormatInt(jobID, 10), env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.JobID != jobID || resp.BuyerID != env.PartnerID || resp.BuyerName != env.PartnerName {
+			t.Errorf("Unexpected job identity: %+v", resp)
+		}
+		if resp.State != types.JobStateFlagged || !resp.IsFinished {
+			t.Errorf("Expected finished job in state %q, got %q (finished %v)", types.JobStateFlagged, resp.State, resp.IsFinished)
+		}
+		if len(resp.Spendings) != 1 || resp.Spendings[0].CategoryName != "Groceries" {
+			t.Fatalf("Expected one Groceries spending, got %+v", resp.Spendings)
+		}
+		if !strings.Contains(resp.Spendings[0].SharingStatus, "Shared with You") {
+			t.Errorf("Expected sharing status from the user's perspective, got %q", resp.Spendings[0].SharingStatus)
+		}
+	})
+
+	// --- Test Case: Pending Job ---
+	t.Run("PendingJob", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/jobs/"+strconv.FormatInt(pendingJobID, 10), env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.State != types.JobStatePending || resp.IsFinished || len(resp.Spendings) != 0 {
+			t.Errorf("Expected pending job without spendings, got %+v", resp)
+		}
+	})
+
+	// --- Test Case: Outside the Household ---
+	t.Run("ErrorOutsideHousehold", func(t *testing.T) {
+		res, err := env.DB.Exec("INSERT INTO users (username, password_hash, first_name) VALUES ('outsider', 'unused', 'Outsider')")
+		if err != nil {
+			t.Fatalf("Failed to insert outsider: %v", err)
+		}
+		outsiderID, _ := res.LastInsertId()
+		token, err := auth.GenerateTestJWT(outsiderID)
+		if err != nil {
+			t.Fatalf("Failed to generate JWT: %v", err)
+		}
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/jobs/"+strconv.FormatInt(jobID, 10), token, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+
+	// --- Test Case: Not Found ---
+	t.Run("ErrorNotFound", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/jobs/99999", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+}
+
+// TestGetJobAttempts tests the GET /v1/jobs/{job_id}/attempts endpoint.
+func TestGetJobAttempts(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	// --- Setup Data ---
+	// A job bought by the partner whose first answer was rejected
+	jobID := testutil.InsertAIJob(t, env.DB, env.PartnerID, &env.UserID, "Dinner", 60.0, "completed", true, false, nil)
+	for _, attempt := range []struct {
+		try     int
+		raw     string
+		outcome string
+		errMsg  *string
+	}{
+		{1, "not json", "invalid_output", ptr("decoding output: invalid character")},
+		{2, `{"spendings": []}`, "accepted", nil},
+	} {
+		_, err := env.DB.Exec(`INSERT INTO ai_job_attempts (job_id, attempt, try, model, prompt, raw_response, outcome, error_message)
+			VALUES (?, 1, ?, 'mock:primary', 'rendered prompt', ?, ?, ?)`, jobID, attempt.try, attempt.raw, attempt.outcome, attempt.errMsg)
+		if err != nil {
+			t.Fatalf("Failed to insert attempt: %v", err)
+		}
+	}
+	url := "/v1/jobs/" + strconv.FormatInt(jobID, 10) + "/attempts"
+
+	// --- Test Case: Household Member ---
+	t.Run("Success", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, url, env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var attempts []types.JobAttempt
+		testutil.DecodeJSONResponse(t, rr, &attempts)
+		if len(attempts) != 2 {
+			t.Fatalf("Expected 2 attempts, got %d", len(attempts))
+		}
+		if attempts[0].Try != 1 || attempts[0].Outcome != "invalid_output" || attempts[0].ErrorMessage == nil || attempts[0].Prompt != "rendered prompt" {
+			t.Errorf("Unexpected first attempt: %+v", attempts[0])
+		}
+		if attempts[1].Outcome != "accepted" || attempts[1].ErrorMessage != nil || attempts[1].Model == nil || *attempts[1].Model != "mock:primary" {
+			t.Errorf("Unexpected second attempt: %+v", attempts[1])
+		}
+	})
+
+	// --- Test Case: Outside the Household ---
+	t.Run("ErrorOutsideHousehold", func(t *testing.T) {
+		res, err := env.DB.Exec("INSERT INTO users (username, password_hash, first_name) VALUES ('attempt_outsider', 'unused', 'Outsider')")
+		if err != nil {
+			t.Fatalf("Failed to insert outsider: %v", err)
+		}
+		outsiderID, _ := res.LastInsertId()
+		token, err := auth.GenerateTestJWT(outsiderID)
+		if err != nil {
+			t.Fatalf("Failed to generate JWT: %v", err)
+		}
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, url, token, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+
+	// --- Test Case: Not Found ---
+	t.Run("ErrorNotFound", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/jobs/99999/attempts", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusNotFound)
+	})
+}
+
+// TestJobEvents tests that the GET /v1/jobs/events stream reports new household jobs.
+func TestJobEvents(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	server := httptest.NewServer(env.Handler)
+	defer server.Close()
+
+	// The partner listens for events
+	partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT for partner: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/jobs/events", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+partnerToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+	if line, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(line, ": connected") {
+		t.Fatalf("Expected connected comment, got %q (err: %v)", line, err)
+	}
+
+	// The user submits a purchase
+	categorize := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/categorize", env.AuthToken, types.AICategorizationPayload{
+		Amount: 4200, Prompt: "Groceries",
+	})
+	rr := testutil.ExecuteRequest(t, env.Handler, categorize)
+	testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+	var created map[string]int64
+	testutil.DecodeJSONResponse(t, rr, &created)
+
+	// The partner receives the pending event
+	var event types.JobEvent
+	for event.JobID == 0 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event stream: %v", err)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatalf("Failed to decode event %q: %v", data, err)
+			}
+		}
+	}
+	if event.JobID != created["job_id"] || event.BuyerID != env.UserID || event.State != types.JobStatePending {
+		t.Errorf("Unexpected job event: %+v", event)
+	}
+}
+
+// TestReviewQueue tests GET /v1/review and resolving flagged jobs with POST /v1/review/{job_id}/resolve.
+func TestReviewQueue(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
+
+	// --- Setup Data ---
+	reason := "Was the wine shared?"
+	newFlaggedJob := func(prompt string, settledAt *time.Time) int64 {
+		jobID := testutil.InsertAIJob(t, env.DB, env.PartnerID, &env.UserID, prompt, 60.0, "completed", true, true, &reason)
+		_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, groceriesID, 60.0, prompt, false, &jobID, settledAt)
+		return jobID
+	}
+	acceptJobID := newFlaggedJob("Dinner and wine", nil)
+	editJobID := newFlaggedJob("Groceries and wine", nil)
+	clarifyJobID := newFlaggedJob("Wine for the party", nil)
+	settled := time.Now().UTC()
+	settledJobID := newFlaggedJob("Old wine", &settled)
+	clearJobID := testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Bread", 5.0, "completed", true, false, nil)
+
+	resolve := func(jobID int64, payload types.ResolveReviewPayload) *httptest.ResponseRecorder {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/review/"+strconv.FormatInt(jobID, 10)+"/resolve", env.AuthToken, payload)
+		return testutil.ExecuteRequest(t, env.Handler, req)
+	}
+	queued := func() map[int64]types.JobResponse {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/review", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var queue []types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &queue)
+		jobs := make(map[int64]types.JobResponse)
+		for _, job := range queue {
+			jobs[job.JobID] = job
+		}
+		return jobs
+	}
+
+	// --- Test Case: Queue Lists Flagged Jobs of the Household ---
+	t.Run("ListQueue", func(t *testing.T) {
+		jobs := queued()
+		for _, id := range []int64{acceptJobID, editJobID, clarifyJobID, settledJobID} {
+			job, ok := jobs[id]
+			if !ok {
+				t.Fatalf("Expected flagged job %d in the queue", id)
+			}
+			if job.AmbiguityFlagReason == nil || *job.AmbiguityFlagReason != reason || len(job.Spendings) != 1 {
+				t.Errorf("Expected job %d with its reason and spending, got %+v", id, job)
+			}
+		}
+		if _, ok := jobs[clearJobID]; ok {
+			t.Errorf("Expected unflagged job %d not to be queued", clearJobID)
+		}
+	})
+
+	// --- Test Case: Accept As-Is ---
+	t.Run("Accept", func(t *testing.T) {
+		rr := resolve(acceptJobID, types.ResolveReviewPayload{Action: types.ReviewActionAccept})
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.State != types.JobStateFinished || len(resp.Spendings) != 1 {
+			t.Errorf("Expected finished job keeping its spending, got %+v", resp)
+		}
+		if _, ok := queued()[acceptJobID]; ok {
+			t.Error("Expected accepted job to leave the queue")
+		}
+
+		// Resolving twice conflicts
+		rr = resolve(acceptJobID, types.ResolveReviewPayload{Action: types.ReviewActionAccept})
+		testutil.AssertStatusCode(t, rr, http.StatusConflict)
+	})
+
+	// --- Test Case: Edit the Spendings ---
+	t.Run("Edit", func(t *testing.T) {
+		rr := resolve(editJobID, types.ResolveReviewPayload{Action: types.ReviewActionEdit, Spendings: []types.ProposedSpending{
+			{Category: "Groceries", Amount: 5000, ApportionMode: "shared", Description: "Groceries"},
+		}})
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+
+		rr = resolve(editJobID, types.ResolveReviewPayload{Action: types.ReviewActionEdit, Spendings: []types.ProposedSpending{
+			{Category: "Groceries", Amount: 4500, ApportionMode: "shared", Description: "Groceries"},
+			{Category: "Alcohol", Amount: 1500, ApportionMode: "alone", Description: "Wine"},
+		}})
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.State != types.JobStateFinished || len(resp.Spendings) != 2 {
+			t.Fatalf("Expected finished job with the two edited spendings, got %+v", resp)
+		}
+		var resolvedAt sql.NullTime
+		if err := env.DB.QueryRow("SELECT ambiguity_resolved_at FROM ai_categorization_jobs WHERE id = ?", editJobID).Scan(&resolvedAt); err != nil || !resolvedAt.Valid {
+			t.Errorf("Expected ambiguity_resolved_at to be set, got %v (err: %v)", resolvedAt, err)
+		}
+	})
+
+	// --- Test Case: Clarify Over the Quota ---
+	t.Run("ClarifyOverQuota", func(t *testing.T) {
+		householdID, _ := household.GetHouseholdID(env.DB, env.UserID)
+		if _, err := env.DB.Exec("UPDATE households SET llm_monthly_cost_limit = 1 WHERE id = ?", householdID); err != nil {
+			t.Fatalf("Failed to set quota: %v", err)
+		}
+		if _, err := env.DB.Exec("INSERT INTO llm_usage (user_id, household_id, latency_ms, cost) VALUES (?, ?, 10, 2)", env.PartnerID, householdID); err != nil {
+			t.Fatalf("Failed to insert usage: %v", err)
+		}
+		defer env.DB.Exec("UPDATE households SET llm_monthly_cost_limit = NULL WHERE id = ?", householdID)
+
+		rr := resolve(clarifyJobID, types.ResolveReviewPayload{Action: types.ReviewActionClarify, Clarification: "The wine was only for me"})
+		testutil.AssertStatusCode(t, rr, http.StatusTooManyRequests)
+		if _, ok := queued()[clarifyJobID]; !ok {
+			t.Error("Expected the job to stay in the queue")
+		}
+	})
+
+	// --- Test Case: Clarify and Categorize Again ---
+	t.Run("Clarify", func(t *testing.T) {
+		rr := resolve(clarifyJobID, types.ResolveReviewPayload{Action: types.ReviewActionClarify, Clarification: "  The wine was only for me  "})
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.JobResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.State != types.JobStatePending || resp.IsFinished || len(resp.Spendings) != 0 {
+			t.Errorf("Expected pending job without spendings, got %+v", resp)
+		}
+		if want := "Wine for the party\n\nPresisering: The wine was only for me"; resp.Prompt != want {
+			t.Errorf("Expected prompt %q, got %q", want, resp.Prompt)
+		}
+		var spendings int
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM spendings WHERE description = 'Wine for the party'").Scan(&spendings); err != nil || spendings != 0 {
+			t.Errorf("Expected the old spending to be deleted, found %d (err: %v)", spendings, err)
+		}
+	})
+
+	// --- Test Case: Errors ---
+	t.Run("Errors", func(t *testing.T) {
+		edit := types.ResolveReviewPayload{Action: types.ReviewActionEdit, Spendings: []types.ProposedSpending{
+			{Category: "Alcohol", Amount: 6000, ApportionMode: "alone", Description: "Wine"},
+		}}
+		testutil.AssertStatusCode(t, resolve(settledJobID, edit), http.StatusConflict)
+		testutil.AssertStatusCode(t, resolve(clearJobID, types.ResolveReviewPayload{Action: types.ReviewActionAccept}), http.StatusConflict)
+		testutil.AssertStatusCode(t, resolve(settledJobID, types.ResolveReviewPayload{Action: "ignore"}), http.StatusBadRequest)
+		testutil.AssertStatusCode(t, resolve(settledJobID, types.ResolveReviewPayload{Action: types.ReviewActionClarify}), http.StatusBadRequest)
+		testutil.AssertStatusCode(t, resolve(99999, types.ResolveReviewPayload{Action: types.ReviewActionAccept}), http.StatusNotFound)
+	})
+
+	for _, jobID := range []int64{acceptJobID, editJobID, clarifyJobID, settledJobID, clearJobID} {
+		for _, stmt := range []string{
+			"DELETE FROM spending_shares WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+			"DELETE FROM user_spendings WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+			"DELETE FROM spendings WHERE id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+			"DELETE FROM ai_categorized_spendings WHERE job_id = ?",
+			"DELETE FROM ai_categorization_jobs WHERE id = ?",
+		} {
+			if _, err := env.DB.Exec(stmt, jobID); err != nil {
+				t.Fatalf("Failed to clean up (%s): %v", stmt, err)
+			}
+		}
+	}
+}
+
+// TestRetryAndRecategorizeJobs tests POST /v1/jobs/{job_id}/retry, POST /v1/jobs/{job_id}/recategorize
+// and the bulk POST /v1/jobs/recategorize.
+func TestRetryAndRecategorizeJobs(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
+	coffeeID := testutil.GetCategoryID(t, env.DB, "Coffee")
+
+	// --- Setup Data ---
+	deadJobID := testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Taxi", 20.0, "dead_letter", true, false, nil)
+	completedJobID := testutil.InsertAIJob(t, env.DB, env.PartnerID, &env.UserID, "Groceries", 40.0, "completed", true, false, nil)
+	_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, groceriesID, 40.0, "Groceries", false, &completedJobID, nil)
+	settled := time.Now().UTC()
+	partlyJobID := testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Coffee and cake", 10.0, "completed", true, false, nil)
+	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, coffeeID, 5.0, "Coffee", false, &partlyJobID, &settled)
+	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, groceriesID, 5.0, "Cake", false, &partlyJobID, nil)
+	coffeeJobID := testutil.InsertAIJob(t, env.DB, env.UserID, nil, "Espresso", 4.0, "completed", true, false, nil)
+	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, coffeeID, 4.0, "Espresso", false, &coffeeJobID, nil)
+
+	post := func(path string, body interface{}) *httptest.ResponseRecorder {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, path, env.AuthToken, body)
+		return testutil.ExecuteRequest(t, env.Handler, req)
+	}
+	jobPath := func(jobID int64, action string) string {
+		return "/v1/jobs/" + strconv.FormatInt(jobID, 10) + "/" + action
+	}
+	statusOf := func(jobID int64) (status string, attempts int) {
+		if err := env.DB.QueryRow("SELECT status, attempts FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&status, &attempts); err != nil {
+			t.Fatalf("Failed to query job %d: %v", jobID, err)
+		}
+		return status, attempts
+	}
+
+	// --- Test Case: Retry ---
+	t.Run("Retry", func(t *testing.T) {
+		if _, err := env.DB.Exec("UPDATE ai_categorization_jobs SET attempts = 5, error_message = 'permanent: boom' WHERE id = ?", deadJobID); err != nil {
+			t.Fatalf("Failed to fail job: %v", err)
+		}
+		testutil.AssertStatusCode(t, post(jobPath(deadJobID, "retry"), nil), http.StatusAccepted)
+		if status, attempts := statusOf(deadJobID); status != "pending" || attempts != 0 {
+			t.Errorf("Expected pending job with fresh attempts, got %s after %d attempts", status, attempts)
+		}
+		testutil.AssertStatusCode(t, post(jobPath(completedJobID, "retry"), nil), http.StatusConflict)
+	})
+
+	// --- Test Case: Recategorize One Job ---
+	t.Run("Recategorize", func(t *testing.T) {
+		testutil.AssertStatusCode(t, post(jobPath(completedJobID, "recategorize"), nil), http.StatusAccepted)
+		if status, _ := statusOf(completedJobID); status != "pending" {
+			t.Errorf("Expected pending job, got %s", status)
+		}
+		var spendings int
+		if err := env.DB.QueryRow("SELECT COUNT(*) FROM ai_categorized_spendings WHERE job_id = ?", completedJobID).Scan(&spendings); err != nil || spendings != 1 {
+			t.Errorf("Expected the spending to stay until replaced, got %d (err: %v)", spendings, err)
+		}
+		testutil.AssertStatusCode(t, post(jobPath(completedJobID, "recategorize"), nil), http.StatusConflict)
+		testutil.AssertStatusCode(t, post(jobPath(partlyJobID, "recategorize"), nil), http.StatusConflict)
+		testutil.AssertStatusCode(t, post(jobPath(99999, "recategorize"), nil), http.StatusNotFound)
+	})
+
+	// --- Test Case: Bulk by Category ---
+	t.Run("BulkByCategory", func(t *testing.T) {
+		rr := post("/v1/jobs/recategorize", types.RecategorizeJobsPayload{CategoryName: testutil.Ptr("Coffee")})
+		testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+		var resp types.RecategorizeJobsResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if len(resp.Recategorized) != 1 || resp.Recategorized[0] != coffeeJobID {
+			t.Errorf("Expected only job %d recategorized, got %+v", coffeeJobID, resp)
+		}
+		if len(resp.Skipped) != 1 || resp.Skipped[0] != partlyJobID || len(resp.Retried) != 0 {
+			t.Errorf("Expected partly settled job %d skipped, got %+v", partlyJobID, resp)
+		}
+	})
+
+	// --- Test Case: Bulk by Date Range ---
+	t.Run("BulkByDate", func(t *testing.T) {
+		for _, id := range []int64{deadJobID, coffeeJobID} {
+			if _, err := env.DB.Exec("UPDATE ai_categorization_jobs SET status = 'dead_letter', transaction_date = ? WHERE id = ?", time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), id); err != nil {
+				t.Fatalf("Failed to update job: %v", err)
+			}
+		}
+		rr := post("/v1/jobs/recategorize", types.RecategorizeJobsPayload{From: testutil.Ptr("2024-03-01"), To: testutil.Ptr("2024-03-10")})
+		testutil.AssertStatusCode(t, rr, http.StatusAccepted)
+		var resp types.RecategorizeJobsResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if len(resp.Retried) != 2 || len(resp.Recategorized) != 0 {
+			t.Errorf("Expected the two dead jobs from March retried, got %+v", resp)
+		}
+
+		testutil.AssertStatusCode(t, post("/v1/jobs/recategorize", types.RecategorizeJobsPayload{}), http.StatusBadRequest)
+		testutil.AssertStatusCode(t, post("/v1/jobs/recategorize", types.RecategorizeJobsPayload{From: testutil.Ptr("March")}), http.StatusBadRequest)
+	})
+
+	for _, jobID := range []int64{deadJobID, completedJobID, partlyJobID, coffeeJobID} {
+		for _, stmt := range []string{
+			"DELETE FROM spending_shares WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+			"DELETE FROM user_spendings WHERE spending_id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+			"DELETE FROM spendings WHERE id IN (SELECT spending_id FROM ai_categorized_spendings WHERE job_id = ?)",
+			"DELETE FROM ai_categorized_spendings WHERE job_id = ?",
+			"DELETE FROM ai_categorization_jobs WHERE id = ?",
+		} {
+			if _, err := env.DB.Exec(stmt, jobID); err != nil {
+				t.Fatalf("Failed to clean up (%s): %v", stmt, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package ledger
+
+import (
+	"fmt"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// Receivable is the balance of a user's receivable account against another user: what the
+// debtor owes the creditor.
+type Receivable struct {
+	CreditorID int64
+	DebtorID   int64
+	Amount     money.Amount // Always positive
+}
+
+// Receivables returns what the members of the household owe each other, one positive balance
+// per pair of members who are not even, ordered by creditor and debtor. Debts to or from users
+// who left the household are not included.
+func Receivables(q household.Querier, householdID int64) ([]Receivable, error) {
+	rows, err := q.Query(`
+		SELECT p.user_id, p.counterparty_id, SUM(p.amount)
+		FROM ledger_postings p
+		JOIN household_members creditor ON creditor.user_id = p.user_id
+		JOIN household_members debtor ON debtor.user_id = p.counterparty_id
+		WHERE p.account = ? AND creditor.household_id = ? AND debtor.household_id = ?
+		GROUP BY p.user_id, p.counterparty_id
+		HAVING SUM(p.amount) > 0
+		ORDER BY p.user_id, p.counterparty_id
+	`, AccountReceivable, householdID, householdID)
+	if err != nil {
+		return nil, fmt.Errorf("querying receivables of household %d: %w", householdID, err)
+	}
+	defer rows.Close()
+
+	var receivables []Receivable
+	for rows.Next() {
+		var r Receivable
+		if err := rows.Scan(&r.CreditorID, &r.DebtorID, &r.Amount); err != nil {
+			return nil, fmt.Errorf("scanning receivable: %w", err)
+		}
+		receivables = append(receivables, r)
+	}
+	return receivables, rows.Err()
+}
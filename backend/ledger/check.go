@@ -0,0 +1,158 @@
+package ledger
+
+import (
+	"fmt"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// Discrepancy is a difference between the ledger and the spendings and deposits tables, or an
+// entry that is not balanced.
+type Discrepancy struct {
+	EntryID    int64 // 0 if the entry is missing
+	SpendingID int64
+	DepositID  int64
+	Problem    string
+}
+
+func (d Discrepancy) String() string {
+	switch {
+	case d.SpendingID != 0:
+		return fmt.Sprintf("spending %d: %s", d.SpendingID, d.Problem)
+	case d.DepositID != 0:
+		return fmt.Sprintf("deposit %d: %s", d.DepositID, d.Problem)
+	default:
+		return fmt.Sprintf("entry %d: %s", d.EntryID, d.Problem)
+	}
+}
+
+// Check compares the ledger with the spendings and deposits tables and returns every
+// difference: unbalanced entries, and spendings or deposits whose entries are missing, differ
+// from them or remain after they were deleted. Nothing is changed; Sync repairs the differences.
+func Check(q household.Querier) ([]Discrepancy, error) {
+	var found []Discrepancy
+
+	// 1. Every entry must add up to zero
+	rows, err := q.Query(`
+		SELECT e.id, COALESCE(e.spending_id, 0), COALESCE(e.deposit_id, 0), COALESCE(SUM(p.amount), 0), COUNT(p.id)
+		FROM ledger_entries e
+		LEFT JOIN ledger_postings p ON p.entry_id = e.id
+		GROUP BY e.id
+		HAVING COALESCE(SUM(p.amount), 0) != 0 OR COUNT(p.id) = 0
+		ORDER BY e.id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("querying unbalanced entries: %w", err)
+	}
+	for rows.Next() {
+		var d Discrepancy
+		var sum money.Amount
+		var postings int
+		if err := rows.Scan(&d.EntryID, &d.SpendingID, &d.DepositID, &sum, &postings); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scanning unbalanced entry: %w", err)
+		}
+		d.Problem = fmt.Sprintf("entry %d has no postings", d.EntryID)
+		if postings > 0 {
+			d.Problem = fmt.Sprintf("postings of entry %d add up to %s", d.EntryID, sum)
+		}
+		found = append(found, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating unbalanced entries: %w", err)
+	}
+
+	orphans, err := queryIDs(q, "SELECT id FROM ledger_postings WHERE entry_id NOT IN (SELECT id FROM ledger_entries)")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range orphans {
+		found = append(found, Discrepancy{Problem: fmt.Sprintf("posting %d belongs to no entry", id)})
+	}
+
+	// 2. Every spending and deposit must have the entries it implies, and no more
+	spendingIDs, err := queryIDs(q, "SELECT id FROM spendings UNION SELECT spending_id FROM ledger_entries WHERE spending_id IS NOT NULL ORDER BY 1")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range spendingIDs {
+		expected, err := expectedSpendingEntries(q, id)
+		if err != nil {
+			return nil, err
+		}
+		recorded, err := loadEntries(q, "spending_id", id)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range compare(recorded, expected) {
+			d.SpendingID = id
+			found = append(found, d)
+		}
+	}
+
+	depositIDs, err := queryIDs(q, "SELECT id FROM deposits UNION SELECT deposit_id FROM ledger_entries WHERE deposit_id IS NOT NULL ORDER BY 1")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range depositIDs {
+		expected, err := expectedDepositEntries(q, id)
+		if err != nil {
+			return nil, err
+		}
+		recorded, err := loadEntries(q, "deposit_id", id)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range compare(recorded, expected) {
+			d.DepositID = id
+			found = append(found, d)
+		}
+	}
+	return found, nil
+}
+
+// compare describes how the recorded entries of a spending or deposit differ from the expected.
+func compare(recorded, expected []Entry) []Discrepancy {
+	var found []Discrepancy
+	expectedByKey := map[string]Entry{}
+	for _, e := range expected {
+		expectedByKey[e.key()] = e
+	}
+	seen := map[string]bool{}
+	for _, r := range recorded {
+		e, ok := expectedByKey[r.key()]
+		switch {
+		case !ok:
+			found = append(found, Discrepancy{EntryID: r.ID, Problem: fmt.Sprintf("unexpected %s entry %d", r.Kind, r.ID)})
+		case seen[r.key()]:
+			found = append(found, Discrepancy{EntryID: r.ID, Problem: fmt.Sprintf("duplicate %s entry %d", r.Kind, r.ID)})
+		case !sameEntry(r, e):
+			found = append(found, Discrepancy{EntryID: r.ID, Problem: fmt.Sprintf("%s entry %d differs: recorded %s, expected %s", r.Kind, r.ID, describe(r), describe(e))})
+		}
+		seen[r.key()] = true
+	}
+	for _, e := range expected {
+		if !seen[e.key()] {
+			found = append(found, Discrepancy{Problem: fmt.Sprintf("missing %s entry %s", e.Kind, describe(e))})
+		}
+	}
+	return found
+}
+
+// describe formats the date and postings of an entry for a discrepancy.
+func describe(e Entry) string {
+	s := e.OccurredAt.UTC().Format("2006-01-02 15:04:05") + " ["
+	for i, p := range e.Postings {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%d:%s", p.UserID, p.Account)
+		if p.CounterpartyID != 0 {
+			s += fmt.Sprintf("/%d", p.CounterpartyID)
+		}
+		s += " " + p.Amount.String()
+	}
+	return s + "]"
+}
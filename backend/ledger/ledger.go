@@ -0,0 +1,526 @@
+// Package ledger records the money of a household in double entry: every spending, settlement
+// of a spending and deposit is an entry of postings between per-user accounts, and the postings
+// of an entry add up to zero. Balances, who owes whom and everyone's share of a spending are
+// derived from the ledger rather than recomputed from the spendings tables by each handler.
+//
+// Every user has these accounts, in minor units with debits positive:
+//   - funds: the user's own money; paying for a spending credits it, a deposit debits it.
+//   - expenses: the user's shares of spendings.
+//   - income: deposits.
+//   - receivable, one per other user: what that user owes the user, negative if the user owes.
+//
+// A spending of A bought by B and shared by participants p (split by household.SplitAmount)
+// credits B's funds with A, debits each p's expenses with their share, and for every p other
+// than B debits B's receivable against p and credits p's receivable against B with p's share.
+// Participants settle their shares with the buyer one by one: a settlement entry reverses the
+// receivables of the shares settled at that time and moves them from the funds of the
+// participants to those of the buyer. A deposit debits the user's funds and credits their
+// income; a recurring deposit is recorded once, at its first date, as later occurrences are
+// projected when read.
+//
+// The spendings, user_spendings, spending_shares and deposits tables remain what users edit.
+// Whoever changes them calls RecordSpending or RecordDeposit in the same transaction, and Prune
+// after deleting rows; Check compares the ledger with the tables.
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// Kinds of entries.
+const (
+	KindSpending   = "spending"
+	KindSettlement = "settlement"
+	KindDeposit    = "deposit"
+)
+
+// Accounts of a user, see the package documentation.
+const (
+	AccountFunds      = "funds"
+	AccountExpenses   = "expenses"
+	AccountIncome     = "income"
+	AccountReceivable = "receivable"
+)
+
+// DB is the part of *sql.DB and *sql.Tx the ledger needs to record entries.
+type DB interface {
+	household.Querier
+	household.Execer
+}
+
+// Posting is an amount debited (positive) or credited (negative) to an account.
+type Posting struct {
+	UserID         int64
+	Account        string
+	CounterpartyID int64 // Other user of a receivable account, 0 for other accounts
+	Amount         money.Amount
+}
+
+// Entry is a set of postings that add up to zero, recording one spending, settlement or deposit.
+type Entry struct {
+	ID         int64 // 0 until stored
+	Kind       string
+	SpendingID int64 // 0 for deposits
+	DepositID  int64 // 0 unless a deposit
+	OccurredAt time.Time
+	Postings   []Posting
+}
+
+// Sum returns the sum of the postings of the entry, zero if it is balanced.
+func (e Entry) Sum() money.Amount {
+	var sum money.Amount
+	for _, p := range e.Postings {
+		sum += p.Amount
+	}
+	return sum
+}
+
+// key identifies the entry among those of its spending or deposit: a spending or deposit has one
+// entry of each kind, but one settlement per time participants settled.
+func (e Entry) key() string {
+	if e.Kind == KindSettlement {
+		return e.Kind + " " + e.OccurredAt.UTC().Format(time.RFC3339Nano)
+	}
+	return e.Kind
+}
+
+// Spending is what the ledger records of a spending.
+type Spending struct {
+	ID           int64
+	Amount       money.Amount
+	Date         time.Time
+	BuyerID      int64
+	Participants []int64             // Users bearing the cost, none if the buyer pays alone
+	SettledAt    map[int64]time.Time // When participants other than the buyer settled their share
+}
+
+// Deposit is what the ledger records of a deposit.
+type Deposit struct {
+	ID     int64
+	UserID int64
+	Amount money.Amount
+	Date   time.Time // First date of a recurring deposit
+}
+
+// SpendingEntries returns the entries recording the spending: the spending itself and one
+// settlement per time participants settled their shares with the buyer.
+func SpendingEntries(s Spending) []Entry {
+	shares := household.SplitAmount(s.Amount, s.BuyerID, s.Participants)
+	debtors := make([]int64, 0, len(shares))
+	for userID := range shares {
+		debtors = append(debtors, userID)
+	}
+	sort.Slice(debtors, func(i, j int) bool { return debtors[i] < debtors[j] })
+
+	spending := Entry{Kind: KindSpending, SpendingID: s.ID, OccurredAt: s.Date}
+	spending.Postings = append(spending.Postings, Posting{UserID: s.BuyerID, Account: AccountFunds, Amount: -s.Amount})
+	settlements := map[time.Time][]Posting{}
+	for _, userID := range debtors {
+		share := shares[userID]
+		// Every participant gets an expenses posting, also of zero, so the ledger tells who shares the spending
+		spending.Postings = append(spending.Postings, Posting{UserID: userID, Account: AccountExpenses, Amount: share})
+		if userID == s.BuyerID || share == 0 {
+			continue
+		}
+		spending.Postings = append(spending.Postings,
+			Posting{UserID: s.BuyerID, Account: AccountReceivable, CounterpartyID: userID, Amount: share},
+			Posting{UserID: userID, Account: AccountReceivable, CounterpartyID: s.BuyerID, Amount: -share},
+		)
+		settledAt, ok := s.SettledAt[userID]
+		if !ok {
+			continue
+		}
+		settledAt = settledAt.UTC()
+		settlements[settledAt] = append(settlements[settledAt],
+			Posting{UserID: s.BuyerID, Account: AccountReceivable, CounterpartyID: userID, Amount: -share},
+			Posting{UserID: userID, Account: AccountReceivable, CounterpartyID: s.BuyerID, Amount: share},
+			Posting{UserID: userID, Account: AccountFunds, Amount: -share},
+			Posting{UserID: s.BuyerID, Account: AccountFunds, Amount: share},
+		)
+	}
+
+	entries := []Entry{spending}
+	times := make([]time.Time, 0, len(settlements))
+	for t := range settlements {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	for _, t := range times {
+		entries = append(entries, Entry{Kind: KindSettlement, SpendingID: s.ID, OccurredAt: t, Postings: settlements[t]})
+	}
+	for i := range entries {
+		entries[i].Postings = normalize(entries[i].Postings)
+	}
+	return entries
+}
+
+// DepositEntries returns the entry recording the deposit.
+func DepositEntries(d Deposit) []Entry {
+	return []Entry{{
+		Kind:       KindDeposit,
+		DepositID:  d.ID,
+		OccurredAt: d.Date,
+		Postings: normalize([]Posting{
+			{UserID: d.UserID, Account: AccountFunds, Amount: d.Amount},
+			{UserID: d.UserID, Account: AccountIncome, Amount: -d.Amount},
+		}),
+	}}
+}
+
+// normalize merges the postings to the same account and orders them, so entries can be compared.
+func normalize(postings []Posting) []Posting {
+	type account struct {
+		userID         int64
+		name           string
+		counterpartyID int64
+	}
+	index := map[account]int{}
+	var merged []Posting
+	for _, p := range postings {
+		key := account{p.UserID, p.Account, p.CounterpartyID}
+		if i, ok := index[key]; ok {
+			merged[i].Amount += p.Amount
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, p)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		return a.CounterpartyID < b.CounterpartyID
+	})
+	return merged
+}
+
+// sameEntry reports whether two entries record the same, ignoring their IDs.
+func sameEntry(a, b Entry) bool {
+	if a.Kind != b.Kind || a.SpendingID != b.SpendingID || a.DepositID != b.DepositID || !a.OccurredAt.Equal(b.OccurredAt) {
+		return false
+	}
+	if len(a.Postings) != len(b.Postings) {
+		return false
+	}
+	for i := range a.Postings {
+		if a.Postings[i] != b.Postings[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadSpending reads a spending as the ledger records it. ok is false if it does not exist.
+func loadSpending(q household.Querier, spendingID int64) (s Spending, ok bool, err error) {
+	err = q.QueryRow(`
+		SELECT s.id, s.amount, s.spending_date, COALESCE(us.buyer, s.made_by)
+		FROM spendings s
+		LEFT JOIN user_spendings us ON us.spending_id = s.id
+		WHERE s.id = ?
+	`, spendingID).Scan(&s.ID, &s.Amount, &s.Date, &s.BuyerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Spending{}, false, nil
+	}
+	if err != nil {
+		return Spending{}, false, fmt.Errorf("querying spending %d: %w", spendingID, err)
+	}
+
+	rows, err := q.Query("SELECT user_id, settled_at FROM spending_shares WHERE spending_id = ? ORDER BY user_id", spendingID)
+	if err != nil {
+		return Spending{}, false, fmt.Errorf("querying shares of spending %d: %w", spendingID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int64
+		var settledAt sql.NullTime
+		if err := rows.Scan(&userID, &settledAt); err != nil {
+			return Spending{}, false, fmt.Errorf("scanning share of spending %d: %w", spendingID, err)
+		}
+		s.Participants = append(s.Participants, userID)
+		if settledAt.Valid && userID != s.BuyerID {
+			if s.SettledAt == nil {
+				s.SettledAt = map[int64]time.Time{}
+			}
+			s.SettledAt[userID] = settledAt.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return Spending{}, false, fmt.Errorf("iterating shares of spending %d: %w", spendingID, err)
+	}
+	return s, true, nil
+}
+
+// loadDeposit reads a deposit as the ledger records it. ok is false if it does not exist.
+func loadDeposit(q household.Querier, depositID int64) (d Deposit, ok bool, err error) {
+	err = q.QueryRow("SELECT id, user_id, amount, deposit_date FROM deposits WHERE id = ?", depositID).
+		Scan(&d.ID, &d.UserID, &d.Amount, &d.Date)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Deposit{}, false, nil
+	}
+	if err != nil {
+		return Deposit{}, false, fmt.Errorf("querying deposit %d: %w", depositID, err)
+	}
+	return d, true, nil
+}
+
+// expectedSpendingEntries returns the entries the spending should have, none if it was deleted.
+func expectedSpendingEntries(q household.Querier, spendingID int64) ([]Entry, error) {
+	s, ok, err := loadSpending(q, spendingID)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return SpendingEntries(s), nil
+}
+
+// expectedDepositEntries returns the entries the deposit should have, none if it was deleted.
+func expectedDepositEntries(q household.Querier, depositID int64) ([]Entry, error) {
+	d, ok, err := loadDeposit(q, depositID)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return DepositEntries(d), nil
+}
+
+// loadEntries returns the recorded entries of a spending or deposit, by the column naming it.
+func loadEntries(q household.Querier, column string, id int64) ([]Entry, error) {
+	rows, err := q.Query(`
+		SELECT e.id, e.kind, COALESCE(e.spending_id, 0), COALESCE(e.deposit_id, 0), e.occurred_at,
+			p.user_id, p.account, COALESCE(p.counterparty_id, 0), p.amount
+		FROM ledger_entries e
+		LEFT JOIN ledger_postings p ON p.entry_id = e.id
+		WHERE e.`+column+` = ?
+		ORDER BY e.id
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("querying ledger entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var userID, counterpartyID sql.NullInt64
+		var account sql.NullString
+		var amount sql.Null[money.Amount]
+		if err := rows.Scan(&e.ID, &e.Kind, &e.SpendingID, &e.DepositID, &e.OccurredAt, &userID, &account, &counterpartyID, &amount); err != nil {
+			return nil, fmt.Errorf("scanning ledger entry: %w", err)
+		}
+		if len(entries) == 0 || entries[len(entries)-1].ID != e.ID {
+			entries = append(entries, e)
+		}
+		if userID.Valid {
+			last := &entries[len(entries)-1]
+			last.Postings = append(last.Postings, Posting{
+				UserID:         userID.Int64,
+				Account:        account.String,
+				CounterpartyID: counterpartyID.Int64,
+				Amount:         amount.V,
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating ledger entries: %w", err)
+	}
+	for i := range entries {
+		entries[i].Postings = normalize(entries[i].Postings)
+	}
+	return entries, nil
+}
+
+// RecordSpending brings the ledger entries of the spending in step with the spendings tables:
+// entries that differ from the spending are replaced, those of a deleted spending are removed.
+// Call it in the transaction that changes the spending, its shares or its settlement.
+func RecordSpending(db DB, spendingID int64) error {
+	expected, err := expectedSpendingEntries(db, spendingID)
+	if err != nil {
+		return err
+	}
+	recorded, err := loadEntries(db, "spending_id", spendingID)
+	if err != nil {
+		return err
+	}
+	if _, err := reconcile(db, recorded, expected); err != nil {
+		return fmt.Errorf("recording spending %d: %w", spendingID, err)
+	}
+	return nil
+}
+
+// RecordDeposit brings the ledger entry of the deposit in step with the deposits table, like
+// RecordSpending.
+func RecordDeposit(db DB, depositID int64) error {
+	expected, err := expectedDepositEntries(db, depositID)
+	if err != nil {
+		return err
+	}
+	recorded, err := loadEntries(db, "deposit_id", depositID)
+	if err != nil {
+		return err
+	}
+	if _, err := reconcile(db, recorded, expected); err != nil {
+		return fmt.Errorf("recording deposit %d: %w", depositID, err)
+	}
+	return nil
+}
+
+// reconcile replaces the recorded entries that differ from the expected ones with the same key,
+// and returns how many entries it wrote or deleted. Entries that match are kept as they are.
+func reconcile(db DB, recorded, expected []Entry) (int, error) {
+	byKey := map[string]Entry{}
+	for _, e := range expected {
+		byKey[e.key()] = e
+	}
+	changed := 0
+	for _, r := range recorded {
+		if e, ok := byKey[r.key()]; ok && sameEntry(r, e) {
+			delete(byKey, r.key())
+			continue
+		}
+		if err := deleteEntry(db, r.ID); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	for _, e := range expected {
+		if _, ok := byKey[e.key()]; !ok {
+			continue // Already recorded
+		}
+		if err := insertEntry(db, e); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// insertEntry stores the entry with its postings. Unbalanced entries are refused.
+func insertEntry(db DB, e Entry) error {
+	if sum := e.Sum(); sum != 0 {
+		return fmt.Errorf("%s entry postings add up to %s, not zero", e.Kind, sum)
+	}
+	res, err := db.Exec("INSERT INTO ledger_entries (kind, spending_id, deposit_id, occurred_at) VALUES (?, ?, ?, ?)",
+		e.Kind, nullID(e.SpendingID), nullID(e.DepositID), e.OccurredAt)
+	if err != nil {
+		return fmt.Errorf("inserting %s entry: %w", e.Kind, err)
+	}
+	entryID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("getting ID of %s entry: %w", e.Kind, err)
+	}
+	for _, p := range e.Postings {
+		_, err := db.Exec("INSERT INTO ledger_postings (entry_id, user_id, account, counterparty_id, amount) VALUES (?, ?, ?, ?, ?)",
+			entryID, p.UserID, p.Account, nullID(p.CounterpartyID), p.Amount)
+		if err != nil {
+			return fmt.Errorf("inserting posting of entry %d: %w", entryID, err)
+		}
+	}
+	return nil
+}
+
+// deleteEntry removes the entry with its postings.
+func deleteEntry(db household.Execer, entryID int64) error {
+	if _, err := db.Exec("DELETE FROM ledger_postings WHERE entry_id = ?", entryID); err != nil {
+		return fmt.Errorf("deleting postings of entry %d: %w", entryID, err)
+	}
+	if _, err := db.Exec("DELETE FROM ledger_entries WHERE id = ?", entryID); err != nil {
+		return fmt.Errorf("deleting entry %d: %w", entryID, err)
+	}
+	return nil
+}
+
+// nullID stores 0 as NULL.
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// orphanedEntries selects the entries of deleted spendings and deposits.
+const orphanedEntries = `
+	SELECT id FROM ledger_entries
+	WHERE (spending_id IS NOT NULL AND spending_id NOT IN (SELECT id FROM spendings))
+	   OR (deposit_id IS NOT NULL AND deposit_id NOT IN (SELECT id FROM deposits))
+`
+
+// Prune removes the entries of deleted spendings and deposits with their postings. Call it in
+// the transaction deleting them; foreign keys would cascade, but are not enabled on every
+// connection.
+func Prune(db household.Execer) error {
+	if _, err := db.Exec("DELETE FROM ledger_postings WHERE entry_id IN (" + orphanedEntries + ")"); err != nil {
+		return fmt.Errorf("deleting postings of removed spendings and deposits: %w", err)
+	}
+	if _, err := db.Exec("DELETE FROM ledger_entries WHERE id IN (" + orphanedEntries + ")"); err != nil {
+		return fmt.Errorf("deleting entries of removed spendings and deposits: %w", err)
+	}
+	return nil
+}
+
+// Sync records every spending and deposit that is missing from the ledger or differs from it,
+// and removes the entries of deleted ones and postings without an entry. It returns the number
+// of entries written or deleted. Used to fill the ledger of an existing database and to repair
+// it after Check.
+func Sync(db DB) (int, error) {
+	if err := Prune(db); err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec("DELETE FROM ledger_postings WHERE entry_id NOT IN (SELECT id FROM ledger_entries)"); err != nil {
+		return 0, fmt.Errorf("deleting postings without an entry: %w", err)
+	}
+	changed := 0
+	for _, source := range []struct {
+		table, column string
+		expected      func(household.Querier, int64) ([]Entry, error)
+	}{
+		{"spendings", "spending_id", expectedSpendingEntries},
+		{"deposits", "deposit_id", expectedDepositEntries},
+	} {
+		ids, err := queryIDs(db, "SELECT id FROM "+source.table+" ORDER BY id")
+		if err != nil {
+			return changed, err
+		}
+		for _, id := range ids {
+			expected, err := source.expected(db, id)
+			if err != nil {
+				return changed, err
+			}
+			recorded, err := loadEntries(db, source.column, id)
+			if err != nil {
+				return changed, err
+			}
+			n, err := reconcile(db, recorded, expected)
+			changed += n
+			if err != nil {
+				return changed, fmt.Errorf("recording %s %d: %w", source.table, id, err)
+			}
+		}
+	}
+	return changed, nil
+}
+
+// queryIDs returns the IDs selected by the query. They are read in full before the caller runs
+// other statements, as the connection may be the only one.
+func queryIDs(q household.Querier, query string, args ...interface{}) ([]int64, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying IDs: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("scanning ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
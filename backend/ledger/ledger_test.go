@@ -0,0 +1,175 @@
+package ledger
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpendingEntries(t *testing.T) {
+	date := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	settled := date.AddDate(0, 0, 5)
+	later := date.AddDate(0, 0, 9)
+
+	tests := []struct {
+		name     string
+		spending Spending
+		expected [][]Posting
+	}{
+		{
+			name:     "alone",
+			spending: Spending{ID: 1, Amount: 1000, Date: date, BuyerID: 1},
+			expected: [][]Posting{{
+				{UserID: 1, Account: AccountExpenses, Amount: 1000},
+				{UserID: 1, Account: AccountFunds, Amount: -1000},
+			}},
+		},
+		{
+			name:     "shared with odd unit",
+			spending: Spending{ID: 1, Amount: 101, Date: date, BuyerID: 2, Participants: []int64{1, 2}},
+			expected: [][]Posting{{
+				{UserID: 1, Account: AccountExpenses, Amount: 50},
+				{UserID: 1, Account: AccountReceivable, CounterpartyID: 2, Amount: -50},
+				{UserID: 2, Account: AccountExpenses, Amount: 51},
+				{UserID: 2, Account: AccountFunds, Amount: -101},
+				{UserID: 2, Account: AccountReceivable, CounterpartyID: 1, Amount: 50},
+			}},
+		},
+		{
+			name:     "partner takes all",
+			spending: Spending{ID: 1, Amount: 500, Date: date, BuyerID: 1, Participants: []int64{2}},
+			expected: [][]Posting{{
+				{UserID: 1, Account: AccountFunds, Amount: -500},
+				{UserID: 1, Account: AccountReceivable, CounterpartyID: 2, Amount: 500},
+				{UserID: 2, Account: AccountExpenses, Amount: 500},
+				{UserID: 2, Account: AccountReceivable, CounterpartyID: 1, Amount: -500},
+			}},
+		},
+		{
+			name:     "less than one unit each",
+			spending: Spending{ID: 1, Amount: 1, Date: date, BuyerID: 1, Participants: []int64{1, 2}},
+			expected: [][]Posting{{
+				{UserID: 1, Account: AccountExpenses, Amount: 1},
+				{UserID: 1, Account: AccountFunds, Amount: -1},
+				{UserID: 2, Account: AccountExpenses, Amount: 0},
+			}},
+		},
+		{
+			name:     "settled",
+			spending: Spending{ID: 1, Amount: 1000, Date: date, BuyerID: 1, Participants: []int64{1, 2}, SettledAt: map[int64]time.Time{2: settled}},
+			expected: [][]Posting{
+				{
+					{UserID: 1, Account: AccountExpenses, Amount: 500},
+					{UserID: 1, Account: AccountFunds, Amount: -1000},
+					{UserID: 1, Account: AccountReceivable, CounterpartyID: 2, Amount: 500},
+					{UserID: 2, Account: AccountExpenses, Amount: 500},
+					{UserID: 2, Account: AccountReceivable, CounterpartyID: 1, Amount: -500},
+				},
+				{
+					{UserID: 1, Account: AccountFunds, Amount: 500},
+					{UserID: 1, Account: AccountReceivable, CounterpartyID: 2, Amount: -500},
+					{UserID: 2, Account: AccountFunds, Amount: -500},
+					{UserID: 2, Account: AccountReceivable, CounterpartyID: 1, Amount: 500},
+				},
+			},
+		},
+		{
+			name:     "settled alone",
+			spending: Spending{ID: 1, Amount: 1000, Date: date, BuyerID: 1, SettledAt: map[int64]time.Time{1: settled}},
+			expected: [][]Posting{{
+				{UserID: 1, Account: AccountExpenses, Amount: 1000},
+				{UserID: 1, Account: AccountFunds, Amount: -1000},
+			}},
+		},
+		{
+			name:     "settled one by one",
+			spending: Spending{ID: 1, Amount: 900, Date: date, BuyerID: 1, Participants: []int64{1, 2, 3}, SettledAt: map[int64]time.Time{3: settled, 2: later}},
+			expected: [][]Posting{
+				{
+					{UserID: 1, Account: AccountExpenses, Amount: 300},
+					{UserID: 1, Account: AccountFunds, Amount: -900},
+					{UserID: 1, Account: AccountReceivable, CounterpartyID: 2, Amount: 300},
+					{UserID: 1, Account: AccountReceivable, CounterpartyID: 3, Amount: 300},
+					{UserID: 2, Account: AccountExpenses, Amount: 300},
+					{UserID: 2, Account: AccountReceivable, CounterpartyID: 1, Amount: -300},
+					{UserID: 3, Account: AccountExpenses, Amount: 300},
+					{UserID: 3, Account: AccountReceivable, CounterpartyID: 1, Amount: -300},
+				},
+				{
+					{UserID: 1, Account: AccountFunds, Amount: 300},
+					{UserID: 1, Account: AccountReceivable, CounterpartyID: 3, Amount: -300},
+					{UserID: 3, Account: AccountFunds, Amount: -300},
+					{UserID: 3, Account: AccountReceivable, CounterpartyID: 1, Amount: 300},
+				},
+				{
+					{UserID: 1, Account: AccountFunds, Amount: 300},
+					{UserID: 1, Account: AccountReceivable, CounterpartyID: 2, Amount: -300},
+					{UserID: 2, Account: AccountFunds, Amount: -300},
+					{UserID: 2, Account: AccountReceivable, CounterpartyID: 1, Amount: 300},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := SpendingEntries(tt.spending)
+			var got [][]Posting
+			for _, e := range entries {
+				if e.Sum() != 0 {
+					t.Errorf("%s entry is not balanced: %v", e.Kind, e.Postings)
+				}
+				if e.SpendingID != tt.spending.ID {
+					t.Errorf("%s entry has spending ID %d, expected %d", e.Kind, e.SpendingID, tt.spending.ID)
+				}
+				got = append(got, e.Postings)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("SpendingEntries() postings = %v, expected %v", got, tt.expected)
+			}
+			for i, e := range entries[1:] {
+				if e.Kind != KindSettlement {
+					t.Errorf("Expected entry %d to be a settlement, got %s", i+1, e.Kind)
+				}
+			}
+			if len(entries) > 1 && !entries[1].OccurredAt.Equal(settled) {
+				t.Errorf("Expected the first settlement on %v, got %v", settled, entries[1].OccurredAt)
+			}
+		})
+	}
+}
+
+func TestDepositEntries(t *testing.T) {
+	date := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := DepositEntries(Deposit{ID: 3, UserID: 2, Amount: 250000, Date: date})
+
+	expected := []Entry{{
+		Kind:       KindDeposit,
+		DepositID:  3,
+		OccurredAt: date,
+		Postings: []Posting{
+			{UserID: 2, Account: AccountFunds, Amount: 250000},
+			{UserID: 2, Account: AccountIncome, Amount: -250000},
+		},
+	}}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("DepositEntries() = %v, expected %v", entries, expected)
+	}
+}
+
+func TestSameEntry(t *testing.T) {
+	date := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	a := SpendingEntries(Spending{ID: 1, Amount: 1000, Date: date, BuyerID: 1, Participants: []int64{1, 2}})[0]
+
+	b := a
+	b.ID = 7
+	b.OccurredAt = date.In(time.FixedZone("CET", 3600))
+	if !sameEntry(a, b) {
+		t.Error("Expected entries differing only in ID and time zone to be the same")
+	}
+
+	c := SpendingEntries(Spending{ID: 1, Amount: 1001, Date: date, BuyerID: 1, Participants: []int64{1, 2}})[0]
+	if sameEntry(a, c) {
+		t.Error("Expected entries with different amounts to differ")
+	}
+}
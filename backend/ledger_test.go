@@ -0,0 +1,143 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/testutil"
+	"git.sr.ht/~relay/sapp-backend/types"
+)
+
+// TestLedgerConsistency runs the handlers that write spendings and deposits and verifies the
+// ledger stays in step with the tables, and that ledger.Check and ledger.Sync catch and repair
+// changes made behind its back.
+func TestLedgerConsistency(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
+	householdID, _ := household.GetHouseholdID(env.DB, env.UserID)
+	partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+	if err != nil {
+		t.Fatalf("Failed to generate partner token: %v", err)
+	}
+
+	assertConsistent := func(t *testing.T) {
+		t.Helper()
+		discrepancies, err := ledger.Check(env.DB)
+		if err != nil {
+			t.Fatalf("ledger.Check failed: %v", err)
+		}
+		for _, d := range discrepancies {
+			t.Errorf("Unexpected discrepancy: %s", d)
+		}
+	}
+
+	// --- Setup Data: the user pays 1.01 shared, the partner pays 30.00 alone ---
+	req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, types.PayPayload{
+		SharedStatus: "shared", Amount: 101, Category: "Groceries",
+	})
+	testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+	var paidID int64
+	if err := env.DB.QueryRow("SELECT MAX(id) FROM spendings").Scan(&paidID); err != nil {
+		t.Fatalf("Failed to query paid spending: %v", err)
+	}
+	aloneID := testutil.InsertSpending(t, env.DB, env.PartnerID, nil, groceriesID, 30.0, "Alone", false, nil, nil)
+	depositID := testutil.InsertDeposit(t, env.DB, env.UserID, 1000.0, "Salary", time.Now(), true, testutil.Ptr("monthly"))
+
+	t.Run("AfterWrites", func(t *testing.T) {
+		assertConsistent(t)
+
+		receivables, err := ledger.Receivables(env.DB, householdID)
+		if err != nil {
+			t.Fatalf("ledger.Receivables failed: %v", err)
+		}
+		if len(receivables) != 1 || receivables[0].CreditorID != env.UserID || receivables[0].DebtorID != env.PartnerID || receivables[0].Amount != 50 {
+			t.Errorf("Expected the partner to owe 0.50, got %+v", receivables)
+		}
+	})
+
+	t.Run("AfterUpdate", func(t *testing.T) {
+		url := fmt.Sprintf("/v1/spendings/%d", aloneID)
+		payload := types.UpdateSpendingPayload{Description: "Now shared", CategoryName: "Groceries", SharingStatus: types.StatusShared}
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPut, url, partnerToken, payload)
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusOK)
+		assertConsistent(t)
+
+		// The partner is now owed 15.00 and owes 0.50
+		req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/transfer/status", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.TransferStatusResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		if resp.AmountOwed != 1450 || resp.OwedTo == nil || *resp.OwedTo != env.PartnerName {
+			t.Errorf("Expected 14.50 owed to the partner, got %s to %v", resp.AmountOwed, resp.OwedTo)
+		}
+	})
+
+	t.Run("AfterTransfer", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", env.AuthToken, nil)
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusOK)
+		assertConsistent(t)
+
+		receivables, err := ledger.Receivables(env.DB, householdID)
+		if err != nil || len(receivables) != 0 {
+			t.Errorf("Expected no receivables after the transfer, got %+v, %v", receivables, err)
+		}
+	})
+
+	t.Run("AfterDeletes", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodDelete, fmt.Sprintf("/v1/deposits/%d", depositID), env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusNoContent {
+			t.Fatalf("Deleting the deposit returned %d: %s", rr.Code, rr.Body.String())
+		}
+		assertConsistent(t)
+
+		var entries int
+		env.DB.QueryRow("SELECT COUNT(*) FROM ledger_entries WHERE deposit_id = ?", depositID).Scan(&entries)
+		if entries != 0 {
+			t.Errorf("Expected the deposit's entries to be removed, got %d", entries)
+		}
+	})
+
+	t.Run("CheckAndSync", func(t *testing.T) {
+		if _, err := env.DB.Exec("UPDATE spendings SET amount = 202 WHERE id = ?", paidID); err != nil {
+			t.Fatalf("Failed to change spending: %v", err)
+		}
+		if _, err := env.DB.Exec("DELETE FROM ledger_entries WHERE spending_id = ? AND kind = ?", aloneID, ledger.KindSettlement); err != nil {
+			t.Fatalf("Failed to delete settlement entry: %v", err)
+		}
+
+		discrepancies, err := ledger.Check(env.DB)
+		if err != nil {
+			t.Fatalf("ledger.Check failed: %v", err)
+		}
+		var problems []string
+		for _, d := range discrepancies {
+			problems = append(problems, d.String())
+		}
+		report := strings.Join(problems, "\n")
+		if !strings.Contains(report, fmt.Sprintf("spending %d: spending entry", paidID)) || !strings.Contains(report, "differs") {
+			t.Errorf("Expected the changed amount to be reported, got:\n%s", report)
+		}
+		if !strings.Contains(report, fmt.Sprintf("spending %d: missing settlement entry", aloneID)) {
+			t.Errorf("Expected the missing settlement to be reported, got:\n%s", report)
+		}
+
+		changed, err := ledger.Sync(env.DB)
+		if err != nil {
+			t.Fatalf("ledger.Sync failed: %v", err)
+		}
+		if changed == 0 {
+			t.Error("Expected ledger.Sync to write entries")
+		}
+		assertConsistent(t)
+	})
+}
@@ -0,0 +1,174 @@
+// Package money represents sums of money exactly, as whole minor units of their currency (øre,
+// cents). Amounts are stored as INTEGER in the database and written as decimal numbers of major
+// units in JSON, e.g. 12.5 for 1250 øre, so the API looks as it did with floating point.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// minorPerMajor is the number of minor units in a major unit. Every currency in use has two
+// decimals.
+const minorPerMajor = 100
+
+// Amount is a sum of money in minor units: 1 is 0.01 of the currency.
+type Amount int64
+
+// ErrInvalid is returned when parsing something that is not a decimal number.
+var ErrInvalid = errors.New("invalid amount")
+
+// FromMinor returns the amount of the given minor units.
+func FromMinor(minor int64) Amount {
+	return Amount(minor)
+}
+
+// FromFloat returns the amount closest to a number of major units, rounding half away from
+// zero. Only for values that come as floating point, like the result of a currency conversion;
+// amounts in text are read exactly with Parse.
+func FromFloat(major float64) Amount {
+	return Amount(math.Round(major * minorPerMajor))
+}
+
+// Parse reads a decimal number of major units, e.g. "12.5" or "-3", rounding half away from zero
+// to whole minor units. Exponents like "1e3" are accepted, as JSON allows them.
+func Parse(s string) (Amount, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	r.Mul(r, big.NewRat(minorPerMajor, 1))
+
+	// Round the fraction half away from zero: truncate |r| + 1/2
+	half := big.NewRat(1, 2)
+	if r.Sign() < 0 {
+		r.Sub(r, half)
+	} else {
+		r.Add(r, half)
+	}
+	minor := new(big.Int).Quo(r.Num(), r.Denom())
+	if !minor.IsInt64() {
+		return 0, fmt.Errorf("%w: %q is out of range", ErrInvalid, s)
+	}
+	return Amount(minor.Int64()), nil
+}
+
+// Minor returns the amount in minor units.
+func (a Amount) Minor() int64 {
+	return int64(a)
+}
+
+// Float returns the amount in major units, for computing with rates and statistics.
+func (a Amount) Float() float64 {
+	return float64(a) / minorPerMajor
+}
+
+// Abs returns the absolute value of the amount.
+func (a Amount) Abs() Amount {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// Split divides the amount into n parts that differ by at most one minor unit and add up to it
+// exactly. The odd minor units go to the first parts, one each, so callers decide who bears them
+// by the order they assign parts in. Split(0) is nil.
+func (a Amount) Split(n int) []Amount {
+	if n <= 0 {
+		return nil
+	}
+	parts := make([]Amount, n)
+	quotient, remainder := a/Amount(n), a%Amount(n) // remainder has the sign of a
+	step := Amount(1)
+	if remainder < 0 {
+		step, remainder = -1, -remainder
+	}
+	for i := range parts {
+		parts[i] = quotient
+		if Amount(i) < remainder {
+			parts[i] += step
+		}
+	}
+	return parts
+}
+
+// String formats the amount in major units with two decimals, e.g. "12.50".
+func (a Amount) String() string {
+	sign := ""
+	minor := int64(a)
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, minor/minorPerMajor, minor%minorPerMajor)
+}
+
+// Format formats the amount in major units with only the decimals needed, e.g. "12.5" or "12".
+func (a Amount) Format() string {
+	s := a.String()
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// MarshalJSON writes the amount as a number of major units, e.g. 12.5.
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.Format()), nil
+}
+
+// UnmarshalJSON reads a number of major units exactly, see Parse. Numbers in strings, like
+// "12.50", are accepted too. null leaves the amount unchanged.
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Value stores the amount as INTEGER minor units.
+func (a Amount) Value() (driver.Value, error) {
+	return int64(a), nil
+}
+
+// Scan reads INTEGER minor units. A REAL, as aggregates like AVG give, is rounded to the closest
+// minor unit.
+func (a *Amount) Scan(src any) error {
+	switch v := src.(type) {
+	case int64:
+		*a = Amount(v)
+	case float64:
+		*a = Amount(math.Round(v))
+	case []byte:
+		return a.scanText(string(v))
+	case string:
+		return a.scanText(v)
+	case nil:
+		return errors.New("cannot scan NULL into money.Amount, use sql.Null[money.Amount]")
+	default:
+		return fmt.Errorf("cannot scan %T into money.Amount", src)
+	}
+	return nil
+}
+
+// scanText reads minor units stored as text.
+func (a *Amount) scanText(s string) error {
+	minor, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q is not whole minor units", ErrInvalid, s)
+	}
+	*a = Amount(minor)
+	return nil
+}
@@ -0,0 +1,138 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Amount
+	}{
+		{input: "12.5", expected: 1250},
+		{input: "12", expected: 1200},
+		{input: "0.01", expected: 1},
+		{input: "-3.75", expected: -375},
+		{input: "0.1", expected: 10}, // not exact in floating point
+		{input: "0.005", expected: 1},
+		{input: "-0.005", expected: -1},
+		{input: "0.0049", expected: 0},
+		{input: "1e3", expected: 100000},
+		{input: " 7.30 ", expected: 730},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if err != nil || got != tt.expected {
+				t.Fatalf("Parse(%q) = %d, %v, expected %d", tt.input, got, err, tt.expected)
+			}
+		})
+	}
+
+	for _, input := range []string{"", "abc", "12,5", "1e30"} {
+		if _, err := Parse(input); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Parse(%q): expected ErrInvalid, got %v", input, err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		amount         Amount
+		string, format string
+	}{
+		{amount: 1250, string: "12.50", format: "12.5"},
+		{amount: 1200, string: "12.00", format: "12"},
+		{amount: 5, string: "0.05", format: "0.05"},
+		{amount: 0, string: "0.00", format: "0"},
+		{amount: -375, string: "-3.75", format: "-3.75"},
+		{amount: -50, string: "-0.50", format: "-0.5"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.amount.String(); got != tt.string {
+			t.Errorf("Amount(%d).String() = %q, expected %q", tt.amount, got, tt.string)
+		}
+		if got := tt.amount.Format(); got != tt.format {
+			t.Errorf("Amount(%d).Format() = %q, expected %q", tt.amount, got, tt.format)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   Amount
+		n        int
+		expected []Amount
+	}{
+		{name: "even", amount: 1000, n: 2, expected: []Amount{500, 500}},
+		{name: "odd unit to the first part", amount: 101, n: 2, expected: []Amount{51, 50}},
+		{name: "two odd units", amount: 1000, n: 3, expected: []Amount{334, 333, 333}},
+		{name: "less than one unit each", amount: 2, n: 3, expected: []Amount{1, 1, 0}},
+		{name: "negative", amount: -101, n: 2, expected: []Amount{-51, -50}},
+		{name: "no parts", amount: 100, n: 0, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.amount.Split(tt.n)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("Amount(%d).Split(%d) = %v, expected %v", tt.amount, tt.n, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Amount  Amount  `json:"amount"`
+		Pointer *Amount `json:"pointer"`
+	}
+	if err := json.Unmarshal([]byte(`{"amount": 19.99, "pointer": "0.10"}`), &v); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if v.Amount != 1999 || v.Pointer == nil || *v.Pointer != 10 {
+		t.Fatalf("Unexpected amounts: %d, %v", v.Amount, v.Pointer)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil || string(data) != `{"amount":19.99,"pointer":0.1}` {
+		t.Fatalf("Marshal = %s, %v", data, err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"amount": true}`), &v); err == nil {
+		t.Error("Expected an error for a boolean amount")
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src      any
+		expected Amount
+	}{
+		{src: int64(1250), expected: 1250},
+		{src: float64(1249.6), expected: 1250},
+		{src: []byte("42"), expected: 42},
+		{src: "-7", expected: -7},
+	}
+
+	for _, tt := range tests {
+		var a Amount
+		if err := a.Scan(tt.src); err != nil || a != tt.expected {
+			t.Errorf("Scan(%#v) = %d, %v, expected %d", tt.src, a, err, tt.expected)
+		}
+	}
+
+	var a Amount
+	if err := a.Scan(nil); err == nil {
+		t.Error("Expected an error scanning NULL")
+	}
+	if err := a.Scan("12.50"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected ErrInvalid scanning a decimal, got %v", err)
+	}
+}
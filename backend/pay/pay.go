@@ -9,6 +9,9 @@ import (
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/currency"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
@@ -40,6 +43,12 @@ func HandlePayRoute(db *sql.DB) http.HandlerFunc { // Return http.HandlerFunc di
 			return
 		}
 
+		code, ok := currency.ParseCode(payload.Currency)
+		if !ok {
+			http.Error(w, "Currency must be a three-letter ISO 4217 code", http.StatusBadRequest)
+			return
+		}
+
 		// --- Parse Spending Date ---
 		var spendingDate time.Time
 		if payload.SpendingDate != nil && *payload.SpendingDate != "" {
@@ -59,7 +68,6 @@ func HandlePayRoute(db *sql.DB) http.HandlerFunc { // Return http.HandlerFunc di
 		}
 		// --- End Parse Spending Date ---
 
-
 		tx, err := db.Begin()
 		if err != nil {
 			slog.Error("failed to begin transaction", "url", r.URL, "user_id", userID, "err", err)
@@ -68,40 +76,49 @@ func HandlePayRoute(db *sql.DB) http.HandlerFunc { // Return http.HandlerFunc di
 		}
 		defer tx.Rollback() // Defer rollback in case of errors before commit
 
-		var shared_with_id *int64 // Use *int64 for nullable foreign key
+		var participants []int64 // Users bearing the cost; empty means the buyer pays alone
 
-		// Determine shared_with_id based on payload.SharedStatus
+		// Determine participants based on payload.SharedStatus
 		switch payload.SharedStatus {
 		case "alone":
-			shared_with_id = nil
+			participants = nil
 		case "shared":
-			// Get the partner ID using the new function that queries the database
-			partnerID, partnerOk := auth.GetPartnerUserID(tx, userID) // Pass transaction tx
-			if !partnerOk {
-				// Check if GetPartnerUserID logged the error already
-				http.Error(w, "Cannot share: Partner not found or not configured for this user.", http.StatusBadRequest)
-				return
-			}
-			// Check if partner exists in DB (optional, but good practice)
-			var exists int
-			err := tx.QueryRow("SELECT 1 FROM users WHERE id = ?", partnerID).Scan(&exists)
+			// Share with the requested household members, or everyone else in the household
+			others, err := household.ResolveOthers(tx, userID, payload.SharedWith)
 			if err != nil {
-				if err == sql.ErrNoRows {
-					slog.Error("configured partner user ID not found in database", "url", r.URL, "user_id", userID, "partner_id", partnerID)
-					http.Error(w, "Internal server error: Partner configuration issue", http.StatusInternalServerError)
-				} else {
-					slog.Error("failed to query partner user", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
+				if errors.Is(err, household.ErrNotMember) {
+					slog.Warn("pay shared with non-member", "url", r.URL, "user_id", userID, "shared_with", payload.SharedWith, "err", err)
+					http.Error(w, "Cannot share: All shared_with users must be members of your household.", http.StatusBadRequest)
+					return
 				}
+				slog.Error("failed to resolve household members", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			if len(others) == 0 {
+				http.Error(w, "Cannot share: Partner not found or not configured for this user.", http.StatusBadRequest)
 				return
 			}
-			shared_with_id = &partnerID // Assign the partner ID
+			participants = append([]int64{userID}, others...)
 		default:
 			slog.Warn("invalid shared status received", "url", r.URL, "user_id", userID, "status", payload.SharedStatus)
 			http.Error(w, "Invalid shared status.", http.StatusBadRequest)
 			return
 		}
 
+		// Convert the amount to the household's currency with the rate of the spending date
+		amount, err := currency.ToBase(tx, userID, payload.Amount, code, spendingDate)
+		if err != nil {
+			if errors.Is(err, currency.ErrNoRate) {
+				slog.Warn("no exchange rate for manual spending", "url", r.URL, "user_id", userID, "currency", code, "err", err)
+				http.Error(w, "No exchange rate for the currency on the spending date", http.StatusBadRequest)
+				return
+			}
+			slog.Error("converting spending amount failed", "url", r.URL, "user_id", userID, "currency", code, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		// Get category ID from payload.Category name
 		var category_id int64 // Category ID is integer
 		row := tx.QueryRow("SELECT id FROM categories WHERE name = ? LIMIT 1", payload.Category)
@@ -119,8 +136,8 @@ func HandlePayRoute(db *sql.DB) http.HandlerFunc { // Return http.HandlerFunc di
 
 		// Insert into spendings table (assuming manual pay creates a single 'spending')
 		spendingDesc := "Manual Entry" // Or potentially get description from frontend if added later
-		res, err := tx.Exec(`INSERT INTO spendings (amount, description, category, made_by, spending_date)
-		VALUES (?,?,?,?,?)`, payload.Amount, spendingDesc, category_id, userID, spendingDate)
+		res, err := tx.Exec(`INSERT INTO spendings (amount, description, category, made_by, spending_date, original_amount, currency)
+		VALUES (?,?,?,?,?,?,?)`, amount.Amount, spendingDesc, category_id, userID, spendingDate, amount.Original, amount.Currency)
 		if err != nil {
 			slog.Error("inserting spending failed", "url", r.URL, "user_id", userID, "spending_date", spendingDate, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -146,13 +163,25 @@ func HandlePayRoute(db *sql.DB) http.HandlerFunc { // Return http.HandlerFunc di
 		}
 
 		_, err = tx.Exec(`INSERT INTO user_spendings (spending_id, buyer, shared_with, shared_user_takes_all, settled_at)
-		VALUES (?,?,?,?,?)`, spendingID, userID, shared_with_id, false, settledAt)
+		VALUES (?,?,?,?,?)`, spendingID, userID, nil, false, settledAt)
 		if err != nil {
 			slog.Error("inserting user_spending failed", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+		// Record who shares the cost (also fills in user_spendings.shared_with)
+		if err := household.SetShares(tx, spendingID, userID, participants); err != nil {
+			slog.Error("inserting spending shares failed", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := ledger.RecordSpending(tx, spendingID); err != nil {
+			slog.Error("recording spending in the ledger failed", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
 		// Commit the transaction
 		if err = tx.Commit(); err != nil {
 			slog.Error("commiting transaction failed", "url", r.URL, "user_id", userID, "err", err)
@@ -2,11 +2,11 @@ package main_test
 
 import (
 	"database/sql"
-	"math"
 	"net/http"
 	"testing"
 	"time"
 
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/testutil"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
@@ -17,7 +17,7 @@ func TestPay(t *testing.T) {
 	defer env.TearDownDB()
 
 	// Get category IDs needed for verification
-	shoppingCatID := testutil.GetCategoryID(t, env.DB, "Shopping")
+	shoppingCatID := testutil.GetCategoryID(t, env.DB, "Shopping (general)")
 	eatingOutCatID := testutil.GetCategoryID(t, env.DB, "Eating Out")
 	_ = testutil.GetCategoryID(t, env.DB, "Groceries")
 
@@ -33,8 +33,8 @@ func TestPay(t *testing.T) {
 			name: "SuccessAloneNotPreSettled",
 			payload: types.PayPayload{ // Use types.PayPayload
 				SharedStatus: "alone",
-				Amount:       42.50,
-				Category:     "Shopping",
+				Amount:       4250,
+				Category:     "Shopping (general)",
 				PreSettled:   false,
 			},
 			expectedStatus: http.StatusCreated,
@@ -60,14 +60,14 @@ func TestPay(t *testing.T) {
 					t.Errorf("Expected settled_at NULL, got %v", settledAt.Time)
 				}
 				// Verify spending details
-				var sAmount float64
+				var sAmount money.Amount
 				var sCatID int64
 				err = env.DB.QueryRow("SELECT amount, category FROM spendings WHERE id = ?", spendingID).Scan(&sAmount, &sCatID)
 				if err != nil {
 					t.Fatalf("Verification spending query failed: %v", err)
 				}
-				if math.Abs(sAmount-42.50) > 0.001 {
-					t.Errorf("Expected amount 42.50, got %f", sAmount)
+				if sAmount != 4250 {
+					t.Errorf("Expected amount 42.50, got %s", sAmount)
 				}
 				if sCatID != shoppingCatID {
 					t.Errorf("Expected category ID %d (Shopping), got %d", shoppingCatID, sCatID)
@@ -78,7 +78,7 @@ func TestPay(t *testing.T) {
 			name: "SuccessSharedPreSettled",
 			payload: types.PayPayload{ // Use types.PayPayload
 				SharedStatus: "shared",
-				Amount:       100.00,
+				Amount:       10000,
 				Category:     "Eating Out",
 				PreSettled:   true, // Mark as pre-settled
 			},
@@ -110,14 +110,14 @@ func TestPay(t *testing.T) {
 					}
 				}
 				// Verify spending details
-				var sAmount float64
+				var sAmount money.Amount
 				var sCatID int64
 				err = env.DB.QueryRow("SELECT amount, category FROM spendings WHERE id = ?", spendingID).Scan(&sAmount, &sCatID)
 				if err != nil {
 					t.Fatalf("Verification spending query failed: %v", err)
 				}
-				if math.Abs(sAmount-100.00) > 0.001 {
-					t.Errorf("Expected amount 100.00, got %f", sAmount)
+				if sAmount != 10000 {
+					t.Errorf("Expected amount 100.00, got %s", sAmount)
 				}
 				if sCatID != eatingOutCatID {
 					t.Errorf("Expected category ID %d (Eating Out), got %d", eatingOutCatID, sCatID)
@@ -128,7 +128,7 @@ func TestPay(t *testing.T) {
 			name: "ErrorInvalidStatus",
 			payload: types.PayPayload{ // Use types.PayPayload
 				SharedStatus: "mixed", // Invalid status
-				Amount:       10.0,
+				Amount:       1000,
 				Category:     "Groceries",
 				PreSettled:   false,
 			},
@@ -150,7 +150,7 @@ func TestPay(t *testing.T) {
 			name: "ErrorInvalidAmountNegative",
 			payload: types.PayPayload{ // Use types.PayPayload
 				SharedStatus: "alone",
-				Amount:       -10.5,
+				Amount:       -1050,
 				Category:     "Groceries",
 				PreSettled:   false,
 			},
@@ -161,7 +161,7 @@ func TestPay(t *testing.T) {
 			name: "ErrorInvalidCategory",
 			payload: types.PayPayload{ // Use types.PayPayload
 				SharedStatus: "alone",
-				Amount:       20.0,
+				Amount:       2000,
 				Category:     "NonExistent",
 				PreSettled:   false,
 			},
@@ -172,7 +172,7 @@ func TestPay(t *testing.T) {
 			name: "ErrorMissingCategory", // Test missing category name in payload
 			payload: types.PayPayload{ // Use types.PayPayload
 				SharedStatus: "alone",
-				Amount:       25.0,
+				Amount:       2500,
 				Category:     "", // Empty category name
 				PreSettled:   false,
 			},
@@ -203,7 +203,7 @@ func TestPay(t *testing.T) {
 	// --- Test Case: Unauthorized ---
 	t.Run("Unauthorized", func(t *testing.T) {
 		url := "/v1/pay"
-		payload := types.PayPayload{SharedStatus: "alone", Amount: 50, Category: "Shopping", PreSettled: false} // Use types.PayPayload
+		payload := types.PayPayload{SharedStatus: "alone", Amount: 5000, Category: "Shopping (general)", PreSettled: false} // Use types.PayPayload
 		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, url, "invalid-token", payload)
 		rr := testutil.ExecuteRequest(t, env.Handler, req)
 		testutil.AssertStatusCode(t, rr, http.StatusUnauthorized)
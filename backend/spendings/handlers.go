@@ -3,17 +3,20 @@ package spendings
 import (
 	"database/sql"
 	"encoding/json"
-	"log/slog"
-	"net/http"
-	"time"
-
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/category"
 	"git.sr.ht/~relay/sapp-backend/history"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
@@ -33,19 +36,24 @@ type FrontendHistoryListItem struct {
 	// Fields from TransactionGroup (omitempty if not applicable)
 	JobID               *int64               `json:"job_id,omitempty"`
 	Prompt              *string              `json:"prompt,omitempty"`
-	TotalAmount         *float64             `json:"total_amount,omitempty"` // Use pointer for optional field
+	TotalAmount         *money.Amount        `json:"total_amount,omitempty"` // Use pointer for optional field
 	BuyerName           *string              `json:"buyer_name,omitempty"`
 	IsAmbiguityFlagged  *bool                `json:"is_ambiguity_flagged,omitempty"`
 	AmbiguityFlagReason *string              `json:"ambiguity_flag_reason,omitempty"`
 	Spendings           []types.SpendingItem `json:"spendings,omitempty"` // Use types.SpendingItem
 
 	// Fields from DepositItem (omitempty if not applicable)
-	ID               *int64     `json:"id,omitempty"`     // Deposit ID (original template ID)
-	Amount           *float64   `json:"amount,omitempty"` // Use pointer for optional field
-	Description      *string    `json:"description,omitempty"`
-	IsRecurring      *bool      `json:"is_recurring,omitempty"`
-	RecurrencePeriod *string    `json:"recurrence_period,omitempty"`
-	CreatedAt        *time.Time `json:"created_at,omitempty"` // Deposit template creation time
+	ID               *int64        `json:"id,omitempty"`     // Deposit ID (original template ID)
+	Amount           *money.Amount `json:"amount,omitempty"` // Use pointer for optional field
+	Description      *string       `json:"description,omitempty"`
+	IsRecurring      *bool         `json:"is_recurring,omitempty"`
+	RecurrencePeriod *string       `json:"recurrence_period,omitempty"`
+	CreatedAt        *time.Time    `json:"created_at,omitempty"`      // Deposit template creation time
+	OriginalAmount   *money.Amount `json:"original_amount,omitempty"` // Deposit amount as entered, if in another currency
+
+	// Common to both: ISO 4217 code of the amounts as entered, if not the household's currency.
+	// For a spending group TotalAmount is in it.
+	Currency *string `json:"currency,omitempty"`
 }
 
 // HistoryResponse defines the structure for the combined history endpoint response.
@@ -96,6 +104,7 @@ func HandleGetHistory(db *sql.DB) http.HandlerFunc {
 				frontendItem.IsAmbiguityFlagged = &typedItem.IsAmbiguityFlagged
 				frontendItem.AmbiguityFlagReason = typedItem.AmbiguityFlagReason // Already a pointer
 				frontendItem.Spendings = typedItem.Spendings
+				frontendItem.Currency = typedItem.Currency
 			case types.DepositItem:
 				// Populate fields specific to DepositItem
 				// Note: frontendItem.Date is already set from internalItem.Date which uses DepositDate
@@ -105,6 +114,8 @@ func HandleGetHistory(db *sql.DB) http.HandlerFunc {
 				frontendItem.IsRecurring = &typedItem.IsRecurring
 				frontendItem.RecurrencePeriod = typedItem.RecurrencePeriod // Already a pointer
 				frontendItem.CreatedAt = &typedItem.CreatedAt
+				frontendItem.OriginalAmount = typedItem.OriginalAmount
+				frontendItem.Currency = typedItem.Currency
 			default:
 				slog.Warn("Unknown item type encountered in history list during conversion", "type", internalItem.Type)
 				continue // Skip unknown types
@@ -122,7 +133,8 @@ func HandleGetHistory(db *sql.DB) http.HandlerFunc {
 }
 
 // HandleDeleteAIJob handles the deletion of an AI categorization job and its associated spendings.
-func HandleDeleteAIJob(db *sql.DB) http.HandlerFunc {
+// The job's receipt photo is removed once the deletion is committed.
+func HandleDeleteAIJob(db *sql.DB, pool category.CategorizingPoolStrategy) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := auth.GetUserIDFromContext(r.Context())
 		if !ok {
@@ -151,7 +163,8 @@ func HandleDeleteAIJob(db *sql.DB) http.HandlerFunc {
 
 		// 3. Verify Ownership: Check if the user is the buyer of this job
 		var buyerID int64
-		err = tx.QueryRow("SELECT buyer FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&buyerID)
+		var receipt sql.NullString
+		err = tx.QueryRow("SELECT buyer, receipt_sha256 FROM ai_categorization_jobs WHERE id = ?", jobID).Scan(&buyerID, &receipt)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				slog.Warn("delete AI job attempt on non-existent job", "url", r.URL, "user_id", userID, "job_id", jobID)
@@ -203,6 +216,15 @@ func HandleDeleteAIJob(db *sql.DB) http.HandlerFunc {
 			}
 			inClause := strings.Join(placeholders, ",")
 
+			// Delete their attachments; the files are removed by the attachment store's sweep
+			attachmentsQuery := fmt.Sprintf("DELETE FROM attachments WHERE spending_id IN (%s)", inClause)
+			_, err = tx.Exec(attachmentsQuery, args...)
+			if err != nil {
+				slog.Error("failed to delete from attachments during job deletion", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
 			// Delete from user_spendings
 			userSpendingsQuery := fmt.Sprintf("DELETE FROM user_spendings WHERE spending_id IN (%s)", inClause)
 			_, err = tx.Exec(userSpendingsQuery, args...)
@@ -212,6 +234,15 @@ func HandleDeleteAIJob(db *sql.DB) http.HandlerFunc {
 				return
 			}
 
+			// Delete from spending_shares
+			sharesQuery := fmt.Sprintf("DELETE FROM spending_shares WHERE spending_id IN (%s)", inClause)
+			_, err = tx.Exec(sharesQuery, args...)
+			if err != nil {
+				slog.Error("failed to delete from spending_shares during job deletion", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
 			// Delete from spendings
 			spendingsQuery := fmt.Sprintf("DELETE FROM spendings WHERE id IN (%s)", inClause)
 			_, err = tx.Exec(spendingsQuery, args...)
@@ -220,10 +251,27 @@ func HandleDeleteAIJob(db *sql.DB) http.HandlerFunc {
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
+
+			// Delete their ledger entries
+			if err := ledger.Prune(tx); err != nil {
+				slog.Error("failed to delete ledger entries during job deletion", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
 			// Note: ai_categorized_spendings will be deleted by cascade when the job is deleted.
 		}
 
-		// 6. Delete the job itself
+		// 6. Delete the job itself, its recorded attempts and attachments kept while recategorizing
+		if _, err = tx.Exec("DELETE FROM attachments WHERE job_id = ?", jobID); err != nil {
+			slog.Error("failed to delete from attachments", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if _, err = tx.Exec("DELETE FROM ai_job_attempts WHERE job_id = ?", jobID); err != nil {
+			slog.Error("failed to delete from ai_job_attempts", "url", r.URL, "user_id", userID, "job_id", jobID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 		_, err = tx.Exec("DELETE FROM ai_categorization_jobs WHERE id = ?", jobID)
 		if err != nil {
 			// This shouldn't fail if the ownership check passed, but handle defensively
@@ -238,6 +286,9 @@ func HandleDeleteAIJob(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		if receipt.Valid {
+			pool.RemoveReceipts([]string{receipt.String})
+		}
 
 		slog.Info("AI job and associated spendings deleted successfully", "url", r.URL, "user_id", userID, "job_id", jobID)
 		w.WriteHeader(http.StatusNoContent) // Send 204 No Content on success
@@ -335,42 +386,35 @@ func HandleUpdateSpending(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// 7. Determine new user_spendings values based on SharingStatus
-		var sharedWithID *int64 = nil
-		var sharedUserTakesAll bool = false
-		var partnerID int64
-		partnerExists := false
+		// 7. Determine who bears the cost based on SharingStatus
+		var participants []int64 // Empty means the buyer pays alone
 
 		// Use constants from types package
 		if payload.SharingStatus == types.StatusShared || payload.SharingStatus == types.StatusPaidByPartner {
-			// Need partner ID for these statuses
-			// Use the new GetPartnerUserID which queries the DB
-			fetchedPartnerID, ok := auth.GetPartnerUserID(tx, userID) // Pass transaction tx
-			if !ok {
-				// Check if the status requires a partner
-				// Use constants from types package
-				if payload.SharingStatus == types.StatusShared || payload.SharingStatus == types.StatusPaidByPartner {
-					// GetPartnerUserID logs errors
-					slog.Warn("attempted to set sharing status requiring partner, but no partner configured", "url", r.URL, "user_id", userID, "spending_id", spendingID, "status", payload.SharingStatus)
-					http.Error(w, "Cannot set status to 'Shared' or 'Paid by Partner': No partner configured for your user.", http.StatusBadRequest)
-					return
+			// Need the other household members for these statuses
+			others, err := household.ResolveOthers(tx, userID, payload.SharedWith)
+			if err != nil {
+				if errors.Is(err, household.ErrNotMember) {
+					slog.Warn("update spending shared with non-member", "url", r.URL, "user_id", userID, "spending_id", spendingID, "shared_with", payload.SharedWith, "err", err)
+					http.Error(w, "Bad Request: All shared_with users must be members of your household", http.StatusBadRequest)
+				} else {
+					slog.Error("failed to resolve household members during update spending", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
 				}
-				// If status is 'Alone', it's fine that no partner exists.
-			} else {
-				partnerID = fetchedPartnerID
-				partnerExists = true // Assume partner exists if GetPartnerUserID returns one
-				// Optional: Verify partner exists in DB? For simplicity, we trust GetPartnerUserID for now.
+				return
+			}
+			if len(others) == 0 {
+				slog.Warn("attempted to set sharing status requiring partner, but no partner configured", "url", r.URL, "user_id", userID, "spending_id", spendingID, "status", payload.SharingStatus)
+				http.Error(w, "Cannot set status to 'Shared' or 'Paid by Partner': No partner configured for your user.", http.StatusBadRequest)
+				return
 			}
 
-			if partnerExists {
-				sharedWithID = &partnerID
-				// Use constant from types package
-				if payload.SharingStatus == types.StatusPaidByPartner {
-					sharedUserTakesAll = true
-				}
+			participants = others
+			if payload.SharingStatus == types.StatusShared {
+				participants = append([]int64{userID}, others...)
 			}
 		}
-		// If payload.SharingStatus is types.StatusAlone, sharedWithID remains nil and sharedUserTakesAll remains false.
+		// If payload.SharingStatus is types.StatusAlone, participants remains empty.
 
 		// 8. Update spendings table
 		_, err = tx.Exec(`UPDATE spendings SET description = ?, category = ? WHERE id = ?`,
@@ -383,12 +427,14 @@ func HandleUpdateSpending(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// 9. Update user_spendings table
-		_, err = tx.Exec(`UPDATE user_spendings SET shared_with = ?, shared_user_takes_all = ? WHERE spending_id = ?`,
-			sharedWithID, sharedUserTakesAll, spendingID)
-		if err != nil {
-			// This update should always find a row because we checked user_spendings in step 5.
-			slog.Error("failed to update user_spendings table", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+		// 9. Replace the spending's shares (also updates the user_spendings sharing columns) and its ledger entries
+		if err := household.SetShares(tx, spendingID, userID, participants); err != nil {
+			slog.Error("failed to update spending shares", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := ledger.RecordSpending(tx, spendingID); err != nil {
+			slog.Error("failed to record updated spending in the ledger", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
@@ -2,7 +2,9 @@ package main_test
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"testing"
 	"time"
@@ -25,6 +27,7 @@ func TestDeleteAIJob(t *testing.T) {
 	jobIDUser := testutil.InsertAIJob(t, env.DB, env.UserID, &env.PartnerID, "User Job", 75.0, "finished", true, false, nil)
 	spending1_1 := testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 50.0, "User Shared", false, &jobIDUser, nil) // Shared with partner
 	spending1_2 := testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 25.0, "User Alone", false, &jobIDUser, nil)             // User alone
+	receiptUser := testutil.AttachReceipt(t, env.DB, env.Attachments, jobIDUser)
 
 	// Job 2 (Partner's job - for forbidden test, shared with User)
 	jobIDPartner := testutil.InsertAIJob(t, env.DB, env.PartnerID, &env.UserID, "Partner Job", 100.0, "finished", true, false, nil)
@@ -55,6 +58,11 @@ func TestDeleteAIJob(t *testing.T) {
 		if jobCount != 0 || spendingCount != 0 || userSpendingCount != 0 {
 			t.Errorf("Post-delete check failed: job=%d, spendings=%d, user_spendings=%d", jobCount, spendingCount, userSpendingCount)
 		}
+
+		// The receipt photo goes with the job
+		if _, err := env.Attachments.Open(receiptUser); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected the job's receipt to be removed, got %v", err)
+		}
 	})
 
 	// --- Test Case: Not Found ---
@@ -175,7 +183,7 @@ func TestGetHistory(t *testing.T) {
 	// Set start date 35 days ago to ensure the next monthly occurrence (approx T-5d) is before 'now'
 	deposit2Date := time.Now().AddDate(0, 0, -35)
 	deposit2ID := testutil.InsertDeposit(t, env.DB, env.UserID, 50.0, "Pocket Money", deposit2Date, true, testutil.Ptr("monthly")) // Use testutil.Ptr
-	_, err = env.DB.Exec("UPDATE deposits SET created_at = ? WHERE id = ?", deposit2Time, deposit2ID) // Update created_at for sorting consistency if needed
+	_, err = env.DB.Exec("UPDATE deposits SET created_at = ? WHERE id = ?", deposit2Time, deposit2ID)                              // Update created_at for sorting consistency if needed
 	if err != nil {
 		t.Fatalf("Failed to update deposit2 time: %v", err)
 	}
@@ -293,7 +301,7 @@ func TestUpdateSpending(t *testing.T) {
 
 	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
 	transportID := testutil.GetCategoryID(t, env.DB, "Transport")
-	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping")
+	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping (general)")
 
 	// --- Setup Data ---
 	// Spending 1: Initially shared groceries (User paid, shared with Partner)
@@ -375,7 +383,7 @@ func TestUpdateSpending(t *testing.T) {
 			spendingID: spendingIDShared, // Use the initially shared one
 			payload: types.UpdateSpendingPayload{ // Use types.UpdateSpendingPayload
 				Description:   "Updated to PaidByPartner",
-				CategoryName:  "Shopping",
+				CategoryName:  "Shopping (general)",
 				SharingStatus: types.StatusPaidByPartner, // Use types constant
 			},
 			expectedStatus: http.StatusOK,
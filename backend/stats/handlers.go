@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
-	"math"
 	"net/http"
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
@@ -63,87 +64,83 @@ func HandleGetSpendingStats(db *sql.DB) http.HandlerFunc {
 		// Adjust endDate to the end of the day to include all spendings on that day
 		endDateEndOfDay := time.Date(endDate.Year(), endDate.Month(), endDate.Day(), 23, 59, 59, 999999999, time.UTC)
 
-		// Query to sum spending amounts per category for the user within the specified date range.
-		// This query considers the user's share of the cost based on user_spendings.
-		// - If buyer=userID and shared_with is NULL -> user pays full amount.
-		// - If buyer=userID and shared_with=partnerID and shared_user_takes_all=false -> user pays half.
-		// - If buyer=userID and shared_with=partnerID and shared_user_takes_all=true -> user pays zero (partner pays all).
-		// - If buyer=partnerID and shared_with=userID and shared_user_takes_all=false -> user pays half.
-		// - If buyer=partnerID and shared_with=userID and shared_user_takes_all=true -> user pays full amount.
-		query := `
-            SELECT
-                c.name AS category_name,
-                SUM(
-                    CASE
-                        -- User paid, not shared
-                        WHEN us.buyer = ? AND us.shared_with IS NULL THEN s.amount
-                        -- User paid, shared 50/50
-                        WHEN us.buyer = ? AND us.shared_with IS NOT NULL AND us.shared_user_takes_all = 0 THEN s.amount / 2.0
-                        -- User paid, partner pays all
-                        WHEN us.buyer = ? AND us.shared_with IS NOT NULL AND us.shared_user_takes_all = 1 THEN 0.0
-                        -- Partner paid, shared 50/50
-                        WHEN us.buyer != ? AND us.shared_with = ? AND us.shared_user_takes_all = 0 THEN s.amount / 2.0
-                        -- Partner paid, user pays all
-                        WHEN us.buyer != ? AND us.shared_with = ? AND us.shared_user_takes_all = 1 THEN s.amount
-                        ELSE 0.0 -- Should not happen with current logic, but default to 0
-                    END
-                ) AS total_amount
-            FROM spendings s
-            JOIN categories c ON s.category = c.id
-            JOIN user_spendings us ON s.id = us.spending_id
-            WHERE
-                s.spending_date >= ? AND s.spending_date <= ? -- Use date range
-                AND (us.buyer = ? OR us.shared_with = ?) -- Include spendings where user is buyer OR shared_with
-            GROUP BY c.name
-            HAVING total_amount > 0.001 -- Only include categories with spending (use tolerance)
-            ORDER BY total_amount DESC;
-        `
-
-		rows, err := db.Query(query,
-			userID, userID, userID, // Conditions for when user is the buyer
-			userID, userID, // Conditions for when user is shared_with
-			userID, userID, // Conditions for when user is shared_with (paid by partner)
-			startDate.Format(time.RFC3339),       // Start date condition
-			endDateEndOfDay.Format(time.RFC3339), // End date condition (end of day)
-			userID, userID,                       // Filter condition for relevant user_spendings rows
-		)
-
+		stats, err := querySpendingStats(db, userID, startDate, endDateEndOfDay)
 		if err != nil {
 			slog.Error("failed to query spending stats", "url", r.URL, "user_id", userID, "startDate", startDate, "endDate", endDate, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
 
-		stats := []types.CategorySpendingStat{} // Use types.CategorySpendingStat
-		for rows.Next() {
-			var stat types.CategorySpendingStat // Use types.CategorySpendingStat
-			if err := rows.Scan(&stat.CategoryName, &stat.TotalAmount); err != nil {
-				slog.Error("failed to scan spending stat row", "url", r.URL, "user_id", userID, "err", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			// Round to 2 decimal places before appending
-			stat.TotalAmount = math.Round(stat.TotalAmount*100) / 100
-			stats = append(stats, stat)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			slog.Error("failed to encode spending stats to JSON", "url", r.URL, "user_id", userID, "startDate", startDate, "endDate", endDate, "err", err)
 		}
+	}
+}
 
-		if err := rows.Err(); err != nil {
-			slog.Error("error iterating spending stat rows", "url", r.URL, "user_id", userID, "startDate", startDate, "endDate", endDate, "err", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+// HandleGetLastMonthSpendingStats returns spending totals per category for the last 30 days,
+// up to now.
+func HandleGetLastMonthSpendingStats(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.GetUserIDFromContext(r.Context())
+		if !ok {
+			slog.Error("failed to get user ID from context for last month stats", "url", r.URL)
+			http.Error(w, "Authentication error", http.StatusInternalServerError)
 			return
 		}
 
-		// Return empty array instead of null if no stats found
-		if stats == nil {
-			stats = []types.CategorySpendingStat{}
+		now := time.Now().UTC()
+		stats, err := querySpendingStats(db, userID, now.AddDate(0, 0, -30), now)
+		if err != nil {
+			slog.Error("failed to query last month spending stats", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(stats); err != nil {
-			slog.Error("failed to encode spending stats to JSON", "url", r.URL, "user_id", userID, "startDate", startDate, "endDate", endDate, "err", err)
+			slog.Error("failed to encode last month spending stats to JSON", "url", r.URL, "user_id", userID, "err", err)
+		}
+	}
+}
+
+// querySpendingStats sums the user's shares of the spendings dated from start to end per
+// category, largest total first. The shares are the user's expenses postings in the ledger,
+// split the same way as the balances:
+// - If the spending has no shares -> the buyer pays the full amount.
+// - If the user is one of the N users sharing the spending -> user pays amount / N.
+// - Otherwise (e.g. user paid, but others take all) -> user pays zero.
+func querySpendingStats(db *sql.DB, userID int64, start, end time.Time) ([]types.CategorySpendingStat, error) {
+	rows, err := db.Query(`
+        SELECT c.name AS category_name, SUM(p.amount) AS total
+        FROM ledger_postings p
+        JOIN ledger_entries e ON e.id = p.entry_id
+        JOIN spendings s ON s.id = e.spending_id
+        JOIN categories c ON s.category = c.id
+        WHERE
+            p.user_id = ? AND p.account = ? AND e.kind = ?
+            AND s.spending_date >= ? AND s.spending_date <= ?
+        GROUP BY c.name
+        HAVING SUM(p.amount) > 0 -- Only include categories with spending
+        ORDER BY total DESC, c.name
+    `, userID, ledger.AccountExpenses, ledger.KindSpending, start.Format(time.RFC3339), end.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []types.CategorySpendingStat{} // Empty array instead of null if no stats found
+	for rows.Next() {
+		var stat types.CategorySpendingStat
+		if err := rows.Scan(&stat.CategoryName, &stat.TotalAmount); err != nil {
+			return nil, fmt.Errorf("failed to scan spending stat row: %w", err)
 		}
+		stats = append(stats, stat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating spending stat rows: %w", err)
 	}
+	return stats, nil
 }
 
 // --- Deposit Stats Helpers (Adapted from history service) ---
@@ -289,7 +286,7 @@ func HandleGetDepositStats(db *sql.DB) http.HandlerFunc {
 		}
 
 		// 2. Calculate total amount from relevant occurrences
-		totalAmount := 0.0
+		var totalAmount money.Amount
 		depositCount := 0
 		for _, template := range templates {
 			if template.IsRecurring && template.RecurrencePeriod != nil {
@@ -309,9 +306,6 @@ func HandleGetDepositStats(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
-		// Round final amount
-		totalAmount = math.Round(totalAmount*100) / 100
-
 		// 3. Prepare and send response
 		resp := types.DepositStatsResponse{
 			TotalAmount: totalAmount,
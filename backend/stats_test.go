@@ -1,13 +1,13 @@
 package main_test
 
 import (
-	"math"
 	"net/http"
 	"testing"
 	"time"
 
 	"fmt"
 
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/testutil"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
@@ -19,28 +19,34 @@ func TestGetSpendingStats(t *testing.T) {
 
 	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
 	transportID := testutil.GetCategoryID(t, env.DB, "Transport")
-	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping")
+	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping (general)")
 
 	now := time.Now().UTC()
 	within30Days := now.AddDate(0, 0, -15)
 	outside30Days := now.AddDate(0, 0, -45)
 
+	// InsertSpending dates spendings today, so move each to its date afterwards
+	insertDated := func(buyerID int64, sharedWithID *int64, categoryID int64, amount float64, description string, sharedUserTakesAll bool, date time.Time) {
+		spendingID := testutil.InsertSpending(t, env.DB, buyerID, sharedWithID, categoryID, amount, description, sharedUserTakesAll, nil, nil)
+		testutil.SetSpendingDate(t, env.DB, spendingID, date)
+	}
+
 	// --- Setup Data ---
 	// User Spendings (within 30 days)
 	// 1. User paid 50, shared 50/50 -> User cost: 25 (Groceries)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 50.0, "Shared Groceries", false, nil, &within30Days)
+	insertDated(env.UserID, &env.PartnerID, groceriesID, 50.0, "Shared Groceries", false, within30Days)
 	// 2. User paid 30, alone -> User cost: 30 (Transport)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 30.0, "Alone Transport", false, nil, &within30Days)
+	insertDated(env.UserID, nil, transportID, 30.0, "Alone Transport", false, within30Days)
 	// 3. User paid 40, partner takes all -> User cost: 0 (Shopping) - Should not appear in results
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, shoppingID, 40.0, "Gift for Partner", true, nil, &within30Days)
+	insertDated(env.UserID, &env.PartnerID, shoppingID, 40.0, "Gift for Partner", true, within30Days)
 	// 4. Partner paid 100, shared 50/50 -> User cost: 50 (Groceries)
-	_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, groceriesID, 100.0, "Partner Shared Groceries", false, nil, &within30Days)
+	insertDated(env.PartnerID, &env.UserID, groceriesID, 100.0, "Partner Shared Groceries", false, within30Days)
 	// 5. Partner paid 20, user takes all -> User cost: 20 (Transport)
-	_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, transportID, 20.0, "Gift for User", true, nil, &within30Days)
+	insertDated(env.PartnerID, &env.UserID, transportID, 20.0, "Gift for User", true, within30Days)
 
 	// User Spendings (outside 30 days - should be ignored)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 200.0, "Old Shared Groceries", false, nil, &outside30Days)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 50.0, "Old Alone Transport", false, nil, &outside30Days)
+	insertDated(env.UserID, &env.PartnerID, groceriesID, 200.0, "Old Shared Groceries", false, outside30Days)
+	insertDated(env.UserID, nil, transportID, 50.0, "Old Alone Transport", false, outside30Days)
 
 	// Expected Totals (within 15 days ago to now):
 	// Groceries: 25 (from #1) + 50 (from #4) = 75
@@ -72,12 +78,38 @@ func TestGetSpendingStats(t *testing.T) {
 			t.Errorf("Expected second category to be 'Transport', got '%s'", resp[1].CategoryName)
 		}
 
-		// Check amounts (use tolerance)
-		if math.Abs(resp[0].TotalAmount-75.0) > 0.001 {
-			t.Errorf("Expected Groceries total 75.0, got %f", resp[0].TotalAmount)
+		// Check amounts
+		if resp[0].TotalAmount != 7500 {
+			t.Errorf("Expected Groceries total 75.00, got %s", resp[0].TotalAmount)
+		}
+		if resp[1].TotalAmount != 5000 {
+			t.Errorf("Expected Transport total 50.00, got %s", resp[1].TotalAmount)
+		}
+	})
+
+	// --- Test Case: Odd Amounts ---
+	t.Run("OddAmounts", func(t *testing.T) {
+		// Shares of 1.01 are 0.51 for the buyer and 0.50 for the other: the user bears 0.51 + 0.50
+		eatingOutID := testutil.GetCategoryID(t, env.DB, "Eating Out")
+		insertDated(env.UserID, &env.PartnerID, eatingOutID, 1.01, "Shared Coffee", false, within30Days)
+		insertDated(env.PartnerID, &env.UserID, eatingOutID, 1.01, "Partner Shared Coffee", false, within30Days)
+
+		startDate := now.AddDate(0, 0, -20).Format("2006-01-02")
+		endDate := now.Format("2006-01-02")
+		url := fmt.Sprintf("/v1/stats/spending?startDate=%s&endDate=%s", startDate, endDate)
+
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, url, env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp []types.CategorySpendingStat
+		testutil.DecodeJSONResponse(t, rr, &resp)
+
+		if len(resp) != 3 || resp[2].CategoryName != "Eating Out" {
+			t.Fatalf("Expected Eating Out as the third category, got %+v", resp)
 		}
-		if math.Abs(resp[1].TotalAmount-50.0) > 0.001 {
-			t.Errorf("Expected Transport total 50.0, got %f", resp[1].TotalAmount)
+		if resp[2].TotalAmount != 101 {
+			t.Errorf("Expected Eating Out total 1.01, got %s", resp[2].TotalAmount)
 		}
 	})
 
@@ -150,6 +182,13 @@ func TestGetDepositStats(t *testing.T) {
 	env := testutil.SetupTestEnvironment(t)
 	defer env.TearDownDB()
 
+	// InsertDeposit leaves recurring deposits open-ended
+	setEndDate := func(depositID int64, endDate time.Time) {
+		if _, err := env.DB.Exec("UPDATE deposits SET end_date = ? WHERE id = ?", endDate.Format(time.RFC3339), depositID); err != nil {
+			t.Fatalf("Failed to set end date of deposit %d: %v", depositID, err)
+		}
+	}
+
 	// --- Setup Data ---
 	// Non-recurring deposits
 	depositDate1 := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC) // In range
@@ -162,12 +201,14 @@ func TestGetDepositStats(t *testing.T) {
 	// Recurring weekly deposit starting before range, ending within range
 	recurDateStart1 := time.Date(2024, 4, 25, 0, 0, 0, 0, time.UTC) // Thu
 	// Occurrences: Apr 25 (out), May 2 (in), May 9 (in), May 16 (in), May 23 (in), May 30 (in)
-	_ = testutil.InsertDeposit(t, env.DB, env.UserID, 50.0, "Weekly Allowance", recurDateStart1, true, testutil.Ptr("weekly")) // Use testutil.Ptr
+	weeklyID := testutil.InsertDeposit(t, env.DB, env.UserID, 50.0, "Weekly Allowance", recurDateStart1, true, testutil.Ptr("weekly")) // Use testutil.Ptr
+	setEndDate(weeklyID, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC))
 
 	// Recurring monthly deposit starting within range, ending after range
 	recurDateStart2 := time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)
 	// Occurrences: May 5 (in)
-	_ = testutil.InsertDeposit(t, env.DB, env.UserID, 200.0, "Monthly Gift", recurDateStart2, true, testutil.Ptr("monthly")) // Use testutil.Ptr
+	monthlyID := testutil.InsertDeposit(t, env.DB, env.UserID, 200.0, "Monthly Gift", recurDateStart2, true, testutil.Ptr("monthly")) // Use testutil.Ptr
+	setEndDate(monthlyID, time.Date(2024, 6, 20, 0, 0, 0, 0, time.UTC))
 
 	// Recurring deposit for partner (should be ignored)
 	_ = testutil.InsertDeposit(t, env.DB, env.PartnerID, 100.0, "Partner Weekly", recurDateStart1, true, testutil.Ptr("weekly")) // Use testutil.Ptr
@@ -192,10 +233,10 @@ func TestGetDepositStats(t *testing.T) {
 		var resp types.DepositStatsResponse // Use types.DepositStatsResponse
 		testutil.DecodeJSONResponse(t, rr, &resp)
 
-		// Check amounts (use tolerance)
-		expectedAmount := 1450.0
-		if math.Abs(resp.TotalAmount-expectedAmount) > 0.001 {
-			t.Errorf("Expected total amount %.2f, got %f", expectedAmount, resp.TotalAmount)
+		// Check amounts
+		expectedAmount := money.Amount(145000)
+		if resp.TotalAmount != expectedAmount {
+			t.Errorf("Expected total amount %s, got %s", expectedAmount, resp.TotalAmount)
 		}
 		expectedCount := 7
 		if resp.Count != expectedCount {
@@ -216,8 +257,8 @@ func TestGetDepositStats(t *testing.T) {
 		var resp types.DepositStatsResponse // Use types.DepositStatsResponse
 		testutil.DecodeJSONResponse(t, rr, &resp)
 
-		if resp.TotalAmount != 0.0 {
-			t.Errorf("Expected total amount 0.0, got %f", resp.TotalAmount)
+		if resp.TotalAmount != 0 {
+			t.Errorf("Expected total amount 0.00, got %s", resp.TotalAmount)
 		}
 		if resp.Count != 0 {
 			t.Errorf("Expected count 0, got %d", resp.Count)
@@ -271,28 +312,34 @@ func TestGetLastMonthSpendingStats(t *testing.T) {
 
 	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
 	transportID := testutil.GetCategoryID(t, env.DB, "Transport")
-	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping")
+	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping (general)")
 
 	now := time.Now().UTC()
 	within30Days := now.AddDate(0, 0, -15)
 	outside30Days := now.AddDate(0, 0, -45)
 
+	// InsertSpending dates spendings today, so move each to its date afterwards
+	insertDated := func(buyerID int64, sharedWithID *int64, categoryID int64, amount float64, description string, sharedUserTakesAll bool, date time.Time) {
+		spendingID := testutil.InsertSpending(t, env.DB, buyerID, sharedWithID, categoryID, amount, description, sharedUserTakesAll, nil, nil)
+		testutil.SetSpendingDate(t, env.DB, spendingID, date)
+	}
+
 	// --- Setup Data ---
 	// User Spendings (within 30 days)
 	// 1. User paid 50, shared 50/50 -> User cost: 25 (Groceries)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 50.0, "Shared Groceries", false, nil, &within30Days)
+	insertDated(env.UserID, &env.PartnerID, groceriesID, 50.0, "Shared Groceries", false, within30Days)
 	// 2. User paid 30, alone -> User cost: 30 (Transport)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 30.0, "Alone Transport", false, nil, &within30Days)
+	insertDated(env.UserID, nil, transportID, 30.0, "Alone Transport", false, within30Days)
 	// 3. User paid 40, partner takes all -> User cost: 0 (Shopping) - Should not appear in results
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, shoppingID, 40.0, "Gift for Partner", true, nil, &within30Days)
+	insertDated(env.UserID, &env.PartnerID, shoppingID, 40.0, "Gift for Partner", true, within30Days)
 	// 4. Partner paid 100, shared 50/50 -> User cost: 50 (Groceries)
-	_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, groceriesID, 100.0, "Partner Shared Groceries", false, nil, &within30Days)
+	insertDated(env.PartnerID, &env.UserID, groceriesID, 100.0, "Partner Shared Groceries", false, within30Days)
 	// 5. Partner paid 20, user takes all -> User cost: 20 (Transport)
-	_ = testutil.InsertSpending(t, env.DB, env.PartnerID, &env.UserID, transportID, 20.0, "Gift for User", true, nil, &within30Days)
+	insertDated(env.PartnerID, &env.UserID, transportID, 20.0, "Gift for User", true, within30Days)
 
 	// User Spendings (outside 30 days - should be ignored)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, &env.PartnerID, groceriesID, 200.0, "Old Shared Groceries", false, nil, &outside30Days)
-	_ = testutil.InsertSpending(t, env.DB, env.UserID, nil, transportID, 50.0, "Old Alone Transport", false, nil, &outside30Days)
+	insertDated(env.UserID, &env.PartnerID, groceriesID, 200.0, "Old Shared Groceries", false, outside30Days)
+	insertDated(env.UserID, nil, transportID, 50.0, "Old Alone Transport", false, outside30Days)
 
 	// Expected Totals (within 30 days):
 	// Groceries: 25 (from #1) + 50 (from #4) = 75
@@ -320,12 +367,11 @@ func TestGetLastMonthSpendingStats(t *testing.T) {
 			t.Errorf("Expected second category to be 'Transport', got '%s'", resp[1].CategoryName)
 		}
 
-		// Check amounts (use tolerance)
-		if math.Abs(resp[0].TotalAmount-75.0) > 0.001 {
-			t.Errorf("Expected Groceries total 75.0, got %f", resp[0].TotalAmount)
+		if resp[0].TotalAmount != 7500 {
+			t.Errorf("Expected Groceries total 75.00, got %s", resp[0].TotalAmount)
 		}
-		if math.Abs(resp[1].TotalAmount-50.0) > 0.001 {
-			t.Errorf("Expected Transport total 50.0, got %f", resp[1].TotalAmount)
+		if resp[1].TotalAmount != 5000 {
+			t.Errorf("Expected Transport total 50.00, got %s", resp[1].TotalAmount)
 		}
 	})
 
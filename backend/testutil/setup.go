@@ -14,56 +14,24 @@ import (
 	"testing"
 	"time"
 
+	"git.sr.ht/~relay/sapp-backend/account"
+	"git.sr.ht/~relay/sapp-backend/attachment"
 	"git.sr.ht/~relay/sapp-backend/auth"
 	"git.sr.ht/~relay/sapp-backend/category"
+	"git.sr.ht/~relay/sapp-backend/currency"
 	"git.sr.ht/~relay/sapp-backend/deposit"
+	"git.sr.ht/~relay/sapp-backend/export"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/pay"
 	"git.sr.ht/~relay/sapp-backend/spendings"
+	"git.sr.ht/~relay/sapp-backend/stats"
 	"git.sr.ht/~relay/sapp-backend/transfer"
 	"github.com/rs/cors"
 	_ "modernc.org/sqlite"
 )
 
-// MockModelAPI provides a mock implementation of the category.ModelAPI interface.
-type MockModelAPI struct {
-	// You can add fields here to control the mock's behavior, e.g., predefined responses.
-	Response *category.ModelAPIResponse
-	Error    error
-	// Optional: Add a function to dynamically determine response based on prompt
-	PromptFunc func(prompt string) (*category.ModelAPIResponse, error)
-}
-
-// Prompt implements the category.ModelAPI interface for the mock.
-func (m *MockModelAPI) Prompt(prompt string) (*category.ModelAPIResponse, error) {
-	slog.Debug("MockModelAPI: Prompt called", "prompt_substring", prompt[:min(100, len(prompt))]) // Log subset of prompt
-
-	// Use dynamic function if provided
-	if m.PromptFunc != nil {
-		return m.PromptFunc(prompt)
-	}
-
-	// Otherwise, use predefined response/error
-	if m.Error != nil {
-		slog.Warn("MockModelAPI: Returning predefined error", "error", m.Error)
-		return nil, m.Error
-	}
-	if m.Response != nil {
-		slog.Info("MockModelAPI: Returning predefined response")
-		return m.Response, nil
-	}
-	// Default response if nothing is set
-	slog.Warn("MockModelAPI: Returning default empty response (no predefined response, error, or function set)")
-	return &category.ModelAPIResponse{
-		Choices: []category.Choice{
-			{
-				Message: category.Message{
-					Content: `{"ambiguity_flag": "mock default response", "spendings":[]}`, // Default valid JSON
-				},
-			},
-		},
-	}, nil
-}
-
 // Helper function to apply middleware (copied from sapp/main.go)
 func applyMiddleware(h http.Handler, middleware ...func(http.Handler) http.Handler) http.Handler {
 	for i := len(middleware) - 1; i >= 0; i-- {
@@ -122,18 +90,19 @@ func runMigrations(db *sql.DB, schemaPath string) error {
 type TestEnv struct {
 	DB          *sql.DB
 	Handler     http.Handler
-	MockAPI     *MockModelAPI // Expose mock API for test-specific configuration
-	AuthToken   string        // Store the auth token (user ID string) for User 1
-	UserID      int64         // Store the primary test user ID (User 1)
-	User1Name   string        // Store User 1's first name
-	PartnerID   int64         // Store the partner user ID (User 2)
-	PartnerName string        // Store User 2's first name
-	TearDownDB  func()        // Function to close the DB connection
+	FakeAPI     *category.FakeModelAPI // Script model answers and failures per test, see category.FakeReply
+	Attachments *attachment.Store      // Store of attached files and receipt photos, in a temporary directory
+	AuthToken   string                 // Store the auth token (user ID string) for User 1
+	UserID      int64                  // Store the primary test user ID (User 1)
+	User1Name   string                 // Store User 1's first name
+	PartnerID   int64                  // Store the partner user ID (User 2)
+	PartnerName string                 // Store User 2's first name
+	TearDownDB  func()                 // Function to close the DB connection
 }
 
 // SetupTestEnvironment initializes an in-memory DB, runs migrations,
 // creates two partnered users (User 1 and User 2),
-// sets up handlers with a mock API, and returns the handler and DB connection.
+// sets up handlers with a fake model API, and returns the handler and DB connection.
 func SetupTestEnvironment(t *testing.T) *TestEnv {
 	t.Helper() // Mark this as a test helper function
 
@@ -182,32 +151,33 @@ func SetupTestEnvironment(t *testing.T) *TestEnv {
 		t.Fatalf("failed to run database migrations: %v", err)
 	}
 
-	// --- Setup Mock AI API ---
-	slog.Debug("Setting up Mock Model API")
-	mockAPI := &MockModelAPI{
-		// Default mock response can be overridden in specific tests
-		Response: &category.ModelAPIResponse{
-			Choices: []category.Choice{
-				{
-					Message: category.Message{
-						Content: `{
-							"ambiguity_flag": "",
-							"spendings": [
-								{"apportion_mode": "shared", "category": "Groceries", "amount": 50.0, "description": "Milk & Bread"},
-								{"apportion_mode": "alone", "category": "Entertainment", "amount": 25.0, "description": "Cinema Ticket"}
-							]
-						}`,
-					},
-				},
-			},
-		},
-		Error: nil,
-	}
-
-	// --- Initialize AI Categorization Pool with Mock API ---
-	numWorkers := 1 // Use fewer workers for tests unless testing concurrency
-	slog.Debug("Initializing AI categorization pool with mock API", "workers", numWorkers)
-	categorizationPool := category.NewCategorizingPool(db, numWorkers, mockAPI)
+	// --- Setup Fake AI API ---
+	slog.Debug("Setting up fake Model API")
+	// Default answer, tests can script others with FakeAPI.Script
+	fakeAPI := category.NewFakeModelAPI(category.FakeAnswer(`{
+		"ambiguity_flag": "",
+		"spendings": [
+			{"apportion_mode": "shared", "category": "Groceries", "amount": 50.0, "description": "Milk & Bread"},
+			{"apportion_mode": "alone", "category": "Entertainment", "amount": 25.0, "description": "Cinema Ticket"}
+		]
+	}`))
+
+	// --- Initialize AI Categorization Pool with Fake API ---
+	poolConfig := category.DefaultPoolConfig()
+	poolConfig.Workers = 1 // Use fewer workers for tests unless testing concurrency
+	attachmentStore := attachment.NewStore(t.TempDir())
+	poolConfig.Receipts = attachmentStore
+	slog.Debug("Initializing AI categorization pool with fake API", "workers", poolConfig.Workers)
+	// The fake answers for every model of the chain, so tests can switch the default freely
+	modelChain, err := category.NewModelChain(
+		category.ModelBackend{Name: "mock:primary", API: fakeAPI},
+		category.ModelBackend{Name: "mock:fallback", API: fakeAPI},
+	)
+	if err != nil {
+		db.Close()
+		t.Fatalf("failed to create model chain: %v", err)
+	}
+	categorizationPool := category.NewCategorizingPool(db, poolConfig, modelChain)
 	// Do NOT start the pool automatically in tests. Start it manually if a test needs background processing.
 	// go categorizationPool.StartPool()
 
@@ -222,26 +192,104 @@ func SetupTestEnvironment(t *testing.T) *TestEnv {
 	payHandler := http.HandlerFunc(pay.HandlePayRoute(db))
 	getCategoriesHandler := http.HandlerFunc(category.HandleGetCategories(db))
 	// Pass pointer to categorizationPool to satisfy the interface
-	categorizeHandler := http.HandlerFunc(category.HandleAICategorize(db, &categorizationPool)) // Use pool with mock API
-	getHistoryHandler := http.HandlerFunc(spendings.HandleGetHistory(db))                      // Use spendings handler
+	categorizeHandler := http.HandlerFunc(category.HandleAICategorize(db, &categorizationPool)) // Use pool with fake API
+	previewCategorizationHandler := http.HandlerFunc(category.HandlePreviewCategorization(db, &categorizationPool))
+	categorizeBatchHandler := http.HandlerFunc(category.HandleAICategorizeBatch(db, &categorizationPool))
+	getBatchHandler := http.HandlerFunc(category.HandleGetBatch(db))
+	categorizeReceiptHandler := http.HandlerFunc(category.HandleAICategorizeReceipt(db, &categorizationPool))
+	confirmCategorizationHandler := http.HandlerFunc(category.HandleConfirmCategorization(db, &categorizationPool))
+	getHistoryHandler := http.HandlerFunc(spendings.HandleGetHistory(db)) // Use spendings handler
 	updateSpendingHandler := http.HandlerFunc(spendings.HandleUpdateSpending(db))
 	getTransferStatusHandler := http.HandlerFunc(transfer.HandleGetTransferStatus(db))
 	recordTransferHandler := http.HandlerFunc(transfer.HandleRecordTransfer(db))
-	deleteAIJobHandler := http.HandlerFunc(spendings.HandleDeleteAIJob(db))
+	deleteAIJobHandler := http.HandlerFunc(spendings.HandleDeleteAIJob(db, &categorizationPool))
+	getAIJobHandler := http.HandlerFunc(category.HandleGetJob(db))
+	getAIJobAttemptsHandler := http.HandlerFunc(category.HandleGetJobAttempts(db))
+	getAIJobReceiptHandler := http.HandlerFunc(category.HandleGetReceipt(db, &categorizationPool))
+	retryAIJobHandler := http.HandlerFunc(category.HandleRetryJob(db, &categorizationPool))
+	recategorizeAIJobHandler := http.HandlerFunc(category.HandleRecategorizeJob(db, &categorizationPool))
+	recategorizeAIJobsHandler := http.HandlerFunc(category.HandleRecategorizeJobs(db, &categorizationPool))
+	getReviewQueueHandler := http.HandlerFunc(category.HandleGetReviewQueue(db))
+	resolveReviewHandler := http.HandlerFunc(category.HandleResolveReview(db, &categorizationPool))
+	jobEventsHandler := http.HandlerFunc(category.HandleJobEvents(db, &categorizationPool))
 	addDepositHandler := http.HandlerFunc(deposit.HandleAddDeposit(db))
 	getDepositsHandler := http.HandlerFunc(deposit.HandleGetDeposits(db))
+	getSpendingStatsHandler := http.HandlerFunc(stats.HandleGetSpendingStats(db))
+	getLastMonthStatsHandler := http.HandlerFunc(stats.HandleGetLastMonthSpendingStats(db))
+	getDepositStatsHandler := http.HandlerFunc(stats.HandleGetDepositStats(db))
+	exportAllDataHandler := http.HandlerFunc(export.HandleExportAllData(db))
+	exportArchiveHandler := http.HandlerFunc(export.HandleExportArchive(db, attachmentStore))
+	deleteDepositHandler := http.HandlerFunc(deposit.HandleDeleteDeposit(db))
+	addSpendingAttachmentHandler := http.HandlerFunc(attachment.HandleAddSpendingAttachment(db, attachmentStore))
+	getSpendingAttachmentsHandler := http.HandlerFunc(attachment.HandleGetSpendingAttachments(db))
+	addDepositAttachmentHandler := http.HandlerFunc(attachment.HandleAddDepositAttachment(db, attachmentStore))
+	getDepositAttachmentsHandler := http.HandlerFunc(attachment.HandleGetDepositAttachments(db))
+	downloadAttachmentHandler := http.HandlerFunc(attachment.HandleDownloadAttachment(db, attachmentStore))
+	deleteAttachmentHandler := http.HandlerFunc(attachment.HandleDeleteAttachment(db, attachmentStore))
+	getHouseholdHandler := http.HandlerFunc(household.HandleGetHousehold(db))
+	updateHouseholdHandler := http.HandlerFunc(household.HandleUpdateHousehold(db))
+	getProfileHandler := http.HandlerFunc(account.HandleGetProfile(db))
+	updateProfileHandler := http.HandlerFunc(account.HandleUpdateProfile(db))
+	changePasswordHandler := http.HandlerFunc(account.HandleChangePassword(db))
+	deleteAccountHandler := http.HandlerFunc(account.HandleDeleteAccount(db, &categorizationPool))
+	getModelsHandler := http.HandlerFunc(category.HandleGetModels(modelChain))
+	setDefaultModelHandler := http.HandlerFunc(category.HandleSetDefaultModel(db, modelChain))
+	getLLMUsageHandler := http.HandlerFunc(category.HandleGetLLMUsage(db))
+	getLLMQuotaHandler := http.HandlerFunc(category.HandleGetLLMQuota(db))
+	setLLMQuotaHandler := http.HandlerFunc(category.HandleSetLLMQuota(db))
+	getExchangeRatesHandler := http.HandlerFunc(currency.HandleGetRates(db))
+	importExchangeRatesHandler := http.HandlerFunc(currency.HandleImportRates(db))
 
 	// Apply AuthMiddleware to protected handlers
 	mux.Handle("POST /v1/pay", applyMiddleware(payHandler, auth.AuthMiddleware))
 	mux.Handle("GET /v1/categories", applyMiddleware(getCategoriesHandler, auth.AuthMiddleware))
 	mux.Handle("POST /v1/categorize", applyMiddleware(categorizeHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/preview", applyMiddleware(previewCategorizationHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/confirm", applyMiddleware(confirmCategorizationHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/batch", applyMiddleware(categorizeBatchHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/categorize/batch/{batch_id}", applyMiddleware(getBatchHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/categorize/receipt", applyMiddleware(categorizeReceiptHandler, auth.AuthMiddleware))
 	mux.Handle("GET /v1/history", applyMiddleware(getHistoryHandler, auth.AuthMiddleware)) // Updated route
 	mux.Handle("PUT /v1/spendings/{spending_id}", applyMiddleware(updateSpendingHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/spendings/{spending_id}/attachments", applyMiddleware(addSpendingAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/spendings/{spending_id}/attachments", applyMiddleware(getSpendingAttachmentsHandler, auth.AuthMiddleware))
 	mux.Handle("DELETE /v1/jobs/{job_id}", applyMiddleware(deleteAIJobHandler, auth.AuthMiddleware)) // Register delete job route
+	mux.Handle("GET /v1/jobs/{job_id}", applyMiddleware(getAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/{job_id}/attempts", applyMiddleware(getAIJobAttemptsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/{job_id}/receipt", applyMiddleware(getAIJobReceiptHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/jobs/events", applyMiddleware(jobEventsHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/jobs/{job_id}/retry", applyMiddleware(retryAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/jobs/{job_id}/recategorize", applyMiddleware(recategorizeAIJobHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/jobs/recategorize", applyMiddleware(recategorizeAIJobsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/review", applyMiddleware(getReviewQueueHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/review/{job_id}/resolve", applyMiddleware(resolveReviewHandler, auth.AuthMiddleware))
 	mux.Handle("GET /v1/transfer/status", applyMiddleware(getTransferStatusHandler, auth.AuthMiddleware))
 	mux.Handle("POST /v1/transfer/record", applyMiddleware(recordTransferHandler, auth.AuthMiddleware))
 	mux.Handle("POST /v1/deposits", applyMiddleware(addDepositHandler, auth.AuthMiddleware)) // Register add deposit route
 	mux.Handle("GET /v1/deposits", applyMiddleware(getDepositsHandler, auth.AuthMiddleware)) // Register get deposits route
+	mux.Handle("DELETE /v1/deposits/{deposit_id}", applyMiddleware(deleteDepositHandler, auth.AuthMiddleware))
+	mux.Handle("POST /v1/deposits/{deposit_id}/attachments", applyMiddleware(addDepositAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/deposits/{deposit_id}/attachments", applyMiddleware(getDepositAttachmentsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/attachments/{attachment_id}", applyMiddleware(downloadAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("DELETE /v1/attachments/{attachment_id}", applyMiddleware(deleteAttachmentHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/stats/spending", applyMiddleware(getSpendingStatsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/stats/spending/last-month", applyMiddleware(getLastMonthStatsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/stats/deposits", applyMiddleware(getDepositStatsHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/export/all", applyMiddleware(exportAllDataHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/export/archive", applyMiddleware(exportArchiveHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/household", applyMiddleware(getHouseholdHandler, auth.AuthMiddleware))
+	mux.Handle("PUT /v1/household", applyMiddleware(updateHouseholdHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/exchange-rates", applyMiddleware(getExchangeRatesHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/profile", applyMiddleware(getProfileHandler, auth.AuthMiddleware))
+	mux.Handle("PUT /v1/profile", applyMiddleware(updateProfileHandler, auth.AuthMiddleware))
+	mux.Handle("PUT /v1/profile/password", applyMiddleware(changePasswordHandler, auth.AuthMiddleware))
+	mux.Handle("DELETE /v1/account", applyMiddleware(deleteAccountHandler, auth.AuthMiddleware))
+	mux.Handle("GET /v1/admin/models", applyMiddleware(getModelsHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("PUT /v1/admin/models/default", applyMiddleware(setDefaultModelHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("GET /v1/admin/llm-usage", applyMiddleware(getLLMUsageHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("GET /v1/admin/households/{household_id}/llm-quota", applyMiddleware(getLLMQuotaHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("PUT /v1/admin/households/{household_id}/llm-quota", applyMiddleware(setLLMQuotaHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
+	mux.Handle("POST /v1/admin/exchange-rates", applyMiddleware(importExchangeRatesHandler, auth.AuthMiddleware, auth.RequireAdmin(db)))
 
 	// --- Apply Middleware (CORS, Logging) ---
 	corsHandler := cors.New(cors.Options{
@@ -292,7 +340,8 @@ func SetupTestEnvironment(t *testing.T) *TestEnv {
 	return &TestEnv{
 		DB:          db,
 		Handler:     handler,
-		MockAPI:     mockAPI,
+		FakeAPI:     fakeAPI,
+		Attachments: attachmentStore,
 		AuthToken:   userTokenString, // User 1's ID string as token
 		UserID:      userID,          // User 1 ID
 		User1Name:   userName,        // User 1 Name
@@ -302,6 +351,27 @@ func SetupTestEnvironment(t *testing.T) *TestEnv {
 	}
 }
 
+// AddHouseholdMember creates a user and adds them to the test user's household.
+func AddHouseholdMember(t *testing.T, env *TestEnv, username, firstName string) int64 {
+	t.Helper()
+
+	res, err := env.DB.Exec("INSERT INTO users (username, password_hash, first_name) VALUES (?, 'unused', ?)", username, firstName)
+	if err != nil {
+		t.Fatalf("Failed to insert household member user: %v", err)
+	}
+	memberID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("Failed to get last insert ID for household member: %v", err)
+	}
+
+	_, err = env.DB.Exec(`INSERT INTO household_members (household_id, user_id)
+		SELECT household_id, ? FROM household_members WHERE user_id = ?`, memberID, env.UserID)
+	if err != nil {
+		t.Fatalf("Failed to add user %d to household: %v", memberID, err)
+	}
+	return memberID
+}
+
 // Helper function to get category ID by name
 func GetCategoryID(t *testing.T, db *sql.DB, categoryName string) int64 {
 	t.Helper()
@@ -315,6 +385,7 @@ func GetCategoryID(t *testing.T, db *sql.DB, categoryName string) int64 {
 
 // Helper function to insert a spending item for testing
 // partnerID parameter now represents the ID of the user being shared *with*, if any.
+// The amount is in major units (kroner), like the amounts of the API.
 func InsertSpending(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *int64, categoryID int64, amount float64, description string, sharedUserTakesAll bool, jobID *int64, settledAt *time.Time) int64 {
 	t.Helper()
 
@@ -326,7 +397,7 @@ func InsertSpending(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *int64
 
 	// Insert into spendings
 	res, err := tx.Exec(`INSERT INTO spendings (amount, description, category, made_by) VALUES (?, ?, ?, ?)`,
-		amount, description, categoryID, buyerID)
+		money.FromFloat(amount), description, categoryID, buyerID)
 	if err != nil {
 		t.Fatalf("Failed to insert into spendings table: %v", err)
 	}
@@ -342,6 +413,21 @@ func InsertSpending(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *int64
 		t.Fatalf("Failed to insert into user_spendings table: %v", err)
 	}
 
+	// Record who bears the cost, mirroring the two-person columns above
+	var participants []int64
+	if sharedWithID != nil {
+		participants = []int64{*sharedWithID}
+		if !sharedUserTakesAll {
+			participants = append(participants, buyerID)
+		}
+	}
+	if err := household.SetShares(tx, spendingID, buyerID, participants); err != nil {
+		t.Fatalf("Failed to insert spending shares: %v", err)
+	}
+	if err := ledger.RecordSpending(tx, spendingID); err != nil {
+		t.Fatalf("Failed to record spending in the ledger: %v", err)
+	}
+
 	// Optionally link to AI job
 	if jobID != nil {
 		_, err = tx.Exec(`INSERT INTO ai_categorized_spendings (spending_id, job_id) VALUES (?, ?)`,
@@ -358,14 +444,27 @@ func InsertSpending(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *int64
 	return spendingID
 }
 
+// SetSpendingDate moves a spending inserted with InsertSpending to the given date and records it
+// again in the ledger.
+func SetSpendingDate(t *testing.T, db *sql.DB, spendingID int64, date time.Time) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE spendings SET spending_date = ? WHERE id = ?", date, spendingID); err != nil {
+		t.Fatalf("Failed to set date of spending %d: %v", spendingID, err)
+	}
+	if err := ledger.RecordSpending(db, spendingID); err != nil {
+		t.Fatalf("Failed to record spending %d in the ledger: %v", spendingID, err)
+	}
+}
+
 // Helper function to insert an AI job for testing
 // partnerID parameter now represents the ID of the user being shared *with*, if any.
+// The total amount is in major units (kroner).
 func InsertAIJob(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *int64, prompt string, totalAmount float64, status string, isFinished bool, isAmbiguous bool, ambiguityReason *string) int64 {
 	t.Helper()
 	res, err := db.Exec(`INSERT INTO ai_categorization_jobs
 		(buyer, shared_with, prompt, total_amount, status, is_finished, is_ambiguity_flagged, ambiguity_flag_reason, created_at, status_updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		buyerID, sharedWithID, prompt, totalAmount, status, isFinished, isAmbiguous, ambiguityReason, time.Now().UTC(), time.Now().UTC())
+		buyerID, sharedWithID, prompt, money.FromFloat(totalAmount), status, isFinished, isAmbiguous, ambiguityReason, time.Now().UTC(), time.Now().UTC())
 	if err != nil {
 		t.Fatalf("Failed to insert AI job: %v", err)
 	}
@@ -376,12 +475,27 @@ func InsertAIJob(t *testing.T, db *sql.DB, buyerID int64, sharedWithID *int64, p
 	return jobID
 }
 
-// Helper function to insert a deposit item for testing
+// AttachReceipt stores a receipt photo in the store and records it on the AI job, as an upload
+// would. Returns the SHA-256 of the photo; the content differs for every job.
+func AttachReceipt(t *testing.T, db *sql.DB, store *attachment.Store, jobID int64) string {
+	t.Helper()
+	data := []byte(fmt.Sprintf("\x89PNG\r\n\x1a\nreceipt of job %d", jobID))
+	hash, err := store.Put(db, data, func(hash string) error {
+		_, err := db.Exec("UPDATE ai_categorization_jobs SET receipt_sha256 = ?, receipt_media_type = ? WHERE id = ?", hash, "image/png", jobID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to attach receipt to AI job: %v", err)
+	}
+	return hash
+}
+
+// Helper function to insert a deposit item for testing, with the amount in major units (kroner)
 func InsertDeposit(t *testing.T, db *sql.DB, userID int64, amount float64, description string, depositDate time.Time, isRecurring bool, recurrencePeriod *string) int64 {
 	t.Helper()
 	res, err := db.Exec(`INSERT INTO deposits (user_id, amount, description, deposit_date, is_recurring, recurrence_period, created_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		userID, amount, description, depositDate.Format("2006-01-02 15:04:05"), isRecurring, recurrencePeriod, time.Now().UTC())
+		userID, money.FromFloat(amount), description, depositDate.Format("2006-01-02 15:04:05"), isRecurring, recurrencePeriod, time.Now().UTC())
 	if err != nil {
 		t.Fatalf("Failed to insert deposit: %v", err)
 	}
@@ -389,6 +503,9 @@ func InsertDeposit(t *testing.T, db *sql.DB, userID int64, amount float64, descr
 	if err != nil {
 		t.Fatalf("Failed to get last insert ID for deposit: %v", err)
 	}
+	if err := ledger.RecordDeposit(db, depositID); err != nil {
+		t.Fatalf("Failed to record deposit in the ledger: %v", err)
+	}
 	return depositID
 }
 
@@ -3,16 +3,25 @@ package transfer
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
-	"math"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/household"
+	"git.sr.ht/~relay/sapp-backend/ledger"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
 
-// HandleGetTransferStatus calculates and returns the net balance between the user and their partner.
+// HandleGetTransferStatus calculates and returns the balances within the user's household.
+// What the members owe each other is read from the ledger, where every unsettled spending with
+// shares makes each non-buying participant owe the buyer their share. The debts are netted per
+// pair, and each pair's balance is suggested as a transfer between the two: recording a transfer
+// settles only what two members owe each other, so debts are never routed through a third.
 func HandleGetTransferStatus(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := auth.GetUserIDFromContext(r.Context())
@@ -22,116 +31,75 @@ func HandleGetTransferStatus(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Use the new GetPartnerUserID which queries the DB
-		partnerID, partnerOk := auth.GetPartnerUserID(db, userID) // Pass db connection
-		if !partnerOk {
-			// GetPartnerUserID logs errors, just return appropriate response
-			// slog.Warn("no partner configured for user, cannot calculate transfer status", "url", r.URL, "user_id", userID)
-			http.Error(w, "Partner not found or not configured for this user.", http.StatusBadRequest) // More specific error
-			return
-		}
-
-		// Get user and partner names
-		var userName, partnerName string
-		err := db.QueryRow("SELECT first_name FROM users WHERE id = ?", userID).Scan(&userName)
+		members, err := household.GetMembers(db, userID)
 		if err != nil {
-			slog.Error("failed to query user name", "url", r.URL, "user_id", userID, "err", err)
+			slog.Error("failed to query household members for transfer status", "url", r.URL, "user_id", userID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		err = db.QueryRow("SELECT first_name FROM users WHERE id = ?", partnerID).Scan(&partnerName)
-		if err != nil {
-			// Log error but continue, partner might have been deleted?
-			slog.Error("failed to query partner name", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
-			partnerName = "Partner" // Fallback name
-		}
-
-		// Calculate net balance from unsettled items
-		query := `
-            SELECT
-                us.buyer, us.shared_with, us.shared_user_takes_all, s.amount
-            FROM user_spendings us
-            JOIN spendings s ON us.spending_id = s.id
-            WHERE us.settled_at IS NULL
-              AND ( (us.buyer = ? AND us.shared_with = ?) OR (us.buyer = ? AND us.shared_with = ?) )
-        `
-		rows, err := db.Query(query, userID, partnerID, partnerID, userID)
-		if err != nil {
-			slog.Error("failed to query unsettled spendings for transfer status", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		if len(members) < 2 {
+			http.Error(w, "Partner not found or not configured for this user.", http.StatusBadRequest)
 			return
 		}
-		defer rows.Close()
-
-		userNetBalance := 0.0
-		for rows.Next() {
-			var buyer, sharedWith sql.NullInt64 // Use NullInt64 for shared_with
-			var sharedUserTakesAll bool
-			var amount float64
+		householdID, _ := household.GetHouseholdID(db, userID)
 
-			if err := rows.Scan(&buyer, &sharedWith, &sharedUserTakesAll, &amount); err != nil {
-				slog.Error("failed to scan spending row for transfer status", "url", r.URL, "user_id", userID, "err", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-
-			// Ensure buyer is valid before proceeding
-			if !buyer.Valid {
-				slog.Warn("Skipping row with NULL buyer in user_spendings", "url", r.URL, "user_id", userID)
-				continue // Should not happen based on schema constraints
-			}
-
-			if buyer.Int64 == userID {
-				// User paid
-				if sharedWith.Valid && sharedWith.Int64 == partnerID {
-					// Shared with partner
-					if sharedUserTakesAll {
-						userNetBalance += amount // Partner owes full amount
-					} else {
-						userNetBalance += amount / 2.0 // Partner owes half
-					}
-				}
-				// If sharedWith is NULL or not partner, it doesn't affect the balance
-			} else if buyer.Int64 == partnerID {
-				// Partner paid
-				if sharedWith.Valid && sharedWith.Int64 == userID {
-					// Shared with user
-					if sharedUserTakesAll {
-						userNetBalance -= amount // User owes full amount
-					} else {
-						userNetBalance -= amount / 2.0 // User owes half
-					}
-				}
-				// If sharedWith is NULL or not user, it doesn't affect the balance
+		// Map member IDs to first names for the response
+		names := make(map[int64]string, len(members))
+		var otherNames []string
+		for _, m := range members {
+			names[m.UserID] = m.FirstName
+			if m.UserID != userID {
+				otherNames = append(otherNames, m.FirstName)
 			}
 		}
+		userName := names[userID]
+		partnerName := strings.Join(otherNames, ", ") // Single name for two-person households
 
-		if err := rows.Err(); err != nil {
-			slog.Error("error iterating unsettled spending rows", "url", r.URL, "user_id", userID, "err", err)
+		debts, err := fetchUnsettledDebts(db, householdID)
+		if err != nil {
+			slog.Error("failed to query unsettled spendings for transfer status", "url", r.URL, "user_id", userID, "household_id", householdID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 
+		balances := PairwiseBalances(debts)
+		userNetBalance := NetBalances(balances)[userID] // Positive: the others owe the user
+
 		// Determine response fields based on balance
 		resp := types.TransferStatusResponse{ // Use types.TransferStatusResponse
-			PartnerName: partnerName,
-			AmountOwed:  math.Abs(userNetBalance), // Always positive amount
-			OwedBy:      nil,
-			OwedTo:      nil,
+			PartnerName:        partnerName,
+			AmountOwed:         userNetBalance.Abs(), // Always positive amount
+			OwedBy:             nil,
+			OwedTo:             nil,
+			Balances:           []types.PairwiseBalance{},
+			SuggestedTransfers: []types.SuggestedTransfer{},
 		}
 
-		// Use a small tolerance for floating point comparison
-		tolerance := 0.001 // Less than a cent
-
-		if userNetBalance > tolerance { // Partner owes user
+		if userNetBalance > 0 { // Partner(s) owe user
 			resp.OwedBy = &partnerName
 			resp.OwedTo = &userName
-		} else if userNetBalance < -tolerance { // User owes partner
+		} else if userNetBalance < 0 { // User owes partner(s)
 			resp.OwedBy = &userName
 			resp.OwedTo = &partnerName
-		} else {
-			// Considered settled (difference is negligible)
-			resp.AmountOwed = 0 // Ensure it's exactly 0 if within tolerance
+		}
+
+		for _, b := range balances {
+			resp.Balances = append(resp.Balances, types.PairwiseBalance{
+				FromUserID: b.From,
+				FromName:   names[b.From],
+				ToUserID:   b.To,
+				ToName:     names[b.To],
+				Amount:     b.Amount,
+			})
+		}
+		for _, t := range balances {
+			resp.SuggestedTransfers = append(resp.SuggestedTransfers, types.SuggestedTransfer{
+				FromUserID: t.From,
+				FromName:   names[t.From],
+				ToUserID:   t.To,
+				ToName:     names[t.To],
+				Amount:     t.Amount,
+			})
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -142,7 +110,25 @@ func HandleGetTransferStatus(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-// HandleRecordTransfer marks relevant spendings as settled and records the transfer event.
+// fetchUnsettledDebts returns what each member of the household owes another, from the
+// balances of their receivable accounts in the ledger.
+func fetchUnsettledDebts(db *sql.DB, householdID int64) ([]Debt, error) {
+	receivables, err := ledger.Receivables(db, householdID)
+	if err != nil {
+		return nil, err
+	}
+	var debts []Debt
+	for _, r := range receivables {
+		debts = append(debts, Debt{From: r.DebtorID, To: r.CreditorID, Amount: r.Amount})
+	}
+	return debts, nil
+}
+
+// HandleRecordTransfer records that the user and one other member of the household have settled
+// up: the shares each owes the other in unsettled spendings are marked settled, in the spendings
+// tables and in the ledger. Debts involving other members are left alone, and a transfer that
+// settles nothing is refused. The other member is taken from the request, and defaults to the
+// partner in a household of two.
 func HandleRecordTransfer(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := auth.GetUserIDFromContext(r.Context())
@@ -152,14 +138,42 @@ func HandleRecordTransfer(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Use the new GetPartnerUserID which queries the DB
-		partnerID, partnerOk := auth.GetPartnerUserID(db, userID) // Pass db connection
-		if !partnerOk {
-			// GetPartnerUserID logs errors
-			// slog.Warn("no partner configured for user, cannot record transfer", "url", r.URL, "user_id", userID)
+		// 1. Decode the optional payload
+		var payload types.RecordTransferPayload
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+				slog.Warn("failed to decode record transfer payload", "url", r.URL, "user_id", userID, "err", err)
+				http.Error(w, "Bad Request: Invalid JSON", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// 2. Determine the counterparty among the other members
+		householdID, householdOk := household.GetHouseholdID(db, userID)
+		otherIDs, err := household.OtherMemberIDs(db, userID)
+		if err != nil {
+			slog.Error("failed to query household members for recording transfer", "url", r.URL, "user_id", userID, "err", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !householdOk || len(otherIDs) == 0 {
 			http.Error(w, "Partner not found or not configured for this user.", http.StatusBadRequest)
 			return
 		}
+		var counterpartyID int64
+		switch {
+		case payload.CounterpartyID != nil:
+			counterpartyID = *payload.CounterpartyID
+			if !slices.Contains(otherIDs, counterpartyID) {
+				http.Error(w, "Bad Request: counterparty_id is not another member of your household", http.StatusBadRequest)
+				return
+			}
+		case len(otherIDs) == 1:
+			counterpartyID = otherIDs[0]
+		default:
+			http.Error(w, "Bad Request: counterparty_id is required in a household of more than two", http.StatusBadRequest)
+			return
+		}
 
 		now := time.Now().UTC()
 
@@ -171,28 +185,32 @@ func HandleRecordTransfer(db *sql.DB) http.HandlerFunc {
 		}
 		defer tx.Rollback() // Rollback on error
 
-		// Update user_spendings to mark as settled
-		updateQuery := `
-            UPDATE user_spendings
-            SET settled_at = ?
-            WHERE settled_at IS NULL
-              AND ( (buyer = ? AND shared_with = ?) OR (buyer = ? AND shared_with = ?) )
-        `
-		_, err = tx.Exec(updateQuery, now, userID, partnerID, partnerID, userID)
+		// 3. Settle the shares between the two and record the settlements in the ledger
+		spendingIDs, err := household.SettleShares(tx, userID, counterpartyID, now)
 		if err != nil {
-			slog.Error("failed to update user_spendings during transfer recording", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
+			slog.Error("failed to settle shares during transfer recording", "url", r.URL, "user_id", userID, "counterparty_id", counterpartyID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+		if len(spendingIDs) == 0 {
+			http.Error(w, "Conflict: Nothing to settle between you and this member", http.StatusConflict)
+			return
+		}
+		for _, spendingID := range spendingIDs {
+			if err := ledger.RecordSpending(tx, spendingID); err != nil {
+				slog.Error("failed to record settlement in the ledger", "url", r.URL, "user_id", userID, "spending_id", spendingID, "err", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
 
-		// Insert into transfers table
-		insertQuery := `
+		// 4. Record the transfer event
+		_, err = tx.Exec(`
             INSERT INTO transfers (settled_by_user_id, settled_with_user_id, settlement_time)
             VALUES (?, ?, ?)
-        `
-		_, err = tx.Exec(insertQuery, userID, partnerID, now)
+        `, userID, counterpartyID, now)
 		if err != nil {
-			slog.Error("failed to insert into transfers table", "url", r.URL, "user_id", userID, "partner_id", partnerID, "err", err)
+			slog.Error("failed to insert into transfers table", "url", r.URL, "user_id", userID, "counterparty_id", counterpartyID, "err", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
@@ -204,7 +222,7 @@ func HandleRecordTransfer(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		slog.Info("Transfer recorded successfully", "url", r.URL, "user_id", userID, "partner_id", partnerID)
+		slog.Info("Transfer recorded successfully", "url", r.URL, "user_id", userID, "household_id", householdID, "counterparty_id", counterpartyID, "spendings", len(spendingIDs))
 		w.WriteHeader(http.StatusOK) // Send 200 OK on success
 	}
 }
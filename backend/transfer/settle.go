@@ -0,0 +1,60 @@
+package transfer
+
+import (
+	"sort"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+)
+
+// Debt is an amount one user owes another.
+type Debt struct {
+	From   int64
+	To     int64
+	Amount money.Amount
+}
+
+// PairwiseBalances nets raw debts so that each pair of users appears at most once,
+// in the direction of the remaining debt. Pairs that net to zero are dropped.
+// The result is ordered by (From, To).
+func PairwiseBalances(debts []Debt) []Debt {
+	type pair struct{ a, b int64 }     // a < b
+	net := make(map[pair]money.Amount) // positive: a owes b
+	for _, d := range debts {
+		if d.From == d.To || d.Amount == 0 {
+			continue
+		}
+		if d.From < d.To {
+			net[pair{d.From, d.To}] += d.Amount
+		} else {
+			net[pair{d.To, d.From}] -= d.Amount
+		}
+	}
+
+	var balances []Debt
+	for p, amount := range net {
+		switch {
+		case amount > 0:
+			balances = append(balances, Debt{From: p.a, To: p.b, Amount: amount})
+		case amount < 0:
+			balances = append(balances, Debt{From: p.b, To: p.a, Amount: -amount})
+		}
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		if balances[i].From != balances[j].From {
+			return balances[i].From < balances[j].From
+		}
+		return balances[i].To < balances[j].To
+	})
+	return balances
+}
+
+// NetBalances returns each user's net position from pairwise balances.
+// Positive means the user is owed money, negative means the user owes money.
+func NetBalances(balances []Debt) map[int64]money.Amount {
+	net := make(map[int64]money.Amount)
+	for _, b := range balances {
+		net[b.From] -= b.Amount
+		net[b.To] += b.Amount
+	}
+	return net
+}
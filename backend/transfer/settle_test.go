@@ -0,0 +1,44 @@
+package transfer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairwiseBalances(t *testing.T) {
+	tests := []struct {
+		name     string
+		debts    []Debt
+		expected []Debt
+	}{
+		{name: "no debts", debts: nil, expected: nil},
+		{
+			name:     "opposite debts net out",
+			debts:    []Debt{{From: 1, To: 2, Amount: 3000}, {From: 2, To: 1, Amount: 1000}},
+			expected: []Debt{{From: 1, To: 2, Amount: 2000}},
+		},
+		{
+			name:     "equal debts cancel",
+			debts:    []Debt{{From: 1, To: 2, Amount: 1000}, {From: 2, To: 1, Amount: 1000}},
+			expected: nil,
+		},
+		{
+			name:     "amounts add up to the minor unit",
+			debts:    []Debt{{From: 3, To: 1, Amount: 333}, {From: 3, To: 1, Amount: 334}},
+			expected: []Debt{{From: 3, To: 1, Amount: 667}},
+		},
+		{
+			name:     "self debts are ignored",
+			debts:    []Debt{{From: 1, To: 1, Amount: 5000}},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PairwiseBalances(tt.debts); !reflect.DeepEqual(got, tt.expected) {
+				t.Fatalf("PairwiseBalances() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -2,11 +2,14 @@ package main_test
 
 import (
 	"database/sql"
-	"math"
 	"net/http"
+	"reflect"
 	"testing"
 	"time"
 
+	"git.sr.ht/~relay/sapp-backend/auth"
+	"git.sr.ht/~relay/sapp-backend/ledger"
+	"git.sr.ht/~relay/sapp-backend/money"
 	"git.sr.ht/~relay/sapp-backend/testutil"
 	"git.sr.ht/~relay/sapp-backend/types"
 )
@@ -17,7 +20,7 @@ func TestGetTransferStatus(t *testing.T) {
 	defer env.TearDownDB()
 
 	groceriesID := testutil.GetCategoryID(t, env.DB, "Groceries")
-	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping")
+	shoppingID := testutil.GetCategoryID(t, env.DB, "Shopping (general)")
 
 	// --- Test Case: Initial Status (No Spendings) ---
 	t.Run("InitialStatus", func(t *testing.T) {
@@ -32,8 +35,8 @@ func TestGetTransferStatus(t *testing.T) {
 		if resp.PartnerName != env.PartnerName {
 			t.Errorf("Expected partner name '%s', got '%s'", env.PartnerName, resp.PartnerName)
 		}
-		if resp.AmountOwed != 0.0 {
-			t.Errorf("Expected amount owed 0.0, got %f", resp.AmountOwed)
+		if resp.AmountOwed != 0 {
+			t.Errorf("Expected amount owed 0.00, got %s", resp.AmountOwed)
 		}
 		if resp.OwedBy != nil || resp.OwedTo != nil {
 			t.Errorf("Expected OwedBy and OwedTo to be nil, got %v, %v", resp.OwedBy, resp.OwedTo)
@@ -73,8 +76,8 @@ func TestGetTransferStatus(t *testing.T) {
 			t.Errorf("Expected partner name '%s', got '%s'", env.PartnerName, resp.PartnerName)
 		}
 		// Use tolerance for float comparison
-		if math.Abs(resp.AmountOwed-5.0) > 0.001 {
-			t.Errorf("Expected amount owed 5.0, got %f", resp.AmountOwed)
+		if resp.AmountOwed != 500 {
+			t.Errorf("Expected amount owed 5.00, got %s", resp.AmountOwed)
 		}
 		if resp.OwedBy == nil || *resp.OwedBy != env.User1Name {
 			t.Errorf("Expected OwedBy '%s', got %v", env.User1Name, resp.OwedBy)
@@ -152,50 +155,24 @@ func TestRecordTransfer(t *testing.T) {
 		testutil.AssertStatusCode(t, rrStatus, http.StatusOK)
 		var resp types.TransferStatusResponse // Use types.TransferStatusResponse
 		testutil.DecodeJSONResponse(t, rrStatus, &resp)
-		if resp.AmountOwed != 0.0 || resp.OwedBy != nil || resp.OwedTo != nil {
+		if resp.AmountOwed != 0 || resp.OwedBy != nil || resp.OwedTo != nil {
 			t.Errorf("Expected status to be settled after recording transfer, got %v", resp)
 		}
 	})
 
-	// --- Test Case: Record Again (Idempotency Check) ---
-	// Should succeed, create a new transfer record, but not update already settled items
-	t.Run("RecordAgain", func(t *testing.T) {
-		// Get initial transfer count
-		var initialTransferCount int
-		err := env.DB.QueryRow("SELECT COUNT(*) FROM transfers WHERE settled_by_user_id = ? AND settled_with_user_id = ?", env.UserID, env.PartnerID).Scan(&initialTransferCount)
-		if err != nil {
-			t.Fatalf("Failed to get initial transfer count: %v", err)
-		}
-		// Ensure the first call happened (from the Success test case)
-		if initialTransferCount == 0 {
-			t.Log("Warning: Initial transfer count was 0, running first record call.")
-			req1 := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", env.AuthToken, nil)
-			rr1 := testutil.ExecuteRequest(t, env.Handler, req1)
-			testutil.AssertStatusCode(t, rr1, http.StatusOK)
-			// Re-query count
-			err = env.DB.QueryRow("SELECT COUNT(*) FROM transfers WHERE settled_by_user_id = ? AND settled_with_user_id = ?", env.UserID, env.PartnerID).Scan(&initialTransferCount)
-			if err != nil || initialTransferCount == 0 {
-				t.Fatalf("Failed to get transfer count after first call: %v (count: %d)", err, initialTransferCount)
-			}
-		}
-
-		// Record again
-		req2 := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", env.AuthToken, nil)
-		rr2 := testutil.ExecuteRequest(t, env.Handler, req2)
-		testutil.AssertStatusCode(t, rr2, http.StatusOK)
-
-		// Verify transfer count increased by exactly one
-		var finalTransferCount int
-		err = env.DB.QueryRow("SELECT COUNT(*) FROM transfers WHERE settled_by_user_id = ? AND settled_with_user_id = ?", env.UserID, env.PartnerID).Scan(&finalTransferCount)
-		if err != nil {
-			t.Fatalf("Failed to get final transfer count: %v", err)
-		}
-		if finalTransferCount != initialTransferCount+1 {
-			t.Errorf("Expected transfer count to increase by 1 (from %d to %d), but got %d", initialTransferCount, initialTransferCount+1, finalTransferCount)
-		}
+	// --- Test Case: Record Again ---
+	// Nothing is left to settle, so no transfer is recorded
+	t.Run("ErrorNothingToSettle", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusConflict)
+		testutil.AssertBodyContains(t, rr, "Nothing to settle")
 
-		// Optional: Verify that the settled_at timestamps of the spendings did not change after the second call
-		// (Requires storing the initial settled_at times from the 'Success' test)
+		var transferCount int
+		err := env.DB.QueryRow("SELECT COUNT(*) FROM transfers WHERE settled_by_user_id = ? AND settled_with_user_id = ?", env.UserID, env.PartnerID).Scan(&transferCount)
+		if err != nil || transferCount != 1 {
+			t.Errorf("Expected still 1 transfer record, found %d (err: %v)", transferCount, err)
+		}
 	})
 
 	// --- Test Case: Unauthorized ---
@@ -208,3 +185,231 @@ func TestRecordTransfer(t *testing.T) {
 
 	// Note: Testing the "No partner configured" case requires modifying the test setup or auth logic.
 }
+
+// TestTransferStatusThreeMembers tests balances and suggested transfers in a three-member household.
+func TestTransferStatusThreeMembers(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	thirdID := testutil.AddHouseholdMember(t, env, "third_user", "Third")
+	partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT for partner: %v", err)
+	}
+
+	// --- Setup Data ---
+	// 1. User paid 90, shared with everyone -> Partner and Third each owe User 30
+	req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, types.PayPayload{
+		SharedStatus: "shared", Amount: 9000, Category: "Groceries",
+	})
+	testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+	// 2. Partner paid 30, shared with Third only -> Third owes Partner 15
+	req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", partnerToken, types.PayPayload{
+		SharedStatus: "shared", Amount: 3000, Category: "Groceries", SharedWith: []int64{thirdID},
+	})
+	testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+
+	// --- Test Case: Balances and Suggestions ---
+	t.Run("CalculatedStatus", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/transfer/status", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+
+		var resp types.TransferStatusResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+
+		if len(resp.Balances) != 3 {
+			t.Fatalf("Expected 3 pairwise balances, got %d: %+v", len(resp.Balances), resp.Balances)
+		}
+
+		// Each pair settles its own balance, nothing is routed through another member
+		suggested := map[[2]int64]money.Amount{}
+		for _, st := range resp.SuggestedTransfers {
+			suggested[[2]int64{st.FromUserID, st.ToUserID}] = st.Amount
+		}
+		expected := map[[2]int64]money.Amount{
+			{env.PartnerID, env.UserID}: 3000,
+			{thirdID, env.UserID}:       3000,
+			{thirdID, env.PartnerID}:    1500,
+		}
+		if !reflect.DeepEqual(suggested, expected) {
+			t.Errorf("Expected the pairwise balances as suggested transfers, got %v", suggested)
+		}
+
+		// The legacy fields report the requesting user's net position
+		if resp.AmountOwed != 6000 {
+			t.Errorf("Expected amount owed 60.00, got %s", resp.AmountOwed)
+		}
+		if resp.OwedTo == nil || *resp.OwedTo != env.User1Name {
+			t.Errorf("Expected OwedTo '%s', got %v", env.User1Name, resp.OwedTo)
+		}
+	})
+
+	// --- Test Case: Sharing With a Non-Member ---
+	t.Run("ErrorNonMember", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, types.PayPayload{
+			SharedStatus: "shared", Amount: 1000, Category: "Groceries", SharedWith: []int64{9999},
+		})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "members of your household")
+	})
+}
+
+// TestRecordTransferThreeMembers tests that a transfer in a three-member household settles only
+// what the two members involved owe each other.
+func TestRecordTransferThreeMembers(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	thirdID := testutil.AddHouseholdMember(t, env, "third_user", "Third")
+	partnerToken, err := auth.GenerateTestJWT(env.PartnerID)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT for partner: %v", err)
+	}
+	thirdToken, err := auth.GenerateTestJWT(thirdID)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT for third member: %v", err)
+	}
+
+	// --- Setup Data ---
+	// 1. User paid 90, shared with everyone -> Partner and Third each owe User 30
+	req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, types.PayPayload{
+		SharedStatus: "shared", Amount: 9000, Category: "Groceries",
+	})
+	testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+	var sharedByAll int64
+	env.DB.QueryRow("SELECT MAX(id) FROM spendings").Scan(&sharedByAll)
+	// 2. Partner paid 30, shared with Third only -> Third owes Partner 15
+	req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", partnerToken, types.PayPayload{
+		SharedStatus: "shared", Amount: 3000, Category: "Groceries", SharedWith: []int64{thirdID},
+	})
+	testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+
+	balances := func(t *testing.T) map[[2]int64]money.Amount {
+		t.Helper()
+		req := testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/transfer/status", env.AuthToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusOK)
+		var resp types.TransferStatusResponse
+		testutil.DecodeJSONResponse(t, rr, &resp)
+		owed := map[[2]int64]money.Amount{}
+		for _, b := range resp.Balances {
+			owed[[2]int64{b.FromUserID, b.ToUserID}] = b.Amount
+		}
+		return owed
+	}
+
+	// --- Test Cases: Invalid Counterparty ---
+	t.Run("ErrorMissingCounterparty", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", partnerToken, nil)
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "counterparty_id is required")
+	})
+	t.Run("ErrorNonMemberCounterparty", func(t *testing.T) {
+		nonMember := int64(9999)
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", partnerToken, types.RecordTransferPayload{CounterpartyID: &nonMember})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusBadRequest)
+		testutil.AssertBodyContains(t, rr, "not another member of your household")
+	})
+
+	// --- Test Case: Partner Pays User ---
+	t.Run("SettlesOnlyThePair", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", partnerToken, types.RecordTransferPayload{CounterpartyID: &env.UserID})
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusOK)
+
+		owed := balances(t)
+		expected := map[[2]int64]money.Amount{
+			{thirdID, env.UserID}:    3000,
+			{thirdID, env.PartnerID}: 1500,
+		}
+		if !reflect.DeepEqual(owed, expected) {
+			t.Errorf("Expected only Third's debts to remain, got %v", owed)
+		}
+
+		// Third's share keeps the spending shared by all open
+		var settledAt sql.NullTime
+		env.DB.QueryRow("SELECT settled_at FROM user_spendings WHERE spending_id = ?", sharedByAll).Scan(&settledAt)
+		if settledAt.Valid {
+			t.Errorf("Spending %d should not be settled while Third's share is open", sharedByAll)
+		}
+
+		var transfers int
+		env.DB.QueryRow("SELECT COUNT(*) FROM transfers").Scan(&transfers)
+		if transfers != 1 {
+			t.Errorf("Expected 1 transfer record, found %d", transfers)
+		}
+	})
+
+	// --- Test Case: Pair Already Settled ---
+	t.Run("ErrorNothingToSettle", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", env.AuthToken, types.RecordTransferPayload{CounterpartyID: &env.PartnerID})
+		rr := testutil.ExecuteRequest(t, env.Handler, req)
+		testutil.AssertStatusCode(t, rr, http.StatusConflict)
+
+		var transfers int
+		env.DB.QueryRow("SELECT COUNT(*) FROM transfers").Scan(&transfers)
+		if transfers != 1 {
+			t.Errorf("Expected still 1 transfer record, found %d", transfers)
+		}
+	})
+
+	// --- Test Case: Third Pays User ---
+	t.Run("SettlesRemainingShare", func(t *testing.T) {
+		req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/transfer/record", thirdToken, types.RecordTransferPayload{CounterpartyID: &env.UserID})
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusOK)
+
+		owed := balances(t)
+		expected := map[[2]int64]money.Amount{{thirdID, env.PartnerID}: 1500}
+		if !reflect.DeepEqual(owed, expected) {
+			t.Errorf("Expected only Third's debt to Partner to remain, got %v", owed)
+		}
+
+		var settledAt sql.NullTime
+		env.DB.QueryRow("SELECT settled_at FROM user_spendings WHERE spending_id = ?", sharedByAll).Scan(&settledAt)
+		if !settledAt.Valid {
+			t.Errorf("Spending %d should be settled once every share is", sharedByAll)
+		}
+
+		discrepancies, err := ledger.Check(env.DB)
+		if err != nil || len(discrepancies) != 0 {
+			t.Errorf("Expected the ledger to match the spendings, got %v (err: %v)", discrepancies, err)
+		}
+	})
+}
+
+// TestTransferStatusOddAmounts tests that shared amounts which do not divide evenly are split to
+// the minor unit, with the odd øre borne by the buyer.
+func TestTransferStatusOddAmounts(t *testing.T) {
+	env := testutil.SetupTestEnvironment(t)
+	defer env.TearDownDB()
+
+	// User paid 1.01, shared with Partner -> Partner owes 0.50, User bears 0.51
+	req := testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, map[string]any{
+		"shared_status": "shared", "amount": 1.01, "category": "Groceries",
+	})
+	testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+
+	req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/transfer/status", env.AuthToken, nil)
+	rr := testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+	testutil.AssertBodyContains(t, rr, `"amount_owed":0.5,`)
+
+	// Two more of 1.01 each add up exactly: 3 × 0.50
+	for range 2 {
+		req = testutil.NewAuthenticatedRequest(t, http.MethodPost, "/v1/pay", env.AuthToken, types.PayPayload{
+			SharedStatus: "shared", Amount: 101, Category: "Groceries",
+		})
+		testutil.AssertStatusCode(t, testutil.ExecuteRequest(t, env.Handler, req), http.StatusCreated)
+	}
+	req = testutil.NewAuthenticatedRequest(t, http.MethodGet, "/v1/transfer/status", env.AuthToken, nil)
+	rr = testutil.ExecuteRequest(t, env.Handler, req)
+	testutil.AssertStatusCode(t, rr, http.StatusOK)
+	var resp types.TransferStatusResponse
+	testutil.DecodeJSONResponse(t, rr, &resp)
+	if resp.AmountOwed != 150 || resp.OwedBy == nil || *resp.OwedBy != env.PartnerName {
+		t.Errorf("Expected Partner to owe 1.50, got %s owed by %v", resp.AmountOwed, resp.OwedBy)
+	}
+}
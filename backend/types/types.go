@@ -1,6 +1,10 @@
 package types
 
-import "time"
+import (
+	"time"
+
+	"git.sr.ht/~relay/sapp-backend/money"
+)
 
 // --- Shared Enums / Constants ---
 
@@ -17,11 +21,13 @@ const (
 
 // PayPayload defines the structure for the manual payment request body.
 type PayPayload struct {
-	SharedStatus string  `json:"shared_status"` // 'alone' or 'shared'
-	Amount       float64 `json:"amount"`
-	Category     string  `json:"category"`              // Category name
-	SpendingDate *string `json:"spending_date,omitempty"` // Optional: Date of spending "YYYY-MM-DD"
-	PreSettled   bool    `json:"pre_settled"`           // New flag
+	SharedStatus string       `json:"shared_status"` // 'alone' or 'shared'
+	Amount       money.Amount `json:"amount"`
+	Category     string       `json:"category"`                // Category name
+	SpendingDate *string      `json:"spending_date,omitempty"` // Optional: Date of spending "YYYY-MM-DD"
+	PreSettled   bool         `json:"pre_settled"`             // New flag
+	SharedWith   []int64      `json:"shared_with,omitempty"`   // Optional: household members to share with when 'shared'; defaults to all
+	Currency     *string      `json:"currency,omitempty"`      // Optional: ISO 4217 code of Amount; defaults to the household's currency
 }
 
 // LoginRequest defines the structure for the login request body
@@ -79,11 +85,12 @@ type PartnerRegistrationResponse struct {
 
 // AddDepositPayload defines the structure for the add deposit request body.
 type AddDepositPayload struct {
-	Amount           float64 `json:"amount"`
-	Description      string  `json:"description"`
-	DepositDate      string  `json:"deposit_date"` // Expecting ISO 8601 date string e.g., "YYYY-MM-DD"
-	IsRecurring      bool    `json:"is_recurring"`
-	RecurrencePeriod *string `json:"recurrence_period,omitempty"` // Optional
+	Amount           money.Amount `json:"amount"`
+	Description      string       `json:"description"`
+	DepositDate      string       `json:"deposit_date"` // Expecting ISO 8601 date string e.g., "YYYY-MM-DD"
+	IsRecurring      bool         `json:"is_recurring"`
+	RecurrencePeriod *string      `json:"recurrence_period,omitempty"` // Optional
+	Currency         *string      `json:"currency,omitempty"`          // Optional: ISO 4217 code of Amount; defaults to the household's currency
 }
 
 // AddDepositResponse defines the structure for the add deposit response body.
@@ -97,22 +104,323 @@ type UpdateSpendingPayload struct {
 	Description   string                `json:"description"`
 	CategoryName  string                `json:"category_name"`
 	SharingStatus EditableSharingStatus `json:"sharing_status"`
+	SharedWith    []int64               `json:"shared_with,omitempty"` // Optional: household members involved; defaults to all others
 }
 
 // TransferStatusResponse defines the structure for the balance status.
 type TransferStatusResponse struct {
-	PartnerName string  `json:"partner_name"`
-	AmountOwed  float64 `json:"amount_owed"` // Always positive, indicates the magnitude of the debt
-	OwedBy      *string `json:"owed_by"`     // Name of the person who owes money (null if settled)
-	OwedTo      *string `json:"owed_to"`     // Name of the person who is owed money (null if settled)
+	PartnerName string       `json:"partner_name"`
+	AmountOwed  money.Amount `json:"amount_owed"` // Always positive, indicates the magnitude of the debt
+	OwedBy      *string      `json:"owed_by"`     // Name of the person who owes money (null if settled)
+	OwedTo      *string      `json:"owed_to"`     // Name of the person who is owed money (null if settled)
+
+	// Household-wide view. For households of more than two members the fields above
+	// describe the requesting user's net position against the rest of the household.
+	Balances           []PairwiseBalance   `json:"balances"`            // Net debt between each pair of members
+	SuggestedTransfers []SuggestedTransfer `json:"suggested_transfers"` // One transfer per pair with a balance
+}
+
+// RecordTransferPayload names the household member the requesting user settled up with. It may
+// be left out in a household of two.
+type RecordTransferPayload struct {
+	CounterpartyID *int64 `json:"counterparty_id,omitempty"`
+}
+
+// PairwiseBalance is the net amount one household member owes another.
+type PairwiseBalance struct {
+	FromUserID int64        `json:"from_user_id"`
+	FromName   string       `json:"from_name"`
+	ToUserID   int64        `json:"to_user_id"`
+	ToName     string       `json:"to_name"`
+	Amount     money.Amount `json:"amount"`
+}
+
+// SuggestedTransfer is a payment that settles what one household member owes another.
+type SuggestedTransfer struct {
+	FromUserID int64        `json:"from_user_id"`
+	FromName   string       `json:"from_name"`
+	ToUserID   int64        `json:"to_user_id"`
+	ToName     string       `json:"to_name"`
+	Amount     money.Amount `json:"amount"`
+}
+
+// --- Household Types ---
+
+// HouseholdMember is a user belonging to a household.
+type HouseholdMember struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+// HouseholdResponse defines the structure for the household response body.
+type HouseholdResponse struct {
+	ID       int64             `json:"id"`
+	Name     string            `json:"name"`
+	AINotes  string            `json:"ai_notes"` // Context for AI categorization, see UpdateHouseholdPayload
+	Currency string            `json:"currency"` // ISO 4217 code of the household's amounts, e.g. "NOK"
+	Members  []HouseholdMember `json:"members"`
+}
+
+// UpdateHouseholdPayload defines the request body for editing a household.
+// Omitted fields are left unchanged.
+type UpdateHouseholdPayload struct {
+	// Free-text context given to the AI when categorizing the purchases of any member,
+	// e.g. "groceries are always shared; 'Oda' is our cat". Empty removes it.
+	AINotes *string `json:"ai_notes,omitempty"`
+	// ISO 4217 code of the household's amounts, e.g. "SEK". The AI is told amounts are in it.
+	// Amounts in other currencies are converted to it, so it cannot change once there are any.
+	Currency *string `json:"currency,omitempty"`
+}
+
+// --- End Household Types ---
+
+// --- Job Types ---
+
+// JobState is the lifecycle state of an AI categorization job as reported to clients.
+type JobState string
+
+const (
+	JobStatePending    JobState = "pending"
+	JobStateProcessing JobState = "processing"
+	JobStateFinished   JobState = "finished"
+	JobStateFailed     JobState = "failed"
+	JobStateFlagged    JobState = "flagged" // Finished, but the AI flagged the prompt as ambiguous
+)
+
+// JobEvent is pushed to household members whenever an AI job changes state.
+type JobEvent struct {
+	JobID        int64     `json:"job_id"`
+	BuyerID      int64     `json:"buyer_id"`
+	BuyerName    string    `json:"buyer_name"`
+	State        JobState  `json:"state"`
+	ErrorMessage *string   `json:"error_message,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// JobResponse is the full state of an AI job and the spendings it produced.
+type JobResponse struct {
+	TransactionGroup           // Prompt, amount, ambiguity and resulting spendings, as shown in history
+	BuyerID          int64     `json:"buyer_id"`
+	State            JobState  `json:"state"`
+	Status           string    `json:"status"` // Raw status as stored in the database
+	IsFinished       bool      `json:"is_finished"`
+	PreSettled       bool      `json:"pre_settled"`
+	ErrorMessage     *string   `json:"error_message,omitempty"`   // Error of the last failed attempt
+	Attempts         int       `json:"attempts"`                  // Processing attempts started so far
+	Model            *string   `json:"model,omitempty"`           // Model that produced the result, once finished
+	PromptTemplate   *string   `json:"prompt_template,omitempty"` // Version of the prompts used, e.g. "nb/v1", once finished
+	CreatedAt        time.Time `json:"created_at"`
+	StatusUpdatedAt  time.Time `json:"status_updated_at"`
+}
+
+// RecategorizeJobsPayload selects the household's AI jobs to categorize again by the date of
+// the purchase (YYYY-MM-DD, inclusive) and/or the category of their spendings.
+type RecategorizeJobsPayload struct {
+	From         *string `json:"from,omitempty"`
+	To           *string `json:"to,omitempty"`
+	CategoryName *string `json:"category_name,omitempty"`
+}
+
+// RecategorizeJobsResponse reports which jobs were queued by a bulk recategorization.
+type RecategorizeJobsResponse struct {
+	Recategorized []int64 `json:"recategorized"` // Completed jobs queued to be categorized again
+	Retried       []int64 `json:"retried"`       // Failed jobs queued for another try
+	Skipped       []int64 `json:"skipped"`       // Partly settled jobs, or jobs that changed meanwhile
+}
+
+// JobAttempt is one model request made for an AI job, for debugging its categorization.
+type JobAttempt struct {
+	ID           int64     `json:"id"`
+	Attempt      int       `json:"attempt"` // Processing attempt of the job
+	Try          int       `json:"try"`     // Request within the attempt, repeated when the output did not validate
+	Model        *string   `json:"model,omitempty"`
+	Prompt       string    `json:"prompt"`
+	RawResponse  *string   `json:"raw_response,omitempty"`
+	Outcome      string    `json:"outcome"`                 // accepted, invalid_output or model_error
+	ErrorMessage *string   `json:"error_message,omitempty"` // Why the output was rejected or the request failed
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// --- End Job Types ---
+
+// --- Admin Types ---
+
+// ModelsResponse lists the configured AI models in fallback order and the one tried first.
+type ModelsResponse struct {
+	Models  []string `json:"models"`
+	Default string   `json:"default"`
+}
+
+// SetDefaultModelPayload defines the request body for switching the default AI model.
+type SetDefaultModelPayload struct {
+	Model string `json:"model"`
+}
+
+// LLMUsageStat aggregates model requests made for AI jobs.
+type LLMUsageStat struct {
+	Requests         int     `json:"requests"`
+	Failures         int     `json:"failures"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"` // USD
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+}
+
+// LLMUsageDay is the usage of one day (UTC).
+type LLMUsageDay struct {
+	Day string `json:"day"` // YYYY-MM-DD
+	LLMUsageStat
+}
+
+// LLMUsageUser is the usage caused by one user's jobs.
+type LLMUsageUser struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	LLMUsageStat
+}
+
+// LLMUsageResponse reports model usage between two days, inclusive.
+type LLMUsageResponse struct {
+	From   string         `json:"from"`
+	To     string         `json:"to"`
+	Total  LLMUsageStat   `json:"total"`
+	ByDay  []LLMUsageDay  `json:"by_day"`
+	ByUser []LLMUsageUser `json:"by_user"`
 }
 
+// SetLLMQuotaPayload defines the request body for setting a household's monthly AI quota.
+// A null limit removes the quota.
+type SetLLMQuotaPayload struct {
+	MonthlyCostLimit *float64 `json:"monthly_cost_limit"`
+}
+
+// LLMQuotaResponse describes a household's monthly AI quota and what was spent of it.
+type LLMQuotaResponse struct {
+	HouseholdID      int64    `json:"household_id"`
+	MonthlyCostLimit *float64 `json:"monthly_cost_limit"` // USD, null if unlimited
+	SpentThisMonth   float64  `json:"spent_this_month"`   // USD, since the start of the month (UTC)
+}
+
+// ExchangeRate is the value of one unit of From in To on Date. Rates are imported, as JSON or
+// as CSV with the header "date,from,to,rate", by POST /v1/admin/exchange-rates.
+type ExchangeRate struct {
+	Date string  `json:"date"` // "YYYY-MM-DD"
+	From string  `json:"from"` // ISO 4217 code, e.g. "EUR"
+	To   string  `json:"to"`   // ISO 4217 code, e.g. "NOK"
+	Rate float64 `json:"rate"`
+}
+
+// ImportExchangeRatesResponse reports how many rates were imported, new or replacing ones for
+// the same date and currencies.
+type ImportExchangeRatesResponse struct {
+	Imported int `json:"imported"`
+}
+
+// --- End Admin Types ---
+
+// --- Account Types ---
+
+// ProfileResponse describes the authenticated user's editable profile.
+type ProfileResponse struct {
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+	AINotes   string `json:"ai_notes"` // Context for AI categorization, see UpdateProfilePayload
+	Language  string `json:"language"` // Language of the AI categorization prompts, see UpdateProfilePayload
+}
+
+// UpdateProfilePayload defines the request body for editing a profile.
+// Omitted fields are left unchanged.
+type UpdateProfilePayload struct {
+	Username  *string `json:"username,omitempty"`
+	FirstName *string `json:"first_name,omitempty"`
+	// Free-text context about the user given to the AI when categorizing the purchases of
+	// anyone in the household, e.g. "drinks energy drinks". Empty removes it.
+	AINotes *string `json:"ai_notes,omitempty"`
+	// Language of the prompts used to categorize the user's purchases, e.g. "sv". The AI
+	// writes its ambiguity reasons in it. See category.PromptLanguages.
+	Language *string `json:"language,omitempty"`
+}
+
+// ChangePasswordPayload defines the request body for changing a password.
+type ChangePasswordPayload struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// DeleteAccountPayload defines the request body for deleting an account.
+// The password is required to confirm the deletion.
+type DeleteAccountPayload struct {
+	Password string `json:"password"`
+}
+
+// --- End Account Types ---
+
 // AICategorizationPayload defines the structure for the AI categorization request body.
 type AICategorizationPayload struct {
-	Amount          float64 `json:"amount"`
-	Prompt          string  `json:"prompt"`
-	TransactionDate *string `json:"transaction_date,omitempty"` // Optional: Date of transaction "YYYY-MM-DD"
-	PreSettled      bool    `json:"pre_settled"`                // Flag to mark as settled immediately
+	Amount          money.Amount `json:"amount"` // Optional: the AI finds the amount in the prompt if 0
+	Prompt          string       `json:"prompt"`
+	TransactionDate *string      `json:"transaction_date,omitempty"` // Optional: Date of transaction "YYYY-MM-DD", else the AI finds it in the prompt
+	LocalDate       *string      `json:"local_date,omitempty"`       // Optional: the user's date today "YYYY-MM-DD", for dates like "i går"; defaults to UTC
+	PreSettled      bool         `json:"pre_settled"`                // Flag to mark as settled immediately
+	Currency        *string      `json:"currency,omitempty"`         // Optional: ISO 4217 code of Amount and the prompt's amounts; defaults to the household's currency
+}
+
+// ProposedSpending is one spending of a categorization preview, possibly edited before confirming.
+type ProposedSpending struct {
+	Category      string       `json:"category"`
+	Amount        money.Amount `json:"amount"`
+	ApportionMode string       `json:"apportion_mode"` // alone, shared or other
+	Description   string       `json:"description"`
+	SharedWith    []string     `json:"shared_with,omitempty"` // Names of the household members involved; empty means all of them
+}
+
+// CategorizationPreview is the AI's proposed split of a purchase. Nothing is stored until it is confirmed.
+type CategorizationPreview struct {
+	Amount          money.Amount `json:"amount"` // As given, or as the AI found it in the prompt
+	Prompt          string       `json:"prompt"`
+	TransactionDate *string      `json:"transaction_date,omitempty"` // As given, or as the AI found it in the prompt
+
+	AmbiguityFlag string             `json:"ambiguity_flag,omitempty"` // Why the AI found the prompt ambiguous, if it did
+	Model         string             `json:"model,omitempty"`          // Model that made the proposal
+	Spendings     []ProposedSpending `json:"spendings"`
+}
+
+// BatchResponse is a message describing several purchases, split by the AI into one job per
+// purchase. Each purchase reports its own state; see POST /v1/categorize/batch.
+type BatchResponse struct {
+	BatchID   int64         `json:"batch_id"`
+	BuyerID   int64         `json:"buyer_id"`
+	Prompt    string        `json:"prompt"` // Message as submitted
+	CreatedAt time.Time     `json:"created_at"`
+	Done      bool          `json:"done"`      // Every purchase is finished, flagged or failed
+	Purchases []JobResponse `json:"purchases"` // In the order of the message
+}
+
+// ConfirmCategorizationPayload stores a preview, as proposed or edited, as a completed AI job.
+type ConfirmCategorizationPayload struct {
+	AICategorizationPayload                    // The purchase, as sent for the preview
+	AmbiguityFlag           string             `json:"ambiguity_flag,omitempty"`
+	Model                   string             `json:"model,omitempty"`
+	Spendings               []ProposedSpending `json:"spendings"`
+}
+
+// Review actions for resolving a job flagged as ambiguous.
+const (
+	ReviewActionAccept  = "accept"  // Keep the spendings as categorized
+	ReviewActionEdit    = "edit"    // Replace the spendings with corrected ones
+	ReviewActionClarify = "clarify" // Answer the model's question and categorize again
+)
+
+// ResolveReviewPayload resolves a job in the review queue, see the ReviewAction constants.
+type ResolveReviewPayload struct {
+	Action        string             `json:"action"`
+	Spendings     []ProposedSpending `json:"spendings,omitempty"`     // Required for edit
+	Clarification string             `json:"clarification,omitempty"` // Required for clarify
+	// Optional for edit, to correct the amount or date the AI found in the prompt
+	Amount          *money.Amount `json:"amount,omitempty"`
+	TransactionDate *string       `json:"transaction_date,omitempty"` // "YYYY-MM-DD"
 }
 
 // --- Core Data Structures ---
@@ -126,15 +434,30 @@ type Category struct {
 
 // Deposit represents a deposit record (template) in the database.
 type Deposit struct {
-	ID               int64      `json:"id"`
-	UserID           int64      `json:"user_id"` // Keep internal for now, response might just confirm success
-	Amount           float64    `json:"amount"`
-	Description      string     `json:"description"`
-	DepositDate      time.Time  `json:"deposit_date"` // Start date for recurring, or date for one-off
-	IsRecurring      bool       `json:"is_recurring"`
-	RecurrencePeriod *string    `json:"recurrence_period"` // Pointer for nullable
-	EndDate          *time.Time `json:"end_date"`          // Pointer for nullable end date of recurrence
-	CreatedAt        time.Time  `json:"created_at"`
+	ID               int64         `json:"id"`
+	UserID           int64         `json:"user_id"`                   // Keep internal for now, response might just confirm success
+	Amount           money.Amount  `json:"amount"`                    // In the household's currency
+	OriginalAmount   *money.Amount `json:"original_amount,omitempty"` // As entered, if in another currency
+	Currency         *string       `json:"currency,omitempty"`        // ISO 4217 code of OriginalAmount
+	Description      string        `json:"description"`
+	DepositDate      time.Time     `json:"deposit_date"` // Start date for recurring, or date for one-off
+	IsRecurring      bool          `json:"is_recurring"`
+	RecurrencePeriod *string       `json:"recurrence_period"` // Pointer for nullable
+	EndDate          *time.Time    `json:"end_date"`          // Pointer for nullable end date of recurrence
+	CreatedAt        time.Time     `json:"created_at"`
+}
+
+// Attachment describes a file attached to a spending or deposit. The content is served
+// separately, by GET /v1/attachments/{attachment_id}.
+type Attachment struct {
+	ID         int64     `json:"id"`
+	SpendingID *int64    `json:"spending_id,omitempty"`
+	DepositID  *int64    `json:"deposit_id,omitempty"`
+	FileName   string    `json:"file_name"`
+	MediaType  string    `json:"media_type"`
+	Size       int64     `json:"size"` // In bytes
+	SHA256     string    `json:"sha256"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 // --- Export Types ---
@@ -143,6 +466,7 @@ type Deposit struct {
 type UserExport struct {
 	Username  string `json:"username"`
 	FirstName string `json:"first_name"`
+	AINotes   string `json:"ai_notes,omitempty"`
 }
 
 // CategoryExport defines the structure for exporting category details.
@@ -153,44 +477,75 @@ type CategoryExport struct {
 
 // SpendingItemExport defines the structure for exporting individual spending items within a job or manual entry.
 type SpendingItemExport struct {
-	CategoryName  string  `json:"category_name"`
-	Amount        float64 `json:"amount"`
-	Description   string  `json:"description"`
-	ApportionMode string  `json:"apportion_mode"` // "Alone", "Shared", "PaidByPartner"
+	CategoryName   string             `json:"category_name"`
+	Amount         money.Amount       `json:"amount"`                    // In the household's currency
+	OriginalAmount *money.Amount      `json:"original_amount,omitempty"` // As entered, if in another currency
+	Currency       *string            `json:"currency,omitempty"`        // ISO 4217 code of OriginalAmount
+	Description    string             `json:"description"`
+	ApportionMode  string             `json:"apportion_mode"`         // "Alone", "Shared", "PaidByPartner"
+	Participants   []string           `json:"participants,omitempty"` // Usernames bearing the cost, if not alone
+	Attachments    []AttachmentExport `json:"attachments,omitempty"`
+}
+
+// AttachmentExport defines the structure for exporting attachments. In the export archive,
+// the content of the file is at Path.
+type AttachmentExport struct {
+	FileName  string    `json:"file_name"`
+	MediaType string    `json:"media_type"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Path      string    `json:"path"` // "attachments/<sha256>"
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // AIJobExport defines the structure for exporting AI categorization jobs and their spendings.
 type AIJobExport struct {
 	Prompt          string               `json:"prompt"`
-	TotalAmount     float64              `json:"total_amount"`
+	TotalAmount     money.Amount         `json:"total_amount"`       // In Currency, if set
+	Currency        *string              `json:"currency,omitempty"` // ISO 4217 code of the job's amounts, if not the household's
 	TransactionDate time.Time            `json:"transaction_date"`
 	PreSettled      bool                 `json:"pre_settled"`
 	BuyerUsername   string               `json:"buyer_username"` // Username of the person who submitted the job
 	IsAmbiguous     bool                 `json:"is_ambiguous"`
 	AmbiguityReason *string              `json:"ambiguity_reason,omitempty"`
+	Receipt         *ReceiptExport       `json:"receipt,omitempty"` // Photo of the receipt, if the job was made from one
 	Spendings       []SpendingItemExport `json:"spendings"`
 }
 
+// ReceiptExport defines the structure for exporting the receipt photo of an AI job.
+type ReceiptExport struct {
+	MediaType string `json:"media_type"`
+	SHA256    string `json:"sha256"`
+	Path      string `json:"path"` // "attachments/<sha256>"
+}
+
 // ManualSpendingExport defines the structure for exporting manually added spendings.
 type ManualSpendingExport struct {
-	Amount        float64    `json:"amount"`
-	Description   string     `json:"description"` // Description from spendings table
-	CategoryName  string     `json:"category_name"`
-	SpendingDate  time.Time  `json:"spending_date"`
-	BuyerUsername string     `json:"buyer_username"` // Username of the person who paid
-	SharedStatus  string     `json:"shared_status"`  // "Alone", "Shared", "PaidByPartner"
-	SettledAt     *time.Time `json:"settled_at,omitempty"`
+	Amount         money.Amount       `json:"amount"`                    // In the household's currency
+	OriginalAmount *money.Amount      `json:"original_amount,omitempty"` // As entered, if in another currency
+	Currency       *string            `json:"currency,omitempty"`        // ISO 4217 code of OriginalAmount
+	Description    string             `json:"description"`               // Description from spendings table
+	CategoryName   string             `json:"category_name"`
+	SpendingDate   time.Time          `json:"spending_date"`
+	BuyerUsername  string             `json:"buyer_username"`         // Username of the person who paid
+	SharedStatus   string             `json:"shared_status"`          // "Alone", "Shared", "PaidByPartner"
+	Participants   []string           `json:"participants,omitempty"` // Usernames bearing the cost, if not alone
+	SettledAt      *time.Time         `json:"settled_at,omitempty"`
+	Attachments    []AttachmentExport `json:"attachments,omitempty"`
 }
 
 // DepositExport defines the structure for exporting deposit templates.
 type DepositExport struct {
-	Description      string     `json:"description"`
-	Amount           float64    `json:"amount"`
-	DepositDate      time.Time  `json:"deposit_date"` // Start date
-	IsRecurring      bool       `json:"is_recurring"`
-	RecurrencePeriod *string    `json:"recurrence_period,omitempty"`
-	EndDate          *time.Time `json:"end_date,omitempty"`
-	OwnerUsername    string     `json:"owner_username"` // Username of the deposit owner
+	Description      string             `json:"description"`
+	Amount           money.Amount       `json:"amount"`                    // In the household's currency
+	OriginalAmount   *money.Amount      `json:"original_amount,omitempty"` // As entered, if in another currency
+	Currency         *string            `json:"currency,omitempty"`        // ISO 4217 code of OriginalAmount
+	DepositDate      time.Time          `json:"deposit_date"`              // Start date
+	IsRecurring      bool               `json:"is_recurring"`
+	RecurrencePeriod *string            `json:"recurrence_period,omitempty"`
+	EndDate          *time.Time         `json:"end_date,omitempty"`
+	OwnerUsername    string             `json:"owner_username"` // Username of the deposit owner
+	Attachments      []AttachmentExport `json:"attachments,omitempty"`
 }
 
 // TransferExport defines the structure for exporting settlement records.
@@ -204,6 +559,7 @@ type FullExport struct {
 	ExportedAt      time.Time              `json:"exported_at"`
 	User            UserExport             `json:"user"`
 	Partner         UserExport             `json:"partner"`
+	Household       []UserExport           `json:"household"` // All other household members
 	Categories      []CategoryExport       `json:"categories"`
 	AIJobs          []AIJobExport          `json:"ai_jobs"`
 	ManualSpendings []ManualSpendingExport `json:"manual_spendings"`
@@ -217,31 +573,32 @@ type FullExport struct {
 
 // CategorySpendingStat represents the total spending for a specific category.
 type CategorySpendingStat struct {
-	CategoryName string  `json:"category_name"`
-	TotalAmount  float64 `json:"total_amount"`
+	CategoryName string       `json:"category_name"`
+	TotalAmount  money.Amount `json:"total_amount"`
 }
 
 // DepositStatsResponse defines the structure for the deposit statistics response.
 type DepositStatsResponse struct {
-	TotalAmount float64 `json:"total_amount"`
-	Count       int     `json:"count"` // Number of deposits included in the sum
+	TotalAmount money.Amount `json:"total_amount"`
+	Count       int          `json:"count"` // Number of deposits included in the sum
 }
 
 // --- End Stats Types ---
 
 // UpdateDepositPayload defines the structure for the update deposit request body.
 type UpdateDepositPayload struct {
-	Amount           *float64 `json:"amount,omitempty"`           // Optional: only update if provided
-	Description      *string  `json:"description,omitempty"`      // Optional
-	DepositDate      *string  `json:"deposit_date,omitempty"`     // Optional: Format "YYYY-MM-DD"
-	IsRecurring      *bool    `json:"is_recurring,omitempty"`     // Optional
-	RecurrencePeriod *string  `json:"recurrence_period,omitempty"` // Optional: Can be nullified
-	EndDate          *string  `json:"end_date,omitempty"`         // Optional: Format "YYYY-MM-DD" or null to clear
+	Amount           *money.Amount `json:"amount,omitempty"`            // Optional: only update if provided
+	Description      *string       `json:"description,omitempty"`       // Optional
+	DepositDate      *string       `json:"deposit_date,omitempty"`      // Optional: Format "YYYY-MM-DD"
+	IsRecurring      *bool         `json:"is_recurring,omitempty"`      // Optional
+	RecurrencePeriod *string       `json:"recurrence_period,omitempty"` // Optional: Can be nullified
+	EndDate          *string       `json:"end_date,omitempty"`          // Optional: Format "YYYY-MM-DD" or null to clear
+	Currency         *string       `json:"currency,omitempty"`          // Optional: ISO 4217 code of the amount
 }
 
 // UpdateDepositResponse defines the structure for the update deposit response body.
 type UpdateDepositResponse struct {
-	Message string `json:"message"`
+	Message string  `json:"message"`
 	Deposit Deposit `json:"deposit"` // Return the updated deposit
 }
 
@@ -253,15 +610,18 @@ type DeleteDepositResponse struct {
 // SpendingItem represents a single item within a transaction group (often generated by AI).
 // Used in TransactionGroup and potentially other contexts.
 type SpendingItem struct {
-	ID                 int64     `json:"id"` // spendings.id
-	Amount             float64   `json:"amount"`
-	Description        string    `json:"description"`
-	CategoryName       string    `json:"category_name"`
-	SpendingDate       time.Time `json:"spending_date"`         // Actual date the spending occurred
-	BuyerName          string    `json:"buyer_name"`            // Name of the user who paid for the original transaction
-	PartnerName        *string   `json:"partner_name"`          // Name of the partner involved, if any
-	SharedUserTakesAll bool      `json:"shared_user_takes_all"` // True if partner pays this item's full cost
-	SharingStatus      string    `json:"sharing_status"`        // Derived: "Alone", "Shared with X", "Paid by X"
+	ID                 int64         `json:"id"`                        // spendings.id
+	Amount             money.Amount  `json:"amount"`                    // In the household's currency
+	OriginalAmount     *money.Amount `json:"original_amount,omitempty"` // As entered, if in another currency
+	Currency           *string       `json:"currency,omitempty"`        // ISO 4217 code of OriginalAmount
+	Description        string        `json:"description"`
+	CategoryName       string        `json:"category_name"`
+	SpendingDate       time.Time     `json:"spending_date"`               // Actual date the spending occurred
+	BuyerName          string        `json:"buyer_name"`                  // Name of the user who paid for the original transaction
+	PartnerName        *string       `json:"partner_name"`                // Name of the partner involved, if any
+	SharedUserTakesAll bool          `json:"shared_user_takes_all"`       // True if partner pays this item's full cost
+	SharingStatus      string        `json:"sharing_status"`              // Derived: "Alone", "Shared with X", "Paid by X"
+	SharedWithNames    []string      `json:"shared_with_names,omitempty"` // Names of the non-buyer members bearing the cost
 }
 
 // TransactionGroup represents a single purchase/submission, potentially containing multiple spending items.
@@ -269,11 +629,13 @@ type TransactionGroup struct {
 	// Type                string         `json:"type"` // Type identifier often added by handler/service
 	JobID               int64          `json:"job_id"` // ai_categorization_jobs.id
 	Prompt              string         `json:"prompt"`
-	TotalAmount         float64        `json:"total_amount"`
-	TransactionDate     time.Time      `json:"date"` // Job's transaction date (or creation if not set)
+	TotalAmount         money.Amount   `json:"total_amount"`       // In Currency, if set
+	Currency            *string        `json:"currency,omitempty"` // ISO 4217 code of the job's amounts, if not the household's
+	TransactionDate     time.Time      `json:"date"`               // Job's transaction date (or creation if not set)
 	BuyerName           string         `json:"buyer_name"`
 	IsAmbiguityFlagged  bool           `json:"is_ambiguity_flagged"`
 	AmbiguityFlagReason *string        `json:"ambiguity_flag_reason"` // Pointer to handle NULL/empty
+	HasReceipt          bool           `json:"has_receipt"`           // Photo available at GET /v1/jobs/{job_id}/receipt
 	Spendings           []SpendingItem `json:"spendings"`
 }
 
@@ -281,12 +643,14 @@ type TransactionGroup struct {
 // Used by history service and potentially API responses.
 type DepositItem struct {
 	// Type             string     `json:"type"` // Type identifier often added by handler/service
-	ID               int64      `json:"id"`                // ID of the original deposit template
-	Amount           float64    `json:"amount"`
-	Description      string     `json:"description"`
-	Date             time.Time  `json:"date"`              // The actual date of this occurrence
-	IsRecurring      bool       `json:"is_recurring"`      // Indicates if this is a generated occurrence from a template
-	RecurrencePeriod *string    `json:"recurrence_period"` // Period of the original template
-	EndDate          *time.Time `json:"end_date"`          // End date of the original template (pointer for nullable)
-	CreatedAt        time.Time  `json:"created_at"`        // Creation time of the original template
+	ID               int64         `json:"id"`                        // ID of the original deposit template
+	Amount           money.Amount  `json:"amount"`                    // In the household's currency
+	OriginalAmount   *money.Amount `json:"original_amount,omitempty"` // As entered, if in another currency
+	Currency         *string       `json:"currency,omitempty"`        // ISO 4217 code of OriginalAmount
+	Description      string        `json:"description"`
+	Date             time.Time     `json:"date"`              // The actual date of this occurrence
+	IsRecurring      bool          `json:"is_recurring"`      // Indicates if this is a generated occurrence from a template
+	RecurrencePeriod *string       `json:"recurrence_period"` // Period of the original template
+	EndDate          *time.Time    `json:"end_date"`          // End date of the original template (pointer for nullable)
+	CreatedAt        time.Time     `json:"created_at"`        // Creation time of the original template
 }